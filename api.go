@@ -2,8 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
+	"net"
 	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
 
 	httprouter "github.com/julienschmidt/httprouter"
 
@@ -14,6 +19,7 @@ import (
 	kv "github.com/polyfire/api/kv"
 	memory "github.com/polyfire/api/memory"
 	middlewares "github.com/polyfire/api/middlewares"
+	models "github.com/polyfire/api/models"
 	stt "github.com/polyfire/api/stt"
 	tts "github.com/polyfire/api/tts"
 	utils "github.com/polyfire/api/utils"
@@ -34,6 +40,7 @@ func (h CORSRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	ctxWithDB := context.WithValue(ctx, utils.ContextKeyDB, h.db)
 	ctxWithDB = context.WithValue(ctxWithDB, utils.ContextKeyGCS, h.gcs)
+	ctxWithDB = context.WithValue(ctxWithDB, utils.ContextKeyAPIKeyUsage, &utils.APIKeyUsage{})
 
 	rWithDB := r.WithContext(ctxWithDB)
 
@@ -72,12 +79,18 @@ func main() {
 
 	// Completion Routes
 	router.POST("/generate", middlewares.Record(utils.Generate, middlewares.Auth(completion.Generate)))
+	router.POST("/generate/batch", middlewares.Record(utils.GenerateBatch, middlewares.Auth(completion.GenerateBatch)))
+	router.GET("/jobs/:id", middlewares.Record(utils.JobGet, middlewares.Auth(completion.GetJob)))
 	router.GET("/chat/:id/history", middlewares.Record(utils.ChatHistory, middlewares.Auth(completion.GetChatHistory)))
 	router.GET("/chats", middlewares.Record(utils.ChatList, middlewares.Auth(completion.ListChat)))
 	router.POST("/chats", middlewares.Record(utils.ChatCreate, middlewares.Auth(completion.CreateChat)))
 	router.PUT("/chat/:id", middlewares.Record(utils.ChatUpdate, middlewares.Auth(completion.UpdateChat)))
 	router.DELETE("/chat/:id", middlewares.Record(utils.ChatDelete, middlewares.Auth(completion.DeleteChat)))
 	router.GET("/stream", middlewares.Record(utils.Generate, middlewares.AuthStream(completion.Stream)))
+	router.GET("/models", middlewares.Record(utils.ModelList, middlewares.Auth(models.List)))
+
+	// Internal Routes
+	router.GET("/internal/providers/status", middlewares.Record(utils.ProviderStatus, middlewares.Internal(models.ProvidersStatus)))
 
 	// Transcription Routes
 	router.POST("/transcribe", middlewares.Record(utils.SpeechToText, middlewares.Auth(stt.Transcribe)))
@@ -100,5 +113,41 @@ func main() {
 	router.PUT("/kv", middlewares.Record(utils.KVSet, middlewares.Auth(kv.Set)))
 	router.DELETE("/kv", middlewares.Record(utils.KVDelete, middlewares.Auth(kv.Delete)))
 
-	log.Fatal(http.ListenAndServe(":8080", GlobalMiddleware(router, DB, GCS)))
+	/*
+	 * Every request context derives from serverCtx so a shutdown aborts the
+	 * ongoing generations (and their upstream calls) instead of waiting for them.
+	 */
+	serverCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	completion.StartJobWorkers(serverCtx, DB, GCS, middlewares.UserContext)
+
+	server := &http.Server{
+		Addr:        ":8080",
+		Handler:     GlobalMiddleware(router, DB, GCS),
+		BaseContext: func(_ net.Listener) context.Context { return serverCtx },
+	}
+
+	shutdownDone := make(chan bool)
+	go func() {
+		defer close(shutdownDone)
+		<-serverCtx.Done()
+		log.Print("Shutting down the server")
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		err := server.Shutdown(shutdownCtx)
+		if err != nil {
+			log.Printf("[ERROR] Shutdown: %v\n", err)
+		}
+	}()
+
+	err := server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+
+	// Wait for the ongoing requests to log their usage before exiting
+	<-shutdownDone
 }
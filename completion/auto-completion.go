@@ -58,13 +58,17 @@ func AddSpaceIfNeeded(prompt string, input chan options.Result) chan options.Res
 
 	go func() {
 		defer close(output)
-		firstOutputWord := <-input
+		firstOutputWord, ok := <-input
 
 		// We need to skip leading empty results in the case there's a warning sent
-		// before any result.
-		for firstOutputWord.Result == "" {
+		// before any result, and the other choices when n > 1. A generation stopped
+		// before any text (e.g. by the moderation) never has one.
+		for ok && (firstOutputWord.Result == "" || firstOutputWord.ChoiceIndex != 0) {
 			output <- firstOutputWord
-			firstOutputWord = <-input
+			firstOutputWord, ok = <-input
+		}
+		if !ok {
+			return
 		}
 
 		if _, ok := englishWordsSet[strings.ToLower(lastPromptWord+firstOutputWord.Result)]; !ok {
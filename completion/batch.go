@@ -0,0 +1,226 @@
+package completion
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+
+	router "github.com/julienschmidt/httprouter"
+	database "github.com/polyfire/api/db"
+	"github.com/polyfire/api/llm"
+	options "github.com/polyfire/api/llm/providers/options"
+	"github.com/polyfire/api/tokens"
+	utils "github.com/polyfire/api/utils"
+)
+
+const (
+	MaxBatchSize = 50
+	// The number of items of a user generated at the same time, can be changed with BATCH_CONCURRENCY
+	DefaultBatchConcurrency = 4
+)
+
+var (
+	ErrInvalidBatchSize      = errors.New("400 Invalid Batch Size")
+	ErrBatchExceedsRateLimit = errors.New("429 Batch Exceeds Rate Limit")
+)
+
+type BatchRequestBody struct {
+	Items []GenerateRequestBody `json:"items"`
+}
+
+type BatchResponse struct {
+	Results          []json.RawMessage `json:"results"`
+	EstimatedCredits int               `json:"estimated_credits"`
+}
+
+func batchConcurrency() int {
+	concurrency, err := strconv.Atoi(os.Getenv("BATCH_CONCURRENCY"))
+	if err != nil || concurrency <= 0 {
+		return DefaultBatchConcurrency
+	}
+	return concurrency
+}
+
+/*
+ * The slots are shared by all the batches of a user so sending several
+ * batches at once doesn't raise the number of parallel generations.
+ */
+var batchSlots sync.Map
+
+func acquireBatchSlot(ctx context.Context, userID string) (func(), error) {
+	slots, _ := batchSlots.LoadOrStore(userID, make(chan struct{}, batchConcurrency()))
+	userSlots := slots.(chan struct{})
+
+	select {
+	case userSlots <- struct{}{}:
+		return func() { <-userSlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+/*
+ * Estimates the credits of the whole batch from the tasks and system prompts,
+ * with max_tokens (or the output reservation) as output for each item. The
+ * context added to the prompts isn't known yet so it's a lower bound.
+ */
+func EstimateBatchCredits(ctx context.Context, items []GenerateRequestBody) (int, bool, error) {
+	db := ctx.Value(utils.ContextKeyDB).(database.Database)
+	projectID, _ := ctx.Value(utils.ContextKeyProjectID).(string)
+
+	catalog, err := db.GetCatalog()
+	if err != nil {
+		return 0, false, err
+	}
+
+	credits := 0
+	followsRateLimit := false
+
+	for _, item := range items {
+		// The "auto" items are estimated with the model they would be routed to now
+		modelInput := item.Model
+		if modelInput == llm.AutoModel {
+			routing, err := llm.Route(ctx, routingRequest(item))
+			if err != nil {
+				continue
+			}
+			modelInput = routing.Model
+		}
+
+		// The unknown models fail on their own when the item is generated
+		provider, err := llm.NewProvider(ctx, modelInput)
+		if err != nil || !provider.DoesFollowRateLimit() {
+			continue
+		}
+		followsRateLimit = true
+
+		providerName, modelName := provider.ProviderModel()
+		model := catalog.Lookup(providerName, modelName, projectID)
+		if model == nil {
+			continue
+		}
+
+		tokenizer := tokens.GetTokenizer(providerName, modelName)
+		inputTokens := tokenizer.CountTokens(item.Task)
+		if item.SystemPrompt != nil {
+			inputTokens += tokenizer.CountTokens(*item.SystemPrompt)
+		}
+
+		outputTokens := outputReservation()
+		if item.MaxTokens != nil {
+			outputTokens = *item.MaxTokens
+		}
+
+		credits += model.Credits(inputTokens, outputTokens)
+	}
+
+	return credits, followsRateLimit, nil
+}
+
+func CheckBatchRateLimit(ctx context.Context, estimatedCredits int) error {
+	err := CheckRateLimit(ctx)
+	if err != nil {
+		return err
+	}
+
+	usage, _ := ctx.Value(utils.ContextKeyProjectUserUsage).(int64)
+	rateLimit, _ := ctx.Value(utils.ContextKeyProjectUserRateLimit).(*int64)
+
+	if rateLimit != nil && usage+int64(estimatedCredits) > *rateLimit {
+		return ErrBatchExceedsRateLimit
+	}
+
+	return nil
+}
+
+func generateBatchItem(ctx context.Context, userID string, input GenerateRequestBody) options.Result {
+	release, err := acquireBatchSlot(ctx, userID)
+	if err != nil {
+		return options.Result{Err: "generation_error"}
+	}
+	defer release()
+
+	resChan, err := GenerationStart(ctx, userID, input)
+	if err != nil {
+		return options.Result{Err: ErrorCode(err)}
+	}
+
+	return CollectResult(*resChan)
+}
+
+/*
+ * Generates every item of the batch like /generate would. The rate limit is
+ * checked once for the whole batch and the result (or the error) of each item
+ * is returned in the order of the input. When no item could be estimated, each
+ * item checks the rate limit itself.
+ */
+func GenerateBatch(w http.ResponseWriter, r *http.Request, _ router.Params) {
+	userID := r.Context().Value(utils.ContextKeyUserID).(string)
+	record := r.Context().Value(utils.ContextKeyRecordEvent).(utils.RecordFunc)
+
+	var input BatchRequestBody
+
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		utils.RespondError(w, record, "invalid_json")
+		return
+	}
+
+	if len(input.Items) == 0 || len(input.Items) > MaxBatchSize {
+		ReturnErrors(w, record, ErrInvalidBatchSize)
+		return
+	}
+
+	estimatedCredits, followsRateLimit, err := EstimateBatchCredits(r.Context(), input.Items)
+	if err != nil {
+		utils.RespondError(w, record, "internal_error")
+		return
+	}
+
+	ctx := r.Context()
+	if followsRateLimit {
+		err = CheckBatchRateLimit(ctx, estimatedCredits)
+		if err != nil {
+			ReturnErrors(w, record, err)
+			return
+		}
+		ctx = context.WithValue(ctx, utils.ContextKeyRateLimitChecked, true)
+	}
+
+	results := make([]options.Result, len(input.Items))
+
+	var wg sync.WaitGroup
+	for i, item := range input.Items {
+		wg.Add(1)
+		go func(i int, item GenerateRequestBody) {
+			defer wg.Done()
+			// Each item logs the keys it was generated with
+			itemCtx := context.WithValue(ctx, utils.ContextKeyAPIKeyUsage, &utils.APIKeyUsage{})
+			results[i] = generateBatchItem(itemCtx, userID, item)
+		}(i, item)
+	}
+	wg.Wait()
+
+	response := BatchResponse{
+		Results:          make([]json.RawMessage, len(results)),
+		EstimatedCredits: estimatedCredits,
+	}
+	for i, result := range results {
+		response.Results[i], _ = result.JSON()
+	}
+
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		utils.RespondError(w, record, "invalid_json")
+		return
+	}
+
+	record(string(responseJSON))
+
+	w.Header()["Content-Type"] = []string{"application/json"}
+	_, _ = w.Write(responseJSON)
+}
@@ -0,0 +1,57 @@
+package completion
+
+import (
+	"context"
+	"testing"
+
+	database "github.com/polyfire/api/db"
+	"github.com/polyfire/api/llm"
+	"github.com/polyfire/api/utils"
+)
+
+func TestBatchEstimateExceedsRateLimit(t *testing.T) {
+	ctx := context.WithValue(context.Background(), utils.ContextKeyDB, database.MockDatabase{
+		MockGetCatalog: mockGetCatalog,
+	})
+	ctx = context.WithValue(ctx, utils.ContextKeyRateLimitStatus, database.RateLimitStatusOk)
+	ctx = context.WithValue(ctx, utils.ContextKeyCreditsStatus, database.CreditsStatusOk)
+
+	var rateLimit int64 = 200
+	ctx = context.WithValue(ctx, utils.ContextKeyProjectUserUsage, int64(100))
+	ctx = context.WithValue(ctx, utils.ContextKeyProjectUserRateLimit, &rateLimit)
+
+	maxTokens := 10
+	items := []GenerateRequestBody{{Task: "Test", MaxTokens: &maxTokens}}
+
+	// 1 input token at 5 credits and 10 output tokens at 15 credits
+	credits, followsRateLimit, err := EstimateBatchCredits(ctx, items)
+	if err != nil || !followsRateLimit || credits != 155 {
+		t.Fatalf("EstimateBatchCredits should have returned 155 but returned %d (%v)", credits, err)
+	}
+
+	if err := CheckBatchRateLimit(ctx, credits); err != ErrBatchExceedsRateLimit {
+		t.Fatalf("CheckBatchRateLimit should have returned ErrBatchExceedsRateLimit but returned %v", err)
+	}
+
+	if err := CheckBatchRateLimit(ctx, 50); err != nil {
+		t.Fatalf("CheckBatchRateLimit should have accepted the batch but returned %v", err)
+	}
+}
+
+func TestBatchEstimateAutoItems(t *testing.T) {
+	ctx := context.WithValue(context.Background(), utils.ContextKeyDB, database.MockDatabase{
+		MockGetCatalog: mockGetCatalog,
+		MockGetRoutingRules: func(_ string) (*database.RoutingRules, error) {
+			return &database.RoutingRules{Candidates: []string{"gpt-3.5-turbo"}}, nil
+		},
+	})
+
+	maxTokens := 10
+	items := []GenerateRequestBody{{Task: "Test", Model: llm.AutoModel, MaxTokens: &maxTokens}}
+
+	// The item is estimated with the model it's routed to so the batch can't skip the rate limit
+	credits, followsRateLimit, err := EstimateBatchCredits(ctx, items)
+	if err != nil || !followsRateLimit || credits != 155 {
+		t.Fatalf("EstimateBatchCredits should have returned 155 for the routed item but returned %d (%v)", credits, err)
+	}
+}
@@ -3,9 +3,11 @@ package completion
 import (
 	"context"
 	"log"
+	"os"
 
 	database "github.com/polyfire/api/db"
 	"github.com/polyfire/api/llm"
+	"github.com/polyfire/api/llm/providers"
 	"github.com/polyfire/api/llm/providers/options"
 	"github.com/polyfire/api/utils"
 )
@@ -17,9 +19,16 @@ func CheckFuzzyCache(
 	modelName string,
 ) (chan options.Result, []float32, error) {
 	db := ctx.Value(utils.ContextKeyDB).(database.Database)
-	embeddings, err := llm.Embed(ctx, []string{prompt}, nil)
+
+	// The cached inputs are only compared with the embeddings of the same size
+	embedder, err := llm.NewEmbedder(ctx, os.Getenv("CACHE_EMBEDDING_MODEL"))
 	if err != nil {
-		return nil, embeddings[0], err
+		return nil, nil, err
+	}
+
+	embeddings, err := llm.Embed(ctx, embedder, []string{prompt}, providers.EmbeddingInputQuery, nil)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	cache, err := db.GetCompletionCacheByInput(providerName, modelName, embeddings[0])
@@ -10,7 +10,6 @@ import (
 
 	router "github.com/julienschmidt/httprouter"
 	database "github.com/polyfire/api/db"
-	"github.com/polyfire/api/llm/providers/options"
 	"github.com/polyfire/api/utils"
 )
 
@@ -144,13 +143,19 @@ func GetChatHistory(w http.ResponseWriter, r *http.Request, ps router.Params) {
 	_ = json.NewEncoder(w).Encode(messages)
 }
 
+/*
+ * AddToChatHistory checks the chat and sets saveToChatHistory to the function
+ * saving the task and the answer once the generation is over. The answer is
+ * saved as it's sent to the user, after the moderation and the validation of
+ * the JSON schema, and not as each provider call returns it.
+ */
 func AddToChatHistory(
 	ctx context.Context,
 	userID string,
 	task string,
+	imageURLs []string,
 	chatID string,
-	callback options.ProviderCallback,
-	opts *options.ProviderOptions,
+	saveToChatHistory *func(completion string),
 ) error {
 	db := ctx.Value(utils.ContextKeyDB).(database.Database)
 	log.Println("GetChatByID")
@@ -163,23 +168,20 @@ func AddToChatHistory(
 		return ErrNotFound
 	}
 
-	oldCallback := *callback
-	*callback = func(providerName string, modelName string, inputCount int, outputCount int, completion string, credit *int) {
-		if oldCallback != nil {
-			log.Println("Old callback")
-			oldCallback(providerName, modelName, inputCount, outputCount, completion, credit)
+	*saveToChatHistory = func(completion string) {
+		// The follow-up requests sending tool results can have no task and the tool calls have no text
+		if task != "" || len(imageURLs) > 0 {
+			log.Println("Add Chat Message")
+			err := db.AddChatMessage(chat.ID, true, task, imageURLs)
+			if err != nil {
+				log.Printf("Error adding chat message for user %s : %v", userID, err)
+			}
 		}
-
-		log.Println("Add Chat Message")
-		err = db.AddChatMessage(chat.ID, true, task)
-		if err != nil {
-			log.Printf("Error adding chat message for user %s : %v", userID, err)
+		if completion != "" {
+			log.Println("Add Chat Message Callback")
+			_ = db.AddChatMessage(chat.ID, false, completion, nil)
 		}
-		log.Println("Add Chat Message Callback")
-		_ = db.AddChatMessage(chat.ID, false, completion)
 	}
 
-	opts.StopWords = &[]string{"User:", "You:"}
-
 	return nil
 }
@@ -2,10 +2,13 @@ package completion
 
 import (
 	"context"
+	"os"
+	"strconv"
 	"sync"
 
 	completionContext "github.com/polyfire/api/completion/context"
 	"github.com/polyfire/api/llm/providers/options"
+	"github.com/polyfire/api/tokens"
 	"github.com/polyfire/api/utils"
 )
 
@@ -27,20 +30,58 @@ func launchContextFillingGoRouting(
 	}()
 }
 
-const MaxContentLength = 4000
+const (
+	// Used for the models the catalog doesn't know the context window of
+	DefaultContextWindow = 4096
+	// The tokens kept free for the answer, can be changed with CONTEXT_OUTPUT_RESERVATION
+	DefaultOutputReservation = 1024
+)
+
+func outputReservation() int {
+	reservation, err := strconv.Atoi(os.Getenv("CONTEXT_OUTPUT_RESERVATION"))
+	if err != nil || reservation < 0 {
+		return DefaultOutputReservation
+	}
+	return reservation
+}
+
+/*
+ * The context (system prompt, memories, web results and chat history) gets
+ * what's left of the model's context window once the task and the answer are
+ * accounted for. max_context_tokens can only lower it.
+ */
+func ContextTokenLimit(contextWindow int, taskTokens int, maxContextTokens *int) int {
+	limit := contextWindow - taskTokens - outputReservation()
+
+	if maxContextTokens != nil && *maxContextTokens < limit {
+		limit = *maxContextTokens
+	}
 
+	if limit < 0 {
+		return 0
+	}
+
+	return limit
+}
+
+/*
+ * GetContextString returns the context to put in the system prompt and the
+ * chat history messages fitting in the context along with it.
+ */
 func GetContextString(
 	ctx context.Context,
 	userID string,
 	input GenerateRequestBody,
-	callback options.ProviderCallback,
-	opts *options.ProviderOptions,
-) (string, []string, error) {
+	imageURLs []string,
+	tokenizer tokens.Tokenizer,
+	tokenLimit int,
+	saveToChatHistory *func(completion string),
+) (string, []options.Message, []string, error) {
 	var wg sync.WaitGroup
 	contextElements := make([]completionContext.ContentElement, 0)
 
 	launchContextFillingGoRouting(&wg, &contextElements, func() (completionContext.ContentElement, error) {
-		return completionContext.GetMemory(ctx, userID, utils.StringOptionalArray(input.MemoryID), input.Task)
+		return completionContext.GetMemory(ctx, userID, utils.StringOptionalArray(input.MemoryID), input.Task, tokenizer)
 	})
 
 	var warnings []string
@@ -53,33 +94,44 @@ func GetContextString(
 			input.SystemPromptID,
 			input.SystemPrompt,
 			input.ChatID,
+			tokenizer,
 		)
 		return systemPrompt, err
 	})
 
 	if input.WebRequest {
 		launchContextFillingGoRouting(&wg, &contextElements, func() (completionContext.ContentElement, error) {
-			return completionContext.GetWebContext(input.Task)
+			return completionContext.GetWebContext(input.Task, tokenizer)
 		})
 	}
 
 	if input.ChatID != nil && len(*input.ChatID) > 0 {
-		err := AddToChatHistory(ctx, userID, input.Task, *input.ChatID, callback, opts)
+		err := AddToChatHistory(ctx, userID, input.Task, imageURLs, *input.ChatID, saveToChatHistory)
 		if err != nil {
-			return "", warnings, err
+			return "", nil, warnings, err
 		}
 
 		launchContextFillingGoRouting(&wg, &contextElements, func() (completionContext.ContentElement, error) {
-			return completionContext.GetChatHistoryContext(ctx, userID, *input.ChatID)
+			return completionContext.GetChatHistoryContext(ctx, userID, *input.ChatID, tokenizer)
 		})
 	}
 
 	wg.Wait()
 
-	contextString, err := completionContext.GetContext(contextElements, MaxContentLength)
+	contextParts, err := completionContext.GetContextParts(contextElements, tokenLimit, tokenizer)
 	if err != nil {
-		return "", warnings, err
+		return "", nil, warnings, err
+	}
+
+	contextString := ""
+	var history []options.Message
+	for _, part := range contextParts {
+		if chatHistory, ok := part.ContentElement.(*completionContext.ChatHistoryContext); ok {
+			history = chatHistory.GetMessagesFittingIn(part.TokenBudget)
+			continue
+		}
+		contextString += part.Content
 	}
 
-	return contextString, warnings, nil
+	return contextString, history, warnings, nil
 }
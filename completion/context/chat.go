@@ -8,6 +8,8 @@ import (
 	"text/template"
 
 	database "github.com/polyfire/api/db"
+	"github.com/polyfire/api/llm/providers/options"
+	"github.com/polyfire/api/tokens"
 	"github.com/polyfire/api/utils"
 )
 
@@ -19,13 +21,26 @@ var chatHistoryTemplate = template.Must(
 `),
 )
 
+/*
+ * The chat history is budgeted like any other context element but it isn't
+ * rendered in the context string. The messages fitting in the budget are sent
+ * to the provider as real user/assistant turns (see GetMessagesFittingIn).
+ */
 type ChatHistoryContext struct {
-	Messages []string
-}
+	Messages     []string
+	ChatMessages []options.Message
 
-var chatHistoryTemplateGrowth = InitContextStructureTemplate(*chatHistoryTemplate)
+	// The token count of each message with the tokenizer of the model
+	MessageSizes   []int
+	TemplateGrowth TemplateGrowth
+}
 
-func GetChatHistoryContext(ctx context.Context, userID string, chatID string) (*ChatHistoryContext, error) {
+func GetChatHistoryContext(
+	ctx context.Context,
+	userID string,
+	chatID string,
+	tokenizer tokens.Tokenizer,
+) (*ChatHistoryContext, error) {
 	db := ctx.Value(utils.ContextKeyDB).(database.Database)
 	allHistory, err := db.GetChatMessages(userID, chatID, true, 20, 0)
 	if err != nil {
@@ -33,18 +48,38 @@ func GetChatHistoryContext(ctx context.Context, userID string, chatID string) (*
 	}
 
 	var messages []string
+	var chatMessages []options.Message
 	for _, message := range allHistory {
-		if strings.TrimSpace(message.Content) != "" {
+		if strings.TrimSpace(message.Content) != "" || len(message.ImageURLs) > 0 {
 			if message.IsUserMessage {
+				var images []options.Image
+				for _, imageURL := range message.ImageURLs {
+					images = append(images, options.Image{URL: imageURL})
+				}
+
 				messages = append(messages, fmt.Sprintf("User:\n%s", message.Content))
+				chatMessages = append(chatMessages, options.Message{
+					Role:    options.RoleUser,
+					Content: message.Content,
+					Images:  images,
+				})
 			} else {
 				messages = append(messages, fmt.Sprintf("You:\n%s", message.Content))
+				chatMessages = append(chatMessages, options.Message{Role: options.RoleAssistant, Content: message.Content})
 			}
 		}
 	}
 
+	messageSizes := make([]int, len(messages))
+	for i, message := range messages {
+		messageSizes[i] = tokenizer.CountTokens(message)
+	}
+
 	chatHistoryContext := ChatHistoryContext{
-		Messages: messages,
+		Messages:       messages,
+		ChatMessages:   chatMessages,
+		MessageSizes:   messageSizes,
+		TemplateGrowth: InitContextStructureTemplate(*chatHistoryTemplate, tokenizer),
 	}
 
 	return &chatHistoryContext, nil
@@ -62,16 +97,16 @@ func (chc *ChatHistoryContext) GetMinimumContextSize() int {
 	if len(chc.Messages) == 0 {
 		return 0
 	}
-	return chatHistoryTemplateGrowth.B + chatHistoryTemplateGrowth.A + len(chc.Messages[0])
+	return chc.TemplateGrowth.B + chc.TemplateGrowth.A + chc.MessageSizes[0]
 }
 
 func (chc *ChatHistoryContext) GetRecommendedContextSize() int {
 	if len(chc.Messages) == 0 {
 		return 0
 	}
-	totalSize := chatHistoryTemplateGrowth.B
+	totalSize := chc.TemplateGrowth.B
 	for i := 0; i < len(chc.Messages); i++ {
-		totalSize += chatHistoryTemplateGrowth.A + len(chc.Messages[i])
+		totalSize += chc.TemplateGrowth.A + chc.MessageSizes[i]
 	}
 
 	return totalSize
@@ -81,14 +116,31 @@ type ChatHistoryTemplateData struct {
 	Data []string
 }
 
-func (chc *ChatHistoryContext) GetContentFittingIn(tokenCount int) string {
-	tokenCurrentSize := chatHistoryTemplateGrowth.B
-	var result []string
+func (chc *ChatHistoryContext) countFittingIn(tokenCount int) int {
+	tokenCurrentSize := chc.TemplateGrowth.B
 	for i := 0; i < len(chc.Messages); i++ {
-		tokenCurrentSize += chatHistoryTemplateGrowth.A + len(chc.Messages[i])
+		tokenCurrentSize += chc.TemplateGrowth.A + chc.MessageSizes[i]
 		if tokenCurrentSize > tokenCount {
-			break
+			return i
 		}
+	}
+	return len(chc.Messages)
+}
+
+// The history is fetched from the most recent message, the result is put back in chronological order
+func (chc *ChatHistoryContext) GetMessagesFittingIn(tokenCount int) []options.Message {
+	count := chc.countFittingIn(tokenCount)
+	result := make([]options.Message, 0, count)
+	for i := count - 1; i >= 0; i-- {
+		result = append(result, chc.ChatMessages[i])
+	}
+	return result
+}
+
+func (chc *ChatHistoryContext) GetContentFittingIn(tokenCount int) string {
+	count := chc.countFittingIn(tokenCount)
+	var result []string
+	for i := 0; i < count; i++ {
 		result = append([]string{chc.Messages[i]}, result...)
 	}
 
@@ -18,7 +18,7 @@ type TemplateGrowth struct {
 	B int
 }
 
-func InitContextStructureTemplate(templ template.Template) TemplateGrowth {
+func InitContextStructureTemplate(templ template.Template, tokenizer tokens.Tokenizer) TemplateGrowth {
 	var result TemplateGrowth
 
 	data1 := TemplateData{Data: []string{}}
@@ -34,8 +34,8 @@ func InitContextStructureTemplate(templ template.Template) TemplateGrowth {
 		panic(err)
 	}
 
-	result.B = tokens.CountTokens(result1.String())
-	result.A = tokens.CountTokens(result2.String()) - result.B
+	result.B = tokenizer.CountTokens(result1.String())
+	result.A = tokenizer.CountTokens(result2.String()) - result.B
 
 	return result
 }
@@ -44,13 +44,15 @@ type TemplateContext struct {
 	Data          []string
 	Template      template.Template
 	ContextGrowth TemplateGrowth
+	Tokenizer     tokens.Tokenizer
 }
 
-func GetTemplateContext(data []string, templ template.Template) (*TemplateContext, error) {
+func GetTemplateContext(data []string, templ template.Template, tokenizer tokens.Tokenizer) (*TemplateContext, error) {
 	memoryContext := TemplateContext{
 		Data:          data,
 		Template:      templ,
-		ContextGrowth: InitContextStructureTemplate(templ),
+		ContextGrowth: InitContextStructureTemplate(templ, tokenizer),
+		Tokenizer:     tokenizer,
 	}
 
 	return &memoryContext, nil
@@ -61,7 +63,7 @@ func (m *TemplateContext) GetMinimumContextSize() int {
 		return 0
 	}
 
-	return m.ContextGrowth.A + tokens.CountTokens(
+	return m.ContextGrowth.A + m.Tokenizer.CountTokens(
 		m.Data[0],
 	) + m.ContextGrowth.B
 }
@@ -74,7 +76,7 @@ func (m *TemplateContext) GetRecommendedContextSize() int {
 	totalTokens := m.ContextGrowth.B
 
 	for _, item := range m.Data {
-		totalTokens += tokens.CountTokens(item) + m.ContextGrowth.A
+		totalTokens += m.Tokenizer.CountTokens(item) + m.ContextGrowth.A
 	}
 
 	return totalTokens
@@ -93,7 +95,7 @@ func (m *TemplateContext) fillContext(data []string, tokenCount int) (string, er
 	currentTokens := m.ContextGrowth.B
 
 	for _, item := range data {
-		textTokens := tokens.CountTokens(item)
+		textTokens := m.Tokenizer.CountTokens(item)
 
 		if currentTokens+textTokens+m.ContextGrowth.A > tokenCount {
 			break
@@ -6,6 +6,7 @@ import (
 
 	database "github.com/polyfire/api/db"
 	"github.com/polyfire/api/memory"
+	"github.com/polyfire/api/tokens"
 )
 
 var memoryTemplate = template.Must(template.New("memory_context").Parse(`Here are some informations you remember:
@@ -14,7 +15,13 @@ var memoryTemplate = template.Must(template.New("memory_context").Parse(`Here ar
 
 type MemoryContext = TemplateContext
 
-func GetMemory(ctx context.Context, userID string, memoryIDs []string, task string) (*MemoryContext, error) {
+func GetMemory(
+	ctx context.Context,
+	userID string,
+	memoryIDs []string,
+	task string,
+	tokenizer tokens.Tokenizer,
+) (*MemoryContext, error) {
 	results := []database.MatchResult{}
 	var err error
 
@@ -30,5 +37,5 @@ func GetMemory(ctx context.Context, userID string, memoryIDs []string, task stri
 		resultStrings[i] = result.Content
 	}
 
-	return GetTemplateContext(resultStrings, *memoryTemplate)
+	return GetTemplateContext(resultStrings, *memoryTemplate, tokenizer)
 }
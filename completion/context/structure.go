@@ -34,8 +34,10 @@ type contextElement struct {
 	MinimumSize     int
 	Recommended     string
 	RecommendedSize int
-	UseRecommended  bool
-	OrderIndex      int
+	// The token count given to GetContentFittingIn to get Recommended
+	RecommendedBudget int
+	UseRecommended    bool
+	OrderIndex        int
 }
 
 type contextElementList []contextElement
@@ -54,17 +56,39 @@ func (cel *contextElementList) Swap(i, j int) {
 
 func contextElementFromContentElement(content ContentElement) contextElement {
 	return contextElement{
-		ContentElement:  content,
-		Minimum:         content.GetContentFittingIn(content.GetMinimumContextSize()),
-		MinimumSize:     content.GetMinimumContextSize(),
-		Recommended:     content.GetContentFittingIn(content.GetRecommendedContextSize()),
-		RecommendedSize: content.GetRecommendedContextSize(),
-		UseRecommended:  false,
-		OrderIndex:      content.GetOrderIndex(),
+		ContentElement:    content,
+		Minimum:           content.GetContentFittingIn(content.GetMinimumContextSize()),
+		MinimumSize:       content.GetMinimumContextSize(),
+		Recommended:       content.GetContentFittingIn(content.GetRecommendedContextSize()),
+		RecommendedSize:   content.GetRecommendedContextSize(),
+		RecommendedBudget: content.GetRecommendedContextSize(),
+		UseRecommended:    false,
+		OrderIndex:        content.GetOrderIndex(),
 	}
 }
 
-func GetContext(content []ContentElement, tokenLimit int) (string, error) {
+// A content element with the content it got in the final context and the token count used to get it
+type ContextPart struct {
+	ContentElement ContentElement
+	Content        string
+	TokenBudget    int
+}
+
+func GetContext(content []ContentElement, tokenLimit int, tokenizer tokens.Tokenizer) (string, error) {
+	parts, err := GetContextParts(content, tokenLimit, tokenizer)
+	if err != nil {
+		return "", err
+	}
+
+	result := ""
+	for _, part := range parts {
+		result += part.Content
+	}
+
+	return result, nil
+}
+
+func GetContextParts(content []ContentElement, tokenLimit int, tokenizer tokens.Tokenizer) ([]ContextPart, error) {
 	tokenCount := 0
 
 	criticalContent := []contextElement{}
@@ -72,9 +96,9 @@ func GetContext(content []ContentElement, tokenLimit int) (string, error) {
 	for _, item := range content {
 		if item.GetPriority() == CRITICAL {
 			added := item.GetContentFittingIn(tokenLimit)
-			addedTokens := tokens.CountTokens(added)
+			addedTokens := tokenizer.CountTokens(added)
 			if addedTokens+tokenCount > tokenLimit {
-				return "", ErrCriticalDoesNotFit
+				return nil, ErrCriticalDoesNotFit
 			}
 
 			criticalContent = append(criticalContent, contextElementFromContentElement(item))
@@ -117,7 +141,8 @@ func GetContext(content []ContentElement, tokenLimit int) (string, error) {
 		importantAndHelpfulContent[i].Recommended = item.ContentElement.GetContentFittingIn(
 			item.RecommendedSize,
 		)
-		importantAndHelpfulContent[i].RecommendedSize = tokens.CountTokens(importantAndHelpfulContent[i].Recommended)
+		importantAndHelpfulContent[i].RecommendedSize = tokenizer.CountTokens(importantAndHelpfulContent[i].Recommended)
+		importantAndHelpfulContent[i].RecommendedBudget = item.RecommendedSize
 
 		if (tokenCount + importantAndHelpfulContent[i].RecommendedSize - importantAndHelpfulContent[i].MinimumSize) > tokenLimit {
 			continue
@@ -133,16 +158,16 @@ func GetContext(content []ContentElement, tokenLimit int) (string, error) {
 		if item.UseRecommended {
 			size = item.RecommendedSize
 		}
-		recommended := item.ContentElement.GetContentFittingIn(
-			tokenLimit - (tokenCount - size),
-		)
-		recommendedSize := tokens.CountTokens(recommended)
+		budget := tokenLimit - (tokenCount - size)
+		recommended := item.ContentElement.GetContentFittingIn(budget)
+		recommendedSize := tokenizer.CountTokens(recommended)
 
 		if (tokenCount + recommendedSize - size) > tokenLimit {
 			continue
 		}
 		importantAndHelpfulContent[i].Recommended = recommended
 		importantAndHelpfulContent[i].RecommendedSize = recommendedSize
+		importantAndHelpfulContent[i].RecommendedBudget = budget
 		importantAndHelpfulContent[i].UseRecommended = true
 		tokenCount = tokenCount - size + importantAndHelpfulContent[i].RecommendedSize
 	}
@@ -152,13 +177,14 @@ func GetContext(content []ContentElement, tokenLimit int) (string, error) {
 
 	sort.Sort(&context)
 
-	result := ""
+	result := make([]ContextPart, 0, len(context))
 	for _, item := range context {
+		part := ContextPart{ContentElement: item.ContentElement, Content: item.Minimum, TokenBudget: item.MinimumSize}
 		if item.UseRecommended {
-			result += item.Recommended
-		} else {
-			result += item.Minimum
+			part.Content = item.Recommended
+			part.TokenBudget = item.RecommendedBudget
 		}
+		result = append(result, part)
 	}
 
 	return result, nil
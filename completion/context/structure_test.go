@@ -49,7 +49,7 @@ func TestContextStructureWithLotOfSpace(t *testing.T) {
 
 	contextElements := []ContentElement{TestContentElement1{}, TestContentElement2{}}
 
-	result, err := GetContext(contextElements, maxTokens)
+	result, err := GetContext(contextElements, maxTokens, tokens.DefaultTokenizer)
 	if err != nil {
 		t.Fatalf(`GetContext returned an error : %v`, err)
 	}
@@ -74,7 +74,7 @@ func TestContextStructureWithSomeSpace(t *testing.T) {
 
 	contextElements := []ContentElement{TestContentElement1{}, TestContentElement2{}}
 
-	result, err := GetContext(contextElements, maxTokens)
+	result, err := GetContext(contextElements, maxTokens, tokens.DefaultTokenizer)
 	if err != nil {
 		t.Fatalf(`GetContext returned an error : %v`, err)
 	}
@@ -99,7 +99,7 @@ func TestContextStructureWithFewSpace(t *testing.T) {
 
 	contextElements := []ContentElement{TestContentElement1{}, TestContentElement2{}}
 
-	result, err := GetContext(contextElements, maxTokens)
+	result, err := GetContext(contextElements, maxTokens, tokens.DefaultTokenizer)
 	if err != nil {
 		t.Fatalf(`GetContext returned an error : %v`, err)
 	}
@@ -124,7 +124,7 @@ func TestContextStructureWithVeryFewSpace(t *testing.T) {
 
 	contextElements := []ContentElement{TestContentElement1{}, TestContentElement2{}}
 
-	result, err := GetContext(contextElements, maxTokens)
+	result, err := GetContext(contextElements, maxTokens, tokens.DefaultTokenizer)
 	if err != nil {
 		t.Fatalf(`GetContext returned an error : %v`, err)
 	}
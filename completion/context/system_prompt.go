@@ -128,6 +128,7 @@ func GetVars(ctx context.Context, userID string, varList []string) (map[string]s
 
 type SystemPromptContext struct {
 	SystemPrompt string
+	Tokenizer    tokens.Tokenizer
 }
 
 func GetSystemPrompt(
@@ -136,6 +137,7 @@ func GetSystemPrompt(
 	systemPromptID *string,
 	systemPrompt *string,
 	chatID *string,
+	tokenizer tokens.Tokenizer,
 ) (*SystemPromptContext, []string, error) {
 	db := ctx.Value(utils.ContextKeyDB).(database.Database)
 	result := ""
@@ -183,7 +185,7 @@ func GetSystemPrompt(
 			warnings = nil
 		}
 	}
-	return &SystemPromptContext{SystemPrompt: result + "\n"}, warnings, nil
+	return &SystemPromptContext{SystemPrompt: result + "\n", Tokenizer: tokenizer}, warnings, nil
 }
 
 func (spc *SystemPromptContext) GetOrderIndex() int {
@@ -195,15 +197,15 @@ func (spc *SystemPromptContext) GetPriority() Priority {
 }
 
 func (spc *SystemPromptContext) GetMinimumContextSize() int {
-	return tokens.CountTokens(spc.SystemPrompt)
+	return spc.Tokenizer.CountTokens(spc.SystemPrompt)
 }
 
 func (spc *SystemPromptContext) GetRecommendedContextSize() int {
-	return tokens.CountTokens(spc.SystemPrompt)
+	return spc.Tokenizer.CountTokens(spc.SystemPrompt)
 }
 
 func (spc *SystemPromptContext) GetContentFittingIn(tokenCount int) string {
-	if tokens.CountTokens(spc.SystemPrompt) > tokenCount {
+	if spc.Tokenizer.CountTokens(spc.SystemPrompt) > tokenCount {
 		return ""
 	}
 	return spc.SystemPrompt
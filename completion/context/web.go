@@ -3,6 +3,7 @@ package context
 import (
 	"text/template"
 
+	"github.com/polyfire/api/tokens"
 	"github.com/polyfire/api/web_request"
 )
 
@@ -15,11 +16,11 @@ var promptWebTemplate = template.Must(
 
 type WebContext = TemplateContext
 
-func GetWebContext(task string) (*WebContext, error) {
+func GetWebContext(task string, tokenizer tokens.Tokenizer) (*WebContext, error) {
 	res, err := webrequest.WebRequest(task)
 	if err != nil || len(res) == 0 {
 		return nil, err
 	}
 
-	return GetTemplateContext(res, *promptWebTemplate)
+	return GetTemplateContext(res, *promptWebTemplate, tokenizer)
 }
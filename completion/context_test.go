@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	database "github.com/polyfire/api/db"
+	"github.com/polyfire/api/tokens"
 	"github.com/polyfire/api/utils"
 )
 
@@ -13,7 +14,28 @@ func mockGetExistingEmbeddingFromContent(_ string) (*[]float32, error) {
 	return nil, nil
 }
 
-func mockMatchEmbeddings(_ []string, _ string, _ []float32) ([]database.MatchResult, error) {
+func mockGetEmbeddingCatalog() (*database.Catalog, error) {
+	dimensions := 1536
+
+	return database.NewCatalog([]database.Model{{
+		ID:         1,
+		Model:      "text-embedding-ada-002",
+		Provider:   "openai",
+		Type:       "embedding",
+		Dimensions: &dimensions,
+	}}, nil), nil
+}
+
+func mockGetMemories(memoryIDs []string) ([]database.Memory, error) {
+	memories := make([]database.Memory, len(memoryIDs))
+	for i, id := range memoryIDs {
+		memories[i] = database.Memory{ID: id, EmbeddingModel: "text-embedding-ada-002", EmbeddingDimensions: 1536}
+	}
+
+	return memories, nil
+}
+
+func mockMatchEmbeddings(_ []string, _ string, _ string, _ []float32) ([]database.MatchResult, error) {
 	result := database.MatchResult{
 		ID:         "00000000-0000-0000-0000-000000000000",
 		Content:    "banana42",
@@ -42,6 +64,8 @@ func TestContextStringMemory(t *testing.T) {
 			MockGetExistingEmbeddingFromContent: mockGetExistingEmbeddingFromContent,
 			MockLogRequests:                     mockLogRequests,
 			MockMatchEmbeddings:                 mockMatchEmbeddings,
+			MockGetMemories:                     mockGetMemories,
+			MockGetCatalog:                      mockGetEmbeddingCatalog,
 		},
 	)
 
@@ -50,7 +74,7 @@ func TestContextStringMemory(t *testing.T) {
 		MemoryID: "11100000-0000-0000-0000-000000000000",
 	}
 
-	result, _, err := GetContextString(ctx, userID, reqBody, nil, nil)
+	result, _, _, err := GetContextString(ctx, userID, reqBody, nil, tokens.DefaultTokenizer, DefaultContextWindow, nil)
 	if err != nil {
 		t.Fatalf(`GetContextString returned an error %v`, err)
 	}
@@ -59,3 +83,23 @@ func TestContextStringMemory(t *testing.T) {
 		t.Fatalf(`GetContextString doesn't contains "banana42". ContextString: "%s"`, result)
 	}
 }
+
+func TestContextTokenLimit(t *testing.T) {
+	t.Setenv("CONTEXT_OUTPUT_RESERVATION", "1000")
+
+	limit := ContextTokenLimit(128000, 500, nil)
+	if limit != 126500 {
+		t.Fatalf("ContextTokenLimit should have returned 126500 but returned %d", limit)
+	}
+
+	maxContextTokens := 2000
+	limit = ContextTokenLimit(128000, 500, &maxContextTokens)
+	if limit != 2000 {
+		t.Fatalf("ContextTokenLimit should have been capped to 2000 but returned %d", limit)
+	}
+
+	limit = ContextTokenLimit(4096, 4000, nil)
+	if limit != 0 {
+		t.Fatalf("ContextTokenLimit should have returned 0 when the task fills the window but returned %d", limit)
+	}
+}
@@ -0,0 +1,141 @@
+package completion
+
+import (
+	"context"
+	"errors"
+
+	database "github.com/polyfire/api/db"
+	"github.com/polyfire/api/llm/providers/options"
+	"github.com/polyfire/api/tokens"
+)
+
+var ErrCreditCeilingTooLow = errors.New("400 Credit Ceiling Too Low")
+
+// The warning of the generations stopped by their max_credits
+const CreditCeilingReached = "credit_ceiling_reached"
+
+// The warning of the generations answered by a model max_credits can't be enforced on
+const CreditCeilingNotEnforced = "credit_ceiling_not_enforced"
+
+// The duration the models billed by second take is only known once they're done
+func canEstimateCredits(model *database.Model) bool {
+	if model == nil {
+		return false
+	}
+
+	switch model.CreditType {
+	case database.TokenInputOutputCreditType, database.RequestCreditType, database.FreeCreditType:
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+ * Caps max_tokens to the output the ceiling can still pay for once the input
+ * is billed. Any model of a fallback chain can answer, so the ceiling must fit
+ * each of them that can be estimated.
+ */
+func capMaxTokens(models []*database.Model, inputTokens int, maxCredits int, opts *options.ProviderOptions) error {
+	for _, model := range models {
+		if !canEstimateCredits(model) || model.CreditType == database.FreeCreditType {
+			continue
+		}
+
+		// The price of a request doesn't depend on its length
+		if model.CreditType == database.RequestCreditType {
+			if model.Credits(0, 0) > maxCredits {
+				return ErrCreditCeilingTooLow
+			}
+			continue
+		}
+
+		inputCredits := model.Credits(inputTokens, 0)
+		if inputCredits >= maxCredits {
+			return ErrCreditCeilingTooLow
+		}
+
+		if model.CreditOutput == nil || *model.CreditOutput <= 0 {
+			continue
+		}
+
+		affordableTokens := (maxCredits - inputCredits) / *model.CreditOutput
+		if affordableTokens < 1 {
+			return ErrCreditCeilingTooLow
+		}
+
+		if opts.MaxTokens == nil || *opts.MaxTokens > affordableTokens {
+			opts.MaxTokens = &affordableTokens
+		}
+	}
+
+	return nil
+}
+
+/*
+ * Tracks the cost of the generation as it's streamed. Once it reaches the
+ * ceiling, the provider is stopped with cancel and the generation ends with
+ * the credit_ceiling_reached warning. The token usage the provider reports
+ * after being stopped is still forwarded.
+ *
+ * The generation is priced with the model that answers it, known once it
+ * starts streaming. When that model can't be estimated, the generation isn't
+ * limited and gets the credit_ceiling_not_enforced warning.
+ */
+func limitCredits(
+	resChan chan options.Result,
+	cancel context.CancelFunc,
+	answeringModel func() *database.Model,
+	tokenizer tokens.Tokenizer,
+	inputTokens int,
+	maxCredits int,
+) chan options.Result {
+	result := make(chan options.Result)
+
+	go func() {
+		defer close(result)
+		defer cancel()
+
+		var model *database.Model
+		started := false
+		outputTokens := 0
+		reached := false
+
+		for res := range resChan {
+			if !started && res.Err == "" {
+				started = true
+				model = answeringModel()
+				if !canEstimateCredits(model) {
+					result <- options.Result{Warnings: []string{CreditCeilingNotEnforced}}
+				}
+			}
+
+			if !canEstimateCredits(model) || model.CreditType != database.TokenInputOutputCreditType {
+				result <- res
+				continue
+			}
+
+			if reached {
+				if res.TokenUsage.Input != 0 || res.TokenUsage.Output != 0 {
+					result <- options.Result{TokenUsage: res.TokenUsage}
+				}
+				continue
+			}
+
+			outputTokens += tokenizer.CountTokens(res.Result)
+			for _, toolCall := range res.ToolCalls {
+				outputTokens += tokenizer.CountTokens(toolCall.Function.Name + toolCall.Function.Arguments)
+			}
+
+			result <- res
+
+			if model.Credits(inputTokens, outputTokens) >= maxCredits {
+				reached = true
+				cancel()
+				result <- options.Result{Warnings: []string{CreditCeilingReached}}
+			}
+		}
+	}()
+
+	return result
+}
@@ -0,0 +1,103 @@
+package completion
+
+import (
+	"context"
+	"testing"
+
+	database "github.com/polyfire/api/db"
+	"github.com/polyfire/api/llm/providers/options"
+	"github.com/polyfire/api/tokens"
+)
+
+func TestCreditCeiling(t *testing.T) {
+	creditInput, creditOutput := 1, 10
+	model := &database.Model{
+		CreditType:   database.TokenInputOutputCreditType,
+		CreditInput:  &creditInput,
+		CreditOutput: &creditOutput,
+	}
+
+	opts := options.ProviderOptions{}
+	if err := capMaxTokens([]*database.Model{model}, 50, 100, &opts); err != nil || opts.MaxTokens == nil || *opts.MaxTokens != 5 {
+		t.Fatalf("capMaxTokens should have capped max_tokens to 5 but returned %v, %v", opts.MaxTokens, err)
+	}
+
+	if err := capMaxTokens([]*database.Model{model}, 100, 100, &opts); err != ErrCreditCeilingTooLow {
+		t.Fatalf("capMaxTokens should have refused an input costing the whole ceiling but returned %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	resChan := make(chan options.Result)
+	go func() {
+		defer close(resChan)
+		for _, word := range []string{"one", " two", " three", " four", " five"} {
+			resChan <- options.Result{Result: word}
+		}
+		resChan <- options.Result{TokenUsage: options.TokenUsage{Input: 50, Output: 5}}
+	}()
+
+	str := ""
+	warnings := []string{}
+	tokenUsage := options.TokenUsage{}
+	for res := range limitCredits(resChan, cancel, func() *database.Model { return model }, tokens.DefaultTokenizer, 50, 80) {
+		str += res.Result
+		warnings = append(warnings, res.Warnings...)
+		tokenUsage.Output += res.TokenUsage.Output
+	}
+
+	if str != "one two three" || len(warnings) != 1 || warnings[0] != CreditCeilingReached {
+		t.Fatalf("The generation should have stopped after 3 tokens with a warning but returned %q, %v", str, warnings)
+	}
+
+	if ctx.Err() == nil || tokenUsage.Output != 5 {
+		t.Fatalf("The provider should have been canceled and its token usage forwarded (%v)", tokenUsage)
+	}
+}
+
+func TestCreditCeilingOfFallbackChain(t *testing.T) {
+	cheapInput, cheapOutput := 1, 5
+	cheap := &database.Model{
+		CreditType:   database.TokenInputOutputCreditType,
+		CreditInput:  &cheapInput,
+		CreditOutput: &cheapOutput,
+	}
+	creditInput, creditOutput := 1, 10
+	expensive := &database.Model{
+		CreditType:   database.TokenInputOutputCreditType,
+		CreditInput:  &creditInput,
+		CreditOutput: &creditOutput,
+	}
+	perSecond := &database.Model{CreditType: database.SecondCreditType}
+	requestCredit := 200
+	perRequest := &database.Model{CreditType: database.RequestCreditType, Credit: &requestCredit}
+
+	// The ceiling must fit whichever model of the chain answers
+	opts := options.ProviderOptions{}
+	err := capMaxTokens([]*database.Model{cheap, expensive, perSecond}, 50, 100, &opts)
+	if err != nil || opts.MaxTokens == nil || *opts.MaxTokens != 5 {
+		t.Fatalf("capMaxTokens should have capped max_tokens to 5 but returned %v, %v", opts.MaxTokens, err)
+	}
+
+	if err := capMaxTokens([]*database.Model{perRequest}, 50, 100, &opts); err != ErrCreditCeilingTooLow {
+		t.Fatalf("capMaxTokens should have refused a request costing more than the ceiling but returned %v", err)
+	}
+
+	resChan := make(chan options.Result)
+	go func() {
+		defer close(resChan)
+		for _, word := range []string{"one", " two", " three", " four", " five"} {
+			resChan <- options.Result{Result: word}
+		}
+	}()
+
+	str := ""
+	warnings := []string{}
+	for res := range limitCredits(resChan, func() {}, func() *database.Model { return perSecond }, tokens.DefaultTokenizer, 50, 60) {
+		str += res.Result
+		warnings = append(warnings, res.Warnings...)
+	}
+
+	if str != "one two three four five" || len(warnings) != 1 || warnings[0] != CreditCeilingNotEnforced {
+		t.Fatalf("The model billed per second should have answered with a warning but returned %q, %v", str, warnings)
+	}
+}
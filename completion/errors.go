@@ -2,6 +2,8 @@ package completion
 
 import (
 	"errors"
+
+	webrequest "github.com/polyfire/api/web_request"
 )
 
 var (
@@ -14,4 +16,61 @@ var (
 	ErrProjectRateLimitReached = errors.New("429 Monthly Project Rate Limit Reached")
 	ErrProjectNotPremiumModel  = errors.New("403 Project Can't Use Premium Models")
 	ErrUnknownError            = errors.New("500 Unknown Error")
+	ErrToolsNotSupported       = errors.New("400 Model Doesn't Support Tools")
+	ErrVisionNotSupported      = errors.New("400 Model Doesn't Support Images")
+	ErrInvalidJSONSchema       = errors.New("400 Invalid JSON Schema")
+	ErrProviderUnavailable     = errors.New("503 Provider Unavailable")
+	ErrNoRoutableModel         = errors.New("400 No Routable Model")
 )
+
+// The API error code returned for each error of GenerationStart
+func ErrorCode(err error) string {
+	switch err {
+	case webrequest.ErrWebsiteExceedsLimit:
+		return "error_website_exceeds_limit"
+	case webrequest.ErrWebsitesContentExceeds:
+		return "error_websites_content_exceeds"
+	case webrequest.ErrFetchWebpage:
+		return "error_fetch_webpage"
+	case webrequest.ErrParseContent:
+		return "error_parse_content"
+	case webrequest.ErrVisitBaseURL:
+		return "error_visit_base_url"
+	case ErrNotFound:
+		return "not_found"
+	case ErrUnknownModelProvider:
+		return "invalid_model_provider"
+	case ErrRateLimitReached:
+		return "rate_limit_reached"
+	case ErrCreditsUsedUp:
+		return "credits_used_up"
+	case ErrProjectRateLimitReached:
+		return "project_rate_limit_reached"
+	case ErrToolsNotSupported:
+		return "tools_not_supported"
+	case ErrVisionNotSupported:
+		return "model_does_not_support_vision"
+	case ErrInvalidImage:
+		return "invalid_image"
+	case ErrInvalidJSONSchema:
+		return "invalid_json_schema"
+	case ErrInvalidBatchSize:
+		return "invalid_batch_size"
+	case ErrBatchExceedsRateLimit:
+		return "batch_exceeds_rate_limit"
+	case ErrInvalidWebhookURL:
+		return "invalid_webhook_url"
+	case ErrProviderUnavailable:
+		return "provider_unavailable"
+	case ErrNoRoutableModel:
+		return "no_routable_model"
+	case ErrCreditCeilingTooLow:
+		return "credit_ceiling_too_low"
+	case ErrContentBlocked:
+		return "content_blocked"
+	case ErrModerationUnavailable:
+		return "moderation_unavailable"
+	default:
+		return "internal_error"
+	}
+}
@@ -2,12 +2,15 @@ package completion
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"log"
 
+	"github.com/polyfire/api/completion/schema"
 	database "github.com/polyfire/api/db"
 	"github.com/polyfire/api/llm"
 	"github.com/polyfire/api/llm/providers/options"
+	"github.com/polyfire/api/tokens"
 	"github.com/polyfire/api/utils"
 )
 
@@ -28,6 +31,32 @@ type GenerateRequestBody struct {
 	Infos          bool        `json:"infos,omitempty"`
 	AutoComplete   bool        `json:"auto_complete,omitempty"`
 	JSONFormat     bool        `json:"json_format,omitempty"`
+
+	Tools       []options.Tool       `json:"tools,omitempty"`
+	ToolChoice  *options.ToolChoice  `json:"tool_choice,omitempty"`
+	ToolCalls   []options.ToolCall   `json:"tool_calls,omitempty"`   // The tool calls of the previous answer
+	ToolResults []options.ToolResult `json:"tool_results,omitempty"` // The results of these tool calls
+
+	Images []options.Image `json:"images,omitempty"`
+
+	MaxContextTokens *int `json:"max_context_tokens,omitempty"`
+
+	MaxTokens        *int           `json:"max_tokens,omitempty"`
+	TopP             *float32       `json:"top_p,omitempty"`
+	PresencePenalty  *float32       `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float32       `json:"frequency_penalty,omitempty"`
+	Seed             *int           `json:"seed,omitempty"`
+	LogitBias        map[string]int `json:"logit_bias,omitempty"`
+	N                *int           `json:"n,omitempty"`
+
+	JSONSchema json.RawMessage `json:"json_schema,omitempty"`
+
+	// The generation is stopped once it costs this many credits
+	MaxCredits *int `json:"max_credits,omitempty"`
+
+	// Queues the generation as a job, its result is polled or sent to the webhook
+	Async   bool    `json:"async,omitempty"`
+	Webhook *string `json:"webhook,omitempty"`
 }
 
 func getLanguageCompletion(language *string) string {
@@ -37,30 +66,126 @@ func getLanguageCompletion(language *string) string {
 	return ""
 }
 
+// With a fallback chain, the prompt must fit in the smallest model it can fall back to
+func getContextWindow(db database.Database, projectID string, provider llm.Provider) int {
+	catalog, err := db.GetCatalog()
+	if err != nil {
+		return DefaultContextWindow
+	}
+
+	contextWindow := 0
+	for _, candidate := range llm.Candidates(provider) {
+		providerName, modelName := candidate.ProviderModel()
+
+		candidateWindow := DefaultContextWindow
+		model := catalog.Lookup(providerName, modelName, projectID)
+		if model != nil && model.ContextWindow != nil {
+			candidateWindow = *model.ContextWindow
+		}
+
+		if contextWindow == 0 || candidateWindow < contextWindow {
+			contextWindow = candidateWindow
+		}
+	}
+
+	if contextWindow == 0 {
+		return DefaultContextWindow
+	}
+	return contextWindow
+}
+
+// What the "auto" model needs to know to pick a model able to answer the request
+func routingRequest(input GenerateRequestBody) llm.RoutingRequest {
+	promptTokens := tokens.CountTokens(input.Task)
+	if input.SystemPrompt != nil {
+		promptTokens += tokens.CountTokens(*input.SystemPrompt)
+	}
+
+	return llm.RoutingRequest{
+		PromptTokens: promptTokens,
+		JSONFormat:   input.JSONFormat,
+		JSONSchema:   len(input.JSONSchema) > 0,
+		Tools:        len(input.Tools) > 0,
+		Vision:       len(input.Images) > 0,
+	}
+}
+
 func GenerationStart(
 	ctx context.Context,
 	userID string,
 	input GenerateRequestBody,
 ) (*chan options.Result, error) {
 	db := ctx.Value(utils.ContextKeyDB).(database.Database)
+	projectID, _ := ctx.Value(utils.ContextKeyProjectID).(string)
 	resources := []database.MatchResult{}
 
+	// The prompt is moderated before anything else uses it
+	moderationStage, err := newModerationStage(ctx, userID)
+	if err != nil {
+		log.Printf("[ERROR] Invalid moderation policy: %v\n", err)
+		return nil, ErrInternalServerError
+	}
+	if moderationStage != nil {
+		if err := moderationStage.moderatePrompt(&input); err != nil {
+			return nil, err
+		}
+	}
+
 	log.Println("[DEBUG] Init provider")
 
+	var routing *options.Routing
+	if input.Model == llm.AutoModel {
+		routing, err = llm.Route(ctx, routingRequest(input))
+		if errors.Is(err, llm.ErrNoRoutableModel) {
+			return nil, ErrNoRoutableModel
+		} else if err != nil {
+			return nil, ErrInternalServerError
+		}
+
+		log.Printf("[INFO] Routed to %s: %s\n", routing.Model, routing.Reason)
+		input.Model = routing.Model
+	}
+
 	// Get provider
 	provider, err := llm.NewProvider(ctx, input.Model)
 	if errors.Is(err, llm.ErrUnknownModel) {
 		return nil, ErrUnknownModelProvider
 	}
 
+	if errors.Is(err, llm.ErrProviderUnavailable) {
+		return nil, ErrProviderUnavailable
+	}
+
 	if err != nil {
 		return nil, ErrInternalServerError
 	}
 
 	providerName, modelName := provider.ProviderModel()
 
-	// Check Rate Limit
-	if provider.DoesFollowRateLimit() {
+	if len(input.Tools) > 0 && !llm.SupportsTools(provider) {
+		return nil, ErrToolsNotSupported
+	}
+
+	if len(input.Images) > 0 && !llm.SupportsVision(provider) {
+		return nil, ErrVisionNotSupported
+	}
+
+	images, err := ResolveImages(input.Images)
+	if err != nil {
+		return nil, err
+	}
+
+	var validator *schema.Schema
+	if len(input.JSONSchema) > 0 {
+		validator, err = schema.Parse(input.JSONSchema)
+		if err != nil {
+			return nil, ErrInvalidJSONSchema
+		}
+	}
+
+	// Check Rate Limit, a batch checks it once for all its items
+	rateLimitChecked, _ := ctx.Value(utils.ContextKeyRateLimitChecked).(bool)
+	if provider.DoesFollowRateLimit() && !rateLimitChecked {
 		log.Println("[DEBUG] Check Rate Limit")
 		err = CheckRateLimit(ctx)
 		if err != nil {
@@ -73,24 +198,39 @@ func GenerationStart(
 		if credit != nil && provider.DoesFollowRateLimit() {
 			db.LogRequestsCredits(
 				ctx.Value(utils.ContextKeyEventID).(string),
-				userID, modelName, *credit, inputCount, outputCount, "completion")
+				userID, modelName, *credit, inputCount, outputCount, "completion", utils.APIKeyID(ctx, providerName))
 		} else {
 			db.LogRequests(
 				ctx.Value(utils.ContextKeyEventID).(string),
 				userID,
+				projectID,
 				providerName,
 				modelName,
 				inputCount,
 				outputCount,
 				"completion",
 				provider.DoesFollowRateLimit(),
+				utils.APIKeyID(ctx, providerName),
 			)
 		}
 	}
 
 	// Get Options
 	opts := options.ProviderOptions{
-		JSONFormat: input.JSONFormat,
+		JSONFormat:   input.JSONFormat,
+		AutoComplete: input.AutoComplete,
+		Tools:        input.Tools,
+		ToolChoice:   input.ToolChoice,
+
+		MaxTokens:        input.MaxTokens,
+		TopP:             input.TopP,
+		PresencePenalty:  input.PresencePenalty,
+		FrequencyPenalty: input.FrequencyPenalty,
+		Seed:             input.Seed,
+		LogitBias:        input.LogitBias,
+		N:                input.N,
+
+		JSONSchema: input.JSONSchema,
 	}
 	if input.Stop != nil {
 		opts.StopWords = input.Stop
@@ -100,35 +240,102 @@ func GenerationStart(
 	}
 
 	// Get Context elements
-	contextString, warnings, err := GetContextString(ctx, userID, input, &callback, &opts)
+	tokenizer := tokens.GetTokenizer(providerName, modelName)
+
+	taskTokens := tokenizer.CountTokens(input.Task)
+	for _, image := range images {
+		taskTokens += image.CountTokens()
+	}
+	for _, toolResult := range input.ToolResults {
+		taskTokens += tokenizer.CountTokens(toolResult.Content)
+	}
+
+	tokenLimit := ContextTokenLimit(getContextWindow(db, projectID, provider), taskTokens, input.MaxContextTokens)
+
+	// Set when the request has a chat_id
+	var saveToChatHistory func(completion string)
+
+	contextString, history, warnings, err := GetContextString(
+		ctx,
+		userID,
+		input,
+		imageReferences(images),
+		tokenizer,
+		tokenLimit,
+		&saveToChatHistory,
+	)
 	if err != nil {
 		return nil, err
 	}
 
+	// The images of the chat history are dropped for the models that can't see them
+	if !llm.SupportsVision(provider) {
+		for i := range history {
+			history[i].Images = nil
+		}
+	}
+
 	/*
-		If the autocomplete flag is on, we skip the question/answer prompt and put
+		If the autocomplete flag is on, we skip the question/answer messages and put
 		the LLM "cursor" at the end of the task, effectively asking it to complete
 		the text instead of answering a question.
 
 		This might not be enough for some models retrained to answer chat questions
 		instead of just completing a text. The systemPrompt should also be ajusted.
 	*/
-	var prompt string
+	var messages []options.Message
+	systemPrompt := getLanguageCompletion(input.Language) + contextString
+	if validator != nil && (!llm.SupportsJSONSchema(provider) || !opts.UsesStructuredOutputTool()) {
+		systemPrompt += jsonSchemaInstructions(input.JSONSchema)
+	}
 	if input.AutoComplete {
-		prompt = getLanguageCompletion(input.Language) + contextString + "\n" + input.Task
+		messages = []options.Message{{Role: options.RoleUser, Content: systemPrompt + "\n" + input.Task, Images: images}}
 	} else {
-		prompt = getLanguageCompletion(input.Language) + contextString + "\nUser:\n" + input.Task + "\nYou:\n"
+		if systemPrompt != "" {
+			messages = append(messages, options.Message{Role: options.RoleSystem, Content: systemPrompt})
+		}
+		messages = append(messages, history...)
+		if input.Task != "" || len(input.ToolResults) == 0 {
+			messages = append(messages, options.Message{Role: options.RoleUser, Content: input.Task, Images: images})
+		}
+
+		// A follow-up request sends back the tool calls of the model with their results
+		if len(input.ToolCalls) > 0 {
+			messages = append(messages, options.Message{Role: options.RoleAssistant, ToolCalls: input.ToolCalls})
+		}
+		for _, toolResult := range input.ToolResults {
+			messages = append(messages, options.Message{
+				Role:       options.RoleTool,
+				Content:    toolResult.Content,
+				ToolCallID: toolResult.ToolCallID,
+			})
+		}
 	}
 
+	// The caches are indexed on a text version of the messages
+	prompt := options.FlattenMessages(messages, input.AutoComplete)
+
 	log.Println("[INFO] Prompt: " + prompt)
 
 	var result chan options.Result
 
 	var embeddings []float32
 
-	if input.Temperature != nil && *(input.Temperature) == 0.0 &&
-		(input.Cache == nil || *(input.Cache)) {
-		result, err = CheckExactCache(ctx, prompt, providerName, modelName)
+	// The caches only index and store a single text, requests with tools, images, several choices
+	// or a schema to validate can't be cached
+	cacheable := len(input.Tools) == 0 && len(images) == 0 && (input.N == nil || *input.N <= 1) && validator == nil
+	useExactCache := input.Temperature != nil && *(input.Temperature) == 0.0 &&
+		(input.Cache == nil || *(input.Cache)) && cacheable
+	useFuzzyCache := input.FuzzyCache && cacheable
+
+	// The exact cache entries are stored with the options so different settings don't collide
+	cacheKey := prompt
+	if useExactCache {
+		cacheKey += opts.CacheKey()
+	}
+
+	if useExactCache {
+		result, err = CheckExactCache(ctx, cacheKey, providerName, modelName)
 	}
 
 	if err != nil {
@@ -136,13 +343,16 @@ func GenerationStart(
 	}
 
 	if result != nil {
+		if moderationStage != nil {
+			result = moderationStage.moderateCompletion(result, func() {})
+		}
 		return &result, nil
 	}
 
 	// The fuzzy cache check for "close enough" embeddings.
 	// It can reduce costs a lot in some cases but might lead to data leakage.
 	// It should never be used in places with user personnal informations.
-	if input.FuzzyCache {
+	if useFuzzyCache {
 		result, embeddings, err = CheckFuzzyCache(ctx, prompt, providerName, modelName)
 	}
 
@@ -151,11 +361,61 @@ func GenerationStart(
 	}
 
 	if result != nil {
+		if moderationStage != nil {
+			result = moderationStage.moderateCompletion(result, func() {})
+		}
 		return &result, nil
 	}
 
+	// The output is capped to what max_credits can pay for, and stopped if it still costs more
+	var catalog *database.Catalog
+	inputTokens := 0
+	if input.MaxCredits != nil {
+		if *input.MaxCredits <= 0 {
+			return nil, ErrCreditCeilingTooLow
+		}
+
+		// Any model of a fallback chain can answer
+		candidateModels := []*database.Model{}
+		if catalog, _ = db.GetCatalog(); catalog != nil {
+			for _, candidate := range llm.Candidates(provider) {
+				candidateProvider, candidateModel := candidate.ProviderModel()
+				candidateModels = append(candidateModels, catalog.Lookup(candidateProvider, candidateModel, projectID))
+			}
+		}
+
+		inputTokens = tokenizer.CountTokens(prompt) + options.CountImagesTokens(messages)
+		if err := capMaxTokens(candidateModels, inputTokens, *input.MaxCredits, &opts); err != nil {
+			return nil, err
+		}
+	}
+
+	// The generation can be stopped early by the credit ceiling or the moderation
+	generationCtx, cancel := context.WithCancel(ctx)
+
 	log.Println("[DEBUG] Generate")
-	resChan := provider.Generate(prompt, &callback, &opts)
+	var resChan chan options.Result
+	if validator != nil {
+		resChan = GenerateWithJSONSchema(generationCtx, provider, messages, &callback, &opts, validator)
+	} else {
+		resChan = provider.Generate(generationCtx, messages, &callback, &opts)
+	}
+
+	if input.MaxCredits != nil {
+		// With a fallback chain, the model answering is only known once it streams
+		answeringModel := func() *database.Model {
+			if catalog == nil {
+				return nil
+			}
+			answeringProvider, answeringModelName := provider.ProviderModel()
+			return catalog.Lookup(answeringProvider, answeringModelName, projectID)
+		}
+		resChan = limitCredits(resChan, cancel, answeringModel, tokenizer, inputTokens, *input.MaxCredits)
+	}
+
+	if moderationStage != nil {
+		resChan = moderationStage.moderateCompletion(resChan, cancel)
+	}
 
 	if input.AutoComplete {
 		resChan = AddSpaceIfNeeded(prompt, resChan)
@@ -166,17 +426,36 @@ func GenerationStart(
 	// Add warnings and cache at the end of the generation
 	go func() {
 		defer close(result)
+		defer cancel()
 		totalCompletion := ""
+		stopped := false
+		blocked := false
+		failed := false
 		for res := range resChan {
 			result <- res
-			totalCompletion += res.Result
+			if res.ChoiceIndex == 0 {
+				totalCompletion += res.Result
+			}
+			blocked = blocked || utils.ContainsString(res.Warnings, ContentBlocked)
+			stopped = stopped || blocked || utils.ContainsString(res.Warnings, CreditCeilingReached)
+			failed = failed || res.Err != ""
+		}
+		// Saved once with the answer that was sent (moderated, without the JSON schema repairs)
+		if saveToChatHistory != nil && !failed && !blocked {
+			saveToChatHistory(totalCompletion)
 		}
-		result <- options.Result{Resources: resources, Warnings: warnings}
-		if (input.Temperature != nil && *(input.Temperature) == 0.0 && (input.Cache == nil || *(input.Cache))) ||
-			input.FuzzyCache {
+		// With a fallback chain, the model that answered isn't known before the end
+		_, answeredModel := provider.ProviderModel()
+		result <- options.Result{Resources: resources, Warnings: warnings, Model: answeredModel, Routing: routing}
+		// An aborted generation is incomplete and mustn't be cached
+		if ctx.Err() != nil || stopped {
+			return
+		}
+
+		if useExactCache || useFuzzyCache {
 			_ = db.AddCompletionCache(
 				embeddings,
-				prompt,
+				cacheKey,
 				totalCompletion,
 				providerName,
 				modelName,
@@ -5,6 +5,8 @@ import (
 	"testing"
 
 	database "github.com/polyfire/api/db"
+	"github.com/polyfire/api/llm"
+	"github.com/polyfire/api/llm/providers"
 	"github.com/polyfire/api/utils"
 )
 
@@ -13,13 +15,31 @@ func mockLogRequests(
 	_ string,
 	_ string,
 	_ string,
+	_ string,
 	_ int,
 	_ int,
 	_ database.Kind,
 	_ bool,
+	_ string,
 ) {
 }
 
+func mockGetCatalog() (*database.Catalog, error) {
+	creditInput := 5
+	creditOutput := 15
+
+	return database.NewCatalog([]database.Model{{
+		ID:           1,
+		Model:        "gpt-3.5-turbo",
+		Provider:     "openai",
+		Type:         "completion",
+		CreditType:   database.TokenInputOutputCreditType,
+		CreditInput:  &creditInput,
+		CreditOutput: &creditOutput,
+		OptionStream: true,
+	}}, nil), nil
+}
+
 func TestSimpleFullGeneration(t *testing.T) {
 	utils.SetLogLevel("WARN")
 	ctx := context.Background()
@@ -37,6 +57,7 @@ func TestSimpleFullGeneration(t *testing.T) {
 			 * Any database request will slow down requests for the users.
 			 */
 			MockLogRequests: mockLogRequests,
+			MockGetCatalog:  mockGetCatalog,
 		},
 	)
 
@@ -67,3 +88,109 @@ func TestSimpleFullGeneration(t *testing.T) {
 		t.Fatalf(`Generate("Test") should have returned "Test response" but returned "%s"`, str)
 	}
 }
+
+func TestContextWindowOfFallbackChain(t *testing.T) {
+	gpt4oWindow, llamaWindow := 128000, 4096
+	db := database.MockDatabase{
+		MockGetCatalog: func() (*database.Catalog, error) {
+			return database.NewCatalog([]database.Model{
+				{ID: 1, Model: "gpt-4o", Provider: "openai", Type: "completion", ContextWindow: &gpt4oWindow},
+				{ID: 2, Model: "llama2", Provider: "llama", Type: "completion", ContextWindow: &llamaWindow},
+			}, nil), nil
+		},
+	}
+
+	provider := &llm.FallbackProvider{Providers: []llm.Provider{
+		providers.OpenAIStreamProvider{Provider: "openai", Model: "gpt-4o"},
+		providers.LLaMaProvider{Model: "llama2"},
+	}}
+
+	if contextWindow := getContextWindow(db, "", provider); contextWindow != llamaWindow {
+		t.Fatalf("The context window of the chain should be the smallest one (%d) but was %d", llamaWindow, contextWindow)
+	}
+}
+
+// The messages saved in the chat are appended to saved
+func chatContext(userID string, saved *[]string) context.Context {
+	ctx := utils.MockOpenAIServer(context.Background())
+	ctx = context.WithValue(ctx, utils.ContextKeyDB, database.MockDatabase{
+		MockLogRequests: mockLogRequests,
+		MockGetCatalog:  mockGetCatalog,
+		MockLogEvents: func(_ string, _ string, _ string, _ string, _ string, _ string, _ bool, _ string, _ string, _ string) {
+		},
+		MockGetChatByID: func(id string) (*database.Chat, error) {
+			return &database.Chat{ID: id, UserID: userID}, nil
+		},
+		MockAddChatMessage: func(_ string, _ bool, content string, _ []string) error {
+			*saved = append(*saved, content)
+			return nil
+		},
+		MockGetChatMessages: func(_ string, _ string, _ bool, _ int, _ int) ([]database.ChatMessage, error) {
+			return nil, nil
+		},
+	})
+	ctx = context.WithValue(ctx, utils.ContextKeyRateLimitStatus, database.RateLimitStatusOk)
+	ctx = context.WithValue(ctx, utils.ContextKeyCreditsStatus, database.CreditsStatusOk)
+	return context.WithValue(ctx, utils.ContextKeyEventID, "00000000-0000-0000-0000-000000000000")
+}
+
+func TestChatHistorySavedOnceWithJSONSchema(t *testing.T) {
+	utils.SetLogLevel("WARN")
+	userID := "00000000-0000-0000-0000-000000000000"
+	chatID := "00000000-0000-0000-0000-000000000001"
+
+	saved := []string{}
+	ctx := chatContext(userID, &saved)
+
+	// "Test response" never matches, every repair is attempted
+	reqBody := GenerateRequestBody{
+		Task:       "Test",
+		ChatID:     &chatID,
+		JSONSchema: []byte(`{"type": "object"}`),
+	}
+
+	result, err := GenerationStart(ctx, userID, reqBody)
+	if err != nil {
+		t.Fatalf(`GenerationStart returned an error %v`, err)
+	}
+
+	for range *result {
+	}
+
+	if len(saved) != 2 || saved[0] != "Test" || saved[1] != "Test response" {
+		t.Fatalf("The task and the final answer should have been saved once but the saved messages were %v", saved)
+	}
+}
+
+func TestChatHistoryOfModeratedAnswer(t *testing.T) {
+	utils.SetLogLevel("WARN")
+	userID := "00000000-0000-0000-0000-000000000000"
+	chatID := "00000000-0000-0000-0000-000000000001"
+
+	generate := func(action string) []string {
+		saved := []string{}
+		ctx := context.WithValue(chatContext(userID, &saved), utils.ContextKeyModerationPolicy, &database.ModerationPolicy{
+			Provider: "local",
+			Action:   action,
+			Rules:    []database.ModerationRule{{Category: "test", Keywords: []string{"response"}}},
+		})
+
+		result, err := GenerationStart(ctx, userID, GenerateRequestBody{Task: "Test", ChatID: &chatID})
+		if err != nil {
+			t.Fatalf(`GenerationStart returned an error %v`, err)
+		}
+
+		for range *result {
+		}
+
+		return saved
+	}
+
+	if saved := generate("redact"); len(saved) != 2 || saved[1] != "Test [redacted]" {
+		t.Fatalf("The redacted answer should have been saved but the saved messages were %v", saved)
+	}
+
+	if saved := generate("block"); len(saved) != 0 {
+		t.Fatalf("Nothing should have been saved for a blocked answer but the saved messages were %v", saved)
+	}
+}
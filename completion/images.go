@@ -0,0 +1,76 @@
+package completion
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/polyfire/api/llm/providers/options"
+)
+
+var ErrInvalidImage = errors.New("400 Invalid Image")
+
+/*
+ * The bucket paths are resolved to the public URL of the object in the supabase
+ * storage, the same place the generated images are stored.
+ */
+func bucketURL(path string) (string, error) {
+	path = strings.TrimPrefix(path, "/")
+	if path == "" || strings.Contains(path, "..") {
+		return "", ErrInvalidImage
+	}
+
+	return os.Getenv("SUPABASE_URL") + "/storage/v1/object/public/" + path, nil
+}
+
+// Checks the images sent by the client and sets their URL so the providers only have to forward it
+func ResolveImages(images []options.Image) ([]options.Image, error) {
+	resolved := make([]options.Image, 0, len(images))
+
+	for _, image := range images {
+		if image.Detail != "" && image.Detail != "low" && image.Detail != "high" && image.Detail != "auto" {
+			return nil, ErrInvalidImage
+		}
+
+		switch {
+		case image.URL != "" && image.Data == "" && image.Path == "":
+			parsedURL, err := url.Parse(image.URL)
+			if err != nil || (parsedURL.Scheme != "https" && parsedURL.Scheme != "http") {
+				return nil, ErrInvalidImage
+			}
+		case image.Data != "" && image.URL == "" && image.Path == "":
+			if !strings.HasPrefix(image.MimeType, "image/") {
+				return nil, ErrInvalidImage
+			}
+			if _, err := base64.StdEncoding.DecodeString(image.Data); err != nil {
+				return nil, ErrInvalidImage
+			}
+			image.URL = "data:" + image.MimeType + ";base64," + image.Data
+		case image.Path != "" && image.URL == "" && image.Data == "":
+			imageURL, err := bucketURL(image.Path)
+			if err != nil {
+				return nil, err
+			}
+			image.URL = imageURL
+		default:
+			return nil, ErrInvalidImage
+		}
+
+		resolved = append(resolved, image)
+	}
+
+	return resolved, nil
+}
+
+// Only the URLs are kept in the chat history, the base64 images would be too heavy
+func imageReferences(images []options.Image) []string {
+	references := []string{}
+	for _, image := range images {
+		if image.Data == "" {
+			references = append(references, image.URL)
+		}
+	}
+	return references
+}
@@ -0,0 +1,51 @@
+package completion
+
+import (
+	"testing"
+
+	"github.com/polyfire/api/llm/providers/options"
+)
+
+func TestResolveImages(t *testing.T) {
+	t.Setenv("SUPABASE_URL", "https://example.supabase.co")
+
+	images, err := ResolveImages([]options.Image{
+		{URL: "https://example.com/cat.png"},
+		{Data: "aGVsbG8=", MimeType: "image/png"},
+		{Path: "generated_images/cat.png", Detail: "low"},
+	})
+	if err != nil {
+		t.Fatalf(`ResolveImages returned an error: %v`, err)
+	}
+
+	expected := []string{
+		"https://example.com/cat.png",
+		"data:image/png;base64,aGVsbG8=",
+		"https://example.supabase.co/storage/v1/object/public/generated_images/cat.png",
+	}
+	for i, image := range images {
+		if image.URL != expected[i] {
+			t.Fatalf(`ResolveImages should have resolved "%s" but resolved "%s"`, expected[i], image.URL)
+		}
+	}
+
+	if references := imageReferences(images); len(references) != 2 {
+		t.Fatalf(`The base64 images shouldn't be kept in the chat history but got %v`, references)
+	}
+
+	if images[2].CountTokens() != 85 || images[0].CountTokens() != 765 {
+		t.Fatalf(`CountTokens returned %d and %d instead of 85 and 765`, images[2].CountTokens(), images[0].CountTokens())
+	}
+
+	invalidImages := [][]options.Image{
+		{{URL: "file:///etc/passwd"}},
+		{{Data: "aGVsbG8=", MimeType: "text/plain"}},
+		{{Path: "../secrets.png"}},
+		{{URL: "https://example.com/cat.png", Path: "generated_images/cat.png"}},
+	}
+	for _, invalidImage := range invalidImages {
+		if _, err := ResolveImages(invalidImage); err != ErrInvalidImage {
+			t.Fatalf(`ResolveImages should have refused %v`, invalidImage)
+		}
+	}
+}
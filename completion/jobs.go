@@ -0,0 +1,370 @@
+package completion
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	router "github.com/julienschmidt/httprouter"
+	database "github.com/polyfire/api/db"
+	options "github.com/polyfire/api/llm/providers/options"
+	utils "github.com/polyfire/api/utils"
+)
+
+const (
+	// The number of jobs generated at the same time by an instance, can be changed with JOB_WORKERS
+	DefaultJobWorkers = 4
+	JobPollInterval   = 5 * time.Second
+	// The partial result of a running job is saved at this interval, it also shows the job is still alive
+	JobHeartbeat = 2 * time.Second
+	// A running job without heartbeat for this long was abandoned by a stopped instance
+	JobStaleAfter    = 2 * time.Minute
+	WebhookAttempts  = 3
+	WebhookTimeout   = 10 * time.Second
+	WebhookSignature = "X-Polyfire-Signature"
+)
+
+var ErrInvalidWebhookURL = errors.New("400 Invalid Webhook URL")
+
+type JobResponse struct {
+	ID            string             `json:"id"`
+	Status        database.JobStatus `json:"status"`
+	PartialResult string             `json:"partial_result"`
+	Result        json.RawMessage    `json:"result,omitempty"`
+	WebhookSecret *string            `json:"webhook_secret,omitempty"`
+	CreatedAt     time.Time          `json:"created_at"`
+	UpdatedAt     time.Time          `json:"updated_at"`
+}
+
+func toJobResponse(job database.GenerationJob) JobResponse {
+	response := JobResponse{
+		ID:            job.ID,
+		Status:        job.Status,
+		PartialResult: job.PartialResult,
+		CreatedAt:     job.CreatedAt,
+		UpdatedAt:     job.UpdatedAt,
+	}
+
+	if job.Result != nil {
+		response.Result = json.RawMessage(*job.Result)
+	}
+
+	return response
+}
+
+// Wakes a worker up when a job is created instead of waiting for the next poll
+var jobsAvailable = make(chan struct{}, 1)
+
+func notifyJobWorkers() {
+	select {
+	case jobsAvailable <- struct{}{}:
+	default:
+	}
+}
+
+/*
+ * The webhooks are signed with a secret generated for each job and returned
+ * when the job is created. The signature is the hex HMAC-SHA256 of
+ * "<timestamp>.<body>", sent as "t=<timestamp>,v1=<signature>".
+ */
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+
+	return "t=" + strconv.FormatInt(timestamp, 10) + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newWebhookSecret() (string, error) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+func CreateJob(w http.ResponseWriter, r *http.Request, input GenerateRequestBody) {
+	userID := r.Context().Value(utils.ContextKeyUserID).(string)
+	eventID := r.Context().Value(utils.ContextKeyEventID).(string)
+	record := r.Context().Value(utils.ContextKeyRecordEvent).(utils.RecordFunc)
+	db := r.Context().Value(utils.ContextKeyDB).(database.Database)
+
+	var webhookSecret *string
+	if input.Webhook != nil {
+		// The webhooks can't reach the network of the server
+		if utils.ValidatePublicURL(r.Context(), *input.Webhook) != nil {
+			ReturnErrors(w, record, ErrInvalidWebhookURL)
+			return
+		}
+
+		secret, err := newWebhookSecret()
+		if err != nil {
+			utils.RespondError(w, record, "internal_error")
+			return
+		}
+		webhookSecret = &secret
+	}
+
+	// The worker runs the request synchronously
+	input.Async = false
+	request, err := json.Marshal(input)
+	if err != nil {
+		utils.RespondError(w, record, "invalid_json")
+		return
+	}
+
+	job, err := db.CreateGenerationJob(userID, eventID, string(request), input.Webhook, webhookSecret)
+	if err != nil || job == nil {
+		utils.RespondError(w, record, "database_error")
+		return
+	}
+
+	notifyJobWorkers()
+
+	response := toJobResponse(*job)
+	response.WebhookSecret = webhookSecret
+
+	responseJSON, _ := json.Marshal(response)
+	record(string(responseJSON))
+
+	w.Header()["Content-Type"] = []string{"application/json"}
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = w.Write(responseJSON)
+}
+
+func GetJob(w http.ResponseWriter, r *http.Request, params router.Params) {
+	userID := r.Context().Value(utils.ContextKeyUserID).(string)
+	record := r.Context().Value(utils.ContextKeyRecordEvent).(utils.RecordFunc)
+	db := r.Context().Value(utils.ContextKeyDB).(database.Database)
+
+	job, err := db.GetGenerationJob(userID, params.ByName("id"))
+	if err != nil {
+		utils.RespondError(w, record, "database_error")
+		return
+	}
+
+	if job == nil {
+		utils.RespondError(w, record, "not_found")
+		return
+	}
+
+	responseJSON, _ := json.Marshal(toJobResponse(*job))
+	record(string(responseJSON))
+
+	w.Header()["Content-Type"] = []string{"application/json"}
+	_, _ = w.Write(responseJSON)
+}
+
+// Rebuilds the context the authentication gives to the requests (see middlewares.UserContext)
+type UserContextFunc func(ctx context.Context, userID string) (context.Context, error)
+
+func jobWorkers() int {
+	workers, err := strconv.Atoi(os.Getenv("JOB_WORKERS"))
+	if err != nil || workers < 0 {
+		return DefaultJobWorkers
+	}
+	return workers
+}
+
+/*
+ * The workers claim the pending jobs from the database so the jobs created
+ * before a restart or on another instance are generated too. They stop when
+ * ctx is canceled, the jobs they were running are started again once stale.
+ */
+func StartJobWorkers(ctx context.Context, db database.Database, gcs utils.GCSUploader, userContext UserContextFunc) {
+	ctx = context.WithValue(ctx, utils.ContextKeyDB, db)
+	ctx = context.WithValue(ctx, utils.ContextKeyGCS, gcs)
+
+	go func() {
+		ticker := time.NewTicker(JobStaleAfter / 2)
+		defer ticker.Stop()
+
+		for {
+			err := db.RequeueStaleGenerationJobs(JobStaleAfter)
+			if err != nil {
+				log.Printf("[ERROR] Requeue stale jobs: %v\n", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	for i := 0; i < jobWorkers(); i++ {
+		go jobWorker(ctx, db, userContext)
+	}
+}
+
+func jobWorker(ctx context.Context, db database.Database, userContext UserContextFunc) {
+	for ctx.Err() == nil {
+		job, err := db.ClaimGenerationJob()
+		if err != nil {
+			log.Printf("[ERROR] Claim job: %v\n", err)
+		}
+
+		if job != nil {
+			RunJob(ctx, db, *job, userContext)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-jobsAvailable:
+		case <-time.After(JobPollInterval):
+		}
+	}
+}
+
+func runJobGeneration(
+	ctx context.Context,
+	db database.Database,
+	job database.GenerationJob,
+	userContext UserContextFunc,
+) options.Result {
+	var input GenerateRequestBody
+	err := json.Unmarshal([]byte(job.Request), &input)
+	if err != nil {
+		return options.Result{Err: "invalid_json"}
+	}
+
+	jobCtx, err := userContext(ctx, job.UserID)
+	if errors.Is(err, database.ErrDevNotPremium) {
+		return options.Result{Err: "dev_not_premium"}
+	}
+	if err != nil {
+		return options.Result{Err: "database_error"}
+	}
+	jobCtx = context.WithValue(jobCtx, utils.ContextKeyEventID, job.EventID)
+	jobCtx = context.WithValue(jobCtx, utils.ContextKeyAPIKeyUsage, &utils.APIKeyUsage{})
+
+	resChan, err := GenerationStart(jobCtx, job.UserID, input)
+	if err != nil {
+		return options.Result{Err: ErrorCode(err)}
+	}
+
+	var mutex sync.Mutex
+	partialResult := ""
+
+	heartbeatDone := make(chan struct{})
+	defer close(heartbeatDone)
+	go func() {
+		ticker := time.NewTicker(JobHeartbeat)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-heartbeatDone:
+				return
+			case <-ticker.C:
+				mutex.Lock()
+				partial := partialResult
+				mutex.Unlock()
+				_ = db.UpdateGenerationJobPartialResult(job.ID, partial)
+			}
+		}
+	}()
+
+	results := make(chan options.Result)
+	go func() {
+		defer close(results)
+		for res := range *resChan {
+			if res.ChoiceIndex == 0 {
+				mutex.Lock()
+				partialResult += res.Result
+				mutex.Unlock()
+			}
+			results <- res
+		}
+	}()
+
+	return CollectResult(results)
+}
+
+func RunJob(ctx context.Context, db database.Database, job database.GenerationJob, userContext UserContextFunc) {
+	result := runJobGeneration(ctx, db, job, userContext)
+
+	// The instance is stopping, the job is left running and will be started again once stale
+	if ctx.Err() != nil {
+		return
+	}
+
+	status := database.JobStatusDone
+	if result.Err != "" {
+		status = database.JobStatusFailed
+	}
+
+	resultJSON, err := result.JSON()
+	if err != nil {
+		resultJSON = []byte("{}")
+	}
+
+	err = db.FinishGenerationJob(job.ID, status, result.Result, string(resultJSON))
+	if err != nil {
+		log.Printf("[ERROR] Finish job %s: %v\n", job.ID, err)
+		return
+	}
+
+	if job.WebhookURL != nil && job.WebhookSecret != nil {
+		job.Status = status
+		job.PartialResult = result.Result
+		job.UpdatedAt = time.Now()
+		resultString := string(resultJSON)
+		job.Result = &resultString
+
+		SendWebhook(ctx, *job.WebhookURL, *job.WebhookSecret, toJobResponse(job))
+	}
+}
+
+func SendWebhook(ctx context.Context, webhookURL string, secret string, payload JobResponse) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+
+	// The host is checked again when connecting, it could resolve to another address since the job was created
+	client := utils.NewPublicHTTPClient(&http.Client{Timeout: WebhookTimeout})
+
+	for attempt := 0; attempt < WebhookAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Duration(attempt) * time.Second):
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "POST", webhookURL, bytes.NewReader(body))
+		if err != nil {
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(WebhookSignature, signWebhook(secret, time.Now().Unix(), body))
+
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Printf("[WARNING] Webhook of job %s failed: %v\n", payload.ID, err)
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return
+		}
+		log.Printf("[WARNING] Webhook of job %s returned %d\n", payload.ID, resp.StatusCode)
+	}
+}
@@ -0,0 +1,61 @@
+package completion
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/polyfire/api/utils"
+)
+
+func TestSendWebhookIsSigned(t *testing.T) {
+	// The test server listens on the loopback
+	utils.AllowPrivateURLs = true
+	defer func() { utils.AllowPrivateURLs = false }()
+
+	secret := "secret"
+	calls := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, _ := io.ReadAll(r.Body)
+
+		signature := r.Header.Get(WebhookSignature)
+		timestamp, err := strconv.ParseInt(strings.TrimPrefix(strings.Split(signature, ",")[0], "t="), 10, 64)
+		if err != nil || signWebhook(secret, timestamp, body) != signature {
+			t.Errorf("The webhook signature %s doesn't match its body", signature)
+		}
+
+		// The first attempt fails to check the webhook is retried
+		if calls == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	SendWebhook(context.Background(), server.URL, secret, JobResponse{ID: "job", CreatedAt: time.Now()})
+
+	if calls != 2 {
+		t.Fatalf("The webhook should have been called twice but was called %d times", calls)
+	}
+}
+
+func TestSendWebhookToPrivateAddress(t *testing.T) {
+	calls := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+		calls++
+	}))
+	defer server.Close()
+
+	SendWebhook(context.Background(), server.URL, "secret", JobResponse{ID: "job", CreatedAt: time.Now()})
+
+	if calls != 0 {
+		t.Fatalf("The webhook to the loopback shouldn't have been called but was called %d times", calls)
+	}
+}
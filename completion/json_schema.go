@@ -0,0 +1,107 @@
+package completion
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/polyfire/api/completion/schema"
+	"github.com/polyfire/api/llm"
+	"github.com/polyfire/api/llm/providers/options"
+)
+
+// The number of times the model can fix an answer that doesn't match the schema
+const MaxJSONSchemaRepairs = 2
+
+// For the models without native structured outputs, the schema is given in the system prompt
+func jsonSchemaInstructions(jsonSchema json.RawMessage) string {
+	return "Answer only with a JSON value matching this JSON schema, without any other text:\n" +
+		string(jsonSchema) + "\n"
+}
+
+func jsonSchemaRepairMessage(validationErrors []string) string {
+	return "Your answer doesn't match the JSON schema:\n- " +
+		strings.Join(validationErrors, "\n- ") +
+		"\nAnswer again with only the corrected JSON."
+}
+
+/*
+ * The answers are validated against the schema once they are complete, so
+ * they can't be streamed. Each attempt is buffered and only the valid one (or
+ * the last one) is sent. The invalid answers are sent back to the model with
+ * the validation errors, up to MaxJSONSchemaRepairs times.
+ */
+func GenerateWithJSONSchema(
+	ctx context.Context,
+	provider llm.Provider,
+	messages []options.Message,
+	c options.ProviderCallback,
+	opts *options.ProviderOptions,
+	validator *schema.Schema,
+) chan options.Result {
+	result := make(chan options.Result)
+
+	go func() {
+		defer close(result)
+		tokenUsage := options.TokenUsage{}
+
+		for attempt := 0; ; attempt++ {
+			completion := ""
+			hasToolCalls := false
+
+			for res := range provider.Generate(ctx, messages, c, opts) {
+				if res.Err != "" {
+					result <- res
+					return
+				}
+
+				// Every attempt is billed, the usage of the response is the total
+				tokenUsage.Input += res.TokenUsage.Input
+				tokenUsage.Output += res.TokenUsage.Output
+
+				if res.ChoiceIndex == 0 {
+					completion += res.Result
+				}
+				hasToolCalls = hasToolCalls || len(res.ToolCalls) > 0
+
+				if len(res.Warnings) > 0 || len(res.IgnoredOptions) > 0 || len(res.ToolCalls) > 0 {
+					result <- options.Result{
+						Warnings:       res.Warnings,
+						IgnoredOptions: res.IgnoredOptions,
+						ToolCalls:      res.ToolCalls,
+					}
+				}
+			}
+
+			// The model chose to call one of the tools of the request instead of answering
+			if ctx.Err() != nil || hasToolCalls {
+				result <- options.Result{Result: completion, TokenUsage: tokenUsage}
+				return
+			}
+
+			parsed, validationErrors := validator.ValidateJSON(completion)
+			if len(validationErrors) == 0 {
+				result <- options.Result{Result: completion, Parsed: parsed, TokenUsage: tokenUsage}
+				return
+			}
+
+			if attempt >= MaxJSONSchemaRepairs {
+				result <- options.Result{
+					Result:           completion,
+					TokenUsage:       tokenUsage,
+					ValidationErrors: validationErrors,
+					Warnings:         []string{"The answer doesn't match the JSON schema."},
+				}
+				return
+			}
+
+			messages = append(
+				messages,
+				options.Message{Role: options.RoleAssistant, Content: completion},
+				options.Message{Role: options.RoleUser, Content: jsonSchemaRepairMessage(validationErrors)},
+			)
+		}
+	}()
+
+	return result
+}
@@ -0,0 +1,73 @@
+package completion
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/polyfire/api/completion/schema"
+	"github.com/polyfire/api/llm/providers/options"
+)
+
+// Answers with the next scripted completion on each call
+type scriptedProvider struct {
+	answers  []string
+	messages *[][]options.Message
+}
+
+func (m scriptedProvider) Generate(
+	_ context.Context,
+	messages []options.Message,
+	_ options.ProviderCallback,
+	_ *options.ProviderOptions,
+) chan options.Result {
+	chanRes := make(chan options.Result)
+	answer := m.answers[len(*m.messages)]
+	*m.messages = append(*m.messages, messages)
+
+	go func() {
+		defer close(chanRes)
+		chanRes <- options.Result{Result: answer}
+		chanRes <- options.Result{TokenUsage: options.TokenUsage{Input: 10, Output: 5}}
+	}()
+
+	return chanRes
+}
+
+func (m scriptedProvider) Name() string                    { return "scripted" }
+func (m scriptedProvider) ProviderModel() (string, string) { return "scripted", "scripted" }
+func (m scriptedProvider) DoesFollowRateLimit() bool       { return false }
+
+func TestJSONSchemaRepair(t *testing.T) {
+	validator, _ := schema.Parse(json.RawMessage(`{"type": "object", "required": ["answer"]}`))
+	provider := scriptedProvider{
+		answers:  []string{`{"response": 42}`, `{"answer": 42}`},
+		messages: &[][]options.Message{},
+	}
+
+	messages := []options.Message{{Role: options.RoleUser, Content: "What's the answer?"}}
+	resChan := GenerateWithJSONSchema(context.Background(), provider, messages, nil, &options.ProviderOptions{}, validator)
+
+	result := options.Result{}
+	for v := range resChan {
+		result.Result += v.Result
+		result.TokenUsage.Input += v.TokenUsage.Input
+		result.TokenUsage.Output += v.TokenUsage.Output
+		if len(v.Parsed) > 0 {
+			result.Parsed = v.Parsed
+		}
+	}
+
+	if result.Result != `{"answer": 42}` || string(result.Parsed) != `{"answer": 42}` {
+		t.Fatalf("The repaired answer should have been returned but got %v", result)
+	}
+
+	if result.TokenUsage.Input != 20 || result.TokenUsage.Output != 10 {
+		t.Fatalf("The usage of both attempts should have been reported but got %v", result.TokenUsage)
+	}
+
+	repairRequest := (*provider.messages)[1]
+	if len(repairRequest) != 3 || repairRequest[2].Content != jsonSchemaRepairMessage([]string{`$: missing required property "answer"`}) {
+		t.Fatalf("The validation errors should have been sent back to the model but got %v", repairRequest)
+	}
+}
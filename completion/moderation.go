@@ -0,0 +1,254 @@
+package completion
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/polyfire/api/completion/moderation"
+	database "github.com/polyfire/api/db"
+	"github.com/polyfire/api/llm/providers/options"
+	"github.com/polyfire/api/utils"
+)
+
+var (
+	ErrContentBlocked        = errors.New("400 Content Blocked")
+	ErrModerationUnavailable = errors.New("503 Moderation Unavailable")
+)
+
+// The warning of the generations stopped by the moderation
+const ContentBlocked = "content_blocked"
+
+// The OpenAI moderation is called once per chunk of at least this many characters of the completion
+var ModerationChunkLength = 400
+
+/*
+ * The projects with a moderation policy have their task and system prompt
+ * checked before the generation and their completion checked while it's
+ * streamed. A flagged text is logged as a models.moderation.flagged event and,
+ * depending on the action of the policy, blocked, redacted or only flagged.
+ *
+ * With the redact and flag actions, the moderation fails open: the texts the
+ * moderator couldn't check are logged and let through. With the block action,
+ * it fails closed: the prompt is refused and the completion is stopped.
+ */
+type moderationStage struct {
+	ctx       context.Context
+	userID    string
+	action    moderation.Action
+	moderator moderation.Moderator
+
+	// The completion is checked by sentence, at least this long
+	chunkLength int
+}
+
+func newModerationStage(ctx context.Context, userID string) (*moderationStage, error) {
+	policy, ok := ctx.Value(utils.ContextKeyModerationPolicy).(*database.ModerationPolicy)
+	if !ok || policy == nil {
+		return nil, nil
+	}
+
+	moderator, err := moderation.New(ctx, *policy)
+	if err != nil {
+		return nil, err
+	}
+
+	action, err := moderation.ParseAction(*policy)
+	if err != nil {
+		return nil, err
+	}
+
+	chunkLength := 0
+	if _, ok := moderator.(moderation.OpenAIModerator); ok {
+		chunkLength = ModerationChunkLength
+	}
+
+	return &moderationStage{
+		ctx:         ctx,
+		userID:      userID,
+		action:      action,
+		moderator:   moderator,
+		chunkLength: chunkLength,
+	}, nil
+}
+
+func (m *moderationStage) logFlagged(stage string, text string, verdict moderation.Verdict) {
+	db := m.ctx.Value(utils.ContextKeyDB).(database.Database)
+	eventID, _ := m.ctx.Value(utils.ContextKeyEventID).(string)
+	originDomain, _ := m.ctx.Value(utils.ContextKeyOriginDomain).(string)
+
+	projectID, _ := m.ctx.Value(utils.ContextKeyProjectID).(string)
+	if projectID == "" {
+		projectID = "00000000-0000-0000-0000-000000000000"
+	}
+
+	categories := verdict.Categories
+	if categories == nil {
+		categories = []string{}
+	}
+
+	details, _ := json.Marshal(struct {
+		EventID    string   `json:"event_id"`
+		Stage      string   `json:"stage"`
+		Action     string   `json:"action"`
+		Categories []string `json:"categories"`
+	}{eventID, stage, string(m.action), categories})
+
+	log.Printf("[INFO] Moderation flagged the %s of %s: %v\n", stage, eventID, categories)
+
+	go db.LogEvents(
+		uuid.New().String(),
+		"moderation",
+		m.userID,
+		projectID,
+		text,
+		string(details),
+		false,
+		"",
+		string(utils.ModerationFlagged),
+		originDomain,
+	)
+}
+
+/*
+ * Returns the text to use instead and whether it's blocked, with
+ * ErrModerationUnavailable when it's blocked because it couldn't be checked.
+ */
+func (m *moderationStage) check(stage string, text string) (string, bool, error) {
+	if strings.TrimSpace(text) == "" {
+		return text, false, nil
+	}
+
+	verdict, err := m.moderator.Check(m.ctx, text)
+	if err != nil {
+		log.Printf("[ERROR] Moderation of the %s failed: %v\n", stage, err)
+		if m.action == moderation.Block {
+			return "", true, ErrModerationUnavailable
+		}
+		return text, false, nil
+	}
+
+	if !verdict.Flagged {
+		return text, false, nil
+	}
+
+	m.logFlagged(stage, text, verdict)
+
+	switch m.action {
+	case moderation.Block:
+		return "", true, nil
+	case moderation.Redact:
+		return verdict.Redact(text), false, nil
+	default:
+		return text, false, nil
+	}
+}
+
+func (m *moderationStage) moderatePrompt(input *GenerateRequestBody) error {
+	task, blocked, err := m.check("task", input.Task)
+	if err != nil {
+		return err
+	} else if blocked {
+		return ErrContentBlocked
+	}
+	input.Task = task
+
+	if input.SystemPrompt != nil {
+		systemPrompt, blocked, err := m.check("system_prompt", *input.SystemPrompt)
+		if err != nil {
+			return err
+		} else if blocked {
+			return ErrContentBlocked
+		}
+		input.SystemPrompt = &systemPrompt
+	}
+
+	return nil
+}
+
+/*
+ * The text of each choice is held back until the end of a sentence to be
+ * checked before being sent, except with the flag action where it's sent right
+ * away. A blocked completion stops the provider with cancel and ends with the
+ * content_blocked warning, the token usage reported afterwards is still
+ * forwarded. The tool calls aren't moderated.
+ */
+func (m *moderationStage) moderateCompletion(resChan chan options.Result, cancel context.CancelFunc) chan options.Result {
+	result := make(chan options.Result)
+
+	go func() {
+		defer close(result)
+
+		pending := map[int]string{}
+		blocked := false
+
+		// Checks the pending text of the choice up to its last sentence, or all of it when final
+		release := func(choice int, final bool) string {
+			text := pending[choice]
+			end := len(text)
+			if !final {
+				end = strings.LastIndexAny(text, ".!?\n") + 1
+				if end == 0 || end < m.chunkLength {
+					return ""
+				}
+			}
+			pending[choice] = text[end:]
+
+			// A completion that couldn't be checked is stopped like a blocked one
+			checked, isBlocked, _ := m.check("completion", text[:end])
+			if isBlocked {
+				blocked = true
+				cancel()
+			}
+			return checked
+		}
+
+		for res := range resChan {
+			if blocked {
+				if res.TokenUsage.Input != 0 || res.TokenUsage.Output != 0 {
+					result <- options.Result{TokenUsage: res.TokenUsage}
+				}
+				continue
+			}
+
+			pending[res.ChoiceIndex] += res.Result
+			released := release(res.ChoiceIndex, false)
+			if m.action != moderation.Flag {
+				res.Result = released
+			}
+
+			result <- res
+
+			if blocked {
+				result <- options.Result{Warnings: []string{ContentBlocked}}
+			}
+		}
+
+		if blocked {
+			return
+		}
+
+		choices := []int{}
+		for choice := range pending {
+			choices = append(choices, choice)
+		}
+		sort.Ints(choices)
+
+		for _, choice := range choices {
+			released := release(choice, true)
+			if blocked {
+				result <- options.Result{Warnings: []string{ContentBlocked}}
+				return
+			}
+			if m.action != moderation.Flag && released != "" {
+				result <- options.Result{ChoiceIndex: choice, Result: released}
+			}
+		}
+	}()
+
+	return result
+}
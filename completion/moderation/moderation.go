@@ -0,0 +1,222 @@
+package moderation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	database "github.com/polyfire/api/db"
+	"github.com/polyfire/api/llm/providers"
+	"github.com/polyfire/api/utils"
+	goOpenai "github.com/sashabaranov/go-openai"
+)
+
+type Action string
+
+const (
+	Block  Action = "block"
+	Redact Action = "redact"
+	Flag   Action = "flag"
+)
+
+const RedactedText = "[redacted]"
+
+var ErrInvalidPolicy = errors.New("Invalid moderation policy")
+
+type Verdict struct {
+	Flagged    bool
+	Categories []string
+
+	// The [start, end] of the flagged parts of the text, nil when the moderator can't locate them
+	Matches [][]int
+}
+
+type Moderator interface {
+	Check(ctx context.Context, text string) (Verdict, error)
+}
+
+func New(ctx context.Context, policy database.ModerationPolicy) (Moderator, error) {
+	switch policy.Provider {
+	case "openai":
+		return NewOpenAIModerator(ctx, policy.Categories), nil
+	case "local":
+		return NewLocalModerator(policy.Rules)
+	default:
+		return nil, ErrInvalidPolicy
+	}
+}
+
+func ParseAction(policy database.ModerationPolicy) (Action, error) {
+	switch action := Action(policy.Action); action {
+	case Block, Redact, Flag:
+		return action, nil
+	case "":
+		return Flag, nil
+	default:
+		return "", ErrInvalidPolicy
+	}
+}
+
+// Replaces the flagged parts of the text, or all of it when they aren't known
+func (v Verdict) Redact(text string) string {
+	if !v.Flagged {
+		return text
+	}
+	if len(v.Matches) == 0 {
+		return RedactedText
+	}
+
+	matches := make([][]int, len(v.Matches))
+	copy(matches, v.Matches)
+	sort.Slice(matches, func(i, j int) bool { return matches[i][0] < matches[j][0] })
+
+	var result strings.Builder
+	last := 0
+	for _, match := range matches {
+		// The overlapping matches are redacted once
+		if match[1] <= last {
+			continue
+		}
+		if match[0] >= last {
+			result.WriteString(text[last:match[0]])
+			result.WriteString(RedactedText)
+		}
+		last = match[1]
+	}
+	result.WriteString(text[last:])
+
+	return result.String()
+}
+
+type localRule struct {
+	category string
+	regexp   *regexp.Regexp
+}
+
+type LocalModerator struct {
+	rules []localRule
+}
+
+func isWordChar(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// A keyword only matches whole words, the \b are only added next to word characters
+func keywordPattern(keyword string) string {
+	pattern := regexp.QuoteMeta(keyword)
+
+	if first, _ := utf8.DecodeRuneInString(keyword); isWordChar(first) {
+		pattern = `\b` + pattern
+	}
+	if last, _ := utf8.DecodeLastRuneInString(keyword); isWordChar(last) {
+		pattern += `\b`
+	}
+
+	return "(?i)" + pattern
+}
+
+func NewLocalModerator(rules []database.ModerationRule) (LocalModerator, error) {
+	moderator := LocalModerator{}
+
+	for _, rule := range rules {
+		patterns := []string{}
+		for _, keyword := range rule.Keywords {
+			if strings.TrimSpace(keyword) != "" {
+				patterns = append(patterns, keywordPattern(strings.TrimSpace(keyword)))
+			}
+		}
+		patterns = append(patterns, rule.Patterns...)
+
+		for _, pattern := range patterns {
+			compiled, err := regexp.Compile(pattern)
+			if err != nil {
+				return LocalModerator{}, ErrInvalidPolicy
+			}
+			moderator.rules = append(moderator.rules, localRule{category: rule.Category, regexp: compiled})
+		}
+	}
+
+	return moderator, nil
+}
+
+func (m LocalModerator) Check(_ context.Context, text string) (Verdict, error) {
+	verdict := Verdict{}
+
+	for _, rule := range m.rules {
+		matches := rule.regexp.FindAllStringIndex(text, -1)
+		if len(matches) == 0 {
+			continue
+		}
+
+		verdict.Flagged = true
+		verdict.Matches = append(verdict.Matches, matches...)
+		if rule.category != "" && !utils.ContainsString(verdict.Categories, rule.category) {
+			verdict.Categories = append(verdict.Categories, rule.category)
+		}
+	}
+
+	return verdict, nil
+}
+
+/*
+ * The OpenAI moderation endpoint is free, it's called with the key of the
+ * user or of the pool like the completions. It doesn't tell which parts of
+ * the text are flagged so a redacted text is replaced entirely.
+ */
+type OpenAIModerator struct {
+	Categories []string
+
+	client *goOpenai.Client
+}
+
+// The client is built once for all the checks of a request
+func NewOpenAIModerator(ctx context.Context, categories []string) OpenAIModerator {
+	client := providers.NewOpenAIStreamProvider(ctx, "").Client
+	return OpenAIModerator{Categories: categories, client: &client}
+}
+
+func (m OpenAIModerator) Check(ctx context.Context, text string) (Verdict, error) {
+	response, err := m.client.Moderations(ctx, goOpenai.ModerationRequest{Input: text})
+	if err != nil {
+		return Verdict{}, err
+	}
+
+	verdict := Verdict{}
+	for _, result := range response.Results {
+		// The categories are named like in the API (e.g. "hate/threatening")
+		categoriesJSON, err := json.Marshal(result.Categories)
+		if err != nil {
+			return Verdict{}, err
+		}
+
+		categories := map[string]bool{}
+		if err := json.Unmarshal(categoriesJSON, &categories); err != nil {
+			return Verdict{}, err
+		}
+
+		for category, flagged := range categories {
+			if !flagged || utils.ContainsString(verdict.Categories, category) {
+				continue
+			}
+			if len(m.Categories) > 0 && !utils.ContainsString(m.Categories, category) {
+				continue
+			}
+			verdict.Categories = append(verdict.Categories, category)
+		}
+
+		// A flagged result without any category is kept when no category is selected
+		if result.Flagged && len(m.Categories) == 0 {
+			verdict.Flagged = true
+		}
+	}
+
+	sort.Strings(verdict.Categories)
+	verdict.Flagged = verdict.Flagged || len(verdict.Categories) > 0
+
+	return verdict, nil
+}
@@ -0,0 +1,111 @@
+package completion
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/polyfire/api/completion/moderation"
+	database "github.com/polyfire/api/db"
+	"github.com/polyfire/api/llm/providers/options"
+	"github.com/polyfire/api/utils"
+)
+
+func moderationContext(action string, events chan string) context.Context {
+	ctx := context.WithValue(context.Background(), utils.ContextKeyModerationPolicy, &database.ModerationPolicy{
+		Provider: "local",
+		Action:   action,
+		Rules: []database.ModerationRule{{
+			Category: "profanity",
+			Keywords: []string{"darn"},
+			Patterns: []string{`\d{4}-\d{4}`},
+		}},
+	})
+
+	return context.WithValue(ctx, utils.ContextKeyDB, database.MockDatabase{
+		MockLogEvents: func(_ string, _ string, _ string, _ string, _ string, responseBody string, _ bool, _ string, _ string, _ string) {
+			events <- responseBody
+		},
+	})
+}
+
+func TestModeration(t *testing.T) {
+	events := make(chan string, 10)
+
+	stage, err := newModerationStage(moderationContext("block", events), "")
+	if err != nil || stage == nil {
+		t.Fatalf("newModerationStage should have loaded the policy but returned %v", err)
+	}
+
+	input := GenerateRequestBody{Task: "Well, DARN it"}
+	if err := stage.moderatePrompt(&input); err != ErrContentBlocked {
+		t.Fatalf("The task should have been blocked but returned %v", err)
+	}
+
+	if event := <-events; !strings.Contains(event, `"stage":"task"`) || !strings.Contains(event, `"categories":["profanity"]`) {
+		t.Fatalf("The flagged task should have been logged with its category but was %s", event)
+	}
+
+	stage, _ = newModerationStage(moderationContext("redact", events), "")
+
+	resChan := make(chan options.Result)
+	go func() {
+		defer close(resChan)
+		for _, word := range []string{"Call", " 1234-", "5678", " now.", " Darn", "ed, darn"} {
+			resChan <- options.Result{Result: word}
+		}
+	}()
+
+	str := ""
+	for res := range stage.moderateCompletion(resChan, func() {}) {
+		str += res.Result
+	}
+
+	if str != "Call [redacted] now. Darned, [redacted]" {
+		t.Fatalf("The completion should have been redacted but returned %q", str)
+	}
+}
+
+type failingModerator struct{}
+
+func (failingModerator) Check(_ context.Context, _ string) (moderation.Verdict, error) {
+	return moderation.Verdict{}, errors.New("moderation down")
+}
+
+func TestModerationFailsClosedForBlock(t *testing.T) {
+	events := make(chan string, 10)
+
+	for _, action := range []string{"block", "flag"} {
+		stage, _ := newModerationStage(moderationContext(action, events), "")
+		stage.moderator = failingModerator{}
+
+		input := GenerateRequestBody{Task: "Hello"}
+		err := stage.moderatePrompt(&input)
+
+		if action == "block" && err != ErrModerationUnavailable {
+			t.Fatalf("The unchecked task should have been refused with the block action but returned %v", err)
+		}
+		if action == "flag" && (err != nil || input.Task != "Hello") {
+			t.Fatalf("The unchecked task should have been let through with the flag action but returned %v", err)
+		}
+	}
+
+	stage, _ := newModerationStage(moderationContext("block", events), "")
+	stage.moderator = failingModerator{}
+
+	resChan := make(chan options.Result)
+	go func() {
+		defer close(resChan)
+		resChan <- options.Result{Result: "Hello."}
+	}()
+
+	results := []options.Result{}
+	for res := range stage.moderateCompletion(resChan, func() {}) {
+		results = append(results, res)
+	}
+
+	if len(results) == 0 || results[0].Result != "" || len(results[len(results)-1].Warnings) == 0 {
+		t.Fatalf("The unchecked completion should have been blocked but returned %+v", results)
+	}
+}
@@ -7,54 +7,14 @@ import (
 	router "github.com/julienschmidt/httprouter"
 	options "github.com/polyfire/api/llm/providers/options"
 	utils "github.com/polyfire/api/utils"
-	webrequest "github.com/polyfire/api/web_request"
 )
 
 func ReturnErrors(w http.ResponseWriter, record utils.RecordFunc, err error) {
-	switch err {
-	case webrequest.ErrWebsiteExceedsLimit:
-		utils.RespondError(w, record, "error_website_exceeds_limit")
-	case webrequest.ErrWebsitesContentExceeds:
-		utils.RespondError(w, record, "error_websites_content_exceeds")
-	case webrequest.ErrFetchWebpage:
-		utils.RespondError(w, record, "error_fetch_webpage")
-	case webrequest.ErrParseContent:
-		utils.RespondError(w, record, "error_parse_content")
-	case webrequest.ErrVisitBaseURL:
-		utils.RespondError(w, record, "error_visit_base_url")
-	case ErrNotFound:
-		utils.RespondError(w, record, "not_found")
-	case ErrUnknownModelProvider:
-		utils.RespondError(w, record, "invalid_model_provider")
-	case ErrRateLimitReached:
-		utils.RespondError(w, record, "rate_limit_reached")
-	case ErrCreditsUsedUp:
-		utils.RespondError(w, record, "credits_used_up")
-	case ErrProjectRateLimitReached:
-		utils.RespondError(w, record, "project_rate_limit_reached")
-	default:
-		utils.RespondError(w, record, "internal_error")
-	}
+	utils.RespondError(w, record, ErrorCode(err))
 }
 
-func Generate(w http.ResponseWriter, r *http.Request, _ router.Params) {
-	userID := r.Context().Value(utils.ContextKeyUserID).(string)
-	record := r.Context().Value(utils.ContextKeyRecordEvent).(utils.RecordFunc)
-
-	var input GenerateRequestBody
-
-	err := json.NewDecoder(r.Body).Decode(&input)
-	if err != nil {
-		utils.RespondError(w, record, "invalid_json")
-		return
-	}
-
-	resChan, err := GenerationStart(r.Context(), userID, input)
-	if err != nil {
-		ReturnErrors(w, record, err)
-		return
-	}
-
+// Merges the results of a generation into a single one
+func CollectResult(resChan chan options.Result) options.Result {
 	result := options.Result{
 		Result:     "",
 		TokenUsage: options.TokenUsage{Input: 0, Output: 0},
@@ -62,7 +22,12 @@ func Generate(w http.ResponseWriter, r *http.Request, _ router.Params) {
 
 	inputTokens := 0
 
-	for v := range *resChan {
+	for v := range resChan {
+		if v.ChoiceIndex != 0 {
+			result.Choices = options.MergeChoiceDelta(result.Choices, v.ChoiceIndex, v.Result)
+			continue
+		}
+
 		result.Result += v.Result
 		if inputTokens == 0 && v.TokenUsage.Input > 0 {
 			inputTokens = v.TokenUsage.Input
@@ -70,9 +35,36 @@ func Generate(w http.ResponseWriter, r *http.Request, _ router.Params) {
 		}
 		result.TokenUsage.Output += v.TokenUsage.Output
 
-		if len(v.Resources) > 0 || v.Warnings != nil && len(v.Warnings) > 0 {
+		if len(v.Resources) > 0 {
 			result.Resources = v.Resources
-			result.Warnings = v.Warnings
+		}
+
+		if len(v.Warnings) > 0 {
+			result.Warnings = append(result.Warnings, v.Warnings...)
+		}
+
+		if len(v.IgnoredOptions) > 0 {
+			result.IgnoredOptions = append(result.IgnoredOptions, v.IgnoredOptions...)
+		}
+
+		if len(v.Parsed) > 0 {
+			result.Parsed = v.Parsed
+		}
+
+		if len(v.ValidationErrors) > 0 {
+			result.ValidationErrors = v.ValidationErrors
+		}
+
+		if v.Model != "" {
+			result.Model = v.Model
+		}
+
+		if v.Routing != nil {
+			result.Routing = v.Routing
+		}
+
+		if len(v.ToolCalls) > 0 {
+			result.ToolCalls = options.MergeToolCallDeltas(result.ToolCalls, v.ToolCalls)
 		}
 
 		if v.Err != "" {
@@ -80,6 +72,38 @@ func Generate(w http.ResponseWriter, r *http.Request, _ router.Params) {
 		}
 	}
 
+	if len(result.Choices) > 0 {
+		result.Choices[0] = result.Result
+	}
+
+	return result
+}
+
+func Generate(w http.ResponseWriter, r *http.Request, _ router.Params) {
+	userID := r.Context().Value(utils.ContextKeyUserID).(string)
+	record := r.Context().Value(utils.ContextKeyRecordEvent).(utils.RecordFunc)
+
+	var input GenerateRequestBody
+
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		utils.RespondError(w, record, "invalid_json")
+		return
+	}
+
+	if input.Async {
+		CreateJob(w, r, input)
+		return
+	}
+
+	resChan, err := GenerationStart(r.Context(), userID, input)
+	if err != nil {
+		ReturnErrors(w, record, err)
+		return
+	}
+
+	result := CollectResult(*resChan)
+
 	w.Header()["Content-Type"] = []string{"application/json"}
 
 	response, _ := result.JSON()
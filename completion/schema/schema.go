@@ -0,0 +1,399 @@
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+ * A validator for the subset of JSON schema the structured outputs use: type,
+ * enum, const, properties, required, additionalProperties, items, the length
+ * and range bounds, pattern, anyOf/oneOf/allOf and the local $ref. The other
+ * keywords are ignored.
+ */
+
+var ErrInvalidSchema = errors.New("Invalid JSON schema")
+
+type Schema struct {
+	root map[string]interface{}
+}
+
+func Parse(raw json.RawMessage) (*Schema, error) {
+	var root map[string]interface{}
+
+	err := json.Unmarshal(raw, &root)
+	if err != nil {
+		return nil, ErrInvalidSchema
+	}
+
+	return &Schema{root: root}, nil
+}
+
+/*
+ * Returns one message per violation, prefixed with the path of the invalid
+ * value (e.g. "$.items[2].name: expected string, got number").
+ */
+func (s *Schema) Validate(value interface{}) []string {
+	return s.validate(s.root, value, "$", 0)
+}
+
+// Some models wrap their answer in a markdown code block even when asked not to
+func stripCodeFence(text string) string {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "```") || !strings.HasSuffix(text, "```") || len(text) < 6 {
+		return text
+	}
+
+	text = strings.TrimSuffix(strings.TrimPrefix(text, "```"), "```")
+	text = strings.TrimPrefix(text, "json")
+
+	return strings.TrimSpace(text)
+}
+
+// Parses the completion and validates it, the errors are nil when it's valid
+func (s *Schema) ValidateJSON(text string) (json.RawMessage, []string) {
+	var value interface{}
+
+	text = stripCodeFence(text)
+
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.UseNumber()
+
+	err := decoder.Decode(&value)
+	if err != nil {
+		return nil, []string{"$: the answer isn't valid JSON (" + err.Error() + ")"}
+	}
+	if decoder.More() {
+		return nil, []string{"$: the answer must contain a single JSON value"}
+	}
+
+	validationErrors := s.Validate(value)
+	if len(validationErrors) > 0 {
+		return nil, validationErrors
+	}
+
+	return json.RawMessage(text), nil
+}
+
+// Prevents the recursive $ref from looping forever
+const maxDepth = 64
+
+func (s *Schema) resolve(ref string) (map[string]interface{}, bool) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, false
+	}
+
+	var current interface{} = s.root
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#"), "/") {
+		if part == "" {
+			continue
+		}
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current = object[part]
+	}
+
+	resolved, ok := current.(map[string]interface{})
+	return resolved, ok
+}
+
+func typeOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		if f, err := v.Float64(); err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return "unknown"
+	}
+}
+
+func matchesType(value interface{}, expected string) bool {
+	actual := typeOf(value)
+	return actual == expected || (expected == "number" && actual == "integer")
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	default:
+		return 0, false
+	}
+}
+
+// Compares two decoded JSON values, the numbers by value
+func equal(a interface{}, b interface{}) bool {
+	fa, aIsNumber := toFloat(a)
+	fb, bIsNumber := toFloat(b)
+	if aIsNumber || bIsNumber {
+		return aIsNumber && bIsNumber && fa == fb
+	}
+
+	switch av := a.(type) {
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !equal(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for key := range av {
+			if !equal(av[key], bv[key]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a == b
+	}
+}
+
+func (s *Schema) validate(schema map[string]interface{}, value interface{}, path string, depth int) []string {
+	if depth > maxDepth {
+		return []string{path + ": the schema is too deeply nested"}
+	}
+
+	if ref, ok := schema["$ref"].(string); ok {
+		resolved, ok := s.resolve(ref)
+		if !ok {
+			return []string{path + ": unresolvable $ref " + ref}
+		}
+		return s.validate(resolved, value, path, depth+1)
+	}
+
+	errs := []string{}
+
+	switch expected := schema["type"].(type) {
+	case string:
+		if !matchesType(value, expected) {
+			return []string{fmt.Sprintf("%s: expected %s, got %s", path, expected, typeOf(value))}
+		}
+	case []interface{}:
+		names := []string{}
+		matches := false
+		for _, t := range expected {
+			name, _ := t.(string)
+			names = append(names, name)
+			matches = matches || matchesType(value, name)
+		}
+		if !matches {
+			return []string{fmt.Sprintf("%s: expected %s, got %s", path, strings.Join(names, " or "), typeOf(value))}
+		}
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, candidate := range enum {
+			if equal(candidate, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			allowed, _ := json.Marshal(enum)
+			errs = append(errs, fmt.Sprintf("%s: must be one of %s", path, string(allowed)))
+		}
+	}
+
+	if constant, ok := schema["const"]; ok && !equal(constant, value) {
+		expected, _ := json.Marshal(constant)
+		errs = append(errs, fmt.Sprintf("%s: must be %s", path, string(expected)))
+	}
+
+	errs = append(errs, s.validateCombinations(schema, value, path, depth)...)
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		errs = append(errs, s.validateObject(schema, v, path, depth)...)
+	case []interface{}:
+		errs = append(errs, s.validateArray(schema, v, path, depth)...)
+	case string:
+		errs = append(errs, validateString(schema, v, path)...)
+	default:
+		if number, ok := toFloat(value); ok {
+			errs = append(errs, validateNumber(schema, number, path)...)
+		}
+	}
+
+	return errs
+}
+
+func (s *Schema) validateCombinations(schema map[string]interface{}, value interface{}, path string, depth int) []string {
+	errs := []string{}
+
+	if allOf, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range allOf {
+			if subSchema, ok := sub.(map[string]interface{}); ok {
+				errs = append(errs, s.validate(subSchema, value, path, depth+1)...)
+			}
+		}
+	}
+
+	countMatches := func(schemas []interface{}) int {
+		matches := 0
+		for _, sub := range schemas {
+			subSchema, ok := sub.(map[string]interface{})
+			if ok && len(s.validate(subSchema, value, path, depth+1)) == 0 {
+				matches++
+			}
+		}
+		return matches
+	}
+
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok && countMatches(anyOf) == 0 {
+		errs = append(errs, path+": doesn't match any of the schemas of anyOf")
+	}
+
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok {
+		if matches := countMatches(oneOf); matches != 1 {
+			errs = append(errs, fmt.Sprintf("%s: must match exactly one of the schemas of oneOf, matches %d", path, matches))
+		}
+	}
+
+	return errs
+}
+
+func (s *Schema) validateObject(schema map[string]interface{}, object map[string]interface{}, path string, depth int) []string {
+	errs := []string{}
+
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, r := range required {
+			name, _ := r.(string)
+			if _, exists := object[name]; !exists {
+				errs = append(errs, fmt.Sprintf("%s: missing required property \"%s\"", path, name))
+			}
+		}
+	}
+
+	properties, _ := schema["properties"].(map[string]interface{})
+
+	// Sorted so the errors are always in the same order
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		propertyPath := path + "." + key
+
+		if propertySchema, ok := properties[key].(map[string]interface{}); ok {
+			errs = append(errs, s.validate(propertySchema, object[key], propertyPath, depth+1)...)
+			continue
+		}
+
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				errs = append(errs, fmt.Sprintf("%s: unexpected property \"%s\"", path, key))
+			}
+		case map[string]interface{}:
+			errs = append(errs, s.validate(additional, object[key], propertyPath, depth+1)...)
+		}
+	}
+
+	return errs
+}
+
+func (s *Schema) validateArray(schema map[string]interface{}, array []interface{}, path string, depth int) []string {
+	errs := []string{}
+
+	if minItems, ok := toFloat(schema["minItems"]); ok && float64(len(array)) < minItems {
+		errs = append(errs, fmt.Sprintf("%s: must have at least %v items, has %d", path, minItems, len(array)))
+	}
+	if maxItems, ok := toFloat(schema["maxItems"]); ok && float64(len(array)) > maxItems {
+		errs = append(errs, fmt.Sprintf("%s: must have at most %v items, has %d", path, maxItems, len(array)))
+	}
+
+	if items, ok := schema["items"].(map[string]interface{}); ok {
+		for i, item := range array {
+			errs = append(errs, s.validate(items, item, path+"["+strconv.Itoa(i)+"]", depth+1)...)
+		}
+	}
+
+	return errs
+}
+
+func validateString(schema map[string]interface{}, str string, path string) []string {
+	errs := []string{}
+	length := float64(len([]rune(str)))
+
+	if minLength, ok := toFloat(schema["minLength"]); ok && length < minLength {
+		errs = append(errs, fmt.Sprintf("%s: must be at least %v characters long", path, minLength))
+	}
+	if maxLength, ok := toFloat(schema["maxLength"]); ok && length > maxLength {
+		errs = append(errs, fmt.Sprintf("%s: must be at most %v characters long", path, maxLength))
+	}
+
+	if pattern, ok := schema["pattern"].(string); ok {
+		re, err := regexp.Compile(pattern)
+		if err == nil && !re.MatchString(str) {
+			errs = append(errs, fmt.Sprintf("%s: must match the pattern %s", path, pattern))
+		}
+	}
+
+	return errs
+}
+
+func validateNumber(schema map[string]interface{}, number float64, path string) []string {
+	errs := []string{}
+
+	if minimum, ok := toFloat(schema["minimum"]); ok && number < minimum {
+		errs = append(errs, fmt.Sprintf("%s: must be >= %v", path, minimum))
+	}
+	if maximum, ok := toFloat(schema["maximum"]); ok && number > maximum {
+		errs = append(errs, fmt.Sprintf("%s: must be <= %v", path, maximum))
+	}
+	if minimum, ok := toFloat(schema["exclusiveMinimum"]); ok && number <= minimum {
+		errs = append(errs, fmt.Sprintf("%s: must be > %v", path, minimum))
+	}
+	if maximum, ok := toFloat(schema["exclusiveMaximum"]); ok && number >= maximum {
+		errs = append(errs, fmt.Sprintf("%s: must be < %v", path, maximum))
+	}
+
+	return errs
+}
@@ -0,0 +1,54 @@
+package schema
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+const personSchema = `{
+	"type": "object",
+	"properties": {
+		"name": {"type": "string", "minLength": 1},
+		"age": {"type": "integer", "minimum": 0},
+		"tags": {"type": "array", "items": {"$ref": "#/$defs/tag"}}
+	},
+	"required": ["name", "age"],
+	"additionalProperties": false,
+	"$defs": {"tag": {"enum": ["a", "b"]}}
+}`
+
+func TestValidateJSON(t *testing.T) {
+	s, err := Parse(json.RawMessage(personSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, validationErrors := s.ValidateJSON("```json\n{\"name\": \"Ada\", \"age\": 36, \"tags\": [\"a\"]}\n```")
+	if validationErrors != nil {
+		t.Fatalf("The answer should have been valid but got %v", validationErrors)
+	}
+	if string(parsed) != `{"name": "Ada", "age": 36, "tags": ["a"]}` {
+		t.Fatalf("The code block should have been removed but got %s", parsed)
+	}
+
+	_, validationErrors = s.ValidateJSON(`{"name": "", "age": 1.5, "tags": ["c"], "extra": true}`)
+	expected := []string{
+		`$.age: expected integer, got number`,
+		`$: unexpected property "extra"`,
+		`$.name: must be at least 1 characters long`,
+		`$.tags[0]: must be one of ["a","b"]`,
+	}
+	if !reflect.DeepEqual(validationErrors, expected) {
+		t.Fatalf("ValidateJSON should have returned %v but returned %v", expected, validationErrors)
+	}
+}
+
+func TestValidateInvalidJSON(t *testing.T) {
+	s, _ := Parse(json.RawMessage(`{"type": "object"}`))
+
+	_, validationErrors := s.ValidateJSON(`{"name": `)
+	if len(validationErrors) != 1 {
+		t.Fatalf("An incomplete answer should have returned one error but returned %v", validationErrors)
+	}
+}
@@ -1,6 +1,7 @@
 package completion
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,7 +11,6 @@ import (
 	router "github.com/julienschmidt/httprouter"
 	options "github.com/polyfire/api/llm/providers/options"
 	utils "github.com/polyfire/api/utils"
-	webrequest "github.com/polyfire/api/web_request"
 )
 
 var upgrader = websocket.Upgrader{
@@ -20,40 +20,39 @@ var upgrader = websocket.Upgrader{
 }
 
 func ReturnErrorsStream(conn *websocket.Conn, record utils.RecordFunc, err error) {
-	switch err {
-	case webrequest.ErrWebsiteExceedsLimit:
-		utils.RespondErrorStream(conn, record, "error_website_exceeds_limit")
-	case webrequest.ErrWebsitesContentExceeds:
-		utils.RespondErrorStream(conn, record, "error_websites_content_exceeds")
-	case webrequest.ErrFetchWebpage:
-		utils.RespondErrorStream(conn, record, "error_fetch_webpage")
-	case webrequest.ErrParseContent:
-		utils.RespondErrorStream(conn, record, "error_parse_content")
-	case webrequest.ErrVisitBaseURL:
-		utils.RespondErrorStream(conn, record, "error_visit_base_url")
-	case ErrNotFound:
-		utils.RespondErrorStream(conn, record, "not_found")
-	case ErrUnknownModelProvider:
-		utils.RespondErrorStream(conn, record, "invalid_model_provider")
-	case ErrRateLimitReached:
-		utils.RespondErrorStream(conn, record, "rate_limit_reached")
-	case ErrCreditsUsedUp:
-		utils.RespondErrorStream(conn, record, "credits_used_up")
-	case ErrProjectRateLimitReached:
-		utils.RespondErrorStream(conn, record, "project_rate_limit_reached")
-	default:
-		utils.RespondErrorStream(conn, record, "internal_error")
-	}
+	utils.RespondErrorStream(conn, record, ErrorCode(err))
 }
 
+/*
+ * Once ctx is canceled (STOP message or closed connection) or an error
+ * occurred, nothing is written anymore but the results are still drained so
+ * the provider can finish logging the tokens it produced.
+ */
 func WriteToWebSocketConn(
+	ctx context.Context,
 	chanRes *chan options.Result,
 	result *options.Result,
 	conn *websocket.Conn,
-	chanStop chan bool,
 ) (string, error) {
 	totalResult := ""
+
+	drain := func(err error) (string, error) {
+		for range *chanRes {
+		}
+		return "", err
+	}
+
 	for v := range *chanRes {
+		if ctx.Err() != nil {
+			continue
+		}
+
+		// Only the first choice is streamed, the others are sent with the [INFOS]
+		if v.ChoiceIndex != 0 {
+			result.Choices = options.MergeChoiceDelta(result.Choices, v.ChoiceIndex, v.Result)
+			continue
+		}
+
 		result.Result += v.Result
 		if v.TokenUsage.Input != 0 {
 			result.TokenUsage.Input = v.TokenUsage.Input
@@ -63,28 +62,63 @@ func WriteToWebSocketConn(
 		if len(v.Resources) > 0 {
 			result.Resources = v.Resources
 		}
-		select {
-		case <-chanStop:
-			break
-		default:
-		}
 
 		if v.Err != "" {
-			return "", errors.New(v.Err)
+			return drain(errors.New(v.Err))
 		}
 
 		if v.Warnings != nil && len(v.Warnings) > 0 {
 			result.Warnings = append(result.Warnings, v.Warnings...)
 		}
 
+		if len(v.IgnoredOptions) > 0 {
+			result.IgnoredOptions = append(result.IgnoredOptions, v.IgnoredOptions...)
+		}
+
+		if len(v.Parsed) > 0 {
+			result.Parsed = v.Parsed
+		}
+
+		if len(v.ValidationErrors) > 0 {
+			result.ValidationErrors = v.ValidationErrors
+		}
+
+		if v.Model != "" {
+			result.Model = v.Model
+		}
+
+		if v.Routing != nil {
+			result.Routing = v.Routing
+		}
+
+		// The tool calls deltas are sent as structured events, merged by index on the client side
+		if len(v.ToolCalls) > 0 {
+			result.ToolCalls = options.MergeToolCallDeltas(result.ToolCalls, v.ToolCalls)
+
+			toolCallsJSON, err := json.Marshal(v.ToolCalls)
+			if err != nil {
+				return drain(errors.New("invalid_json"))
+			}
+
+			err = conn.WriteMessage(websocket.TextMessage, []byte("[TOOL_CALLS]:"+string(toolCallsJSON)))
+			if err != nil {
+				return drain(errors.New("write_result_error"))
+			}
+		}
+
 		totalResult += v.Result
 		if v.Result != "" {
 			err := conn.WriteMessage(websocket.TextMessage, []byte(v.Result))
 			if err != nil {
-				return "", errors.New("write_result_error")
+				return drain(errors.New("write_result_error"))
 			}
 		}
 	}
+
+	if len(result.Choices) > 0 {
+		result.Choices[0] = result.Result
+	}
+
 	return totalResult, nil
 }
 
@@ -123,7 +157,21 @@ func Stream(w http.ResponseWriter, r *http.Request, _ router.Params) {
 		return
 	}
 
-	chanRes, err := GenerationStart(r.Context(), userID, input)
+	// The request context isn't canceled when a hijacked connection is closed
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	go func() {
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil || string(message) == "STOP" {
+				cancel()
+				return
+			}
+		}
+	}()
+
+	chanRes, err := GenerationStart(ctx, userID, input)
 	if err != nil {
 		fmt.Println(err)
 		ReturnErrorsStream(conn, record, err)
@@ -135,20 +183,7 @@ func Stream(w http.ResponseWriter, r *http.Request, _ router.Params) {
 		TokenUsage: options.TokenUsage{Input: 0, Output: 0},
 	}
 
-	chanStop := make(chan bool)
-	go func() {
-		for {
-			size, message, _ := conn.ReadMessage()
-			if string(message) == "STOP" {
-				chanStop <- true
-			}
-			if size == -1 {
-				break
-			}
-		}
-	}()
-
-	totalResult, err := WriteToWebSocketConn(chanRes, &result, conn, chanStop)
+	totalResult, err := WriteToWebSocketConn(ctx, chanRes, &result, conn)
 	if err != nil {
 		utils.RespondErrorStream(conn, record, err.Error())
 		return
@@ -0,0 +1,33 @@
+package completion
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/polyfire/api/llm/providers/options"
+)
+
+func TestWriteToWebSocketConnDrainsAfterError(t *testing.T) {
+	chanRes := make(chan options.Result)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(chanRes)
+		chanRes <- options.Result{Err: "generation_error"}
+		chanRes <- options.Result{TokenUsage: options.TokenUsage{Output: 1}}
+		close(done)
+	}()
+
+	result := options.Result{}
+	_, err := WriteToWebSocketConn(context.Background(), &chanRes, &result, nil)
+	if err == nil || err.Error() != "generation_error" {
+		t.Fatalf(`WriteToWebSocketConn should have returned "generation_error" but returned %v`, err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("The results sent after the error should have been drained")
+	}
+}
@@ -47,9 +47,10 @@ func (db DB) GetCompletionCacheByInput(provider string, model string, input []fl
 	var cache []CompletionCache
 	err := db.sql.Find(
 		&cache,
-		"exact = false AND provider = ? AND model = ? AND input <-> ? < 0.15 ORDER BY input <-> ? ASC",
+		"exact = false AND provider = ? AND model = ? AND vector_dims(input) = ? AND input <-> ? < 0.15 ORDER BY input <-> ? ASC",
 		provider,
 		model,
+		len(input),
 		embeddingstr,
 		embeddingstr,
 	).Error
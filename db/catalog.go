@@ -0,0 +1,337 @@
+package db
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Model struct {
+	ID            int     `json:"id"`
+	Model         string  `json:"model"`
+	Provider      string  `json:"provider"`
+	Type          string  `json:"type"`
+	ProjectID     *string `json:"project_id"`
+	BaseURL       *string `json:"base_url"`
+	APIKey        *string `json:"api_key"`
+	UpstreamModel *string `json:"upstream_model"`
+	CreditType    string  `json:"credit_type"`
+	CreditInput   *int    `json:"credit_input"`
+	CreditOutput  *int    `json:"credit_output"`
+	Credit        *int    `json:"credit"`
+	ContextWindow *int    `json:"context_window"`
+	Dimensions    *int    `json:"dimensions"` // The size of the vectors of the embedding models
+	Hidden        bool    `json:"hidden"`
+	OptionStream  bool    `json:"option_stream"`
+	OptionJSON    bool    `json:"option_json" gorm:"column:option_json"`
+	OptionTools   bool    `json:"option_tools"`
+	OptionVision  bool    `json:"option_vision"`
+}
+
+const (
+	// Models with this credit type are served on the project's own infrastructure and aren't billed
+	FreeCreditType = "free"
+	// Billed per input and output token with CreditInput and CreditOutput
+	TokenInputOutputCreditType = "token_input_output"
+	// Billed Credit per request, like the image generations
+	RequestCreditType = "request"
+	// Billed Credit per second of compute, like the replicate models
+	SecondCreditType = "second"
+)
+
+func (Model) TableName() string {
+	return "models"
+}
+
+// The id the provider knows the model by, it's the replicate version for the replicate models
+func (m Model) UpstreamID() string {
+	if m.UpstreamModel != nil && *m.UpstreamModel != "" {
+		return *m.UpstreamModel
+	}
+	return m.Model
+}
+
+func (m Model) Credits(inputTokenCount int, outputTokenCount int) int {
+	switch m.CreditType {
+	case FreeCreditType:
+		return 0
+	case RequestCreditType:
+		if m.Credit == nil {
+			return 0
+		}
+		return *m.Credit
+	case SecondCreditType:
+		// The duration is only known by the provider, it logs the credits itself
+		return 0
+	}
+
+	credits := 0
+	if m.CreditInput != nil {
+		credits += inputTokenCount * *m.CreditInput
+	}
+	if m.CreditOutput != nil {
+		credits += outputTokenCount * *m.CreditOutput
+	}
+	return credits
+}
+
+func (m Model) isVisibleBy(projectID string) bool {
+	return m.ProjectID == nil || *m.ProjectID == projectID
+}
+
+type ModelAlias struct {
+	Alias     string  `json:"alias"`
+	ProjectID *string `json:"project_id"`
+	ModelID   int     `json:"model_id"`
+	Position  int     `json:"position"` // The order of the models of a fallback chain
+}
+
+func (ModelAlias) TableName() string {
+	return "model_aliases"
+}
+
+/*
+ * The catalog of every model the API can serve, with their pricing and
+ * capabilities. It's loaded from the models and model_aliases tables and kept
+ * in memory since it's needed by every generation.
+ */
+type Catalog struct {
+	Models  []Model
+	Aliases []ModelAlias
+
+	byID map[int]*Model
+
+	// The projects can register a model under the name of another project's model
+	byName map[string][]*Model
+}
+
+func NewCatalog(models []Model, aliases []ModelAlias) *Catalog {
+	catalog := Catalog{
+		Models:  models,
+		Aliases: aliases,
+		byID:    make(map[int]*Model, len(models)),
+		byName:  make(map[string][]*Model, len(models)),
+	}
+
+	for i := range catalog.Models {
+		catalog.byID[catalog.Models[i].ID] = &catalog.Models[i]
+		name := catalog.Models[i].Model
+		catalog.byName[name] = append(catalog.byName[name], &catalog.Models[i])
+	}
+
+	return &catalog
+}
+
+/*
+ * Finds the model a user asked for. The aliases of the project come first so
+ * a project can redirect a global alias (like "regular") to its own model,
+ * then the global aliases and finally the model names themselves.
+ */
+func (c *Catalog) Resolve(alias string, projectID string, modelType string) *Model {
+	chain := c.ResolveChain(alias, projectID, modelType)
+	if len(chain) == 0 {
+		return nil
+	}
+	return chain[0]
+}
+
+/*
+ * An alias with several models is a fallback chain (like "best"), they are
+ * returned by position. A project defining the alias replaces the whole global
+ * chain.
+ */
+func (c *Catalog) ResolveChain(alias string, projectID string, modelType string) []*Model {
+	projectAliases := []ModelAlias{}
+	globalAliases := []ModelAlias{}
+
+	for _, modelAlias := range c.Aliases {
+		if modelAlias.Alias != alias {
+			continue
+		}
+
+		model, ok := c.byID[modelAlias.ModelID]
+		if !ok || model.Type != modelType || !model.isVisibleBy(projectID) {
+			continue
+		}
+
+		if modelAlias.ProjectID != nil && *modelAlias.ProjectID == projectID {
+			projectAliases = append(projectAliases, modelAlias)
+		} else if modelAlias.ProjectID == nil {
+			globalAliases = append(globalAliases, modelAlias)
+		}
+	}
+
+	aliases := projectAliases
+	if len(aliases) == 0 {
+		aliases = globalAliases
+	}
+
+	if len(aliases) == 0 {
+		model := c.byProjectName(alias, projectID, func(model *Model) bool { return model.Type == modelType })
+		if model == nil {
+			return nil
+		}
+		return []*Model{model}
+	}
+
+	sort.SliceStable(aliases, func(i, j int) bool { return aliases[i].Position < aliases[j].Position })
+
+	chain := make([]*Model, len(aliases))
+	for i, modelAlias := range aliases {
+		chain[i] = c.byID[modelAlias.ModelID]
+	}
+	return chain
+}
+
+// The model of the project with this name, or else the global one
+func (c *Catalog) byProjectName(modelName string, projectID string, match func(*Model) bool) *Model {
+	var global *Model
+	for _, model := range c.byName[modelName] {
+		if !match(model) {
+			continue
+		}
+		if model.ProjectID != nil && *model.ProjectID == projectID {
+			return model
+		}
+		if model.ProjectID == nil && global == nil {
+			global = model
+		}
+	}
+
+	return global
+}
+
+/*
+ * Finds the model a provider answered with, the project's model first and
+ * then the global one. The models of the other projects are never used, their
+ * pricing is their own.
+ */
+func (c *Catalog) Lookup(provider string, modelName string, projectID string) *Model {
+	return c.byProjectName(modelName, projectID, func(model *Model) bool { return model.Provider == provider })
+}
+
+type CatalogEntry struct {
+	Model         string       `json:"model"`
+	Provider      string       `json:"provider"`
+	Type          string       `json:"type"`
+	Aliases       []string     `json:"aliases"`
+	Custom        bool         `json:"custom"`
+	ContextWindow *int         `json:"context_window"`
+	Dimensions    *int         `json:"dimensions,omitempty"`
+	Pricing       ModelPricing `json:"pricing"`
+	Capabilities  Capabilities `json:"capabilities"`
+}
+
+type ModelPricing struct {
+	CreditType   string `json:"credit_type"`
+	CreditInput  *int   `json:"credit_input,omitempty"`
+	CreditOutput *int   `json:"credit_output,omitempty"`
+	Credit       *int   `json:"credit,omitempty"`
+}
+
+type Capabilities struct {
+	Stream bool `json:"stream"`
+	JSON   bool `json:"json"`
+	Tools  bool `json:"tools"`
+	Vision bool `json:"vision"`
+}
+
+func (m Model) Capabilities() Capabilities {
+	return Capabilities{
+		Stream: m.OptionStream,
+		JSON:   m.OptionJSON,
+		Tools:  m.OptionTools,
+		Vision: m.OptionVision,
+	}
+}
+
+// The models a project can use, without the hidden ones
+func (c *Catalog) List(projectID string) []CatalogEntry {
+	aliases := map[int][]string{}
+	for _, modelAlias := range c.Aliases {
+		if modelAlias.ProjectID == nil || *modelAlias.ProjectID == projectID {
+			aliases[modelAlias.ModelID] = append(aliases[modelAlias.ModelID], modelAlias.Alias)
+		}
+	}
+
+	result := []CatalogEntry{}
+	for _, model := range c.Models {
+		if model.Hidden || !model.isVisibleBy(projectID) {
+			continue
+		}
+
+		modelAliases := aliases[model.ID]
+		if modelAliases == nil {
+			modelAliases = []string{}
+		}
+		sort.Strings(modelAliases)
+
+		result = append(result, CatalogEntry{
+			Model:         model.Model,
+			Provider:      model.Provider,
+			Type:          model.Type,
+			Aliases:       modelAliases,
+			Custom:        model.ProjectID != nil,
+			ContextWindow: model.ContextWindow,
+			Dimensions:    model.Dimensions,
+			Pricing: ModelPricing{
+				CreditType:   model.CreditType,
+				CreditInput:  model.CreditInput,
+				CreditOutput: model.CreditOutput,
+				Credit:       model.Credit,
+			},
+			Capabilities: model.Capabilities(),
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Provider != result[j].Provider {
+			return result[i].Provider < result[j].Provider
+		}
+		return result[i].Model < result[j].Model
+	})
+
+	return result
+}
+
+// The catalog is reloaded from the database after this duration
+var CatalogCacheDuration = 5 * time.Minute
+
+var (
+	catalogMutex    sync.Mutex
+	catalogCache    *Catalog
+	catalogLoadedAt time.Time
+)
+
+func (db DB) GetCatalog() (*Catalog, error) {
+	catalogMutex.Lock()
+	defer catalogMutex.Unlock()
+
+	if catalogCache != nil && time.Since(catalogLoadedAt) < CatalogCacheDuration {
+		return catalogCache, nil
+	}
+
+	var models []Model
+	var aliases []ModelAlias
+
+	err := db.sql.Find(&models).Error
+	if err == nil {
+		err = db.sql.Find(&aliases).Error
+	}
+
+	// A database hiccup shouldn't make every model unknown, the previous catalog is kept
+	if err != nil && catalogCache != nil {
+		log.Printf("[ERROR] Can't reload the model catalog: %v\n", err)
+		catalogLoadedAt = time.Now()
+		return catalogCache, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	catalogCache = NewCatalog(models, aliases)
+	catalogLoadedAt = time.Now()
+
+	return catalogCache, nil
+}
@@ -0,0 +1,131 @@
+package db
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCatalogResolve(t *testing.T) {
+	projectID := "11100000-0000-0000-0000-000000000000"
+	otherProjectID := "22200000-0000-0000-0000-000000000000"
+
+	catalog := NewCatalog(
+		[]Model{
+			{ID: 1, Model: "gpt-3.5-turbo", Provider: "openai", Type: "completion"},
+			{ID: 2, Model: "llama2", Provider: "llama", Type: "completion"},
+			{ID: 3, Model: "project-llama3", Provider: "openai-compatible", Type: "completion", ProjectID: &projectID},
+			{ID: 4, Model: "text-embedding-ada-002", Provider: "openai", Type: "embedding"},
+			{ID: 5, Model: "project-llama3", Provider: "openai-compatible", Type: "completion", ProjectID: &otherProjectID},
+		},
+		[]ModelAlias{
+			{Alias: "regular", ModelID: 1},
+			{Alias: "cheap", ModelID: 2},
+			{Alias: "regular", ModelID: 3, ProjectID: &projectID},
+		},
+	)
+
+	tests := []struct {
+		alias     string
+		projectID string
+		model     string
+	}{
+		{"regular", otherProjectID, "gpt-3.5-turbo"},
+		{"regular", projectID, "project-llama3"},
+		{"cheap", projectID, "llama2"},
+		{"llama2", projectID, "llama2"},
+		{"project-llama3", projectID, "project-llama3"},
+		{"project-llama3", "33300000-0000-0000-0000-000000000000", ""},
+		{"text-embedding-ada-002", projectID, ""},
+		{"unknown", projectID, ""},
+	}
+
+	for _, test := range tests {
+		model := catalog.Resolve(test.alias, test.projectID, "completion")
+
+		name := ""
+		if model != nil {
+			name = model.Model
+		}
+
+		if name != test.model {
+			t.Fatalf(`Resolve("%s") should have returned "%s" but returned "%s"`, test.alias, test.model, name)
+		}
+	}
+
+	// Two projects can have a model with the same name
+	if model := catalog.Resolve("project-llama3", otherProjectID, "completion"); model == nil || model.ID != 5 {
+		t.Fatalf(`Resolve("project-llama3") should have returned the model of the other project but returned %v`, model)
+	}
+	if model := catalog.Lookup("openai-compatible", "project-llama3", projectID); model == nil || model.ID != 3 {
+		t.Fatalf(`Lookup("project-llama3") should have returned the model of the project but returned %v`, model)
+	}
+	if model := catalog.Lookup("openai-compatible", "project-llama3", "33300000-0000-0000-0000-000000000000"); model != nil {
+		t.Fatalf(`Lookup("project-llama3") shouldn't return the model of another project but returned %v`, model)
+	}
+}
+
+func TestCatalogResolveChain(t *testing.T) {
+	projectID := "11100000-0000-0000-0000-000000000000"
+
+	catalog := NewCatalog(
+		[]Model{
+			{ID: 1, Model: "gpt-4", Provider: "openai", Type: "completion"},
+			{ID: 2, Model: "anthropic/claude-3.5-sonnet", Provider: "openrouter", Type: "completion"},
+			{ID: 3, Model: "llama-2-70b-chat", Provider: "replicate", Type: "completion"},
+			{ID: 4, Model: "project-llama3", Provider: "openai-compatible", Type: "completion", ProjectID: &projectID},
+		},
+		[]ModelAlias{
+			{Alias: "best", ModelID: 3, Position: 2},
+			{Alias: "best", ModelID: 1, Position: 0},
+			{Alias: "best", ModelID: 2, Position: 1},
+			{Alias: "best", ModelID: 4, ProjectID: &projectID},
+			{Alias: "best", ModelID: 1, ProjectID: &projectID, Position: 1},
+		},
+	)
+
+	tests := []struct {
+		projectID string
+		models    []string
+	}{
+		{"22200000-0000-0000-0000-000000000000", []string{"gpt-4", "anthropic/claude-3.5-sonnet", "llama-2-70b-chat"}},
+		{projectID, []string{"project-llama3", "gpt-4"}},
+	}
+
+	for _, test := range tests {
+		chain := catalog.ResolveChain("best", test.projectID, "completion")
+
+		names := []string{}
+		for _, model := range chain {
+			names = append(names, model.Model)
+		}
+
+		if strings.Join(names, ",") != strings.Join(test.models, ",") {
+			t.Fatalf(`ResolveChain("best") should have returned %v but returned %v`, test.models, names)
+		}
+	}
+
+	if model := catalog.Resolve("best", "22200000-0000-0000-0000-000000000000", "completion"); model == nil || model.Model != "gpt-4" {
+		t.Fatalf(`Resolve("best") should have returned the first model of the chain but returned %v`, model)
+	}
+}
+
+func TestModelCredits(t *testing.T) {
+	creditInput := 5
+	creditOutput := 15
+	credit := 200000
+
+	tokens := Model{CreditType: TokenInputOutputCreditType, CreditInput: &creditInput, CreditOutput: &creditOutput}
+	if tokens.Credits(10, 2) != 80 {
+		t.Fatalf(`A token priced model should cost 10*5 + 2*15 credits but cost %d`, tokens.Credits(10, 2))
+	}
+
+	request := Model{CreditType: RequestCreditType, Credit: &credit}
+	if request.Credits(0, 0) != credit {
+		t.Fatalf(`A request priced model should cost %d credits but cost %d`, credit, request.Credits(0, 0))
+	}
+
+	free := Model{CreditType: FreeCreditType, CreditInput: &creditInput}
+	if free.Credits(10, 2) != 0 {
+		t.Fatalf(`A free model shouldn't cost anything`)
+	}
+}
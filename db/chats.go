@@ -93,11 +93,12 @@ func (db DB) UpdateChat(userID string, id string, name string) (*Chat, error) {
 }
 
 type ChatMessage struct {
-	ID            *string `json:"id"`
-	ChatID        string  `json:"chat_id"`
-	IsUserMessage bool    `json:"is_user_message"`
-	Content       string  `json:"content"`
-	CreatedAt     string  `json:"created_at"`
+	ID            *string     `json:"id"`
+	ChatID        string      `json:"chat_id"`
+	IsUserMessage bool        `json:"is_user_message"`
+	Content       string      `json:"content"`
+	ImageURLs     StringArray `json:"image_urls"`
+	CreatedAt     string      `json:"created_at"`
 }
 
 func (ChatMessage) TableName() string {
@@ -128,12 +129,13 @@ func (db DB) GetChatMessages(userID string, chatID string, orderByDESC bool, lim
 	return results, nil
 }
 
-func (db DB) AddChatMessage(chatID string, isUserMessage bool, content string) error {
+func (db DB) AddChatMessage(chatID string, isUserMessage bool, content string, imageURLs []string) error {
 	err := db.sql.Exec(
-		"INSERT INTO chat_messages (chat_id, is_user_message, content) VALUES (?, ?, ?)",
+		"INSERT INTO chat_messages (chat_id, is_user_message, content, image_urls) VALUES (?, ?, ?, ?)",
 		chatID,
 		isUserMessage,
 		content,
+		StringArray(imageURLs),
 	).Error
 	if err != nil {
 		return err
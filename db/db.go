@@ -3,6 +3,7 @@ package db
 import (
 	"fmt"
 	"os"
+	"time"
 
 	postgrest "github.com/supabase/postgrest-go"
 	"gorm.io/driver/postgres"
@@ -12,6 +13,7 @@ import (
 type Database interface {
 	getUserInfos(userID string) (*UserInfos, error)
 	CheckDBVersionRateLimit(userID string, version int) (*UserInfos, RateLimitStatus, CreditsStatus, error)
+	CheckRateLimit(userID string) (*UserInfos, RateLimitStatus, CreditsStatus, error)
 	RemoveCreditsFromDev(userID string, credits int) error
 	CreateRefreshToken(refreshToken string, refreshTokenSupabase string, projectID string) error
 	GetAndDeleteRefreshToken(refreshToken string) (*RefreshToken, error)
@@ -26,12 +28,14 @@ type Database interface {
 	LogRequests(
 		eventID string,
 		userID string,
+		projectID string,
 		providerName string,
 		modelName string,
 		inputTokenCount int,
 		outputTokenCount int,
 		kind Kind,
 		countCredits bool,
+		apiKeyID string,
 	)
 	LogRequestsCredits(
 		eventID string,
@@ -41,6 +45,7 @@ type Database interface {
 		inputTokenCount int,
 		outputTokenCount int,
 		kind Kind,
+		apiKeyID string,
 	)
 	LogEvents(
 		id string,
@@ -67,18 +72,26 @@ type Database interface {
 	DeleteChat(userID string, id string) error
 	UpdateChat(userID string, id string, name string) (*Chat, error)
 	GetChatMessages(userID string, chatID string, orderByDESC bool, limit int, offset int) ([]ChatMessage, error)
-	AddChatMessage(chatID string, isUserMessage bool, content string) error
-	CreateMemory(memoryID string, userID string, public bool) error
+	AddChatMessage(chatID string, isUserMessage bool, content string, imageURLs []string) error
+	CreateMemory(memoryID string, userID string, public bool, embeddingModel string, embeddingDimensions int) error
 	GetMemory(memoryID string) (*Memory, error)
+	GetMemories(memoryIDs []string) ([]Memory, error)
+	GetRoutingRules(projectID string) (*RoutingRules, error)
 	AddMemory(userID string, memoryID string, content string, embedding []float32) error
 	AddMemories(memoryID string, embeddings []Embedding) error
 	GetExistingEmbeddingFromContent(content string) (*[]float32, error)
 	GetMemoryIDs(userID string) ([]MemoryRecord, error)
-	MatchEmbeddings(memoryIDs []string, userID string, embedding []float32) ([]MatchResult, error)
+	MatchEmbeddings(memoryIDs []string, userID string, embeddingModel string, embedding []float32) ([]MatchResult, error)
 	GetProjectByID(id string) (*Project, error)
 	GetProjectUserByID(id string) (*ProjectUser, error)
 	GetProjectForUserID(userID string) (*string, error)
-	GetModelByAliasAndProjectID(alias string, projectID string, modelType string) (*Model, error)
+	GetCatalog() (*Catalog, error)
+	CreateGenerationJob(userID string, eventID string, request string, webhookURL *string, webhookSecret *string) (*GenerationJob, error)
+	GetGenerationJob(userID string, id string) (*GenerationJob, error)
+	ClaimGenerationJob() (*GenerationJob, error)
+	UpdateGenerationJobPartialResult(id string, partialResult string) error
+	FinishGenerationJob(id string, status JobStatus, partialResult string, result string) error
+	RequeueStaleGenerationJobs(staleAfter time.Duration) error
 }
 
 type DB struct {
@@ -0,0 +1,122 @@
+package db
+
+import (
+	"time"
+)
+
+type JobStatus string
+
+const (
+	JobStatusPending JobStatus = "pending"
+	JobStatusRunning JobStatus = "running"
+	JobStatusDone    JobStatus = "done"
+	JobStatusFailed  JobStatus = "failed"
+)
+
+/*
+ * The asynchronous generations. The request is stored as sent to /generate so
+ * a job can be started again by any instance after a restart.
+ */
+type GenerationJob struct {
+	ID            string    `json:"id"`
+	UserID        string    `json:"user_id"`
+	EventID       string    `json:"event_id"`
+	Status        JobStatus `json:"status"`
+	Request       string    `json:"request"`
+	PartialResult string    `json:"partial_result"`
+	Result        *string   `json:"result"`
+	WebhookURL    *string   `json:"webhook_url"`
+	WebhookSecret *string   `json:"webhook_secret"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+func (GenerationJob) TableName() string {
+	return "generation_jobs"
+}
+
+func (db DB) CreateGenerationJob(
+	userID string,
+	eventID string,
+	request string,
+	webhookURL *string,
+	webhookSecret *string,
+) (*GenerationJob, error) {
+	var result *GenerationJob
+
+	err := db.sql.Raw(
+		"INSERT INTO generation_jobs (user_id, event_id, request, webhook_url, webhook_secret) VALUES (?::uuid, ?, ?::jsonb, ?, ?) RETURNING *",
+		userID, eventID, request, webhookURL, webhookSecret,
+	).Scan(&result).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (db DB) GetGenerationJob(userID string, id string) (*GenerationJob, error) {
+	var result []GenerationJob
+
+	err := db.sql.Find(&result, "id = try_cast_uuid(?) AND user_id = try_cast_uuid(?)", id, userID).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result) == 0 {
+		return nil, nil
+	}
+
+	return &result[0], nil
+}
+
+// Marks the oldest pending job as running. SKIP LOCKED lets several instances claim jobs at the same time.
+func (db DB) ClaimGenerationJob() (*GenerationJob, error) {
+	var result []GenerationJob
+
+	err := db.sql.Raw(`
+		UPDATE generation_jobs SET status = 'running', updated_at = now()
+		WHERE id = (
+			SELECT id FROM generation_jobs
+			WHERE status = 'pending'
+			ORDER BY created_at
+			FOR UPDATE SKIP LOCKED
+			LIMIT 1
+		)
+		RETURNING *
+	`).Scan(&result).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result) == 0 {
+		return nil, nil
+	}
+
+	return &result[0], nil
+}
+
+func (db DB) UpdateGenerationJobPartialResult(id string, partialResult string) error {
+	return db.sql.Exec(
+		"UPDATE generation_jobs SET partial_result = ?, updated_at = now() WHERE id = ?",
+		partialResult, id,
+	).Error
+}
+
+func (db DB) FinishGenerationJob(id string, status JobStatus, partialResult string, result string) error {
+	return db.sql.Exec(
+		"UPDATE generation_jobs SET status = ?, partial_result = ?, result = ?::jsonb, updated_at = now() WHERE id = ?",
+		status, partialResult, result, id,
+	).Error
+}
+
+/*
+ * The running jobs are updated regularly (see completion.JobHeartbeat), the ones that
+ * weren't for a long time belonged to an instance that stopped.
+ */
+func (db DB) RequeueStaleGenerationJobs(staleAfter time.Duration) error {
+	return db.sql.Exec(
+		"UPDATE generation_jobs SET status = 'pending', partial_result = '' WHERE status = 'running' AND updated_at < ?",
+		time.Now().Add(-staleAfter),
+	).Error
+}
@@ -11,6 +11,10 @@ type Memory struct {
 	ID     string `json:"id"`
 	UserID string `json:"user_id"`
 	Public bool   `json:"public"`
+
+	// The memory is searched with the model it was built with
+	EmbeddingModel      string `json:"embedding_model"`
+	EmbeddingDimensions int    `json:"embedding_dimensions"`
 }
 
 type MatchParams struct {
@@ -19,6 +23,7 @@ type MatchParams struct {
 	MatchCount     int16     `json:"match_count"`
 	MemoryID       []string  `json:"memoryid"`
 	UserID         string    `json:"userid"`
+	EmbeddingModel string    `json:"embeddingmodel"`
 }
 
 type MatchResult struct {
@@ -61,8 +66,21 @@ type Embedding struct {
 	Embedding FloatArray `json:"embedding"`
 }
 
-func (db DB) CreateMemory(memoryID string, userID string, public bool) error {
-	err := db.sql.Exec("INSERT INTO memories (id, user_id, public) VALUES (?, ?::uuid, ?)", memoryID, userID, public).Error
+func (db DB) CreateMemory(
+	memoryID string,
+	userID string,
+	public bool,
+	embeddingModel string,
+	embeddingDimensions int,
+) error {
+	err := db.sql.Exec(
+		"INSERT INTO memories (id, user_id, public, embedding_model, embedding_dimensions) VALUES (?, ?::uuid, ?, ?, ?)",
+		memoryID,
+		userID,
+		public,
+		embeddingModel,
+		embeddingDimensions,
+	).Error
 	if err != nil {
 		return err
 	}
@@ -80,6 +98,16 @@ func (db DB) GetMemory(memoryID string) (*Memory, error) {
 	return &memory, nil
 }
 
+func (db DB) GetMemories(memoryIDs []string) ([]Memory, error) {
+	var memories []Memory
+	err := db.sql.Find(&memories, "id IN ?", memoryIDs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return memories, nil
+}
+
 func (db DB) AddMemory(userID string, memoryID string, content string, embedding []float32) error {
 	memory, err := db.GetMemory(memoryID)
 	if err != nil {
@@ -185,13 +213,20 @@ func (db DB) GetMemoryIDs(userID string) ([]MemoryRecord, error) {
 	return results, nil
 }
 
-func (db DB) MatchEmbeddings(memoryIDs []string, userID string, embedding []float32) ([]MatchResult, error) {
+// Only the memories built with embeddingModel are searched, the others can't be compared to the embedding
+func (db DB) MatchEmbeddings(
+	memoryIDs []string,
+	userID string,
+	embeddingModel string,
+	embedding []float32,
+) ([]MatchResult, error) {
 	params := MatchParams{
 		QueryEmbedding: embedding,
 		MatchTreshold:  0.70,
 		MatchCount:     10,
 		MemoryID:       memoryIDs,
 		UserID:         userID,
+		EmbeddingModel: embeddingModel,
 	}
 
 	client, err := CreateClient()
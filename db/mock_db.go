@@ -1,51 +1,120 @@
 package db
 
+import "time"
+
 type MockDatabase struct {
-	MockgetUserInfos                    func(userID string) (*UserInfos, error)
-	MockCheckDBVersionRateLimit         func(userID string, version int) (*UserInfos, RateLimitStatus, CreditsStatus, error)
-	MockRemoveCreditsFromDev            func(userID string, credits int) error
-	MockCreateRefreshToken              func(refreshToken string, refreshTokenSupabase string, projectID string) error
-	MockGetAndDeleteRefreshToken        func(refreshToken string) (*RefreshToken, error)
-	MockGetDevEmail                     func(projectID string) (string, error)
-	MockGetUserIDFromProjectAuthID      func(project string, authID string) (*string, error)
-	MockCreateProjectUser               func(authID string, projectID string, monthlyCreditRateLimit *int) (*string, error)
-	MockGetTTSVoice                     func(slug string) (TTSVoice, error)
-	MockGetCompletionCache              func(id string) (*CompletionCache, error)
-	MockGetCompletionCacheByInput       func(provider string, model string, input []float32) (*CompletionCache, error)
-	MockAddCompletionCache              func(input []float32, prompt string, result string, provider string, model string, exact bool) error
-	MockGetExactCompletionCacheByHash   func(provider string, model string, input string) (*CompletionCache, error)
-	MockLogRequests                     func(eventID string, userID string, providerName string, modelName string, inputTokenCount int, outputTokenCount int, kind Kind, countCredits bool)
-	MockLogRequestsCredits              func(eventID string, userID string, modelName string, credits int, inputTokenCount int, outputTokenCount int, kind Kind)
-	MockLogEvents                       func(id string, path string, userID string, projectID string, requestBody string, responseBody string, error bool, promptID string, eventType string, orginDomain string)
-	MockSetKV                           func(userID, key, value string) error
-	MockGetKV                           func(userID, key string) (*KVStore, error)
-	MockGetKVMap                        func(userID string, keys []string) (map[string]string, error)
-	MockDeleteKV                        func(userID, key string) error
-	MockListKV                          func(userID string) ([]KVStore, error)
-	MockGetPromptByIDOrSlug             func(id string) (*Prompt, error)
-	MockRetrieveSystemPromptID          func(systemPromptIDOrSlug *string) (*string, error)
-	MockGetChatByID                     func(id string) (*Chat, error)
-	MockCreateChat                      func(userID string, systemPrompt *string, SystemPromptID *string, name *string) (*Chat, error)
-	MockListChats                       func(userID string) ([]ChatWithLatestMessage, error)
-	MockDeleteChat                      func(userID string, id string) error
-	MockUpdateChat                      func(userID string, id string, name string) (*Chat, error)
-	MockGetChatMessages                 func(userID string, chatID string, orderByDESC bool, limit int, offset int) ([]ChatMessage, error)
-	MockAddChatMessage                  func(chatID string, isUserMessage bool, content string) error
-	MockCreateMemory                    func(memoryID string, userID string, public bool) error
-	MockGetMemory                       func(memoryID string) (*Memory, error)
-	MockAddMemory                       func(userID string, memoryID string, content string, embedding []float32) error
-	MockAddMemories                     func(memoryID string, embeddings []Embedding) error
-	MockGetExistingEmbeddingFromContent func(content string) (*[]float32, error)
-	MockGetMemoryIDs                    func(userID string) ([]MemoryRecord, error)
-	MockMatchEmbeddings                 func(memoryIDs []string, userID string, embedding []float32) ([]MatchResult, error)
-	MockGetProjectByID                  func(id string) (*Project, error)
-	MockGetProjectUserByID              func(id string) (*ProjectUser, error)
-	MockGetProjectForUserID             func(userID string) (*string, error)
-	MockGetModelByAliasAndProjectID     func(alias string, projectID string, modelType string) (*Model, error)
-}
-
-func (mdb MockDatabase) GetModelByAliasAndProjectID(_ string, _ string, _ string) (*Model, error) {
-	panic("Mock GetModelByAliasAndProjectID Unimplemented")
+	MockgetUserInfos                     func(userID string) (*UserInfos, error)
+	MockCheckDBVersionRateLimit          func(userID string, version int) (*UserInfos, RateLimitStatus, CreditsStatus, error)
+	MockCheckRateLimit                   func(userID string) (*UserInfos, RateLimitStatus, CreditsStatus, error)
+	MockRemoveCreditsFromDev             func(userID string, credits int) error
+	MockCreateRefreshToken               func(refreshToken string, refreshTokenSupabase string, projectID string) error
+	MockGetAndDeleteRefreshToken         func(refreshToken string) (*RefreshToken, error)
+	MockGetDevEmail                      func(projectID string) (string, error)
+	MockGetUserIDFromProjectAuthID       func(project string, authID string) (*string, error)
+	MockCreateProjectUser                func(authID string, projectID string, monthlyCreditRateLimit *int) (*string, error)
+	MockGetTTSVoice                      func(slug string) (TTSVoice, error)
+	MockGetCompletionCache               func(id string) (*CompletionCache, error)
+	MockGetCompletionCacheByInput        func(provider string, model string, input []float32) (*CompletionCache, error)
+	MockAddCompletionCache               func(input []float32, prompt string, result string, provider string, model string, exact bool) error
+	MockGetExactCompletionCacheByHash    func(provider string, model string, input string) (*CompletionCache, error)
+	MockLogRequests                      func(eventID string, userID string, projectID string, providerName string, modelName string, inputTokenCount int, outputTokenCount int, kind Kind, countCredits bool, apiKeyID string)
+	MockLogRequestsCredits               func(eventID string, userID string, modelName string, credits int, inputTokenCount int, outputTokenCount int, kind Kind)
+	MockLogEvents                        func(id string, path string, userID string, projectID string, requestBody string, responseBody string, error bool, promptID string, eventType string, orginDomain string)
+	MockSetKV                            func(userID, key, value string) error
+	MockGetKV                            func(userID, key string) (*KVStore, error)
+	MockGetKVMap                         func(userID string, keys []string) (map[string]string, error)
+	MockDeleteKV                         func(userID, key string) error
+	MockListKV                           func(userID string) ([]KVStore, error)
+	MockGetPromptByIDOrSlug              func(id string) (*Prompt, error)
+	MockRetrieveSystemPromptID           func(systemPromptIDOrSlug *string) (*string, error)
+	MockGetChatByID                      func(id string) (*Chat, error)
+	MockCreateChat                       func(userID string, systemPrompt *string, SystemPromptID *string, name *string) (*Chat, error)
+	MockListChats                        func(userID string) ([]ChatWithLatestMessage, error)
+	MockDeleteChat                       func(userID string, id string) error
+	MockUpdateChat                       func(userID string, id string, name string) (*Chat, error)
+	MockGetChatMessages                  func(userID string, chatID string, orderByDESC bool, limit int, offset int) ([]ChatMessage, error)
+	MockAddChatMessage                   func(chatID string, isUserMessage bool, content string, imageURLs []string) error
+	MockCreateMemory                     func(memoryID string, userID string, public bool, embeddingModel string, embeddingDimensions int) error
+	MockGetMemory                        func(memoryID string) (*Memory, error)
+	MockAddMemory                        func(userID string, memoryID string, content string, embedding []float32) error
+	MockAddMemories                      func(memoryID string, embeddings []Embedding) error
+	MockGetExistingEmbeddingFromContent  func(content string) (*[]float32, error)
+	MockGetMemoryIDs                     func(userID string) ([]MemoryRecord, error)
+	MockMatchEmbeddings                  func(memoryIDs []string, userID string, embeddingModel string, embedding []float32) ([]MatchResult, error)
+	MockGetMemories                      func(memoryIDs []string) ([]Memory, error)
+	MockGetRoutingRules                  func(projectID string) (*RoutingRules, error)
+	MockGetProjectByID                   func(id string) (*Project, error)
+	MockGetProjectUserByID               func(id string) (*ProjectUser, error)
+	MockGetProjectForUserID              func(userID string) (*string, error)
+	MockGetCatalog                       func() (*Catalog, error)
+	MockCreateGenerationJob              func(userID string, eventID string, request string, webhookURL *string, webhookSecret *string) (*GenerationJob, error)
+	MockGetGenerationJob                 func(userID string, id string) (*GenerationJob, error)
+	MockClaimGenerationJob               func() (*GenerationJob, error)
+	MockUpdateGenerationJobPartialResult func(id string, partialResult string) error
+	MockFinishGenerationJob              func(id string, status JobStatus, partialResult string, result string) error
+	MockRequeueStaleGenerationJobs       func(staleAfter time.Duration) error
+}
+
+func (mdb MockDatabase) CheckRateLimit(userID string) (*UserInfos, RateLimitStatus, CreditsStatus, error) {
+	if mdb.MockCheckRateLimit != nil {
+		return mdb.MockCheckRateLimit(userID)
+	}
+	panic("Mock CheckRateLimit Unimplemented")
+}
+
+func (mdb MockDatabase) CreateGenerationJob(
+	userID string,
+	eventID string,
+	request string,
+	webhookURL *string,
+	webhookSecret *string,
+) (*GenerationJob, error) {
+	if mdb.MockCreateGenerationJob != nil {
+		return mdb.MockCreateGenerationJob(userID, eventID, request, webhookURL, webhookSecret)
+	}
+	panic("Mock CreateGenerationJob Unimplemented")
+}
+
+func (mdb MockDatabase) GetGenerationJob(userID string, id string) (*GenerationJob, error) {
+	if mdb.MockGetGenerationJob != nil {
+		return mdb.MockGetGenerationJob(userID, id)
+	}
+	panic("Mock GetGenerationJob Unimplemented")
+}
+
+func (mdb MockDatabase) ClaimGenerationJob() (*GenerationJob, error) {
+	if mdb.MockClaimGenerationJob != nil {
+		return mdb.MockClaimGenerationJob()
+	}
+	panic("Mock ClaimGenerationJob Unimplemented")
+}
+
+func (mdb MockDatabase) UpdateGenerationJobPartialResult(id string, partialResult string) error {
+	if mdb.MockUpdateGenerationJobPartialResult != nil {
+		return mdb.MockUpdateGenerationJobPartialResult(id, partialResult)
+	}
+	panic("Mock UpdateGenerationJobPartialResult Unimplemented")
+}
+
+func (mdb MockDatabase) FinishGenerationJob(id string, status JobStatus, partialResult string, result string) error {
+	if mdb.MockFinishGenerationJob != nil {
+		return mdb.MockFinishGenerationJob(id, status, partialResult, result)
+	}
+	panic("Mock FinishGenerationJob Unimplemented")
+}
+
+func (mdb MockDatabase) RequeueStaleGenerationJobs(staleAfter time.Duration) error {
+	if mdb.MockRequeueStaleGenerationJobs != nil {
+		return mdb.MockRequeueStaleGenerationJobs(staleAfter)
+	}
+	panic("Mock RequeueStaleGenerationJobs Unimplemented")
+}
+
+func (mdb MockDatabase) GetCatalog() (*Catalog, error) {
+	if mdb.MockGetCatalog != nil {
+		return mdb.MockGetCatalog()
+	}
+	panic("Mock GetCatalog Unimplemented")
 }
 
 func (mdb MockDatabase) GetProjectForUserID(_ string) (*string, error) {
@@ -60,13 +129,32 @@ func (mdb MockDatabase) GetProjectByID(_ string) (*Project, error) {
 	panic("Mock GetProjectByID Unimplemented")
 }
 
-func (mdb MockDatabase) MatchEmbeddings(memoryIDs []string, userID string, embedding []float32) ([]MatchResult, error) {
+func (mdb MockDatabase) MatchEmbeddings(
+	memoryIDs []string,
+	userID string,
+	embeddingModel string,
+	embedding []float32,
+) ([]MatchResult, error) {
 	if mdb.MockMatchEmbeddings != nil {
-		return mdb.MockMatchEmbeddings(memoryIDs, userID, embedding)
+		return mdb.MockMatchEmbeddings(memoryIDs, userID, embeddingModel, embedding)
 	}
 	panic("Mock MatchEmbeddings Unimplemented")
 }
 
+func (mdb MockDatabase) GetRoutingRules(projectID string) (*RoutingRules, error) {
+	if mdb.MockGetRoutingRules != nil {
+		return mdb.MockGetRoutingRules(projectID)
+	}
+	panic("Mock GetRoutingRules Unimplemented")
+}
+
+func (mdb MockDatabase) GetMemories(memoryIDs []string) ([]Memory, error) {
+	if mdb.MockGetMemories != nil {
+		return mdb.MockGetMemories(memoryIDs)
+	}
+	panic("Mock GetMemories Unimplemented")
+}
+
 func (mdb MockDatabase) GetMemoryIDs(_ string) ([]MemoryRecord, error) {
 	panic("Mock GetMemoryIDs Unimplemented")
 }
@@ -90,15 +178,27 @@ func (mdb MockDatabase) GetMemory(_ string) (*Memory, error) {
 	panic("Mock GetMemory Unimplemented")
 }
 
-func (mdb MockDatabase) CreateMemory(_ string, _ string, _ bool) error {
+func (mdb MockDatabase) CreateMemory(_ string, _ string, _ bool, _ string, _ int) error {
 	panic("Mock CreateMemory Unimplemented")
 }
 
-func (mdb MockDatabase) AddChatMessage(_ string, _ bool, _ string) error {
+func (mdb MockDatabase) AddChatMessage(chatID string, isUserMessage bool, content string, imageURLs []string) error {
+	if mdb.MockAddChatMessage != nil {
+		return mdb.MockAddChatMessage(chatID, isUserMessage, content, imageURLs)
+	}
 	panic("Mock AddChatMessage Unimplemented")
 }
 
-func (mdb MockDatabase) GetChatMessages(_ string, _ string, _ bool, _ int, _ int) ([]ChatMessage, error) {
+func (mdb MockDatabase) GetChatMessages(
+	userID string,
+	chatID string,
+	orderByDESC bool,
+	limit int,
+	offset int,
+) ([]ChatMessage, error) {
+	if mdb.MockGetChatMessages != nil {
+		return mdb.MockGetChatMessages(userID, chatID, orderByDESC, limit, offset)
+	}
 	panic("Mock GetChatMessages Unimplemented")
 }
 
@@ -118,7 +218,10 @@ func (mdb MockDatabase) CreateChat(_ string, _ *string, _ *string, _ *string) (*
 	panic("Mock CreateChat Unimplemented")
 }
 
-func (mdb MockDatabase) GetChatByID(_ string) (*Chat, error) {
+func (mdb MockDatabase) GetChatByID(id string) (*Chat, error) {
+	if mdb.MockGetChatByID != nil {
+		return mdb.MockGetChatByID(id)
+	}
 	panic("Mock GetChatByID Unimplemented")
 }
 
@@ -151,44 +254,52 @@ func (mdb MockDatabase) SetKV(_ string, _ string, _ string) error {
 }
 
 func (mdb MockDatabase) LogEvents(
-	_ string,
-	_ string,
-	_ string,
-	_ string,
-	_ string,
-	_ string,
-	_ bool,
-	_ string,
-	_ string,
-	_ string,
+	id string,
+	path string,
+	userID string,
+	projectID string,
+	requestBody string,
+	responseBody string,
+	error bool,
+	promptID string,
+	eventType string,
+	orginDomain string,
 ) {
+	if mdb.MockLogEvents != nil {
+		mdb.MockLogEvents(id, path, userID, projectID, requestBody, responseBody, error, promptID, eventType, orginDomain)
+		return
+	}
 	panic("Mock LogEvents Unimplemented")
 }
 
-func (mdb MockDatabase) LogRequestsCredits(_ string, _ string, _ string, _ int, _ int, _ int, _ Kind) {
+func (mdb MockDatabase) LogRequestsCredits(_ string, _ string, _ string, _ int, _ int, _ int, _ Kind, _ string) {
 	panic("Mock LogRequestsCredits Unimplemented")
 }
 
 func (mdb MockDatabase) LogRequests(
 	eventID string,
 	userID string,
+	projectID string,
 	providerName string,
 	modelName string,
 	inputTokenCount int,
 	outputTokenCount int,
 	kind Kind,
 	countCredits bool,
+	apiKeyID string,
 ) {
 	if mdb.MockLogRequests != nil {
 		mdb.MockLogRequests(
 			eventID,
 			userID,
+			projectID,
 			providerName,
 			modelName,
 			inputTokenCount,
 			outputTokenCount,
 			kind,
 			countCredits,
+			apiKeyID,
 		)
 		return
 	}
@@ -0,0 +1,39 @@
+package db
+
+import "encoding/json"
+
+/*
+ * The moderation of the generations of a project (the moderation column of
+ * projects). Without it, nothing is moderated.
+ */
+type ModerationPolicy struct {
+	// "openai" for the OpenAI moderation endpoint, "local" for the keywords and patterns of Rules
+	Provider string `json:"provider"`
+
+	// What happens to a flagged text: "block", "redact" or "flag"
+	Action string `json:"action"`
+
+	// Only these OpenAI categories are flagged, all of them when empty
+	Categories []string `json:"categories,omitempty"`
+
+	Rules []ModerationRule `json:"rules,omitempty"`
+}
+
+type ModerationRule struct {
+	Category string   `json:"category"`
+	Keywords []string `json:"keywords,omitempty"` // Matched as whole words, case insensitive
+	Patterns []string `json:"patterns,omitempty"` // Regular expressions
+}
+
+func ParseModerationPolicy(policy string) (*ModerationPolicy, error) {
+	if policy == "" {
+		return nil, nil
+	}
+
+	var result ModerationPolicy
+	if err := json.Unmarshal([]byte(policy), &result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
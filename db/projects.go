@@ -103,29 +103,3 @@ type AuthUser struct {
 type AuthUserProject struct {
 	UserID string `json:"param_user_id"`
 }
-
-type Model struct {
-	ID       int    `json:"id"`
-	Model    string `json:"model"`
-	Provider string `json:"provider"`
-}
-
-func (Model) TableName() string {
-	return "models"
-}
-
-func (db DB) GetModelByAliasAndProjectID(alias string, projectID string, modelType string) (*Model, error) {
-	model := Model{}
-
-	err := db.sql.Raw(
-		"SELECT models.* FROM models JOIN model_aliases ON model_aliases.model_id = models.id WHERE model_aliases.alias = ? AND (model_aliases.project_id = ? OR model_aliases.project_id IS NULL) AND models.type = ? LIMIT 1",
-		alias,
-		projectID,
-		modelType,
-	).First(&model).Error
-	if err != nil {
-		return nil, err
-	}
-
-	return &model, nil
-}
@@ -2,8 +2,7 @@ package db
 
 import (
 	"database/sql"
-
-	"github.com/polyfire/api/codegen"
+	"log"
 )
 
 type Kind string
@@ -23,53 +22,39 @@ type RequestLog struct {
 	Kind             Kind   `json:"kind"`
 }
 
-func tokenToCredit(
+func (db DB) tokenToCredit(
+	projectID string,
 	providerName string,
 	modelName string,
 	inputTokenCount int,
 	outputTokenCount int,
 ) int {
-	switch providerName {
-	case "openai":
-		switch modelName {
-		case "gpt-3.5-turbo":
-			return (inputTokenCount * 5) + (outputTokenCount * 15)
-		case "gpt-3.5-turbo-16k":
-			return (inputTokenCount * 5) + (outputTokenCount * 15)
-		case "gpt-4":
-			return (inputTokenCount * 300) + (outputTokenCount * 600)
-		case "gpt-4-32k":
-			return (inputTokenCount * 600) + (outputTokenCount * 1200)
-		case "gpt-4o":
-			return (inputTokenCount * 50) + (outputTokenCount * 150)
-		case "gpt-4-turbo":
-			return (inputTokenCount * 100) + (outputTokenCount * 300)
-		case "text-embedding-ada-002":
-			return inputTokenCount * 1
-		case "dall-e-2":
-			return 200000
-		case "dall-e-3":
-			return 800000
-		}
-	case "openrouter":
-		return codegen.OpenRouterPrices(modelName, inputTokenCount, outputTokenCount)
-	case "llama":
+	catalog, err := db.GetCatalog()
+	if err != nil {
+		log.Printf("[ERROR] Can't load the model catalog to bill %s/%s: %v\n", providerName, modelName, err)
+		return 0
+	}
+
+	model := catalog.Lookup(providerName, modelName, projectID)
+	if model == nil {
+		log.Printf("[WARNING] No pricing for %s/%s\n", providerName, modelName)
 		return 0
-	case "cohere":
-		return (inputTokenCount + outputTokenCount) * 150
 	}
-	return 0
+
+	return model.Credits(inputTokenCount, outputTokenCount)
 }
 
 func (db DB) LogRequests(
 	eventID string,
 	userID string,
+	projectID string,
 	providerName string,
 	modelName string,
 	inputTokenCount int,
 	outputTokenCount int,
 	kind Kind,
 	countCredits bool,
+	apiKeyID string,
 ) {
 	if kind == "" {
 		kind = "completion"
@@ -77,7 +62,7 @@ func (db DB) LogRequests(
 	var credits int
 
 	if countCredits {
-		credits = tokenToCredit(providerName, modelName, inputTokenCount, outputTokenCount)
+		credits = db.tokenToCredit(projectID, providerName, modelName, inputTokenCount, outputTokenCount)
 	} else {
 		credits = 0
 	}
@@ -85,7 +70,7 @@ func (db DB) LogRequests(
 	err1 := db.RemoveCreditsFromDev(userID, credits)
 
 	err2 := db.sql.Exec(
-		"INSERT INTO request_logs (user_id, model_name, kind, input_token_count, output_token_count, credits, event_id) VALUES (?::uuid, ?, ?, ?, ?, ?, try_cast_uuid(?))",
+		"INSERT INTO request_logs (user_id, model_name, kind, input_token_count, output_token_count, credits, event_id, api_key_id) VALUES (?::uuid, ?, ?, ?, ?, ?, try_cast_uuid(?), NULLIF(?, ''))",
 		userID,
 		modelName,
 		kind,
@@ -93,6 +78,7 @@ func (db DB) LogRequests(
 		outputTokenCount,
 		credits,
 		eventID,
+		apiKeyID,
 	).Error
 	if err1 != nil {
 		panic(err1)
@@ -110,10 +96,11 @@ func (db DB) LogRequestsCredits(
 	inputTokenCount int,
 	outputTokenCount int,
 	kind Kind,
+	apiKeyID string,
 ) {
 	err1 := db.RemoveCreditsFromDev(userID, credits)
 	err2 := db.sql.Exec(
-		"INSERT INTO request_logs (user_id, model_name, kind, input_token_count, output_token_count, credits, event_id) VALUES (?::uuid, ?, ?, ?, ?, ?, try_cast_uuid(?))",
+		"INSERT INTO request_logs (user_id, model_name, kind, input_token_count, output_token_count, credits, event_id, api_key_id) VALUES (?::uuid, ?, ?, ?, ?, ?, try_cast_uuid(?), NULLIF(?, ''))",
 		userID,
 		modelName,
 		kind,
@@ -121,6 +108,7 @@ func (db DB) LogRequestsCredits(
 		outputTokenCount,
 		credits,
 		eventID,
+		apiKeyID,
 	).Error
 	if err1 != nil {
 		panic(err1)
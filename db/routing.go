@@ -0,0 +1,47 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+)
+
+/*
+ * The rules of the "auto" model of a project (the routing_rules column of
+ * projects), the missing fields keep their default value.
+ */
+type RoutingRules struct {
+	// The models "auto" can pick, from the cheapest to the most capable
+	Candidates []string `json:"candidates,omitempty"`
+
+	// A prompt of this many tokens is sent to the most capable model
+	ComplexPromptTokens int `json:"complex_prompt_tokens,omitempty"`
+
+	// The cheapest model is picked when the remaining credits can't pay for this many requests with the most capable one
+	LowBudgetRequests int `json:"low_budget_requests,omitempty"`
+
+	// The models slower than this to send their first token are avoided
+	MaxFirstTokenLatencyMs int `json:"max_first_token_latency_ms,omitempty"`
+}
+
+func (db DB) GetRoutingRules(projectID string) (*RoutingRules, error) {
+	var rules sql.NullString
+
+	err := db.sql.Raw("SELECT routing_rules::text FROM projects WHERE id::text = ?", projectID).Row().Scan(&rules)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !rules.Valid {
+		return nil, nil
+	}
+
+	var result RoutingRules
+	if err := json.Unmarshal([]byte(rules.String), &result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
@@ -42,9 +42,11 @@ type UserInfos struct {
 	OpenaiOrg            string      `json:"openai_org"`
 	ElevenlabsToken      string      `json:"elevenlabs_token"` // Same here, don't change to ElevenLabs
 	ReplicateToken       string      `json:"replicate_token"`
+	AnthropicToken       string      `json:"anthropic_token"`
 	AuthorizedDomains    StringArray `json:"authorized_domains"`
 	ProjectID            string      `json:"project_id"`
 	ProjectUserID        string      `json:"project_user_id"`
+	Moderation           string      `json:"moderation"`
 }
 
 func (db DB) getUserInfos(userID string) (*UserInfos, error) {
@@ -61,6 +63,7 @@ func (db DB) getUserInfos(userID string) (*UserInfos, error) {
 			dev_users.openai_org as openai_org,
 			dev_users.replicate_token as replicate_token,
 			dev_users.elevenlabs_token as elevenlabs_token,
+			dev_users.anthropic_token as anthropic_token,
 			projects.authorized_domains as authorized_domains,
 			CASE
 				WHEN projects.dev_rate_limit IS false AND projects.auth_id::text = project_users.auth_id
@@ -71,7 +74,8 @@ func (db DB) getUserInfos(userID string) (*UserInfos, error) {
 			END as project_user_rate_limit,
 			get_monthly_credit_usage(project_users.id::text) as project_user_usage,
 			projects.id as project_id,
-			project_users.id as project_user_id
+			project_users.id as project_user_id,
+			projects.moderation::text as moderation
 		FROM project_users
 		JOIN projects ON project_users.project_id = projects.id
 		JOIN auth_users as dev_users ON dev_users.id::text = projects.auth_id::text
@@ -99,6 +103,24 @@ func (db DB) CheckDBVersionRateLimit(userID string, version int) (*UserInfos, Ra
 		return nil, RateLimitStatusNone, CreditsStatusNone, ErrDBVersionMismatch
 	}
 
+	return userInfos.rateLimitStatuses()
+}
+
+// Same as CheckDBVersionRateLimit for the work done outside of a request (without a token to check)
+func (db DB) CheckRateLimit(userID string) (*UserInfos, RateLimitStatus, CreditsStatus, error) {
+	userInfos, err := db.getUserInfos(userID)
+	if err != nil {
+		return nil, RateLimitStatusNone, CreditsStatusNone, err
+	}
+
+	if userInfos == nil {
+		return nil, RateLimitStatusNone, CreditsStatusNone, ErrUnknownUserID
+	}
+
+	return userInfos.rateLimitStatuses()
+}
+
+func (userInfos *UserInfos) rateLimitStatuses() (*UserInfos, RateLimitStatus, CreditsStatus, error) {
 	rateLimitStatus := RateLimitStatusOk
 	if userInfos.ProjectUserRateLimit != nil && userInfos.ProjectUserUsage >= *userInfos.ProjectUserRateLimit {
 		rateLimitStatus = RateLimitStatusReached
@@ -10,19 +10,19 @@ require (
 	github.com/deepgram-devs/deepgram-go-sdk v0.15.0
 	github.com/gocolly/colly/v2 v2.1.0
 	github.com/golang-jwt/jwt/v5 v5.0.0
+	github.com/google/go-querystring v1.1.0
 	github.com/google/uuid v1.6.0
 	github.com/gorilla/websocket v1.5.0
 	github.com/haguro/elevenlabs-go v0.2.2
 	github.com/hashicorp/logutils v1.0.0
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/nedpals/supabase-go v0.3.0
-	github.com/pkoukk/tiktoken-go v0.1.6
+	github.com/pkoukk/tiktoken-go v0.1.7
 	github.com/pkoukk/tiktoken-go-loader v0.0.1
 	github.com/posthog/posthog-go v0.0.0-20230801140217-d607812dee69
 	github.com/rakyll/openai-go v1.0.9
-	github.com/sashabaranov/go-openai v1.17.9
+	github.com/sashabaranov/go-openai v1.24.0
 	github.com/supabase/postgrest-go v0.0.7
-	github.com/tmc/langchaingo v0.0.0-20230802030916-271e9bd7e7c5
 	google.golang.org/protobuf v1.33.0
 	gorm.io/driver/postgres v1.5.2
 	gorm.io/gorm v1.25.4
@@ -48,7 +48,6 @@ require (
 	github.com/gobwas/glob v0.2.3 // indirect
 	github.com/golang/groupcache v0.0.0-20210331224755-41bb18bfe9da // indirect
 	github.com/golang/protobuf v1.5.3 // indirect
-	github.com/google/go-querystring v1.1.0 // indirect
 	github.com/google/s2a-go v0.1.7 // indirect
 	github.com/googleapis/enterprise-certificate-proxy v0.3.2 // indirect
 	github.com/googleapis/gax-go/v2 v2.12.0 // indirect
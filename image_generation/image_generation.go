@@ -40,6 +40,7 @@ func storeImageBucket(reader io.Reader, path string) (string, error) {
 func ImageGeneration(w http.ResponseWriter, r *http.Request, _ router.Params) {
 	db := r.Context().Value(utils.ContextKeyDB).(database.Database)
 	userID := r.Context().Value(utils.ContextKeyUserID).(string)
+	projectID, _ := r.Context().Value(utils.ContextKeyProjectID).(string)
 	request, _ := json.Marshal(r.URL.Query())
 	prompt := r.URL.Query().Get("p")
 	model := r.URL.Query().Get("model")
@@ -75,7 +76,7 @@ func ImageGeneration(w http.ResponseWriter, r *http.Request, _ router.Params) {
 
 	db.LogRequests(
 		r.Context().Value(utils.ContextKeyEventID).(string),
-		userID, "openai", model, 0, 0, "image", true)
+		userID, projectID, "openai", model, 0, 0, "image", true, utils.APIKeyID(r.Context(), "openai"))
 
 	if err != nil {
 		utils.RespondError(w, record, "image_generation_error")
@@ -2,45 +2,95 @@ package llm
 
 import (
 	"context"
-	"fmt"
+	"errors"
+	"log"
 
+	database "github.com/polyfire/api/db"
 	providers "github.com/polyfire/api/llm/providers"
-	llmTokens "github.com/polyfire/api/tokens"
-	goOpenai "github.com/sashabaranov/go-openai"
-
 	"github.com/polyfire/api/utils"
 )
 
-func Embed(ctx context.Context, contents []string, c *func(string, int)) ([][]float32, error) {
-	userID := ctx.Value(utils.ContextKeyUserID).(string)
+// The model of the memories created before the embedding models could be chosen
+const DefaultEmbeddingModel = "text-embedding-ada-002"
+
+var ErrUnknownEmbeddingModel = errors.New("Unknown embedding model")
 
-	client := providers.NewOpenAIStreamProvider(ctx, fmt.Sprint(goOpenai.AdaEmbeddingV2)).Client
+/*
+ * An Embedder turns texts into vectors of Dimensions() floats. The vectors of
+ * two embedders can't be compared, even with the same dimension, so a memory
+ * keeps the model it was built with.
+ */
+type Embedder interface {
+	ProviderModel() (string, string)
+	Dimensions() int
+	Embed(
+		ctx context.Context,
+		contents []string,
+		inputType providers.EmbeddingInputType,
+	) ([][]float32, int, error)
+}
 
-	embeddingCtx := context.Background()
-	res, err := client.CreateEmbeddings(embeddingCtx, goOpenai.EmbeddingRequestStrings{
-		Input: contents,
-		Model: goOpenai.AdaEmbeddingV2,
-		User:  userID,
-	})
+func NewEmbedder(ctx context.Context, modelName string) (Embedder, error) {
+	if MockProviderEnabled && modelName == "mock" {
+		return providers.MockEmbedder{}, nil
+	}
+
+	projectID, _ := ctx.Value(utils.ContextKeyProjectID).(string)
+	db := ctx.Value(utils.ContextKeyDB).(database.Database)
+
+	catalog, err := db.GetCatalog()
 	if err != nil {
 		return nil, err
 	}
 
-	var embeddings [][]float32
+	if modelName == "" {
+		modelName = DefaultEmbeddingModel
+	}
 
-	for _, embed := range res.Data {
-		embeddings = append(embeddings, embed.Embedding)
+	model := catalog.Resolve(modelName, projectID, "embedding")
+	if model == nil {
+		return nil, ErrUnknownEmbeddingModel
 	}
 
-	model := "text-embedding-ada-002"
+	switch model.Provider {
+	case "openai":
+		return providers.NewOpenAIEmbedder(ctx, *model), nil
+	case "openai-compatible":
+		if model.BaseURL == nil || utils.ValidatePublicURL(ctx, *model.BaseURL) != nil {
+			return nil, ErrUnknownEmbeddingModel
+		}
+		return providers.NewOpenAICompatibleEmbedder(ctx, *model), nil
+	case "cohere":
+		return providers.NewCohereEmbedder(ctx, *model), nil
+	default:
+		return nil, ErrUnknownEmbeddingModel
+	}
+}
+
+/*
+ * Embeds the contents with the embedder and logs the request, the callback
+ * receives the provider, the model and the input token count.
+ */
+func Embed(
+	ctx context.Context,
+	embedder Embedder,
+	contents []string,
+	inputType providers.EmbeddingInputType,
+	c *func(string, string, int),
+) ([][]float32, error) {
+	embeddings, tokenUsage, err := embedder.Embed(ctx, contents, inputType)
+	if err != nil {
+		return nil, err
+	}
 
-	tokenUsage := 0
-	for _, content := range contents {
-		tokenUsage += llmTokens.CountTokens(content)
+	if len(embeddings) != len(contents) {
+		log.Printf("[ERROR] %d embeddings returned for %d contents\n", len(embeddings), len(contents))
+		return nil, providers.ErrEmbedding
 	}
 
 	if c != nil {
-		(*c)(model, tokenUsage)
+		provider, model := embedder.ProviderModel()
+		(*c)(provider, model, tokenUsage)
 	}
 
 	return embeddings, nil
@@ -0,0 +1,245 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	database "github.com/polyfire/api/db"
+	"github.com/polyfire/api/llm/providers/options"
+)
+
+// A provider that didn't send anything after this delay is considered down.
+// The last provider of a chain has no other choice than to be waited for.
+var FallbackFirstTokenTimeout = 30 * time.Second
+
+// The cause of the cancellation of a provider given up on, it's a failure of the provider and not an abort
+var ErrFirstTokenTimeout = errors.New("No first token before the timeout")
+
+type providerCall struct {
+	providerName string
+	modelName    string
+	inputCount   int
+	outputCount  int
+	completion   string
+	credits      *int
+}
+
+type FallbackProvider struct {
+	Providers []Provider
+	answered  Provider
+}
+
+/*
+ * Some aliases resolve to an ordered list of models (see Catalog.ResolveChain).
+ * If a model fails before sending its first token, the next one is tried
+ * without the user noticing.
+ */
+func newFallbackProvider(ctx context.Context, chain []*database.Model) (Provider, error) {
+	fallbackProvider := FallbackProvider{}
+	unavailable := false
+
+	for _, model := range chain {
+		provider, err := newModelProvider(ctx, *model)
+		if err != nil {
+			log.Printf("[WARNING] Skipping %s in fallback chain: %v\n", model.Model, err)
+			unavailable = unavailable || errors.Is(err, ErrProviderUnavailable)
+			continue
+		}
+		fallbackProvider.Providers = append(fallbackProvider.Providers, provider)
+	}
+
+	if len(fallbackProvider.Providers) == 0 && unavailable {
+		return nil, ErrProviderUnavailable
+	} else if len(fallbackProvider.Providers) == 0 {
+		return nil, ErrUnknownModel
+	}
+
+	return &fallbackProvider, nil
+}
+
+func (m *FallbackProvider) current() Provider {
+	if m.answered != nil {
+		return m.answered
+	}
+	return m.Providers[0]
+}
+
+/*
+ * Waits for the first result with some content. The empty results received
+ * before it are returned too so they can be forwarded if the provider succeeds.
+ */
+func waitFirstResult(resChan chan options.Result, timeout <-chan time.Time) ([]options.Result, bool) {
+	pending := []options.Result{}
+
+	for {
+		select {
+		case res, ok := <-resChan:
+			if !ok {
+				return pending, true
+			}
+			if res.Err != "" {
+				return append(pending, res), false
+			}
+			pending = append(pending, res)
+			if res.Result != "" || len(res.ToolCalls) > 0 {
+				return pending, true
+			}
+		case <-timeout:
+			return pending, false
+		}
+	}
+}
+
+func canHandle(provider Provider, messages []options.Message, opts *options.ProviderOptions) bool {
+	if opts != nil && len(opts.Tools) > 0 && !SupportsTools(provider) {
+		return false
+	}
+
+	for _, message := range messages {
+		if len(message.Images) > 0 && !SupportsVision(provider) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (m *FallbackProvider) Generate(
+	ctx context.Context,
+	messages []options.Message,
+	c options.ProviderCallback,
+	opts *options.ProviderOptions,
+) chan options.Result {
+	chanRes := make(chan options.Result)
+
+	go func() {
+		defer close(chanRes)
+		lastErr := "generation_error"
+
+		providers := []Provider{}
+		for _, provider := range m.Providers {
+			if canHandle(provider, messages, opts) {
+				providers = append(providers, provider)
+			}
+		}
+
+		for i, provider := range providers {
+			// The callbacks of the providers that failed are dropped so only the one answering is billed
+			var call *providerCall
+			callback := func(providerName string, modelName string, inputCount int, outputCount int, completion string, credits *int) {
+				call = &providerCall{providerName, modelName, inputCount, outputCount, completion, credits}
+			}
+
+			// A provider given up on is stopped so it doesn't keep generating upstream
+			attemptCtx, cancel := context.WithCancelCause(ctx)
+
+			resChan := provider.Generate(attemptCtx, messages, &callback, opts)
+			if resChan == nil {
+				cancel(nil)
+				continue
+			}
+
+			var timeout <-chan time.Time
+			if i < len(providers)-1 {
+				timeout = time.After(FallbackFirstTokenTimeout)
+			}
+
+			pending, ok := waitFirstResult(resChan, timeout)
+			if !ok {
+				_, modelName := provider.ProviderModel()
+				log.Printf("[WARNING] %s failed before its first token, trying the next provider\n", modelName)
+				if len(pending) > 0 && pending[len(pending)-1].Err != "" {
+					lastErr = pending[len(pending)-1].Err
+					cancel(nil)
+				} else {
+					cancel(ErrFirstTokenTimeout)
+				}
+				go func() {
+					for range resChan {
+					}
+				}()
+				continue
+			}
+
+			m.answered = provider
+
+			for _, res := range pending {
+				chanRes <- res
+			}
+			for res := range resChan {
+				chanRes <- res
+			}
+			cancel(nil)
+
+			if call != nil && c != nil {
+				(*c)(call.providerName, call.modelName, call.inputCount, call.outputCount, call.completion, call.credits)
+			}
+			return
+		}
+
+		chanRes <- options.Result{Err: lastErr}
+	}()
+
+	return chanRes
+}
+
+// The providers a generation can be answered by, the whole chain for a FallbackProvider
+func Candidates(provider Provider) []Provider {
+	if fallbackProvider, ok := provider.(*FallbackProvider); ok {
+		return fallbackProvider.Providers
+	}
+	return []Provider{provider}
+}
+
+func (m *FallbackProvider) Name() string {
+	return m.current().Name()
+}
+
+// Before the generation, it returns the primary model. After, the one that answered.
+func (m *FallbackProvider) ProviderModel() (string, string) {
+	return m.current().ProviderModel()
+}
+
+// The providers without the capabilities a request needs are skipped (see canHandle)
+func (m *FallbackProvider) SupportsTools() bool {
+	for _, provider := range m.Providers {
+		if SupportsTools(provider) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *FallbackProvider) SupportsVision() bool {
+	for _, provider := range m.Providers {
+		if SupportsVision(provider) {
+			return true
+		}
+	}
+	return false
+}
+
+// The schema instructions are only left out of the prompt when every model of the chain is native
+func (m *FallbackProvider) SupportsJSONSchema() bool {
+	for _, provider := range m.Providers {
+		if !SupportsJSONSchema(provider) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *FallbackProvider) DoesFollowRateLimit() bool {
+	if m.answered != nil {
+		return m.answered.DoesFollowRateLimit()
+	}
+
+	for _, provider := range m.Providers {
+		if provider.DoesFollowRateLimit() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package llm
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/polyfire/api/llm/providers/options"
+)
+
+type fakeProvider struct {
+	model   string
+	results []options.Result
+}
+
+func (m fakeProvider) Generate(
+	_ context.Context,
+	_ []options.Message,
+	c options.ProviderCallback,
+	_ *options.ProviderOptions,
+) chan options.Result {
+	chanRes := make(chan options.Result)
+
+	go func() {
+		defer close(chanRes)
+		for _, res := range m.results {
+			chanRes <- res
+		}
+		if c != nil {
+			(*c)("fake", m.model, 1, 1, "", nil)
+		}
+	}()
+
+	return chanRes
+}
+
+func (m fakeProvider) Name() string                    { return "fake" }
+func (m fakeProvider) ProviderModel() (string, string) { return "fake", m.model }
+func (m fakeProvider) DoesFollowRateLimit() bool       { return true }
+
+func TestFallbackProvider(t *testing.T) {
+	provider := &FallbackProvider{Providers: []Provider{
+		fakeProvider{model: "down", results: []options.Result{{Result: ""}, {Err: "generation_error"}}},
+		fakeProvider{model: "up", results: []options.Result{{Result: "Test"}, {Result: " response"}}},
+	}}
+
+	billedModels := []string{}
+	callback := func(_ string, model string, _ int, _ int, _ string, _ *int) {
+		billedModels = append(billedModels, model)
+	}
+
+	str := ""
+	for v := range provider.Generate(context.Background(), nil, &callback, nil) {
+		if v.Err != "" {
+			t.Fatalf(`Generate returned an error: %s`, v.Err)
+		}
+		str += v.Result
+	}
+
+	if str != "Test response" {
+		t.Fatalf(`Generate should have returned "Test response" but returned "%s"`, str)
+	}
+
+	if _, model := provider.ProviderModel(); model != "up" {
+		t.Fatalf(`ProviderModel should report the model that answered but returned "%s"`, model)
+	}
+
+	if len(billedModels) != 1 || billedModels[0] != "up" {
+		t.Fatalf(`Only the model that answered should be billed but got %v`, billedModels)
+	}
+}
+
+func TestFallbackProviderAllFailing(t *testing.T) {
+	provider := &FallbackProvider{Providers: []Provider{
+		fakeProvider{model: "down", results: []options.Result{{Err: "generation_error"}}},
+		fakeProvider{model: "invalid", results: []options.Result{{Err: "openai_invalid_api_key"}}},
+	}}
+
+	errorCode := ""
+	for v := range provider.Generate(context.Background(), nil, nil, nil) {
+		errorCode = v.Err
+	}
+
+	if errorCode != "openai_invalid_api_key" {
+		t.Fatalf(`Generate should return the last error but returned "%s"`, errorCode)
+	}
+}
+
+// Doesn't answer until its context is canceled
+type hangingProvider struct {
+	fakeProvider
+	canceled chan struct{}
+}
+
+func (m hangingProvider) Generate(
+	ctx context.Context,
+	_ []options.Message,
+	_ options.ProviderCallback,
+	_ *options.ProviderOptions,
+) chan options.Result {
+	chanRes := make(chan options.Result)
+
+	go func() {
+		defer close(chanRes)
+		<-ctx.Done()
+		close(m.canceled)
+	}()
+
+	return chanRes
+}
+
+func TestFallbackProviderCancelsTimedOut(t *testing.T) {
+	FallbackFirstTokenTimeout = 10 * time.Millisecond
+	defer func() { FallbackFirstTokenTimeout = 30 * time.Second }()
+
+	hanging := hangingProvider{fakeProvider: fakeProvider{model: "slow"}, canceled: make(chan struct{})}
+	provider := &FallbackProvider{Providers: []Provider{
+		hanging,
+		fakeProvider{model: "up", results: []options.Result{{Result: "Test"}}},
+	}}
+
+	for range provider.Generate(context.Background(), nil, nil, nil) {
+	}
+
+	select {
+	case <-hanging.canceled:
+	case <-time.After(time.Second):
+		t.Fatalf("The provider that timed out should have been canceled")
+	}
+}
@@ -0,0 +1,384 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/polyfire/api/llm/providers/options"
+)
+
+/*
+ * The error rate and the latency of each provider/model are tracked in memory
+ * from the outcome of its generations. When a model keeps failing, its circuit
+ * opens and NewProvider refuses it with ErrProviderUnavailable (a fallback
+ * chain skips it) instead of waiting for it to fail again. After
+ * CircuitOpenDuration the circuit is half-open: a single probe request goes
+ * through, its success closes the circuit and its failure reopens it.
+ */
+
+var ErrProviderUnavailable = errors.New("Provider unavailable")
+
+type CircuitState string
+
+const (
+	CircuitClosed   CircuitState = "closed"
+	CircuitOpen     CircuitState = "open"
+	CircuitHalfOpen CircuitState = "half_open"
+)
+
+func envInt(name string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return defaultValue
+	}
+	return value
+}
+
+var (
+	// The circuit opens after CircuitFailureThreshold failures in a row...
+	CircuitFailureThreshold = envInt("CIRCUIT_FAILURE_THRESHOLD", 5)
+	// ...or when half of the last CircuitWindow requests failed
+	CircuitWindow       = envInt("CIRCUIT_WINDOW", 20)
+	CircuitErrorRate    = 0.5
+	CircuitOpenDuration = time.Duration(envInt("CIRCUIT_OPEN_SECONDS", 30)) * time.Second
+)
+
+/*
+ * The errors caused by the request or the user's own key say nothing about the
+ * provider, the circuit is shared by all the users. Only the server errors,
+ * the timeouts and the rate limits of the keys of the pool are counted.
+ */
+var requestErrors = map[string]bool{
+	"generation_invalid_request":    true,
+	"openai_invalid_api_key":        true,
+	"anthropic_invalid_api_key":     true,
+	"json_format_must_mention_json": true,
+	"llama_invalid_request":         true,
+	"provider_unavailable":          true,
+}
+
+// The latencies are exponential moving averages
+const latencySmoothing = 0.2
+
+type providerHealth struct {
+	provider string
+	model    string
+
+	outcomes            []bool // The last CircuitWindow outcomes, true for a failure
+	consecutiveFailures int
+	requests            int
+	failures            int
+
+	firstTokenLatency time.Duration
+	latency           time.Duration
+
+	state          CircuitState
+	openedAt       time.Time
+	probing        bool
+	probeStartedAt time.Time
+
+	lastError   string
+	lastErrorAt time.Time
+}
+
+type ProviderStatus struct {
+	Provider            string       `json:"provider"`
+	Model               string       `json:"model"`
+	State               CircuitState `json:"state"`
+	Requests            int          `json:"requests"`
+	Failures            int          `json:"failures"`
+	ErrorRate           float64      `json:"error_rate"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	FirstTokenLatencyMs int64        `json:"first_token_latency_ms"`
+	LatencyMs           int64        `json:"latency_ms"`
+	LastError           string       `json:"last_error,omitempty"`
+	LastErrorAt         *time.Time   `json:"last_error_at,omitempty"`
+	OpenedAt            *time.Time   `json:"opened_at,omitempty"`
+}
+
+var (
+	healthMutex sync.Mutex
+	health      = map[string]*providerHealth{}
+)
+
+// Must be called with healthMutex locked
+func getHealth(providerName string, modelName string) *providerHealth {
+	key := providerName + "/" + modelName
+	h, ok := health[key]
+	if !ok {
+		h = &providerHealth{provider: providerName, model: modelName, state: CircuitClosed}
+		health[key] = h
+	}
+	return h
+}
+
+func (h *providerHealth) errorRate() float64 {
+	if len(h.outcomes) == 0 {
+		return 0
+	}
+
+	failures := 0
+	for _, failed := range h.outcomes {
+		if failed {
+			failures++
+		}
+	}
+	return float64(failures) / float64(len(h.outcomes))
+}
+
+func (h *providerHealth) open(now time.Time) {
+	if h.state != CircuitOpen {
+		log.Printf("[WARNING] Opening the circuit of %s/%s\n", h.provider, h.model)
+	}
+	h.state = CircuitOpen
+	h.openedAt = now
+}
+
+func (h *providerHealth) close() {
+	if h.state != CircuitClosed {
+		log.Printf("[INFO] Closing the circuit of %s/%s\n", h.provider, h.model)
+	}
+	h.state = CircuitClosed
+	h.consecutiveFailures = 0
+	h.outcomes = nil
+}
+
+// Whether a provider can be used. An open circuit becomes half-open once CircuitOpenDuration is over.
+func circuitAllows(providerName string, modelName string) bool {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+
+	h := getHealth(providerName, modelName)
+	if h.state == CircuitOpen {
+		if time.Since(h.openedAt) < CircuitOpenDuration {
+			return false
+		}
+		h.state = CircuitHalfOpen
+	}
+
+	return true
+}
+
+/*
+ * Called when a generation starts. In the half-open state only one probe
+ * can be in flight, a probe that never reported back is replaced after
+ * CircuitOpenDuration.
+ */
+func acquireCircuit(providerName string, modelName string) (probe bool, ok bool) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+
+	h := getHealth(providerName, modelName)
+	switch h.state {
+	case CircuitOpen:
+		return false, false
+	case CircuitHalfOpen:
+		if h.probing && time.Since(h.probeStartedAt) < CircuitOpenDuration {
+			return false, false
+		}
+		h.probing = true
+		h.probeStartedAt = time.Now()
+		return true, true
+	default:
+		return false, true
+	}
+}
+
+type generationOutcome struct {
+	errorCode         string
+	aborted           bool
+	customKey         bool // The errors of a user's own key are the user's
+	firstTokenLatency time.Duration
+	latency           time.Duration
+}
+
+func recordOutcome(providerName string, modelName string, probe bool, outcome generationOutcome) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+
+	h := getHealth(providerName, modelName)
+	now := time.Now()
+
+	if probe {
+		h.probing = false
+	}
+
+	// A request canceled by the user before its end doesn't tell anything
+	if outcome.aborted || requestErrors[outcome.errorCode] || (outcome.customKey && outcome.errorCode != "") {
+		return
+	}
+
+	failed := outcome.errorCode != ""
+
+	h.requests++
+	h.outcomes = append(h.outcomes, failed)
+	if len(h.outcomes) > CircuitWindow {
+		h.outcomes = h.outcomes[len(h.outcomes)-CircuitWindow:]
+	}
+
+	if failed {
+		h.failures++
+		h.consecutiveFailures++
+		h.lastError = outcome.errorCode
+		h.lastErrorAt = now
+	} else {
+		h.consecutiveFailures = 0
+
+		if outcome.firstTokenLatency > 0 {
+			if h.firstTokenLatency == 0 {
+				h.firstTokenLatency = outcome.firstTokenLatency
+			} else {
+				h.firstTokenLatency += time.Duration(latencySmoothing * float64(outcome.firstTokenLatency-h.firstTokenLatency))
+			}
+		}
+		if h.latency == 0 {
+			h.latency = outcome.latency
+		} else {
+			h.latency += time.Duration(latencySmoothing * float64(outcome.latency-h.latency))
+		}
+	}
+
+	switch {
+	case probe && failed:
+		h.open(now)
+	case probe:
+		h.close()
+	case h.state == CircuitClosed && failed:
+		windowFull := len(h.outcomes) >= CircuitWindow
+		if h.consecutiveFailures >= CircuitFailureThreshold || (windowFull && h.errorRate() >= CircuitErrorRate) {
+			h.open(now)
+		}
+	}
+}
+
+// The live state of every provider/model used since the server started
+func ProvidersStatus() []ProviderStatus {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+
+	statuses := make([]ProviderStatus, 0, len(health))
+	for _, h := range health {
+		state := h.state
+		if state == CircuitOpen && time.Since(h.openedAt) >= CircuitOpenDuration {
+			state = CircuitHalfOpen
+		}
+
+		status := ProviderStatus{
+			Provider:            h.provider,
+			Model:               h.model,
+			State:               state,
+			Requests:            h.requests,
+			Failures:            h.failures,
+			ErrorRate:           h.errorRate(),
+			ConsecutiveFailures: h.consecutiveFailures,
+			FirstTokenLatencyMs: h.firstTokenLatency.Milliseconds(),
+			LatencyMs:           h.latency.Milliseconds(),
+			LastError:           h.lastError,
+		}
+		if !h.lastErrorAt.IsZero() {
+			lastErrorAt := h.lastErrorAt
+			status.LastErrorAt = &lastErrorAt
+		}
+		if state != CircuitClosed {
+			openedAt := h.openedAt
+			status.OpenedAt = &openedAt
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Provider != statuses[j].Provider {
+			return statuses[i].Provider < statuses[j].Provider
+		}
+		return statuses[i].Model < statuses[j].Model
+	})
+
+	return statuses
+}
+
+// Forgets every tracked provider, used by the tests
+func ResetProvidersHealth() {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+
+	health = map[string]*providerHealth{}
+}
+
+// Wraps a provider to report the outcome of its generations
+type trackedProvider struct {
+	Provider
+}
+
+func (m trackedProvider) Generate(
+	ctx context.Context,
+	messages []options.Message,
+	c options.ProviderCallback,
+	opts *options.ProviderOptions,
+) chan options.Result {
+	providerName, modelName := m.Provider.ProviderModel()
+
+	probe, ok := acquireCircuit(providerName, modelName)
+	if !ok {
+		chanRes := make(chan options.Result, 1)
+		chanRes <- options.Result{Err: "provider_unavailable"}
+		close(chanRes)
+		return chanRes
+	}
+
+	start := time.Now()
+	resChan := m.Provider.Generate(ctx, messages, c, opts)
+	if resChan == nil {
+		recordOutcome(providerName, modelName, probe, generationOutcome{aborted: true})
+		return nil
+	}
+
+	chanRes := make(chan options.Result)
+
+	go func() {
+		defer close(chanRes)
+		outcome := generationOutcome{customKey: UsesCustomKey(m.Provider)}
+
+		for res := range resChan {
+			if outcome.firstTokenLatency == 0 && (res.Result != "" || len(res.ToolCalls) > 0) {
+				outcome.firstTokenLatency = time.Since(start)
+			}
+			if res.Err != "" {
+				outcome.errorCode = res.Err
+			}
+			chanRes <- res
+		}
+
+		outcome.latency = time.Since(start)
+
+		// Only the cancellation of the request is an abort, a provider timing out in a fallback chain failed
+		if errors.Is(context.Cause(ctx), ErrFirstTokenTimeout) {
+			if outcome.errorCode == "" {
+				outcome.errorCode = "generation_timeout"
+			}
+		} else {
+			outcome.aborted = ctx.Err() != nil
+		}
+		recordOutcome(providerName, modelName, probe, outcome)
+	}()
+
+	return chanRes
+}
+
+func (m trackedProvider) SupportsTools() bool {
+	return SupportsTools(m.Provider)
+}
+
+func (m trackedProvider) SupportsVision() bool {
+	return SupportsVision(m.Provider)
+}
+
+func (m trackedProvider) SupportsJSONSchema() bool {
+	return SupportsJSONSchema(m.Provider)
+}
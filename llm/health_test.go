@@ -0,0 +1,125 @@
+package llm
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/polyfire/api/llm/providers/options"
+)
+
+func drain(resChan chan options.Result) string {
+	errCode := ""
+	for res := range resChan {
+		if res.Err != "" {
+			errCode = res.Err
+		}
+	}
+	return errCode
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	ResetProvidersHealth()
+	defer ResetProvidersHealth()
+
+	openDuration := CircuitOpenDuration
+	CircuitOpenDuration = 50 * time.Millisecond
+	defer func() { CircuitOpenDuration = openDuration }()
+
+	ctx := context.Background()
+	down := trackedProvider{fakeProvider{model: "flaky", results: []options.Result{{Err: "generation_error"}}}}
+	up := trackedProvider{fakeProvider{model: "flaky", results: []options.Result{{Result: "Test"}}}}
+
+	for i := 0; i < CircuitFailureThreshold; i++ {
+		if !circuitAllows("fake", "flaky") {
+			t.Fatalf("The circuit shouldn't be open after %d failures", i)
+		}
+		drain(down.Generate(ctx, nil, nil, nil))
+	}
+
+	if circuitAllows("fake", "flaky") {
+		t.Fatalf("The circuit should be open after %d failures", CircuitFailureThreshold)
+	}
+
+	time.Sleep(CircuitOpenDuration)
+
+	if !circuitAllows("fake", "flaky") {
+		t.Fatalf("The circuit should be half-open after CircuitOpenDuration")
+	}
+
+	// Only one probe can be in flight while the circuit is half-open
+	probe := up.Generate(ctx, nil, nil, nil)
+	if errCode := drain(up.Generate(ctx, nil, nil, nil)); errCode != "provider_unavailable" {
+		t.Fatalf("A second request during the probe should have failed but returned %q", errCode)
+	}
+	drain(probe)
+
+	statuses := ProvidersStatus()
+	if len(statuses) != 1 || statuses[0].State != CircuitClosed || statuses[0].Failures != CircuitFailureThreshold {
+		t.Fatalf("The successful probe should have closed the circuit but the status is %+v", statuses)
+	}
+}
+
+type customKeyProvider struct {
+	fakeProvider
+}
+
+func (m customKeyProvider) UsesCustomKey() bool { return true }
+
+func TestCircuitIgnoresRequestErrors(t *testing.T) {
+	ResetProvidersHealth()
+	defer ResetProvidersHealth()
+
+	ctx := context.Background()
+	invalid := trackedProvider{fakeProvider{model: "model", results: []options.Result{{Err: "generation_invalid_request"}}}}
+	customKey := trackedProvider{customKeyProvider{fakeProvider{model: "model", results: []options.Result{{Err: "generation_error"}}}}}
+
+	for i := 0; i < CircuitFailureThreshold; i++ {
+		drain(invalid.Generate(ctx, nil, nil, nil))
+		drain(customKey.Generate(ctx, nil, nil, nil))
+	}
+
+	if !circuitAllows("fake", "model") {
+		t.Fatalf("The errors of the requests and of the users' own keys shouldn't open the circuit")
+	}
+}
+
+func TestCircuitCountsFallbackTimeouts(t *testing.T) {
+	ResetProvidersHealth()
+	defer ResetProvidersHealth()
+
+	FallbackFirstTokenTimeout = 10 * time.Millisecond
+	defer func() { FallbackFirstTokenTimeout = 30 * time.Second }()
+
+	hanging := hangingProvider{fakeProvider: fakeProvider{model: "slow"}, canceled: make(chan struct{})}
+	provider := &FallbackProvider{Providers: []Provider{
+		trackedProvider{hanging},
+		fakeProvider{model: "up", results: []options.Result{{Result: "Test"}}},
+	}}
+
+	drain(provider.Generate(context.Background(), nil, nil, nil))
+	<-hanging.canceled
+
+	// The outcome is recorded once the provider given up on stops
+	deadline := time.Now().Add(time.Second)
+	for ProvidersStatus()[0].Requests == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	statuses := ProvidersStatus()
+	if len(statuses) != 1 || statuses[0].Failures != 1 {
+		t.Fatalf("The provider that timed out should have been counted as a failure but the status is %+v", statuses)
+	}
+
+	// A request canceled by the user doesn't tell anything about the provider
+	ResetProvidersHealth()
+	ctx, cancel := context.WithCancel(context.Background())
+	aborted := trackedProvider{hangingProvider{fakeProvider: fakeProvider{model: "slow"}, canceled: make(chan struct{})}}
+	resChan := aborted.Generate(ctx, nil, nil, nil)
+	cancel()
+	drain(resChan)
+
+	if statuses := ProvidersStatus(); len(statuses) != 1 || statuses[0].Requests != 0 {
+		t.Fatalf("An aborted request shouldn't have been recorded but the status is %+v", statuses)
+	}
+}
@@ -4,13 +4,12 @@ import (
 	"context"
 	"errors"
 	"log"
+	"os"
 
-	"github.com/polyfire/api/codegen"
 	database "github.com/polyfire/api/db"
 	"github.com/polyfire/api/llm/providers"
 	"github.com/polyfire/api/llm/providers/options"
 	"github.com/polyfire/api/utils"
-	"github.com/tmc/langchaingo/llms/cohere"
 )
 
 var ErrUnknownModel = errors.New("Unknown model")
@@ -19,99 +18,148 @@ type Provider interface {
 	Name() string
 	ProviderModel() (string, string)
 	Generate(
-		prompt string,
+		ctx context.Context,
+		messages []options.Message,
 		c options.ProviderCallback,
 		opts *options.ProviderOptions,
 	) chan options.Result
 	DoesFollowRateLimit() bool
 }
 
-func getAvailableModels(model string) (string, string) {
-	switch model {
-	case "cheap":
-		return "llama", "llama2"
-	case "regular":
-		return "openai", "gpt-3.5-turbo"
-	case "best":
-		return "openai", "gpt-4"
-	case "uncensored":
-		return "replicate", "wizard-mega-13b-awq"
-	case "gpt-3.5-turbo":
-		return "openai", "gpt-3.5-turbo"
-	case "gpt-3.5-turbo-16k":
-		return "openai", "gpt-3.5-turbo"
-	case "gpt-4":
-		return "openai", "gpt-4"
-	case "gpt-4-32k":
-		return "openai", "gpt-4-32k"
-	case "gpt-4o":
-		return "openai", "gpt-4o"
-	case "gpt-4-turbo":
-		return "openai", "gpt-4-turbo"
-	case "cohere":
-		return "cohere", "cohere_command"
-	case "llama-2-70b-chat":
-		return "replicate", "llama-2-70b-chat"
-	case "replit-code-v1-3b":
-		return "replicate", "replit-code-v1-3b"
-	case "wizard-mega-13b-awq":
-		return "replicate", "wizard-mega-13b-awq"
-	case "airoboros-llama-2-70b":
-		return "replicate", "airoboros-llama-2-70b"
-	case "":
-		return "openai", "gpt-3.5-turbo"
-	}
-	if codegen.IsOpenRouterModel(model) {
-		return "openrouter", model
-	}
-	return "", ""
+// Implemented by the providers able to send tool calls back
+type ToolsProvider interface {
+	SupportsTools() bool
+}
+
+func SupportsTools(provider Provider) bool {
+	toolsProvider, ok := provider.(ToolsProvider)
+	return ok && toolsProvider.SupportsTools()
+}
+
+// Implemented by the providers able to take images as input
+type VisionProvider interface {
+	SupportsVision() bool
+}
+
+func SupportsVision(provider Provider) bool {
+	visionProvider, ok := provider.(VisionProvider)
+	return ok && visionProvider.SupportsVision()
+}
+
+// Implemented by the providers producing the structured outputs natively (see options.StructuredOutputTools)
+type JSONSchemaProvider interface {
+	SupportsJSONSchema() bool
+}
+
+func SupportsJSONSchema(provider Provider) bool {
+	jsonSchemaProvider, ok := provider.(JSONSchemaProvider)
+	return ok && jsonSchemaProvider.SupportsJSONSchema()
+}
+
+// Implemented by the providers that can be called with the user's own API key
+type CustomKeyProvider interface {
+	UsesCustomKey() bool
+}
+
+func UsesCustomKey(provider Provider) bool {
+	customKeyProvider, ok := provider.(CustomKeyProvider)
+	return ok && customKeyProvider.UsesCustomKey()
 }
 
-func getModelWithAliases(
-	ctx context.Context,
-	modelAlias string,
-	projectID string,
-) (string, string) {
+// The mock provider answers without any key, it must never be reachable in production
+var MockProviderEnabled = os.Getenv("APP_MODE") == "development"
+
+// Used when a request doesn't ask for a specific model
+const DefaultModel = "gpt-3.5-turbo"
+
+// The models an alias resolves to, more than one for a fallback chain
+func getModels(ctx context.Context, modelAlias string) ([]*database.Model, error) {
+	projectID, _ := ctx.Value(utils.ContextKeyProjectID).(string)
+	log.Println("[INFO] Project ID: ", projectID)
+
 	db := ctx.Value(utils.ContextKeyDB).(database.Database)
-	provider, model := getAvailableModels(modelAlias)
 
-	if model == "" {
-		newModel, err := db.GetModelByAliasAndProjectID(modelAlias, projectID, "completion")
-		if err != nil {
-			return "", ""
-		}
+	catalog, err := db.GetCatalog()
+	if err != nil {
+		return nil, err
+	}
 
-		model = newModel.Model
-		provider = newModel.Provider
+	if modelAlias == "" {
+		modelAlias = DefaultModel
 	}
 
-	return provider, model
+	models := catalog.ResolveChain(modelAlias, projectID, "completion")
+	if len(models) == 0 {
+		return nil, ErrUnknownModel
+	}
+
+	return models, nil
 }
 
+/*
+ * The providers whose circuit is open (see health.go) are refused, the others
+ * report the outcome of their generations.
+ */
 func NewProvider(ctx context.Context, modelInput string) (Provider, error) {
-	projectID, _ := ctx.Value(utils.ContextKeyProjectID).(string)
-	log.Println("[INFO] Project ID: ", projectID)
+	if MockProviderEnabled && providers.IsMockModel(modelInput) {
+		log.Println("[INFO] Using the mock provider")
+		llm, ok := providers.NewMockProvider(modelInput)
+		if !ok {
+			return nil, ErrUnknownModel
+		}
+
+		return track(llm)
+	}
+
+	models, err := getModels(ctx, modelInput)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(models) > 1 {
+		return newFallbackProvider(ctx, models)
+	}
+
+	return newModelProvider(ctx, *models[0])
+}
 
-	provider, model := getModelWithAliases(ctx, modelInput, projectID)
+func newModelProvider(ctx context.Context, model database.Model) (Provider, error) {
+	provider, err := newProvider(ctx, model)
+	if err != nil {
+		return nil, err
+	}
 
-	log.Println("[INFO] Provider: ", provider)
+	return track(provider)
+}
+
+func track(provider Provider) (Provider, error) {
+	providerName, modelName := provider.ProviderModel()
+	if !circuitAllows(providerName, modelName) {
+		log.Printf("[WARNING] The circuit of %s/%s is open\n", providerName, modelName)
+		return nil, ErrProviderUnavailable
+	}
 
-	switch provider {
+	return trackedProvider{provider}, nil
+}
+
+func newProvider(ctx context.Context, model database.Model) (Provider, error) {
+	log.Println("[INFO] Provider: ", model.Provider)
+
+	switch model.Provider {
 	case "openai":
 		log.Println("[INFO] Using OpenAI")
-		llm := providers.NewOpenAIStreamProvider(ctx, model)
+		llm := providers.NewOpenAIStreamProvider(ctx, model.Model)
+		llm.Capabilities = model.Capabilities()
 
 		return llm, nil
 	case "cohere":
 		log.Println("[INFO] Using Cohere")
-		llm, err := cohere.New()
-		if err != nil {
-			return nil, err
-		}
-		return providers.LangchainProvider{Model: llm, ModelName: "cohere_command"}, nil
+		llm := providers.NewCohereProvider(ctx, model)
+
+		return llm, nil
 	case "llama":
 		return providers.LLaMaProvider{
-			Model: model,
+			Model: model.Model,
 		}, nil
 	case "replicate":
 		log.Println("[INFO] Using Replicate")
@@ -119,7 +167,26 @@ func NewProvider(ctx context.Context, modelInput string) (Provider, error) {
 		return llm, nil
 	case "openrouter":
 		log.Println("[INFO] Using OpenRouter")
-		llm := providers.NewOpenRouterProvider(ctx, model)
+		llm := providers.NewOpenRouterProvider(ctx, model.Model)
+		llm.Capabilities = model.Capabilities()
+
+		return llm, nil
+	case "anthropic":
+		log.Println("[INFO] Using Anthropic")
+		llm := providers.NewAnthropicProvider(ctx, model.Model)
+
+		return llm, nil
+	case "openai-compatible":
+		if model.BaseURL == nil {
+			return nil, ErrUnknownModel
+		}
+		if err := utils.ValidatePublicURL(ctx, *model.BaseURL); err != nil {
+			log.Printf("[ERROR] Invalid base_url for the model %s: %v\n", model.Model, err)
+			return nil, ErrUnknownModel
+		}
+
+		log.Println("[INFO] Using OpenAI-compatible endpoint")
+		llm := providers.NewOpenAICompatibleProvider(ctx, model)
 
 		return llm, nil
 	default:
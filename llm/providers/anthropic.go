@@ -0,0 +1,449 @@
+package providers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/polyfire/api/llm/providers/options"
+	tokens "github.com/polyfire/api/tokens"
+	utils "github.com/polyfire/api/utils"
+)
+
+const (
+	AnthropicDefaultBaseURL   = "https://api.anthropic.com/v1"
+	AnthropicAPIVersion       = "2023-06-01"
+	AnthropicDefaultMaxTokens = 4096
+)
+
+type AnthropicProvider struct {
+	Client        *http.Client
+	BaseURL       string
+	APIKey        string
+	Model         string
+	IsCustomToken bool
+}
+
+func NewAnthropicProvider(ctx context.Context, model string) AnthropicProvider {
+	provider := AnthropicProvider{
+		Client:  http.DefaultClient,
+		BaseURL: AnthropicDefaultBaseURL,
+		APIKey:  os.Getenv("ANTHROPIC_API_KEY"),
+		Model:   model,
+	}
+
+	if customToken, ok := ctx.Value(utils.ContextKeyAnthropicToken).(string); ok {
+		provider.APIKey = customToken
+		provider.IsCustomToken = true
+	}
+
+	if client, ok := ctx.Value(utils.ContextKeyHTTPClient).(*http.Client); ok {
+		provider.Client = client
+	}
+
+	if base, ok := ctx.Value(utils.ContextKeyAnthropicBaseURL).(string); ok {
+		provider.BaseURL = base
+	}
+
+	provider.Client = utils.NewRetryClient(provider.Client, "anthropic")
+
+	return provider
+}
+
+type AnthropicContent struct {
+	Type      string          `json:"type"`
+	Text      string          `json:"text,omitempty"`
+	ID        string          `json:"id,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Input     json.RawMessage `json:"input,omitempty"`
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	Content   string          `json:"content,omitempty"`
+}
+
+type AnthropicMessage struct {
+	Role    string             `json:"role"`
+	Content []AnthropicContent `json:"content"`
+}
+
+type AnthropicTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+type AnthropicToolChoice struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+}
+
+type AnthropicRequestBody struct {
+	Model         string               `json:"model"`
+	System        string               `json:"system,omitempty"`
+	Messages      []AnthropicMessage   `json:"messages"`
+	MaxTokens     int                  `json:"max_tokens"`
+	Temperature   *float32             `json:"temperature,omitempty"`
+	TopP          *float32             `json:"top_p,omitempty"`
+	StopSequences []string             `json:"stop_sequences,omitempty"`
+	Tools         []AnthropicTool      `json:"tools,omitempty"`
+	ToolChoice    *AnthropicToolChoice `json:"tool_choice,omitempty"`
+	Stream        bool                 `json:"stream"`
+}
+
+type AnthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type AnthropicError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+type AnthropicEvent struct {
+	Type    string `json:"type"`
+	Index   int    `json:"index"`
+	Message struct {
+		Usage AnthropicUsage `json:"usage"`
+	} `json:"message"`
+	ContentBlock AnthropicContent `json:"content_block"`
+	Delta        struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"`
+	} `json:"delta"`
+	Usage AnthropicUsage  `json:"usage"`
+	Error *AnthropicError `json:"error"`
+}
+
+func toAnthropicContent(message options.Message) []AnthropicContent {
+	content := []AnthropicContent{}
+
+	if message.Role == options.RoleTool {
+		return append(content, AnthropicContent{
+			Type:      "tool_result",
+			ToolUseID: message.ToolCallID,
+			Content:   message.Content,
+		})
+	}
+
+	if message.Content != "" {
+		content = append(content, AnthropicContent{Type: "text", Text: message.Content})
+	}
+
+	for _, toolCall := range message.ToolCalls {
+		input := json.RawMessage(toolCall.Function.Arguments)
+		if !json.Valid(input) {
+			input = json.RawMessage("{}")
+		}
+
+		content = append(content, AnthropicContent{
+			Type:  "tool_use",
+			ID:    toolCall.ID,
+			Name:  toolCall.Function.Name,
+			Input: input,
+		})
+	}
+
+	return content
+}
+
+/*
+ * The messages API takes the system prompt as a separate field and requires
+ * the conversation to alternate between user and assistant, starting with the
+ * user. Consecutive messages with the same role are merged together and the
+ * tool results are sent by the user.
+ */
+func toAnthropicMessages(messages []options.Message) (string, []AnthropicMessage) {
+	systemPrompt := ""
+	result := make([]AnthropicMessage, 0, len(messages))
+
+	for _, message := range messages {
+		if message.Role == options.RoleSystem {
+			systemPrompt += message.Content
+			continue
+		}
+
+		role := "user"
+		if message.Role == options.RoleAssistant {
+			role = "assistant"
+		}
+
+		if len(result) == 0 && role == "assistant" {
+			result = append(result, AnthropicMessage{
+				Role:    "user",
+				Content: []AnthropicContent{{Type: "text", Text: "..."}},
+			})
+		}
+
+		content := toAnthropicContent(message)
+		if len(content) == 0 {
+			continue
+		}
+
+		if len(result) > 0 && result[len(result)-1].Role == role {
+			result[len(result)-1].Content = append(result[len(result)-1].Content, content...)
+			continue
+		}
+
+		result = append(result, AnthropicMessage{Role: role, Content: content})
+	}
+
+	return systemPrompt, result
+}
+
+func toAnthropicTools(tools []options.Tool) []AnthropicTool {
+	result := make([]AnthropicTool, 0, len(tools))
+
+	for _, tool := range tools {
+		inputSchema := tool.Function.Parameters
+		if len(inputSchema) == 0 {
+			inputSchema = json.RawMessage(`{"type":"object","properties":{}}`)
+		}
+
+		result = append(result, AnthropicTool{
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			InputSchema: inputSchema,
+		})
+	}
+
+	return result
+}
+
+func toAnthropicToolChoice(toolChoice *options.ToolChoice) *AnthropicToolChoice {
+	switch {
+	case toolChoice == nil:
+		return nil
+	case toolChoice.Function != "":
+		return &AnthropicToolChoice{Type: "tool", Name: toolChoice.Function}
+	case toolChoice.Mode == options.ToolChoiceRequired:
+		return &AnthropicToolChoice{Type: "any"}
+	default:
+		return &AnthropicToolChoice{Type: "auto"}
+	}
+}
+
+func (m AnthropicProvider) errorCode(statusCode int, body []byte) string {
+	var errorResponse struct {
+		Error AnthropicError `json:"error"`
+	}
+	_ = json.Unmarshal(body, &errorResponse)
+	log.Printf("[ERROR] Anthropic error %d: %v\n", statusCode, errorResponse.Error)
+
+	if (statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden) && m.IsCustomToken {
+		return "anthropic_invalid_api_key"
+	}
+
+	// The other 4xx are caused by the request, and a 429 of the user's own key by its quota
+	if statusCode >= 400 && statusCode < 500 && (statusCode != http.StatusTooManyRequests || m.IsCustomToken) {
+		return "generation_invalid_request"
+	}
+
+	return "generation_error"
+}
+
+func (m AnthropicProvider) Generate(
+	ctx context.Context,
+	messages []options.Message,
+	c options.ProviderCallback,
+	opts *options.ProviderOptions,
+) chan options.Result {
+	chanRes := make(chan options.Result)
+
+	go func() {
+		defer close(chanRes)
+
+		if opts == nil {
+			opts = &options.ProviderOptions{}
+		}
+
+		systemPrompt, anthropicMessages := toAnthropicMessages(messages)
+
+		reqBody := AnthropicRequestBody{
+			Model:       m.Model,
+			System:      systemPrompt,
+			Messages:    anthropicMessages,
+			MaxTokens:   AnthropicDefaultMaxTokens,
+			Temperature: opts.Temperature,
+			TopP:        opts.TopP,
+			Stream:      true,
+		}
+
+		if opts.MaxTokens != nil {
+			reqBody.MaxTokens = *opts.MaxTokens
+		}
+
+		unsupported := opts.Unsupported(options.OptionMaxTokens, options.OptionTopP)
+		if len(unsupported) > 0 {
+			chanRes <- options.UnsupportedOptionsResult("anthropic", unsupported)
+		}
+
+		if opts.StopWords != nil {
+			reqBody.StopSequences = *opts.StopWords
+		}
+
+		structuredOutput := opts.UsesStructuredOutputTool()
+		if structuredOutput {
+			tools, toolChoice := options.StructuredOutputTools(opts.JSONSchema)
+			reqBody.Tools = toAnthropicTools(tools)
+			reqBody.ToolChoice = toAnthropicToolChoice(toolChoice)
+		}
+
+		// Anthropic has no "none" tool choice, not sending the tools has the same effect
+		if len(opts.Tools) > 0 && (opts.ToolChoice == nil || opts.ToolChoice.Mode != options.ToolChoiceNone) {
+			reqBody.Tools = toAnthropicTools(opts.Tools)
+			reqBody.ToolChoice = toAnthropicToolChoice(opts.ToolChoice)
+		}
+
+		input, err := json.Marshal(reqBody)
+		if err != nil {
+			chanRes <- options.Result{Err: "generation_error"}
+			return
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "POST", m.BaseURL+"/messages", bytes.NewReader(input))
+		if err != nil {
+			chanRes <- options.Result{Err: "generation_error"}
+			return
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "text/event-stream")
+		req.Header.Set("X-Api-Key", m.APIKey)
+		req.Header.Set("Anthropic-Version", AnthropicAPIVersion)
+
+		resp, err := m.Client.Do(req)
+		if err != nil {
+			log.Printf("[ERROR] Anthropic request: %v\n", err)
+			chanRes <- options.Result{Err: "generation_error"}
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			chanRes <- options.Result{Err: m.errorCode(resp.StatusCode, body)}
+			return
+		}
+
+		tokenUsage := options.TokenUsage{Input: 0, Output: 0}
+		totalCompletion := ""
+
+		// The content blocks indexes include the text blocks, the tool calls are numbered separately
+		toolCallIndexes := map[int]int{}
+
+		failed := false
+
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	stream:
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data:") {
+				continue
+			}
+
+			var event AnthropicEvent
+			err := json.Unmarshal([]byte(strings.TrimSpace(strings.TrimPrefix(line, "data:"))), &event)
+			if err != nil {
+				continue
+			}
+
+			switch event.Type {
+			case "message_start":
+				tokenUsage.Input = event.Message.Usage.InputTokens
+				tokenUsage.Output = event.Message.Usage.OutputTokens
+			case "content_block_start":
+				if event.ContentBlock.Type != "tool_use" || structuredOutput {
+					continue
+				}
+				toolCallIndexes[event.Index] = len(toolCallIndexes)
+				chanRes <- options.Result{ToolCalls: []options.ToolCall{{
+					Index:    toolCallIndexes[event.Index],
+					ID:       event.ContentBlock.ID,
+					Type:     "function",
+					Function: options.ToolCallFunction{Name: event.ContentBlock.Name},
+				}}}
+			case "content_block_delta":
+				// The arguments of the forced call are the answer
+				if event.Delta.Type == "input_json_delta" && event.Delta.PartialJSON != "" && structuredOutput {
+					totalCompletion += event.Delta.PartialJSON
+					chanRes <- options.Result{Result: event.Delta.PartialJSON}
+					continue
+				}
+				if event.Delta.Type == "input_json_delta" && event.Delta.PartialJSON != "" {
+					chanRes <- options.Result{ToolCalls: []options.ToolCall{{
+						Index:    toolCallIndexes[event.Index],
+						Function: options.ToolCallFunction{Arguments: event.Delta.PartialJSON},
+					}}}
+					continue
+				}
+				if event.Delta.Type != "text_delta" || event.Delta.Text == "" {
+					continue
+				}
+				totalCompletion += event.Delta.Text
+				chanRes <- options.Result{Result: event.Delta.Text}
+			case "message_delta":
+				// The output token count in message_delta is cumulative
+				tokenUsage.Output = event.Usage.OutputTokens
+			case "error":
+				log.Printf("[ERROR] Anthropic stream error: %v\n", event.Error)
+				failed = true
+				break stream
+			}
+		}
+
+		// A line too long for the buffer or a lost connection would cut the completion short
+		if err := scanner.Err(); err != nil && ctx.Err() == nil {
+			log.Printf("[ERROR] Anthropic stream: %v\n", err)
+			failed = true
+		}
+
+		// When the request is aborted or fails, the final usage event never arrives
+		if ctx.Err() != nil || failed {
+			tokenUsage.Output = tokens.GetTokenizer("anthropic", m.Model).CountTokens(totalCompletion)
+		}
+
+		// What was streamed before an error is billed, the error comes last for the consumers that stop on it
+		chanRes <- options.Result{TokenUsage: tokenUsage}
+		if failed {
+			chanRes <- options.Result{Err: "generation_error"}
+		}
+
+		if c != nil {
+			(*c)("anthropic", m.Model, tokenUsage.Input, tokenUsage.Output, totalCompletion, nil)
+		}
+	}()
+
+	return chanRes
+}
+
+func (m AnthropicProvider) Name() string {
+	return "anthropic"
+}
+
+func (m AnthropicProvider) ProviderModel() (string, string) {
+	return "anthropic", m.Model
+}
+
+func (m AnthropicProvider) DoesFollowRateLimit() bool {
+	return !m.IsCustomToken
+}
+
+func (m AnthropicProvider) UsesCustomKey() bool {
+	return m.IsCustomToken
+}
+
+func (m AnthropicProvider) SupportsTools() bool {
+	return true
+}
+
+func (m AnthropicProvider) SupportsJSONSchema() bool {
+	return true
+}
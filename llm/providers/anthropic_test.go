@@ -0,0 +1,90 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/polyfire/api/llm/providers/options"
+	"github.com/polyfire/api/utils"
+)
+
+func TestAnthropicProvider(t *testing.T) {
+	utils.SetLogLevel("WARN")
+	ctx := utils.MockAnthropicServer(context.Background())
+	messages := []options.Message{
+		{Role: options.RoleSystem, Content: "You are a test."},
+		{Role: options.RoleUser, Content: "Test"},
+	}
+	result := NewAnthropicProvider(ctx, "test-model").Generate(ctx, messages, nil, nil)
+
+	str := ""
+	tokenUsage := options.TokenUsage{}
+
+	for v := range result {
+		if v.Err != "" {
+			t.Fatalf(`Generate("Test") returned an error: %s`, v.Err)
+		}
+		str += v.Result
+		tokenUsage.Input += v.TokenUsage.Input
+		tokenUsage.Output += v.TokenUsage.Output
+	}
+
+	if str != "Test response" {
+		t.Fatalf(`Generate("Test") should have returned "Test response" but returned "%s"`, str)
+	}
+
+	if tokenUsage.Input != 12 || tokenUsage.Output != 2 {
+		t.Fatalf(`Generate("Test") should have reported the API usage (12/2) but reported %v`, tokenUsage)
+	}
+}
+
+func TestAnthropicProviderInvalidKey(t *testing.T) {
+	utils.SetLogLevel("WARN")
+	ctx := utils.MockAnthropicServer(context.Background())
+	ctx = context.WithValue(ctx, utils.ContextKeyAnthropicToken, "invalid-key")
+	messages := []options.Message{{Role: options.RoleUser, Content: "Test"}}
+	result := NewAnthropicProvider(ctx, "test-model").Generate(ctx, messages, nil, nil)
+
+	errorCode := ""
+	for v := range result {
+		if v.Err != "" {
+			errorCode = v.Err
+		}
+	}
+
+	if errorCode != "anthropic_invalid_api_key" {
+		t.Fatalf(`Generate with an invalid custom key should return "anthropic_invalid_api_key" but returned "%s"`, errorCode)
+	}
+}
+
+func TestAnthropicProviderStreamError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintln(w, `data: {"type":"message_start","message":{"usage":{"input_tokens":12,"output_tokens":1}}}`)
+		fmt.Fprintln(w, `data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Test response"}}`)
+		fmt.Fprintln(w, `data: {"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`)
+	}))
+	defer server.Close()
+
+	ctx := context.WithValue(context.Background(), utils.ContextKeyAnthropicBaseURL, server.URL)
+	messages := []options.Message{{Role: options.RoleUser, Content: "Test"}}
+
+	billed := false
+	callback := func(_ string, _ string, inputCount int, outputCount int, _ string, _ *int) {
+		billed = inputCount == 12 && outputCount > 0
+	}
+
+	results := []options.Result{}
+	for v := range NewAnthropicProvider(ctx, "test-model").Generate(ctx, messages, &callback, nil) {
+		results = append(results, v)
+	}
+
+	if len(results) == 0 || results[len(results)-1].Err != "generation_error" {
+		t.Fatalf("The stream error should have ended the generation with generation_error but returned %+v", results)
+	}
+	if !billed {
+		t.Fatalf("The completion streamed before the error should have been billed")
+	}
+}
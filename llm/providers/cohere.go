@@ -0,0 +1,285 @@
+package providers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/polyfire/api/db"
+	"github.com/polyfire/api/llm/providers/options"
+	tokens "github.com/polyfire/api/tokens"
+	utils "github.com/polyfire/api/utils"
+)
+
+const (
+	CohereDefaultBaseURL = "https://api.cohere.ai/v1"
+	CohereDefaultModel   = "command"
+)
+
+type CohereProvider struct {
+	Client        *http.Client
+	BaseURL       string
+	APIKey        string
+	Model         string
+	UpstreamModel string
+}
+
+/*
+ * The catalog name of the model (e.g. cohere_command) is logged in
+ * request_logs while its upstream_model, or COHERE_MODEL, is sent to Cohere.
+ */
+func NewCohereProvider(ctx context.Context, model db.Model) CohereProvider {
+	provider := CohereProvider{
+		Client:        http.DefaultClient,
+		BaseURL:       CohereDefaultBaseURL,
+		APIKey:        os.Getenv("COHERE_API_KEY"),
+		Model:         model.Model,
+		UpstreamModel: CohereDefaultModel,
+	}
+
+	if model.UpstreamModel != nil && *model.UpstreamModel != "" {
+		provider.UpstreamModel = *model.UpstreamModel
+	} else if envModel := os.Getenv("COHERE_MODEL"); envModel != "" {
+		provider.UpstreamModel = envModel
+	}
+
+	if base := os.Getenv("COHERE_BASE_URL"); base != "" {
+		provider.BaseURL = base
+	}
+
+	if client, ok := ctx.Value(utils.ContextKeyHTTPClient).(*http.Client); ok {
+		provider.Client = client
+	}
+
+	if base, ok := ctx.Value(utils.ContextKeyCohereBaseURL).(string); ok {
+		provider.BaseURL = base
+	}
+
+	provider.Client = utils.NewRetryClient(provider.Client, "cohere")
+
+	return provider
+}
+
+type CohereMessage struct {
+	Role    string `json:"role"`
+	Message string `json:"message"`
+}
+
+type CohereRequestBody struct {
+	Model            string          `json:"model"`
+	Message          string          `json:"message"`
+	ChatHistory      []CohereMessage `json:"chat_history,omitempty"`
+	Preamble         string          `json:"preamble,omitempty"`
+	Temperature      *float32        `json:"temperature,omitempty"`
+	MaxTokens        *int            `json:"max_tokens,omitempty"`
+	StopSequences    []string        `json:"stop_sequences,omitempty"`
+	P                *float32        `json:"p,omitempty"`
+	Seed             *int            `json:"seed,omitempty"`
+	PresencePenalty  *float32        `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float32        `json:"frequency_penalty,omitempty"`
+	Stream           bool            `json:"stream"`
+}
+
+type CohereUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type CohereEvent struct {
+	EventType    string `json:"event_type"`
+	Text         string `json:"text"`
+	FinishReason string `json:"finish_reason"`
+	Response     struct {
+		Meta struct {
+			BilledUnits CohereUsage `json:"billed_units"`
+		} `json:"meta"`
+	} `json:"response"`
+}
+
+/*
+ * The chat API takes the system prompt as the preamble and the last user
+ * message separately from the history. Cohere has no tool role in this
+ * format, the tool results are sent as user messages.
+ */
+func toCohereMessages(messages []options.Message) (string, []CohereMessage, string) {
+	preamble := ""
+	history := make([]CohereMessage, 0, len(messages))
+
+	for _, message := range messages {
+		switch message.Role {
+		case options.RoleSystem:
+			preamble += message.Content
+		case options.RoleAssistant:
+			history = append(history, CohereMessage{Role: "CHATBOT", Message: message.Content})
+		default:
+			history = append(history, CohereMessage{Role: "USER", Message: message.Content})
+		}
+	}
+
+	if len(history) == 0 || history[len(history)-1].Role != "USER" {
+		return preamble, history, ""
+	}
+
+	return preamble, history[:len(history)-1], history[len(history)-1].Message
+}
+
+func (m CohereProvider) Generate(
+	ctx context.Context,
+	messages []options.Message,
+	c options.ProviderCallback,
+	opts *options.ProviderOptions,
+) chan options.Result {
+	chanRes := make(chan options.Result)
+
+	go func() {
+		defer close(chanRes)
+
+		if opts == nil {
+			opts = &options.ProviderOptions{}
+		}
+
+		reqBody := CohereRequestBody{
+			Model:            m.UpstreamModel,
+			Temperature:      opts.Temperature,
+			MaxTokens:        opts.MaxTokens,
+			P:                opts.TopP,
+			Seed:             opts.Seed,
+			PresencePenalty:  opts.PresencePenalty,
+			FrequencyPenalty: opts.FrequencyPenalty,
+			Stream:           true,
+		}
+
+		if opts.AutoComplete {
+			reqBody.Message = options.FlattenMessages(messages, true)
+		} else {
+			reqBody.Preamble, reqBody.ChatHistory, reqBody.Message = toCohereMessages(messages)
+		}
+
+		if opts.StopWords != nil {
+			reqBody.StopSequences = *opts.StopWords
+		}
+
+		unsupported := opts.Unsupported(
+			options.OptionMaxTokens,
+			options.OptionTopP,
+			options.OptionSeed,
+			options.OptionPresencePenalty,
+			options.OptionFrequencyPenalty,
+		)
+		if len(unsupported) > 0 {
+			chanRes <- options.UnsupportedOptionsResult("cohere", unsupported)
+		}
+
+		input, err := json.Marshal(reqBody)
+		if err != nil {
+			chanRes <- options.Result{Err: "generation_error"}
+			return
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "POST", m.BaseURL+"/chat", bytes.NewReader(input))
+		if err != nil {
+			chanRes <- options.Result{Err: "generation_error"}
+			return
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+m.APIKey)
+
+		resp, err := m.Client.Do(req)
+		if err != nil {
+			fmt.Println(err)
+			chanRes <- options.Result{Err: "generation_error"}
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			fmt.Printf("Cohere error %d: %s\n", resp.StatusCode, string(body))
+			chanRes <- options.Result{Err: "generation_error"}
+			return
+		}
+
+		tokenUsage := options.TokenUsage{Input: 0, Output: 0}
+		totalCompletion := ""
+		ended := false
+		failed := false
+
+		// The stream is a JSON object per line, the stream-end event repeats the whole response
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	stream:
+		for scanner.Scan() {
+			var event CohereEvent
+			err := json.Unmarshal(scanner.Bytes(), &event)
+			if err != nil {
+				continue
+			}
+
+			switch event.EventType {
+			case "text-generation":
+				if event.Text == "" {
+					continue
+				}
+				totalCompletion += event.Text
+				chanRes <- options.Result{Result: event.Text}
+			case "stream-end":
+				if event.FinishReason == "ERROR" || event.FinishReason == "ERROR_TOXIC" {
+					fmt.Printf("Cohere stream error: %s\n", event.FinishReason)
+					failed = true
+					break stream
+				}
+				tokenUsage.Input = event.Response.Meta.BilledUnits.InputTokens
+				tokenUsage.Output = event.Response.Meta.BilledUnits.OutputTokens
+				ended = true
+			}
+		}
+
+		// A line too long for the buffer or a lost connection would look like an aborted request
+		if err := scanner.Err(); err != nil && ctx.Err() == nil {
+			fmt.Printf("Cohere stream error: %v\n", err)
+			failed = true
+		}
+
+		if failed && totalCompletion == "" {
+			chanRes <- options.Result{Err: "generation_error"}
+			return
+		}
+
+		// When the request is aborted or fails, the stream-end event with the usage never arrives
+		if !ended || failed {
+			tokenizer := tokens.GetTokenizer("cohere", m.Model)
+			tokenUsage.Input = tokenizer.CountTokens(options.FlattenMessages(messages, opts.AutoComplete))
+			tokenUsage.Output = tokenizer.CountTokens(totalCompletion)
+		}
+
+		// What was streamed before an error is billed, the error comes last for the consumers that stop on it
+		chanRes <- options.Result{TokenUsage: tokenUsage}
+		if failed {
+			chanRes <- options.Result{Err: "generation_error"}
+		}
+
+		if c != nil {
+			(*c)("cohere", m.Model, tokenUsage.Input, tokenUsage.Output, totalCompletion, nil)
+		}
+	}()
+
+	return chanRes
+}
+
+func (m CohereProvider) Name() string {
+	return "cohere"
+}
+
+func (m CohereProvider) ProviderModel() (string, string) {
+	return "cohere", m.Model
+}
+
+func (m CohereProvider) DoesFollowRateLimit() bool {
+	return true
+}
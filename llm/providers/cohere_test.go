@@ -0,0 +1,131 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/polyfire/api/db"
+	"github.com/polyfire/api/llm/providers/options"
+	"github.com/polyfire/api/utils"
+)
+
+func TestCohereProvider(t *testing.T) {
+	utils.SetLogLevel("WARN")
+	ctx := utils.MockCohereServer(context.Background())
+	messages := []options.Message{
+		{Role: options.RoleSystem, Content: "You are a test."},
+		{Role: options.RoleUser, Content: "Test"},
+	}
+	result := NewCohereProvider(ctx, db.Model{Model: "cohere_command"}).Generate(ctx, messages, nil, nil)
+
+	chunks := 0
+	str := ""
+	tokenUsage := options.TokenUsage{}
+
+	for v := range result {
+		if v.Err != "" {
+			t.Fatalf(`Generate("Test") returned an error: %s`, v.Err)
+		}
+		if v.Result != "" {
+			chunks++
+		}
+		str += v.Result
+		tokenUsage.Input += v.TokenUsage.Input
+		tokenUsage.Output += v.TokenUsage.Output
+	}
+
+	if str != "Test response" || chunks != 2 {
+		t.Fatalf(`Generate("Test") should have streamed "Test response" in 2 chunks but returned "%s" in %d`, str, chunks)
+	}
+
+	if tokenUsage.Input != 7 || tokenUsage.Output != 2 {
+		t.Fatalf(`Generate("Test") should have reported the billed units (7/2) but reported %v`, tokenUsage)
+	}
+}
+
+// The stream-end event repeats the whole response, it can be longer than the default buffer of bufio.Scanner
+func TestCohereProviderLongResponse(t *testing.T) {
+	text := strings.Repeat("a", 100*1024)
+
+	generate := func(text string) (string, string) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			fmt.Fprintf(w, "{\"event_type\":\"text-generation\",\"text\":\"%s\"}\n", text)
+			fmt.Fprintf(
+				w,
+				"{\"event_type\":\"stream-end\",\"finish_reason\":\"COMPLETE\",\"response\":{\"text\":\"%s\"}}\n",
+				text,
+			)
+		}))
+		defer server.Close()
+
+		ctx := context.WithValue(context.Background(), utils.ContextKeyCohereBaseURL, server.URL)
+		messages := []options.Message{{Role: options.RoleUser, Content: "Test"}}
+
+		str := ""
+		for v := range NewCohereProvider(ctx, db.Model{Model: "cohere_command"}).Generate(ctx, messages, nil, nil) {
+			if v.Err != "" {
+				return str, v.Err
+			}
+			str += v.Result
+		}
+		return str, ""
+	}
+
+	if str, err := generate(text); err != "" || str != text {
+		t.Fatalf("The long response should have been streamed but returned %d characters and the error %q", len(str), err)
+	}
+
+	if _, err := generate(strings.Repeat("a", 2*1024*1024)); err != "generation_error" {
+		t.Fatalf("A line longer than the buffer should have returned generation_error but returned %q", err)
+	}
+}
+
+func TestCohereProviderStreamError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintln(w, `{"event_type":"text-generation","text":"Test"}`)
+		fmt.Fprintln(w, `{"event_type":"stream-end","finish_reason":"ERROR","response":{}}`)
+	}))
+	defer server.Close()
+
+	ctx := context.WithValue(context.Background(), utils.ContextKeyCohereBaseURL, server.URL)
+	messages := []options.Message{{Role: options.RoleUser, Content: "Test"}}
+
+	billed := ""
+	callback := func(_ string, _ string, _ int, outputCount int, completion string, _ *int) {
+		if outputCount > 0 {
+			billed = completion
+		}
+	}
+
+	results := []options.Result{}
+	for v := range NewCohereProvider(ctx, db.Model{Model: "cohere_command"}).Generate(ctx, messages, &callback, nil) {
+		results = append(results, v)
+	}
+
+	if len(results) == 0 || results[len(results)-1].Err != "generation_error" {
+		t.Fatalf("The stream error should have been returned last but got %v", results)
+	}
+
+	if billed != "Test" {
+		t.Fatalf("The completion streamed before the error should have been billed but got %q", billed)
+	}
+}
+
+func TestToCohereMessages(t *testing.T) {
+	messages := []options.Message{
+		{Role: options.RoleSystem, Content: "You are a pirate."},
+		{Role: options.RoleUser, Content: "Hello"},
+		{Role: options.RoleAssistant, Content: "Ahoy"},
+		{Role: options.RoleUser, Content: "Who are you?"},
+	}
+
+	preamble, history, message := toCohereMessages(messages)
+
+	if preamble != "You are a pirate." || message != "Who are you?" || len(history) != 2 || history[1].Role != "CHATBOT" {
+		t.Fatalf("toCohereMessages returned %s, %v, %s", preamble, history, message)
+	}
+}
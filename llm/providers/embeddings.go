@@ -0,0 +1,235 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/polyfire/api/db"
+	tokens "github.com/polyfire/api/tokens"
+	goOpenai "github.com/sashabaranov/go-openai"
+)
+
+var ErrEmbedding = errors.New("Embedding error")
+
+// Some models (like Cohere's) embed the searched texts and the stored texts differently
+type EmbeddingInputType string
+
+const (
+	EmbeddingInputDocument EmbeddingInputType = "document"
+	EmbeddingInputQuery    EmbeddingInputType = "query"
+)
+
+// The dimension of the models when the catalog doesn't have it
+var defaultEmbeddingDimensions = map[string]int{
+	"text-embedding-ada-002":        1536,
+	"text-embedding-3-small":        1536,
+	"text-embedding-3-large":        3072,
+	"embed-english-v3.0":            1024,
+	"embed-multilingual-v3.0":       1024,
+	"embed-english-light-v3.0":      384,
+	"embed-multilingual-light-v3.0": 384,
+}
+
+func embeddingDimensions(model db.Model) int {
+	if model.Dimensions != nil {
+		return *model.Dimensions
+	}
+	return defaultEmbeddingDimensions[model.UpstreamID()]
+}
+
+type OpenAIEmbedder struct {
+	Client        goOpenai.Client
+	Provider      string
+	Model         string
+	UpstreamModel string
+	Dims          int
+}
+
+func NewOpenAIEmbedder(ctx context.Context, model db.Model) OpenAIEmbedder {
+	return OpenAIEmbedder{
+		Client:        NewOpenAIStreamProvider(ctx, model.Model).Client,
+		Provider:      "openai",
+		Model:         model.Model,
+		UpstreamModel: model.UpstreamID(),
+		Dims:          embeddingDimensions(model),
+	}
+}
+
+// The local embedding servers (Ollama, LM Studio, vLLM...) registered in the models table
+func NewOpenAICompatibleEmbedder(ctx context.Context, model db.Model) OpenAIEmbedder {
+	return OpenAIEmbedder{
+		Client:        NewOpenAICompatibleProvider(ctx, model).Client,
+		Provider:      "openai-compatible",
+		Model:         model.Model,
+		UpstreamModel: model.UpstreamID(),
+		Dims:          embeddingDimensions(model),
+	}
+}
+
+func (m OpenAIEmbedder) Embed(
+	ctx context.Context,
+	contents []string,
+	_ EmbeddingInputType,
+) ([][]float32, int, error) {
+	request := goOpenai.EmbeddingRequestStrings{
+		Input: contents,
+		Model: goOpenai.EmbeddingModel(m.UpstreamModel),
+	}
+
+	// Only the text-embedding-3 models can be shortened
+	if strings.HasPrefix(m.UpstreamModel, "text-embedding-3") {
+		request.Dimensions = m.Dims
+	}
+
+	res, err := m.Client.CreateEmbeddings(ctx, request)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	embeddings := make([][]float32, len(res.Data))
+	for _, embedding := range res.Data {
+		if embedding.Index < 0 || embedding.Index >= len(embeddings) {
+			return nil, 0, ErrEmbedding
+		}
+		embeddings[embedding.Index] = embedding.Embedding
+	}
+
+	tokenUsage := res.Usage.PromptTokens
+	if tokenUsage == 0 {
+		for _, content := range contents {
+			tokenUsage += tokens.CountTokens(content)
+		}
+	}
+
+	return embeddings, tokenUsage, nil
+}
+
+func (m OpenAIEmbedder) ProviderModel() (string, string) {
+	return m.Provider, m.Model
+}
+
+func (m OpenAIEmbedder) Dimensions() int {
+	return m.Dims
+}
+
+// Cohere embeds at most 96 texts per request
+const CohereEmbedBatchSize = 96
+
+type CohereEmbedder struct {
+	CohereProvider
+	Dims int
+}
+
+func NewCohereEmbedder(ctx context.Context, model db.Model) CohereEmbedder {
+	provider := NewCohereProvider(ctx, model)
+	provider.UpstreamModel = model.UpstreamID()
+
+	return CohereEmbedder{CohereProvider: provider, Dims: embeddingDimensions(model)}
+}
+
+type CohereEmbedRequestBody struct {
+	Texts          []string `json:"texts"`
+	Model          string   `json:"model"`
+	InputType      string   `json:"input_type"`
+	EmbeddingTypes []string `json:"embedding_types"`
+	Truncate       string   `json:"truncate"`
+}
+
+type CohereEmbedResponse struct {
+	Embeddings struct {
+		Float [][]float32 `json:"float"`
+	} `json:"embeddings"`
+	Meta struct {
+		BilledUnits CohereUsage `json:"billed_units"`
+	} `json:"meta"`
+}
+
+func (m CohereEmbedder) embedBatch(
+	ctx context.Context,
+	contents []string,
+	inputType EmbeddingInputType,
+) ([][]float32, int, error) {
+	reqBody := CohereEmbedRequestBody{
+		Texts:          contents,
+		Model:          m.UpstreamModel,
+		InputType:      "search_document",
+		EmbeddingTypes: []string{"float"},
+		Truncate:       "END",
+	}
+	if inputType == EmbeddingInputQuery {
+		reqBody.InputType = "search_query"
+	}
+
+	input, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", m.BaseURL+"/embed", bytes.NewReader(input))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+m.APIKey)
+
+	resp, err := m.Client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		fmt.Printf("Cohere embed error %d: %s\n", resp.StatusCode, string(body))
+		return nil, 0, ErrEmbedding
+	}
+
+	var response CohereEmbedResponse
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response.Embeddings.Float, response.Meta.BilledUnits.InputTokens, nil
+}
+
+func (m CohereEmbedder) Embed(
+	ctx context.Context,
+	contents []string,
+	inputType EmbeddingInputType,
+) ([][]float32, int, error) {
+	embeddings := make([][]float32, 0, len(contents))
+	tokenUsage := 0
+
+	for start := 0; start < len(contents); start += CohereEmbedBatchSize {
+		end := start + CohereEmbedBatchSize
+		if end > len(contents) {
+			end = len(contents)
+		}
+
+		batch, batchTokenUsage, err := m.embedBatch(ctx, contents[start:end], inputType)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		embeddings = append(embeddings, batch...)
+		tokenUsage += batchTokenUsage
+	}
+
+	return embeddings, tokenUsage, nil
+}
+
+func (m CohereEmbedder) ProviderModel() (string, string) {
+	return "cohere", m.Model
+}
+
+func (m CohereEmbedder) Dimensions() int {
+	return m.Dims
+}
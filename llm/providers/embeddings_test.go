@@ -0,0 +1,28 @@
+package providers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/polyfire/api/db"
+	"github.com/polyfire/api/utils"
+)
+
+func TestCohereEmbedder(t *testing.T) {
+	utils.SetLogLevel("WARN")
+	ctx := utils.MockCohereServer(context.Background())
+	embedder := NewCohereEmbedder(ctx, db.Model{Model: "embed-english-v3.0", Provider: "cohere"})
+
+	embeddings, tokenUsage, err := embedder.Embed(ctx, []string{"Test"}, EmbeddingInputQuery)
+	if err != nil {
+		t.Fatalf(`Embed("Test") returned an error: %v`, err)
+	}
+
+	if len(embeddings) != 1 || len(embeddings[0]) != 3 || tokenUsage != 1 {
+		t.Fatalf(`Embed("Test") returned %v with %d tokens`, embeddings, tokenUsage)
+	}
+
+	if embedder.Dimensions() != 1024 {
+		t.Fatalf("embed-english-v3.0 should have 1024 dimensions but has %d", embedder.Dimensions())
+	}
+}
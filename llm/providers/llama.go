@@ -1,6 +1,9 @@
 package providers
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,61 +11,368 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/polyfire/api/llm/providers/options"
 	tokens "github.com/polyfire/api/tokens"
+	utils "github.com/polyfire/api/utils"
 )
 
+var llamaClient = utils.NewRetryClient(http.DefaultClient, "llama")
+
+/*
+ * The request is understood by both the llama.cpp server (/completion) and
+ * Ollama (/api/generate): llama.cpp reads the top level fields and Ollama the
+ * options. The prompt is already formatted so Ollama must not apply its
+ * template (raw).
+ */
 type LLaMaInputBody struct {
 	Prompt      string   `json:"prompt"`
 	Model       string   `json:"model"`
 	Temperature *float32 `json:"temperature"`
+	Stream      bool     `json:"stream"`
+	Raw         bool     `json:"raw"`
+
+	MaxTokens        *int     `json:"max_tokens,omitempty"`
+	NPredict         *int     `json:"n_predict,omitempty"`
+	TopP             *float32 `json:"top_p,omitempty"`
+	PresencePenalty  *float32 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float32 `json:"frequency_penalty,omitempty"`
+	Seed             *int     `json:"seed,omitempty"`
+	Stop             []string `json:"stop,omitempty"`
+
+	Format     string          `json:"format,omitempty"`
+	JSONSchema json.RawMessage `json:"json_schema,omitempty"`
+
+	Options LLaMaOllamaOptions `json:"options"`
+}
+
+type LLaMaOllamaOptions struct {
+	Temperature      *float32 `json:"temperature,omitempty"`
+	NumPredict       *int     `json:"num_predict,omitempty"`
+	TopP             *float32 `json:"top_p,omitempty"`
+	PresencePenalty  *float32 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float32 `json:"frequency_penalty,omitempty"`
+	Seed             *int     `json:"seed,omitempty"`
+	Stop             []string `json:"stop,omitempty"`
+}
+
+func newLLaMaInputBody(model string, prompt string, opts *options.ProviderOptions) LLaMaInputBody {
+	body := LLaMaInputBody{Prompt: prompt, Model: model, Stream: true, Raw: true}
+	if opts == nil {
+		return body
+	}
+
+	body.Temperature = opts.Temperature
+	body.MaxTokens = opts.MaxTokens
+	body.NPredict = opts.MaxTokens
+	body.TopP = opts.TopP
+	body.PresencePenalty = opts.PresencePenalty
+	body.FrequencyPenalty = opts.FrequencyPenalty
+	body.Seed = opts.Seed
+	if opts.StopWords != nil {
+		body.Stop = *opts.StopWords
+	}
+
+	if opts.JSONFormat {
+		body.Format = "json"
+		body.JSONSchema = json.RawMessage(`{"type":"object"}`)
+	}
+
+	body.Options = LLaMaOllamaOptions{
+		Temperature:      body.Temperature,
+		NumPredict:       body.NPredict,
+		TopP:             body.TopP,
+		PresencePenalty:  body.PresencePenalty,
+		FrequencyPenalty: body.FrequencyPenalty,
+		Seed:             body.Seed,
+		Stop:             body.Stop,
+	}
+
+	return body
+}
+
+/*
+ * A chunk of the llama.cpp server stream (SSE, "data: {...}") or of the Ollama
+ * stream (NDJSON). The last chunk has the token counts.
+ */
+type LLaMaStreamChunk struct {
+	Content  string `json:"content"`  // llama.cpp
+	Response string `json:"response"` // Ollama
+	Stop     bool   `json:"stop"`
+	Done     bool   `json:"done"`
+
+	TokensEvaluated int `json:"tokens_evaluated"`
+	TokensPredicted int `json:"tokens_predicted"`
+	PromptEvalCount int `json:"prompt_eval_count"`
+	EvalCount       int `json:"eval_count"`
+
+	Error json.RawMessage `json:"error"`
+}
+
+func (chunk LLaMaStreamChunk) Text() string {
+	return chunk.Content + chunk.Response
+}
+
+func (chunk LLaMaStreamChunk) Usage() (int, int, bool) {
+	if chunk.PromptEvalCount > 0 || chunk.EvalCount > 0 {
+		return chunk.PromptEvalCount, chunk.EvalCount, true
+	}
+	if chunk.TokensEvaluated > 0 || chunk.TokensPredicted > 0 {
+		return chunk.TokensEvaluated, chunk.TokensPredicted, true
+	}
+	return 0, 0, false
+}
+
+// Returns the JSON of a stream line, or nil for the SSE lines without data
+func llamaStreamLine(line []byte) []byte {
+	line = bytes.TrimSpace(line)
+
+	if bytes.HasPrefix(line, []byte("data:")) {
+		line = bytes.TrimSpace(bytes.TrimPrefix(line, []byte("data:")))
+	} else if bytes.HasPrefix(line, []byte("event:")) || bytes.HasPrefix(line, []byte(":")) {
+		return nil
+	}
+
+	if len(line) == 0 || string(line) == "[DONE]" {
+		return nil
+	}
+
+	return line
+}
+
+/*
+ * Splits a plain text stream on the rune boundaries: the bytes of a character
+ * cut by a read are kept until the next one.
+ */
+type utf8Buffer struct {
+	pending []byte
+}
+
+func (b *utf8Buffer) Write(p []byte) string {
+	b.pending = append(b.pending, p...)
+
+	end := len(b.pending)
+	for i := len(b.pending) - 1; i >= 0 && i >= len(b.pending)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b.pending[i]) {
+			if !utf8.FullRune(b.pending[i:]) {
+				end = i
+			}
+			break
+		}
+	}
+
+	text := string(b.pending[:end])
+	b.pending = b.pending[end:]
+	return text
+}
+
+func (b *utf8Buffer) Flush() string {
+	text := string(b.pending)
+	b.pending = nil
+	return text
+}
+
+func llamaErrorCode(statusCode int, body []byte) string {
+	fmt.Printf("LLaMa error %d: %s\n", statusCode, string(body))
+
+	switch statusCode {
+	case http.StatusNotFound:
+		return "llama_model_not_found"
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return "llama_invalid_request"
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return "llama_unavailable"
+	default:
+		return "generation_error"
+	}
 }
 
 type LLaMaProvider struct {
 	Model string
 }
 
-func (m LLaMaProvider) Generate(task string, c options.ProviderCallback, opts *options.ProviderOptions) chan options.Result {
+/*
+ * Llama 2 chat models expect the conversation as alternating [INST] blocks.
+ * This returns the system prompt and the turns ("u1 [/INST] a1 </s><s>[INST] u2")
+ * separately since some hosts (like replicate) wrap the first [INST] themselves.
+ */
+func llama2ChatTurns(messages []options.Message) (string, string) {
+	systemPrompt := ""
+	turns := ""
+
+	for _, message := range messages {
+		switch message.Role {
+		case options.RoleSystem:
+			systemPrompt += message.Content + "\n"
+		case options.RoleAssistant:
+			turns = strings.TrimSpace(turns) + " [/INST] " + strings.TrimSpace(message.Content) + " </s><s>[INST] "
+		default:
+			turns += strings.TrimSpace(message.Content) + "\n"
+		}
+	}
+
+	return strings.TrimSpace(turns), strings.TrimSpace(systemPrompt)
+}
+
+func llama2ChatPrompt(messages []options.Message) string {
+	turns, systemPrompt := llama2ChatTurns(messages)
+
+	if systemPrompt != "" {
+		systemPrompt = "<<SYS>>\n" + systemPrompt + "\n<</SYS>>\n\n"
+	}
+
+	return "<s>[INST] " + systemPrompt + turns + " [/INST]"
+}
+
+func (m LLaMaProvider) Generate(
+	ctx context.Context,
+	messages []options.Message,
+	c options.ProviderCallback,
+	opts *options.ProviderOptions,
+) chan options.Result {
 	chanRes := make(chan options.Result)
 
 	go func() {
 		defer close(chanRes)
 		tokenUsage := options.TokenUsage{Input: 0, Output: 0}
-		body := LLaMaInputBody{Prompt: task, Model: m.Model}
-		if opts != nil && opts.Temperature != nil {
-			body.Temperature = opts.Temperature
+
+		var task string
+		if opts != nil && opts.AutoComplete {
+			task = options.FlattenMessages(messages, true)
+		} else {
+			task = llama2ChatPrompt(messages)
+		}
+
+		body := newLLaMaInputBody(m.Model, task, opts)
+		if opts != nil {
+			unsupported := opts.Unsupported(
+				options.OptionMaxTokens,
+				options.OptionTopP,
+				options.OptionPresencePenalty,
+				options.OptionFrequencyPenalty,
+				options.OptionSeed,
+			)
+			if len(unsupported) > 0 {
+				chanRes <- options.UnsupportedOptionsResult("llama", unsupported)
+			}
 		}
-		fmt.Println(body)
+
 		input, err := json.Marshal(body)
-		tokenUsage.Input += tokens.CountTokens(task)
+		tokenUsage.Input += tokens.GetTokenizer("llama", m.Model).CountTokens(task)
 		if err != nil {
 			chanRes <- options.Result{Err: "generation_error"}
 			return
 		}
-		reqBody := string(input)
-		fmt.Println(reqBody)
-		resp, err := http.Post(os.Getenv("LLAMA_URL"), "application/json", strings.NewReader(reqBody))
+
+		req, err := http.NewRequestWithContext(ctx, "POST", os.Getenv("LLAMA_URL"), bytes.NewReader(input))
 		if err != nil {
 			chanRes <- options.Result{Err: "generation_error"}
 			return
 		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "text/event-stream, application/x-ndjson")
+		if apiKey := os.Getenv("LLAMA_API_KEY"); apiKey != "" {
+			req.Header.Set("Authorization", "Bearer "+apiKey)
+		}
+
+		resp, err := llamaClient.Do(req)
+		if err != nil {
+			fmt.Println(err)
+			chanRes <- options.Result{Err: "llama_unavailable"}
+			return
+		}
 		defer resp.Body.Close()
-		p := make([]byte, 128)
-		totalOutput := 0
+
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+			chanRes <- options.Result{Err: llamaErrorCode(resp.StatusCode, body)}
+			return
+		}
+
 		totalCompletion := ""
-		for {
-			nb, err := resp.Body.Read(p)
-			if errors.Is(err, io.EOF) || err != nil {
-				break
+		reportedUsage := false
+		failed := false
+
+		contentType := resp.Header.Get("Content-Type")
+		if strings.HasPrefix(contentType, "text/plain") {
+			// The servers streaming the raw completion without any protocol
+			var buffer utf8Buffer
+			p := make([]byte, 128)
+			for {
+				nb, err := resp.Body.Read(p)
+				if text := buffer.Write(p[:nb]); text != "" {
+					totalCompletion += text
+					chanRes <- options.Result{Result: text}
+				}
+				if err != nil {
+					failed = !errors.Is(err, io.EOF) && ctx.Err() == nil
+					break
+				}
+			}
+			if text := buffer.Flush(); text != "" {
+				totalCompletion += text
+				chanRes <- options.Result{Result: text}
+			}
+		} else {
+			scanner := bufio.NewScanner(resp.Body)
+			scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		stream:
+			for scanner.Scan() {
+				line := llamaStreamLine(scanner.Bytes())
+				if line == nil {
+					continue
+				}
+
+				var chunk LLaMaStreamChunk
+				err := json.Unmarshal(line, &chunk)
+				if err != nil {
+					continue
+				}
+
+				if len(chunk.Error) > 0 && string(chunk.Error) != "null" {
+					fmt.Printf("LLaMa stream error: %s\n", string(chunk.Error))
+					failed = true
+					break stream
+				}
+
+				if text := chunk.Text(); text != "" {
+					totalCompletion += text
+					chanRes <- options.Result{Result: text}
+				}
+
+				if input, output, ok := chunk.Usage(); ok && (chunk.Stop || chunk.Done) {
+					tokenUsage.Input = input
+					tokenUsage.Output = output
+					reportedUsage = true
+				}
+			}
+
+			// A line too long for the buffer or a lost connection would cut the completion short
+			if err := scanner.Err(); err != nil && ctx.Err() == nil {
+				fmt.Printf("LLaMa stream error: %v\n", err)
+				failed = true
 			}
-			tokenUsage.Output = tokens.CountTokens(string(p[:nb]))
-			totalOutput += tokenUsage.Output
-			totalCompletion += string(p[:nb])
-			chanRes <- options.Result{Result: string(p[:nb]), TokenUsage: tokenUsage}
 		}
+
+		if failed && totalCompletion == "" {
+			chanRes <- options.Result{Err: "generation_error"}
+			return
+		}
+
+		// Without the usage of the server, the completion is counted once it's complete
+		if !reportedUsage {
+			tokenUsage.Output = tokens.GetTokenizer("llama", m.Model).CountTokens(totalCompletion)
+		}
+
+		// What was streamed before an error is billed, the error comes last for the consumers that stop on it
+		chanRes <- options.Result{TokenUsage: tokenUsage}
+		if failed {
+			chanRes <- options.Result{Err: "generation_error"}
+		}
+
 		if c != nil {
-			(*c)("llama", m.Model, tokenUsage.Input, totalOutput, totalCompletion, nil)
+			(*c)("llama", m.Model, tokenUsage.Input, tokenUsage.Output, totalCompletion, nil)
 		}
 	}()
 
@@ -0,0 +1,115 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/polyfire/api/llm/providers/options"
+)
+
+func TestLlama2ChatPrompt(t *testing.T) {
+	messages := []options.Message{
+		{Role: options.RoleSystem, Content: "You are a pirate."},
+		{Role: options.RoleUser, Content: "Hello"},
+		{Role: options.RoleAssistant, Content: "Ahoy"},
+		{Role: options.RoleUser, Content: "Who are you?"},
+	}
+
+	expected := "<s>[INST] <<SYS>>\nYou are a pirate.\n<</SYS>>\n\nHello [/INST] Ahoy </s><s>[INST] Who are you? [/INST]"
+
+	prompt := llama2ChatPrompt(messages)
+	if prompt != expected {
+		t.Fatalf(`llama2ChatPrompt should have returned "%s" but returned "%s"`, expected, prompt)
+	}
+}
+
+func generateLLaMa(t *testing.T, contentType string, stream string) (string, options.TokenUsage, string) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body LLaMaInputBody
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		if !body.Stream || len(body.Stop) != 1 || len(body.Options.Stop) != 1 {
+			t.Errorf("The stop words should have been sent to llama.cpp and Ollama: %v", body)
+		}
+
+		if contentType == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		fmt.Fprint(w, stream)
+	}))
+	defer server.Close()
+	t.Setenv("LLAMA_URL", server.URL)
+
+	stop := []string{"User:"}
+	messages := []options.Message{{Role: options.RoleUser, Content: "Test"}}
+	result := LLaMaProvider{Model: "llama2"}.Generate(context.Background(), messages, nil, &options.ProviderOptions{StopWords: &stop})
+
+	str := ""
+	errorCode := ""
+	tokenUsage := options.TokenUsage{}
+	for v := range result {
+		str += v.Result
+		tokenUsage.Input += v.TokenUsage.Input
+		tokenUsage.Output += v.TokenUsage.Output
+		if v.Err != "" {
+			errorCode = v.Err
+		}
+	}
+
+	return str, tokenUsage, errorCode
+}
+
+func TestLLaMaStreamProtocols(t *testing.T) {
+	sse := "data: {\"content\":\"Caf\\u00e9\",\"stop\":false}\n\ndata: {\"content\":\" ok\",\"stop\":false}\n\n" +
+		"data: {\"content\":\"\",\"stop\":true,\"tokens_evaluated\":5,\"tokens_predicted\":3}\n\n"
+	ndjson := "{\"response\":\"Café\",\"done\":false}\n{\"response\":\" ok\",\"done\":false}\n" +
+		"{\"response\":\"\",\"done\":true,\"prompt_eval_count\":5,\"eval_count\":3}\n"
+
+	for contentType, stream := range map[string]string{"text/event-stream": sse, "application/x-ndjson": ndjson} {
+		str, tokenUsage, errorCode := generateLLaMa(t, contentType, stream)
+		if str != "Café ok" || errorCode != "" {
+			t.Fatalf(`The %s stream should have returned "Café ok" but returned "%s" (%s)`, contentType, str, errorCode)
+		}
+		if tokenUsage.Input != 5 || tokenUsage.Output != 3 {
+			t.Fatalf("The %s stream should have reported the server usage (5/3) but reported %v", contentType, tokenUsage)
+		}
+	}
+
+	if _, _, errorCode := generateLLaMa(t, "", ""); errorCode != "llama_model_not_found" {
+		t.Fatalf(`A 404 should have returned "llama_model_not_found" but returned "%s"`, errorCode)
+	}
+}
+
+func TestLLaMaStreamError(t *testing.T) {
+	// A line longer than the scanner buffer after some text
+	ndjson := "{\"response\":\"Test\",\"done\":false}\n{\"response\":\"" + strings.Repeat("a", 2*1024*1024) + "\"}\n"
+
+	str, tokenUsage, errorCode := generateLLaMa(t, "application/x-ndjson", ndjson)
+	if str != "Test" || errorCode != "generation_error" {
+		t.Fatalf(`The stream should have returned "Test" and "generation_error" but returned "%s" (%s)`, str, errorCode)
+	}
+	if tokenUsage.Output == 0 {
+		t.Fatalf("The completion streamed before the error should have been counted")
+	}
+}
+
+func TestUTF8Buffer(t *testing.T) {
+	var buffer utf8Buffer
+	text := []byte("Café 日本")
+
+	// "é" and "日" are cut in the middle
+	first := buffer.Write(text[:4])
+	second := buffer.Write(text[4:8])
+	third := buffer.Write(text[8:])
+
+	if first != "Caf" || second != "é " || third != "日本" || buffer.Flush() != "" {
+		t.Fatalf(`The buffer returned "%s", "%s" and "%s"`, first, second, third)
+	}
+}
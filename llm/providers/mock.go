@@ -0,0 +1,231 @@
+package providers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/polyfire/api/llm/providers/options"
+	tokens "github.com/polyfire/api/tokens"
+)
+
+/*
+ * The mock provider answers without calling any LLM so the frontends and the
+ * CI can use the API without any provider key. It's only available when
+ * APP_MODE=development and is selected with the model field:
+ *   - mock or mock/echo: answers with the last user message
+ *   - mock/script: answers with the response of the task in the JSON object
+ *     of MOCK_PROVIDER_SCRIPT ({"task": "response", "*": "default response"})
+ *   - mock/rate-limit, mock/invalid-key: fail before the first token
+ *   - mock/stream-error: fails in the middle of the answer
+ *
+ * The answer is streamed word by word every MOCK_PROVIDER_DELAY_MS (20ms by
+ * default) and the token usage is counted with the default tokenizer, so the
+ * same request always gets the same result.
+ */
+
+type MockScenario string
+
+const (
+	MockScenarioEcho        MockScenario = "echo"
+	MockScenarioScript      MockScenario = "script"
+	MockScenarioRateLimit   MockScenario = "rate-limit"
+	MockScenarioInvalidKey  MockScenario = "invalid-key"
+	MockScenarioStreamError MockScenario = "stream-error"
+)
+
+const MockDefaultDelay = 20 * time.Millisecond
+
+type MockProvider struct {
+	Model    string
+	Scenario MockScenario
+	Delay    time.Duration
+}
+
+func IsMockModel(model string) bool {
+	return model == "mock" || strings.HasPrefix(model, "mock/")
+}
+
+func NewMockProvider(model string) (MockProvider, bool) {
+	scenario := MockScenarioEcho
+	if model != "mock" {
+		scenario = MockScenario(strings.TrimPrefix(model, "mock/"))
+	}
+
+	switch scenario {
+	case MockScenarioEcho, MockScenarioScript, MockScenarioRateLimit, MockScenarioInvalidKey, MockScenarioStreamError:
+	default:
+		return MockProvider{}, false
+	}
+
+	delay := MockDefaultDelay
+	if ms, err := strconv.Atoi(os.Getenv("MOCK_PROVIDER_DELAY_MS")); err == nil && ms >= 0 {
+		delay = time.Duration(ms) * time.Millisecond
+	}
+
+	return MockProvider{Model: model, Scenario: scenario, Delay: delay}, true
+}
+
+func lastUserMessage(messages []options.Message) string {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == options.RoleUser {
+			return messages[i].Content
+		}
+	}
+	return ""
+}
+
+func (m MockProvider) response(messages []options.Message) string {
+	task := lastUserMessage(messages)
+	if m.Scenario != MockScenarioScript {
+		return task
+	}
+
+	script, err := os.ReadFile(os.Getenv("MOCK_PROVIDER_SCRIPT"))
+	if err != nil {
+		log.Printf("[WARNING] Can't read MOCK_PROVIDER_SCRIPT: %v\n", err)
+		return task
+	}
+
+	var responses map[string]string
+	if err := json.Unmarshal(script, &responses); err != nil {
+		log.Printf("[WARNING] MOCK_PROVIDER_SCRIPT isn't a JSON object of strings: %v\n", err)
+		return task
+	}
+
+	if response, ok := responses[task]; ok {
+		return response
+	}
+	if response, ok := responses["*"]; ok {
+		return response
+	}
+
+	return task
+}
+
+func (m MockProvider) Generate(
+	ctx context.Context,
+	messages []options.Message,
+	c options.ProviderCallback,
+	_ *options.ProviderOptions,
+) chan options.Result {
+	chanRes := make(chan options.Result)
+
+	go func() {
+		defer close(chanRes)
+
+		switch m.Scenario {
+		case MockScenarioRateLimit:
+			chanRes <- options.Result{Err: "rate_limit_reached"}
+			return
+		case MockScenarioInvalidKey:
+			chanRes <- options.Result{Err: "openai_invalid_api_key"}
+			return
+		}
+
+		response := m.response(messages)
+		words := strings.SplitAfter(response, " ")
+
+		failAt := -1
+		if m.Scenario == MockScenarioStreamError {
+			failAt = len(words) / 2
+		}
+
+		completion := ""
+		for i, word := range words {
+			if i == failAt {
+				chanRes <- options.Result{Err: "generation_error"}
+				return
+			}
+
+			if m.Delay > 0 {
+				timer := time.NewTimer(m.Delay)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				case <-timer.C:
+				}
+			}
+
+			completion += word
+			chanRes <- options.Result{Result: word}
+		}
+
+		tokenUsage := options.TokenUsage{Output: tokens.CountTokens(completion)}
+		for _, message := range messages {
+			tokenUsage.Input += tokens.CountTokens(message.Content)
+		}
+
+		chanRes <- options.Result{TokenUsage: tokenUsage}
+
+		if c != nil {
+			(*c)("mock", m.Model, tokenUsage.Input, tokenUsage.Output, completion, nil)
+		}
+	}()
+
+	return chanRes
+}
+
+func (m MockProvider) Name() string {
+	return "mock"
+}
+
+func (m MockProvider) ProviderModel() (string, string) {
+	return "mock", m.Model
+}
+
+func (m MockProvider) DoesFollowRateLimit() bool {
+	return false
+}
+
+// The embeddings of the mock provider only match identical texts
+const MockEmbeddingDimensions = 64
+
+type MockEmbedder struct{}
+
+func (m MockEmbedder) Embed(
+	_ context.Context,
+	contents []string,
+	_ EmbeddingInputType,
+) ([][]float32, int, error) {
+	embeddings := make([][]float32, len(contents))
+	tokenUsage := 0
+
+	for i, content := range contents {
+		embedding := make([]float32, MockEmbeddingDimensions)
+		norm := 0.0
+
+		seed := sha256.Sum256([]byte(content))
+		for j := range embedding {
+			block := sha256.Sum256(append(seed[:], byte(j)))
+			value := float64(binary.BigEndian.Uint32(block[:4]))/math.MaxUint32*2 - 1
+			embedding[j] = float32(value)
+			norm += value * value
+		}
+
+		for j := range embedding {
+			embedding[j] /= float32(math.Sqrt(norm))
+		}
+
+		embeddings[i] = embedding
+		tokenUsage += tokens.CountTokens(content)
+	}
+
+	return embeddings, tokenUsage, nil
+}
+
+func (m MockEmbedder) ProviderModel() (string, string) {
+	return "mock", "mock"
+}
+
+func (m MockEmbedder) Dimensions() int {
+	return MockEmbeddingDimensions
+}
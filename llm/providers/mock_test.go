@@ -0,0 +1,68 @@
+package providers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/polyfire/api/llm/providers/options"
+)
+
+func collectMock(t *testing.T, model string, task string) (string, string, options.TokenUsage) {
+	provider, ok := NewMockProvider(model)
+	if !ok {
+		t.Fatalf("NewMockProvider(%s) should have returned a provider", model)
+	}
+	provider.Delay = 0
+
+	messages := []options.Message{{Role: options.RoleUser, Content: task}}
+
+	str := ""
+	errCode := ""
+	tokenUsage := options.TokenUsage{}
+	for v := range provider.Generate(context.Background(), messages, nil, nil) {
+		str += v.Result
+		if v.Err != "" {
+			errCode = v.Err
+		}
+		tokenUsage.Input += v.TokenUsage.Input
+		tokenUsage.Output += v.TokenUsage.Output
+	}
+
+	return str, errCode, tokenUsage
+}
+
+func TestMockProvider(t *testing.T) {
+	str, errCode, tokenUsage := collectMock(t, "mock", "Hello mock world")
+	if str != "Hello mock world" || errCode != "" || tokenUsage.Input == 0 || tokenUsage.Output != tokenUsage.Input {
+		t.Fatalf("mock should have echoed the task but returned %q, %q, %v", str, errCode, tokenUsage)
+	}
+
+	str, errCode, _ = collectMock(t, "mock/stream-error", "one two three four")
+	if str != "one two " || errCode != "generation_error" {
+		t.Fatalf("mock/stream-error should have failed after 2 words but returned %q, %q", str, errCode)
+	}
+
+	str, errCode, _ = collectMock(t, "mock/rate-limit", "Test")
+	if str != "" || errCode != "rate_limit_reached" {
+		t.Fatalf("mock/rate-limit should have failed but returned %q, %q", str, errCode)
+	}
+
+	script := filepath.Join(t.TempDir(), "script.json")
+	if err := os.WriteFile(script, []byte(`{"Ping": "Pong", "*": "Default"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MOCK_PROVIDER_SCRIPT", script)
+
+	if str, _, _ = collectMock(t, "mock/script", "Ping"); str != "Pong" {
+		t.Fatalf(`mock/script should have answered "Pong" but returned %q`, str)
+	}
+	if str, _, _ = collectMock(t, "mock/script", "Other"); str != "Default" {
+		t.Fatalf(`mock/script should have answered "Default" but returned %q`, str)
+	}
+
+	if _, ok := NewMockProvider("mock/unknown"); ok {
+		t.Fatalf("NewMockProvider(mock/unknown) shouldn't have returned a provider")
+	}
+}
@@ -2,14 +2,16 @@ package providers
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
+	"log"
 	"math"
 	"net/http"
 	"os"
 	"strings"
 
+	"github.com/polyfire/api/db"
 	"github.com/polyfire/api/llm/providers/options"
 	tokens "github.com/polyfire/api/tokens"
 	utils "github.com/polyfire/api/utils"
@@ -21,6 +23,25 @@ type OpenAIStreamProvider struct {
 	Model         string
 	IsCustomToken bool
 	Provider      string
+	UpstreamModel string
+	Pricing       *CustomPricing
+	Capabilities  db.Capabilities
+}
+
+/*
+ * Credits per input and output token for the models that aren't priced in
+ * tokenToCredit (e.g. the OpenAI-compatible endpoints registered by a project)
+ */
+type CustomPricing struct {
+	CreditInput  int
+	CreditOutput int
+}
+
+func (m OpenAIStreamProvider) upstreamModel() string {
+	if m.UpstreamModel != "" {
+		return m.UpstreamModel
+	}
+	return m.Model
 }
 
 func NewOpenAIStreamProvider(ctx context.Context, model string) OpenAIStreamProvider {
@@ -36,7 +57,7 @@ func NewOpenAIStreamProvider(ctx context.Context, model string) OpenAIStreamProv
 		}
 		isCustomToken = true
 	} else {
-		config = goOpenai.DefaultConfig(os.Getenv("OPENAI_API_KEY"))
+		config = goOpenai.DefaultConfig(utils.GetKeyPool("openai").Acquire(ctx))
 		config.OrgID = os.Getenv("OPENAI_ORGANIZATION")
 		isCustomToken = false
 	}
@@ -49,6 +70,9 @@ func NewOpenAIStreamProvider(ctx context.Context, model string) OpenAIStreamProv
 		config.BaseURL = base
 	}
 
+	config.HTTPClient = utils.NewKeyPoolClient(config.HTTPClient, "openai", "Authorization", "Bearer ")
+	config.HTTPClient = utils.NewRetryClient(config.HTTPClient, "openai")
+
 	return OpenAIStreamProvider{
 		Client:        *goOpenai.NewClientWithConfig(config),
 		Model:         model,
@@ -57,8 +81,118 @@ func NewOpenAIStreamProvider(ctx context.Context, model string) OpenAIStreamProv
 	}
 }
 
+func toOpenAIMessages(messages []options.Message) []goOpenai.ChatCompletionMessage {
+	result := make([]goOpenai.ChatCompletionMessage, 0, len(messages))
+
+	for _, message := range messages {
+		openaiMessage := goOpenai.ChatCompletionMessage{
+			Role:       string(message.Role),
+			Content:    message.Content,
+			ToolCallID: message.ToolCallID,
+		}
+
+		// The API can't have both Content and MultiContent set
+		if len(message.Images) > 0 {
+			openaiMessage.Content = ""
+			if message.Content != "" {
+				openaiMessage.MultiContent = append(openaiMessage.MultiContent, goOpenai.ChatMessagePart{
+					Type: goOpenai.ChatMessagePartTypeText,
+					Text: message.Content,
+				})
+			}
+			for _, image := range message.Images {
+				openaiMessage.MultiContent = append(openaiMessage.MultiContent, goOpenai.ChatMessagePart{
+					Type: goOpenai.ChatMessagePartTypeImageURL,
+					ImageURL: &goOpenai.ChatMessageImageURL{
+						URL:    image.URL,
+						Detail: goOpenai.ImageURLDetail(image.Detail),
+					},
+				})
+			}
+		}
+
+		for _, toolCall := range message.ToolCalls {
+			openaiMessage.ToolCalls = append(openaiMessage.ToolCalls, goOpenai.ToolCall{
+				ID:   toolCall.ID,
+				Type: goOpenai.ToolTypeFunction,
+				Function: goOpenai.FunctionCall{
+					Name:      toolCall.Function.Name,
+					Arguments: toolCall.Function.Arguments,
+				},
+			})
+		}
+
+		result = append(result, openaiMessage)
+	}
+
+	return result
+}
+
+func toOpenAITools(tools []options.Tool) []goOpenai.Tool {
+	result := make([]goOpenai.Tool, 0, len(tools))
+
+	for _, tool := range tools {
+		definition := goOpenai.FunctionDefinition{
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			Parameters:  tool.Function.Parameters,
+		}
+
+		// The parameters are required by the API even when the function has none
+		if len(tool.Function.Parameters) == 0 {
+			definition.Parameters = json.RawMessage(`{"type":"object","properties":{}}`)
+		}
+
+		result = append(result, goOpenai.Tool{Type: goOpenai.ToolTypeFunction, Function: &definition})
+	}
+
+	return result
+}
+
+func fromOpenAIToolCalls(toolCalls []goOpenai.ToolCall) []options.ToolCall {
+	result := make([]options.ToolCall, 0, len(toolCalls))
+
+	for i, toolCall := range toolCalls {
+		index := i
+		if toolCall.Index != nil {
+			index = *toolCall.Index
+		}
+
+		result = append(result, options.ToolCall{
+			Index: index,
+			ID:    toolCall.ID,
+			Type:  string(toolCall.Type),
+			Function: options.ToolCallFunction{
+				Name:      toolCall.Function.Name,
+				Arguments: toolCall.Function.Arguments,
+			},
+		})
+	}
+
+	return result
+}
+
+func (m OpenAIStreamProvider) supportedOptions() []string {
+	supported := []string{
+		options.OptionMaxTokens,
+		options.OptionTopP,
+		options.OptionPresencePenalty,
+		options.OptionFrequencyPenalty,
+		options.OptionSeed,
+		options.OptionLogitBias,
+	}
+
+	// OpenRouter always returns a single choice
+	if m.Provider != "openrouter" {
+		supported = append(supported, options.OptionN)
+	}
+
+	return supported
+}
+
 func (m OpenAIStreamProvider) Generate(
-	task string,
+	ctx context.Context,
+	messages []options.Message,
 	c options.ProviderCallback,
 	opts *options.ProviderOptions,
 ) chan options.Result {
@@ -67,26 +201,34 @@ func (m OpenAIStreamProvider) Generate(
 	go func() {
 		defer close(chanRes)
 		tokenUsage := options.TokenUsage{Input: 0, Output: 0}
-		ctx := context.Background()
 
 		if opts == nil {
 			opts = &options.ProviderOptions{}
 		}
 
 		req := goOpenai.ChatCompletionRequest{
-			Model: m.Model,
-			Messages: []goOpenai.ChatCompletionMessage{
-				{
-					Role:    goOpenai.ChatMessageRoleUser,
-					Content: task,
-				},
+			Model:    m.upstreamModel(),
+			Messages: toOpenAIMessages(messages),
+			Stream:   true,
+			StreamOptions: &goOpenai.StreamOptions{
+				IncludeUsage: true,
 			},
-			Stream: true,
 		}
 
-		if opts.JSONFormat {
+		prompt := options.FlattenMessages(messages, opts.AutoComplete)
+
+		if unsupported := opts.Unsupported(m.supportedOptions()...); len(unsupported) > 0 {
+			chanRes <- options.UnsupportedOptionsResult(m.Provider, unsupported)
+		}
+
+		structuredOutput := opts.UsesStructuredOutputTool() && m.Capabilities.Tools
+		if structuredOutput {
+			tools, toolChoice := options.StructuredOutputTools(opts.JSONSchema)
+			req.Tools = toOpenAITools(tools)
+			req.ToolChoice = toolChoice
+		} else if opts.JSONFormat {
 			// The OpenAI api requires the message to mention the word json
-			if !strings.Contains(strings.ToLower(task), "json") {
+			if !strings.Contains(strings.ToLower(prompt), "json") {
 				chanRes <- options.Result{Err: "json_format_must_mention_json"}
 				return
 			}
@@ -95,6 +237,13 @@ func (m OpenAIStreamProvider) Generate(
 			}
 		}
 
+		if len(opts.Tools) > 0 {
+			req.Tools = toOpenAITools(opts.Tools)
+			if opts.ToolChoice != nil {
+				req.ToolChoice = opts.ToolChoice
+			}
+		}
+
 		if opts.StopWords != nil {
 			req.Stop = *opts.StopWords
 		}
@@ -106,55 +255,152 @@ func (m OpenAIStreamProvider) Generate(
 				req.Temperature = *opts.Temperature
 			}
 		}
+		if opts.MaxTokens != nil {
+			req.MaxTokens = *opts.MaxTokens
+		}
+		if opts.TopP != nil {
+			req.TopP = *opts.TopP
+			if req.TopP == 0.0 {
+				req.TopP = math.SmallestNonzeroFloat32 // Same omitempty issue as the temperature
+			}
+		}
+		if opts.PresencePenalty != nil {
+			req.PresencePenalty = *opts.PresencePenalty
+		}
+		if opts.FrequencyPenalty != nil {
+			req.FrequencyPenalty = *opts.FrequencyPenalty
+		}
+		if opts.N != nil && m.Provider != "openrouter" {
+			req.N = *opts.N
+		}
+		req.Seed = opts.Seed
+		req.LogitBias = opts.LogitBias
 
 		stream, err := m.Client.CreateChatCompletionStream(ctx, req)
-		if err != nil && strings.Contains(err.Error(), "Incorrect API key provided") &&
-			m.IsCustomToken {
-			chanRes <- options.Result{Err: "openai_invalid_api_key"}
-			return
-		} else if err != nil {
-			fmt.Println(err)
-			chanRes <- options.Result{Err: "generation_error"}
+		if err != nil {
+			log.Printf("[ERROR] OpenAI request error: %v\n", err)
+			chanRes <- options.Result{Err: m.errorCode(err)}
 			return
 		}
 
-		tokenUsage.Input += tokens.CountTokens(task)
-
-		totalOutput := 0
 		totalCompletion := ""
+		toolCallsText := ""
+		otherChoicesText := ""
+		receivedOutput := false
+		var reportedUsage *goOpenai.Usage
 
 		for {
 			completion, err := stream.Recv()
 
-			if errors.Is(err, io.EOF) || err != nil {
+			if errors.Is(err, io.EOF) {
 				break
 			}
 
-			if len(completion.Choices) == 0 {
-				continue
+			if err != nil {
+				log.Printf("[ERROR] OpenAI stream error: %v\n", err)
+				// A failure before the first token can still be retried on another provider
+				if !receivedOutput && ctx.Err() == nil {
+					chanRes <- options.Result{Err: "generation_error"}
+					return
+				}
+				break
 			}
 
-			tokenUsage.Output = tokens.CountTokens(completion.Choices[0].Delta.Content)
+			// With include_usage, the last chunk has no choices and carries the usage of the whole request
+			if completion.Usage != nil {
+				reportedUsage = completion.Usage
+			}
 
-			totalOutput += tokenUsage.Output
+			// With n > 1, the choices are interleaved and billed together
+			for _, choice := range completion.Choices {
+				delta := choice.Delta
 
-			result := options.Result{
-				Result:     completion.Choices[0].Delta.Content,
-				TokenUsage: tokenUsage,
-			}
+				if choice.Index != 0 {
+					otherChoicesText += delta.Content
+					if delta.Content != "" {
+						chanRes <- options.Result{Result: delta.Content, ChoiceIndex: choice.Index}
+					}
+					continue
+				}
 
-			totalCompletion += completion.Choices[0].Delta.Content
+				result := options.Result{
+					Result: delta.Content,
+				}
 
-			chanRes <- result
+				// The arguments of the forced call are the answer
+				if structuredOutput {
+					for _, toolCall := range delta.ToolCalls {
+						result.Result += toolCall.Function.Arguments
+					}
+					delta.ToolCalls = nil
+				}
+
+				totalCompletion += result.Result
+
+				if len(delta.ToolCalls) > 0 {
+					result.ToolCalls = fromOpenAIToolCalls(delta.ToolCalls)
+					for _, toolCall := range delta.ToolCalls {
+						toolCallsText += toolCall.Function.Name + toolCall.Function.Arguments
+					}
+				}
+
+				receivedOutput = receivedOutput || result.Result != "" || len(delta.ToolCalls) > 0
+
+				chanRes <- result
+			}
 		}
+
+		if reportedUsage != nil {
+			tokenUsage.Input = reportedUsage.PromptTokens
+			tokenUsage.Output = reportedUsage.CompletionTokens
+		} else {
+			// Some OpenAI-compatible servers and aborted streams don't report anything
+			tokenizer := tokens.GetTokenizer(m.Provider, m.upstreamModel())
+			tokenUsage.Input = tokenizer.CountTokens(prompt) + options.CountImagesTokens(messages)
+			tokenUsage.Output = tokenizer.CountTokens(totalCompletion + otherChoicesText + toolCallsText)
+		}
+
+		chanRes <- options.Result{TokenUsage: tokenUsage}
+
 		if c != nil {
-			(*c)(m.Provider, m.Model, tokenUsage.Input, totalOutput, totalCompletion, nil)
+			var credits *int
+			if m.Pricing != nil {
+				total := tokenUsage.Input*m.Pricing.CreditInput + tokenUsage.Output*m.Pricing.CreditOutput
+				credits = &total
+			}
+			(*c)(m.Provider, m.Model, tokenUsage.Input, tokenUsage.Output, totalCompletion, credits)
 		}
 	}()
 
 	return chanRes
 }
 
+/*
+ * The 4xx are caused by the request (a prompt too long for the context, an
+ * invalid tool schema...) or by the user's own key, only the 429 of the keys
+ * of the pool are the provider's.
+ */
+func (m OpenAIStreamProvider) errorCode(err error) string {
+	if strings.Contains(err.Error(), "Incorrect API key provided") && m.IsCustomToken {
+		return "openai_invalid_api_key"
+	}
+
+	statusCode := 0
+	var apiErr *goOpenai.APIError
+	var requestErr *goOpenai.RequestError
+	if errors.As(err, &apiErr) {
+		statusCode = apiErr.HTTPStatusCode
+	} else if errors.As(err, &requestErr) {
+		statusCode = requestErr.HTTPStatusCode
+	}
+
+	if statusCode >= 400 && statusCode < 500 && (statusCode != http.StatusTooManyRequests || m.IsCustomToken) {
+		return "generation_invalid_request"
+	}
+
+	return "generation_error"
+}
+
 func (m OpenAIStreamProvider) Name() string {
 	return m.Provider
 }
@@ -166,3 +412,19 @@ func (m OpenAIStreamProvider) ProviderModel() (string, string) {
 func (m OpenAIStreamProvider) DoesFollowRateLimit() bool {
 	return !m.IsCustomToken
 }
+
+func (m OpenAIStreamProvider) UsesCustomKey() bool {
+	return m.IsCustomToken
+}
+
+func (m OpenAIStreamProvider) SupportsTools() bool {
+	return m.Capabilities.Tools
+}
+
+func (m OpenAIStreamProvider) SupportsJSONSchema() bool {
+	return m.Capabilities.Tools
+}
+
+func (m OpenAIStreamProvider) SupportsVision() bool {
+	return m.Capabilities.Vision
+}
@@ -0,0 +1,58 @@
+package providers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/polyfire/api/db"
+	utils "github.com/polyfire/api/utils"
+	goOpenai "github.com/sashabaranov/go-openai"
+)
+
+/*
+ * Projects can register their own OpenAI-compatible servers (vLLM, Ollama,
+ * LM Studio, LiteLLM...) in the models table. The model column is the name
+ * known by Polyfire (and logged in request_logs) while upstream_model is the
+ * name sent to the server.
+ */
+
+func NewOpenAICompatibleProvider(ctx context.Context, model db.Model) OpenAIStreamProvider {
+	apiKey := ""
+	if model.APIKey != nil {
+		apiKey = *model.APIKey
+	}
+
+	config := goOpenai.DefaultConfig(apiKey)
+	if model.BaseURL != nil {
+		config.BaseURL = *model.BaseURL
+	}
+
+	if client, ok := ctx.Value(utils.ContextKeyHTTPClient).(*http.Client); ok {
+		config.HTTPClient = client
+	}
+	// The base_url is given by the project, it mustn't reach the internal network
+	config.HTTPClient = utils.NewPublicHTTPClient(config.HTTPClient)
+	config.HTTPClient = utils.NewRetryClient(config.HTTPClient, "openai-compatible")
+
+	provider := OpenAIStreamProvider{
+		Client:        *goOpenai.NewClientWithConfig(config),
+		Model:         model.Model,
+		UpstreamModel: model.UpstreamID(),
+		Provider:      "openai-compatible",
+		// Free models don't count against the rate limit, like a user's own API key
+		IsCustomToken: model.CreditType == db.FreeCreditType,
+		Capabilities:  model.Capabilities(),
+	}
+
+	if !provider.IsCustomToken {
+		provider.Pricing = &CustomPricing{}
+		if model.CreditInput != nil {
+			provider.Pricing.CreditInput = *model.CreditInput
+		}
+		if model.CreditOutput != nil {
+			provider.Pricing.CreditOutput = *model.CreditOutput
+		}
+	}
+
+	return provider
+}
@@ -0,0 +1,62 @@
+package providers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/polyfire/api/db"
+	"github.com/polyfire/api/llm/providers/options"
+	"github.com/polyfire/api/utils"
+)
+
+func TestOpenAICompatibleProvider(t *testing.T) {
+	utils.SetLogLevel("WARN")
+	ctx := utils.MockOpenAIServer(context.Background())
+
+	// The mock server listens on localhost
+	utils.AllowPrivateURLs = true
+	defer func() { utils.AllowPrivateURLs = false }()
+	baseURL := ctx.Value(utils.ContextKeyOpenAIBaseURL).(string)
+	upstreamModel := "llama3:8b"
+	creditInput := 2
+	creditOutput := 3
+
+	provider := NewOpenAICompatibleProvider(ctx, db.Model{
+		Model:         "project-llama3",
+		Provider:      "openai-compatible",
+		BaseURL:       &baseURL,
+		UpstreamModel: &upstreamModel,
+		CreditType:    "token_input_output",
+		CreditInput:   &creditInput,
+		CreditOutput:  &creditOutput,
+	})
+
+	var loggedModel string
+	var loggedCredits *int
+	callback := func(_ string, model string, _ int, _ int, _ string, credits *int) {
+		loggedModel = model
+		loggedCredits = credits
+	}
+
+	messages := []options.Message{{Role: options.RoleUser, Content: "Test"}}
+	str := ""
+	for v := range provider.Generate(ctx, messages, &callback, nil) {
+		str += v.Result
+	}
+
+	if str != "Test response" {
+		t.Fatalf(`Generate("Test") should have returned "Test response" but returned "%s"`, str)
+	}
+
+	if loggedModel != "project-llama3" {
+		t.Fatalf(`The callback should log the Polyfire model name but logged "%s"`, loggedModel)
+	}
+
+	if loggedCredits == nil || *loggedCredits <= 0 {
+		t.Fatalf(`The callback should receive the credits computed from the project rates`)
+	}
+
+	if !provider.DoesFollowRateLimit() {
+		t.Fatalf(`A billed OpenAI-compatible model should follow the rate limit`)
+	}
+}
@@ -4,21 +4,54 @@ import (
 	"context"
 	"testing"
 
+	"github.com/polyfire/api/llm/providers/options"
 	"github.com/polyfire/api/utils"
+	goOpenai "github.com/sashabaranov/go-openai"
 )
 
 func TestOpenAIProvider(t *testing.T) {
 	utils.SetLogLevel("WARN")
 	ctx := utils.MockOpenAIServer(context.Background())
-	result := NewOpenAIStreamProvider(ctx, "test-model").Generate("Test", nil, nil)
+	messages := []options.Message{{Role: options.RoleUser, Content: "Test"}}
+	result := NewOpenAIStreamProvider(ctx, "test-model").Generate(ctx, messages, nil, nil)
 
 	str := ""
+	tokenUsage := options.TokenUsage{}
 
 	for v := range result {
 		str += v.Result
+		tokenUsage.Input += v.TokenUsage.Input
+		tokenUsage.Output += v.TokenUsage.Output
 	}
 
 	if str != "Test response" {
 		t.Fatalf(`Generate("Test") should have returned "Test response" but returned "%s"`, str)
 	}
+
+	if tokenUsage.Input != 9 || tokenUsage.Output != 2 {
+		t.Fatalf(`Generate("Test") should have reported the usage sent by the API but reported %v`, tokenUsage)
+	}
+}
+
+func TestOpenAIErrorCode(t *testing.T) {
+	poolKey := OpenAIStreamProvider{}
+	customKey := OpenAIStreamProvider{IsCustomToken: true}
+
+	cases := []struct {
+		provider OpenAIStreamProvider
+		err      error
+		code     string
+	}{
+		{poolKey, &goOpenai.APIError{HTTPStatusCode: 400, Message: "maximum context length"}, "generation_invalid_request"},
+		{poolKey, &goOpenai.APIError{HTTPStatusCode: 429}, "generation_error"},
+		{customKey, &goOpenai.APIError{HTTPStatusCode: 429}, "generation_invalid_request"},
+		{poolKey, &goOpenai.RequestError{HTTPStatusCode: 503}, "generation_error"},
+		{customKey, &goOpenai.APIError{HTTPStatusCode: 401, Message: "Incorrect API key provided"}, "openai_invalid_api_key"},
+	}
+
+	for _, c := range cases {
+		if code := c.provider.errorCode(c.err); code != c.code {
+			t.Fatalf("The error %v should have returned %s but returned %s", c.err, c.code, code)
+		}
+	}
 }
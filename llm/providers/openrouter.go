@@ -4,6 +4,7 @@ import (
 	"context"
 	"os"
 
+	utils "github.com/polyfire/api/utils"
 	goOpenai "github.com/sashabaranov/go-openai"
 )
 
@@ -19,6 +20,7 @@ func NewOpenRouterProvider(_ context.Context, model string) OpenAIStreamProvider
 	config = goOpenai.DefaultConfig(os.Getenv("OPENROUTER_API_KEY"))
 	isCustomToken = false
 	config.BaseURL = "https://openrouter.ai/api/v1"
+	config.HTTPClient = utils.NewRetryClient(config.HTTPClient, "openrouter")
 
 	return OpenAIStreamProvider{
 		Client:        *goOpenai.NewClientWithConfig(config),
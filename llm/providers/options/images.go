@@ -0,0 +1,64 @@
+package options
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	_ "image/gif"  // Registers the gif format for image.DecodeConfig
+	_ "image/jpeg" // Registers the jpeg format for image.DecodeConfig
+	_ "image/png"  // Registers the png format for image.DecodeConfig
+	"strings"
+
+	"github.com/polyfire/api/tokens"
+)
+
+/*
+ * An image attached to a message. The clients set one of URL, Data (base64
+ * encoded, with its MimeType) or Path (in the storage bucket). Once resolved,
+ * URL is always set, as a data URL for the base64 images.
+ */
+type Image struct {
+	URL      string `json:"url,omitempty"`
+	Data     string `json:"data,omitempty"`
+	MimeType string `json:"mime_type,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+func (i Image) size() (int, int) {
+	data := i.Data
+	if data == "" && strings.HasPrefix(i.URL, "data:") {
+		data = i.URL[strings.Index(i.URL, ",")+1:]
+	}
+
+	if data == "" {
+		return tokens.DefaultImageWidth, tokens.DefaultImageHeight
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return tokens.DefaultImageWidth, tokens.DefaultImageHeight
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(decoded))
+	if err != nil {
+		return tokens.DefaultImageWidth, tokens.DefaultImageHeight
+	}
+
+	return config.Width, config.Height
+}
+
+func (i Image) CountTokens() int {
+	width, height := i.size()
+	return tokens.CountImageTokens(width, height, i.Detail)
+}
+
+func CountImagesTokens(messages []Message) int {
+	total := 0
+	for _, message := range messages {
+		for _, image := range message.Images {
+			total += image.CountTokens()
+		}
+	}
+	return total
+}
@@ -0,0 +1,27 @@
+package options
+
+import "encoding/json"
+
+/*
+ * The providers with tool calling produce the structured outputs natively by
+ * forcing the model to call a single function taking the schema as parameters.
+ * The arguments of that call are the answer and are streamed as the Result.
+ */
+const StructuredOutputTool = "respond"
+
+func (opts ProviderOptions) UsesStructuredOutputTool() bool {
+	return len(opts.JSONSchema) > 0 && len(opts.Tools) == 0
+}
+
+func StructuredOutputTools(schema json.RawMessage) ([]Tool, *ToolChoice) {
+	tools := []Tool{{
+		Type: "function",
+		Function: ToolFunction{
+			Name:        StructuredOutputTool,
+			Description: "Sends the answer to the user.",
+			Parameters:  schema,
+		},
+	}}
+
+	return tools, &ToolChoice{Function: StructuredOutputTool}
+}
@@ -8,9 +8,94 @@ import (
 )
 
 type ProviderOptions struct {
-	StopWords   *[]string
-	Temperature *float32
-	JSONFormat  bool
+	StopWords    *[]string
+	Temperature  *float32
+	JSONFormat   bool
+	AutoComplete bool
+	Tools        []Tool
+	ToolChoice   *ToolChoice
+
+	MaxTokens        *int
+	TopP             *float32
+	PresencePenalty  *float32
+	FrequencyPenalty *float32
+	Seed             *int
+	LogitBias        map[string]int
+	N                *int
+
+	JSONSchema json.RawMessage
+}
+
+type Role string
+
+const (
+	RoleSystem    Role = "system"
+	RoleUser      Role = "user"
+	RoleAssistant Role = "assistant"
+	RoleTool      Role = "tool"
+)
+
+type Message struct {
+	Role       Role       `json:"role"`
+	Content    string     `json:"content"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+	Images     []Image    `json:"images,omitempty"`
+}
+
+// A flattened chat has no end of turn token, this stops the models going on with the next user message
+const FlattenedChatStopWord = "\nUser:"
+
+/*
+ * FlattenMessages renders a list of messages as a single text prompt for the
+ * models that don't have a chat format. When autoComplete is set, the content
+ * is concatenated without any role so the model continues the last message
+ * instead of answering it.
+ */
+func FlattenMessages(messages []Message, autoComplete bool) string {
+	prompt := ""
+
+	for _, message := range messages {
+		if autoComplete {
+			prompt += message.Content
+			continue
+		}
+
+		switch message.Role {
+		case RoleSystem:
+			prompt += message.Content + "\n"
+		case RoleUser:
+			prompt += "User:\n" + message.Content + "\n"
+		case RoleAssistant:
+			prompt += "Assistant:\n" + message.Content + "\n"
+			if len(message.ToolCalls) > 0 {
+				toolCalls, _ := json.Marshal(message.ToolCalls)
+				prompt += string(toolCalls) + "\n"
+			}
+		case RoleTool:
+			prompt += "Tool:\n" + message.Content + "\n"
+		}
+	}
+
+	if !autoComplete {
+		prompt += "Assistant:\n"
+	}
+
+	return prompt
+}
+
+// Returns a copy of the options also stopping at stopWord
+func (opts ProviderOptions) WithStopWord(stopWord string) *ProviderOptions {
+	stopWords := []string{}
+	if opts.StopWords != nil {
+		stopWords = append(stopWords, *opts.StopWords...)
+	}
+	if !utils.ContainsString(stopWords, stopWord) {
+		stopWords = append(stopWords, stopWord)
+	}
+
+	opts.StopWords = &stopWords
+	return &opts
 }
 
 type TokenUsage struct {
@@ -24,6 +109,24 @@ type Result struct {
 	Resources  []db.MatchResult `json:"ressources,omitempty"`
 	Err        string           `json:"error,omitempty"`
 	Warnings   []string         `json:"warnings,omitempty"`
+	Model      string           `json:"model,omitempty"`
+	Routing    *Routing         `json:"routing,omitempty"`
+	ToolCalls  []ToolCall       `json:"tool_calls,omitempty"`
+
+	// With n > 1, the deltas of the other choices are sent with their index
+	ChoiceIndex    int      `json:"-"`
+	Choices        []string `json:"choices,omitempty"`
+	IgnoredOptions []string `json:"ignored_options,omitempty"`
+
+	// With a json_schema, the answer once validated or the reasons it's invalid
+	Parsed           json.RawMessage `json:"parsed,omitempty"`
+	ValidationErrors []string        `json:"validation_errors,omitempty"`
+}
+
+// The model picked by the "auto" model and why
+type Routing struct {
+	Model  string `json:"model"`
+	Reason string `json:"reason"`
 }
 
 type ProviderCallback *func(string, string, int, int, string, *int)
@@ -34,6 +137,15 @@ type jsonableResult struct {
 	Resources  []db.MatchResult `json:"ressources,omitempty"`
 	Error      *utils.APIError  `json:"error,omitempty"`
 	Warnings   []string         `json:"warnings,omitempty"`
+	Model      string           `json:"model,omitempty"`
+	Routing    *Routing         `json:"routing,omitempty"`
+	ToolCalls  []ToolCall       `json:"tool_calls,omitempty"`
+
+	Choices        []string `json:"choices,omitempty"`
+	IgnoredOptions []string `json:"ignored_options,omitempty"`
+
+	Parsed           json.RawMessage `json:"parsed,omitempty"`
+	ValidationErrors []string        `json:"validation_errors,omitempty"`
 }
 
 func (r Result) JSON() ([]byte, error) {
@@ -54,6 +166,15 @@ func (r Result) JSON() ([]byte, error) {
 		Resources:  r.Resources,
 		Error:      apiError,
 		Warnings:   r.Warnings,
+		Model:      r.Model,
+		Routing:    r.Routing,
+		ToolCalls:  r.ToolCalls,
+
+		Choices:        r.Choices,
+		IgnoredOptions: r.IgnoredOptions,
+
+		Parsed:           r.Parsed,
+		ValidationErrors: r.ValidationErrors,
 	})
 	if err != nil {
 		return []byte{}, err
@@ -0,0 +1,127 @@
+package options
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	OptionMaxTokens        = "max_tokens"
+	OptionTopP             = "top_p"
+	OptionPresencePenalty  = "presence_penalty"
+	OptionFrequencyPenalty = "frequency_penalty"
+	OptionSeed             = "seed"
+	OptionLogitBias        = "logit_bias"
+	OptionN                = "n"
+)
+
+// The sampling options set in the request, in the order of the constants above
+func (opts ProviderOptions) SamplingOptions() []string {
+	set := []string{}
+
+	if opts.MaxTokens != nil {
+		set = append(set, OptionMaxTokens)
+	}
+	if opts.TopP != nil {
+		set = append(set, OptionTopP)
+	}
+	if opts.PresencePenalty != nil {
+		set = append(set, OptionPresencePenalty)
+	}
+	if opts.FrequencyPenalty != nil {
+		set = append(set, OptionFrequencyPenalty)
+	}
+	if opts.Seed != nil {
+		set = append(set, OptionSeed)
+	}
+	if len(opts.LogitBias) > 0 {
+		set = append(set, OptionLogitBias)
+	}
+	if opts.N != nil && *opts.N != 1 {
+		set = append(set, OptionN)
+	}
+
+	return set
+}
+
+/*
+ * Returns the sampling options set in the request that the provider can't
+ * honor. The providers send them back with UnsupportedOptionsResult instead
+ * of silently dropping them.
+ */
+func (opts ProviderOptions) Unsupported(supported ...string) []string {
+	unsupported := []string{}
+
+	for _, option := range opts.SamplingOptions() {
+		isSupported := false
+		for _, s := range supported {
+			if s == option {
+				isSupported = true
+				break
+			}
+		}
+		if !isSupported {
+			unsupported = append(unsupported, option)
+		}
+	}
+
+	return unsupported
+}
+
+func UnsupportedOptionsResult(provider string, unsupported []string) Result {
+	return Result{
+		IgnoredOptions: unsupported,
+		Warnings: []string{
+			fmt.Sprintf("%s doesn't support %s, ignored.", provider, strings.Join(unsupported, ", ")),
+		},
+	}
+}
+
+type cacheKeyOptions struct {
+	StopWords        *[]string      `json:"stop,omitempty"`
+	JSONFormat       bool           `json:"json_format,omitempty"`
+	MaxTokens        *int           `json:"max_tokens,omitempty"`
+	TopP             *float32       `json:"top_p,omitempty"`
+	PresencePenalty  *float32       `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float32       `json:"frequency_penalty,omitempty"`
+	Seed             *int           `json:"seed,omitempty"`
+	LogitBias        map[string]int `json:"logit_bias,omitempty"`
+}
+
+/*
+ * The exact cache is indexed on the prompt followed by this key so two
+ * requests with different settings don't share their completions. It's empty
+ * without any option to keep the entries cached before the options existed.
+ */
+func (opts ProviderOptions) CacheKey() string {
+	key, err := json.Marshal(cacheKeyOptions{
+		StopWords:        opts.StopWords,
+		JSONFormat:       opts.JSONFormat,
+		MaxTokens:        opts.MaxTokens,
+		TopP:             opts.TopP,
+		PresencePenalty:  opts.PresencePenalty,
+		FrequencyPenalty: opts.FrequencyPenalty,
+		Seed:             opts.Seed,
+		LogitBias:        opts.LogitBias,
+	})
+	if err != nil || string(key) == "{}" {
+		return ""
+	}
+
+	return "\n" + string(key)
+}
+
+/*
+ * Merges a streamed delta into the complete choices. The first choice is the
+ * Result itself, its slot is only filled once the generation is over.
+ */
+func MergeChoiceDelta(choices []string, index int, delta string) []string {
+	for len(choices) <= index {
+		choices = append(choices, "")
+	}
+
+	choices[index] += delta
+
+	return choices
+}
@@ -0,0 +1,32 @@
+package options
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUnsupportedOptions(t *testing.T) {
+	maxTokens := 100
+	seed := 42
+	one := 1
+
+	opts := ProviderOptions{MaxTokens: &maxTokens, Seed: &seed, N: &one}
+
+	unsupported := opts.Unsupported(OptionMaxTokens)
+	if !reflect.DeepEqual(unsupported, []string{OptionSeed}) {
+		t.Fatalf(`Unsupported should have returned ["seed"] but returned %v`, unsupported)
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	if key := (ProviderOptions{}).CacheKey(); key != "" {
+		t.Fatalf(`CacheKey should be empty without options but returned "%s"`, key)
+	}
+
+	var first float32 = 0.5
+	var second float32 = 0.9
+
+	if (ProviderOptions{TopP: &first}).CacheKey() == (ProviderOptions{TopP: &second}).CacheKey() {
+		t.Fatal("CacheKey should differ when the options differ")
+	}
+}
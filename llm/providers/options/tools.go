@@ -0,0 +1,114 @@
+package options
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+/*
+ * The tools use the same shape as the OpenAI function definitions so the
+ * clients can send the same objects whatever the provider is.
+ */
+
+type ToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+type Tool struct {
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+
+type ToolCallFunction struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
+/*
+ * While streaming, a tool call is sent in several deltas sharing the same index.
+ * Only the first one has the id and the name, the next ones complete the arguments.
+ */
+type ToolCall struct {
+	Index    int              `json:"index"`
+	ID       string           `json:"id,omitempty"`
+	Type     string           `json:"type,omitempty"`
+	Function ToolCallFunction `json:"function"`
+}
+
+type ToolResult struct {
+	ToolCallID string `json:"tool_call_id"`
+	Content    string `json:"content"`
+}
+
+const (
+	ToolChoiceNone     = "none"
+	ToolChoiceAuto     = "auto"
+	ToolChoiceRequired = "required"
+)
+
+// Either one of the ToolChoice* modes or a function the model must call
+type ToolChoice struct {
+	Mode     string
+	Function string
+}
+
+var ErrInvalidToolChoice = errors.New("Invalid tool choice")
+
+func (tc *ToolChoice) UnmarshalJSON(data []byte) error {
+	var mode string
+	if err := json.Unmarshal(data, &mode); err == nil {
+		if mode != ToolChoiceNone && mode != ToolChoiceAuto && mode != ToolChoiceRequired {
+			return ErrInvalidToolChoice
+		}
+		tc.Mode = mode
+		return nil
+	}
+
+	var function struct {
+		Type     string `json:"type"`
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(data, &function); err != nil || function.Function.Name == "" {
+		return ErrInvalidToolChoice
+	}
+	tc.Function = function.Function.Name
+
+	return nil
+}
+
+func (tc ToolChoice) MarshalJSON() ([]byte, error) {
+	if tc.Function != "" {
+		return json.Marshal(map[string]interface{}{
+			"type":     "function",
+			"function": map[string]string{"name": tc.Function},
+		})
+	}
+	return json.Marshal(tc.Mode)
+}
+
+// Merges the streamed deltas into complete tool calls
+func MergeToolCallDeltas(toolCalls []ToolCall, deltas []ToolCall) []ToolCall {
+	for _, delta := range deltas {
+		for len(toolCalls) <= delta.Index {
+			toolCalls = append(toolCalls, ToolCall{Index: len(toolCalls)})
+		}
+
+		toolCall := &toolCalls[delta.Index]
+		if delta.ID != "" {
+			toolCall.ID = delta.ID
+		}
+		if delta.Type != "" {
+			toolCall.Type = delta.Type
+		}
+		if delta.Function.Name != "" {
+			toolCall.Function.Name = delta.Function.Name
+		}
+		toolCall.Function.Arguments += delta.Function.Arguments
+	}
+
+	return toolCalls
+}
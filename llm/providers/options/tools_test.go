@@ -0,0 +1,54 @@
+package options
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestToolChoiceJSON(t *testing.T) {
+	var choices []ToolChoice
+	err := json.Unmarshal([]byte(`["auto", {"type": "function", "function": {"name": "get_weather"}}]`), &choices)
+	if err != nil {
+		t.Fatalf(`Unmarshal returned an error: %v`, err)
+	}
+
+	if choices[0].Mode != ToolChoiceAuto || choices[1].Function != "get_weather" {
+		t.Fatalf(`Unmarshal returned %v`, choices)
+	}
+
+	var choice ToolChoice
+	if err := json.Unmarshal([]byte(`"sometimes"`), &choice); err == nil {
+		t.Fatalf(`Unmarshal should refuse unknown modes`)
+	}
+
+	result, _ := json.Marshal(choices[1])
+	if string(result) != `{"function":{"name":"get_weather"},"type":"function"}` {
+		t.Fatalf(`Marshal returned %s`, result)
+	}
+}
+
+func TestMergeToolCallDeltas(t *testing.T) {
+	deltas := [][]ToolCall{
+		{{Index: 0, ID: "call_1", Type: "function", Function: ToolCallFunction{Name: "get_weather"}}},
+		{{Index: 0, Function: ToolCallFunction{Arguments: `{"city":`}}},
+		{{Index: 1, ID: "call_2", Type: "function", Function: ToolCallFunction{Name: "get_time"}}},
+		{{Index: 0, Function: ToolCallFunction{Arguments: `"Paris"}`}}},
+	}
+
+	var toolCalls []ToolCall
+	for _, delta := range deltas {
+		toolCalls = MergeToolCallDeltas(toolCalls, delta)
+	}
+
+	if len(toolCalls) != 2 {
+		t.Fatalf(`MergeToolCallDeltas should have returned 2 tool calls but returned %v`, toolCalls)
+	}
+
+	if toolCalls[0].ID != "call_1" || toolCalls[0].Function.Arguments != `{"city":"Paris"}` {
+		t.Fatalf(`MergeToolCallDeltas merged the first tool call as %v`, toolCalls[0])
+	}
+
+	if toolCalls[1].Function.Name != "get_time" {
+		t.Fatalf(`MergeToolCallDeltas merged the second tool call as %v`, toolCalls[1])
+	}
+}
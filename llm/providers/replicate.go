@@ -2,89 +2,140 @@ package providers
 
 import (
 	"context"
-	"errors"
-	"fmt"
-	"os"
+	"strings"
 
+	"github.com/polyfire/api/db"
 	"github.com/polyfire/api/llm/providers/options"
 	replicate "github.com/polyfire/api/llm/providers/replicate"
 	"github.com/polyfire/api/utils"
 )
 
 type ReplicateProvider struct {
-	Model           string
-	ReplicateAPIKey string
-	IsCustomAPIKey  bool
+	Model            string
+	Version          string
+	CreditsPerSecond float64
+	Stream           bool
+	ReplicateAPIKey  string
+	IsCustomAPIKey   bool
 }
 
-func NewReplicateProvider(ctx context.Context, model string) ReplicateProvider {
+/*
+ * The version of each model, its price and whether it can stream come from the
+ * catalog (the upstream_model, credit and option_stream columns)
+ */
+func NewReplicateProvider(ctx context.Context, model db.Model) ReplicateProvider {
 	var apiKey string
 
 	customToken, ok := ctx.Value(utils.ContextKeyReplicateToken).(string)
 	if ok {
 		apiKey = customToken
 	} else {
-		apiKey = os.Getenv("REPLICATE_API_KEY")
+		apiKey = utils.GetKeyPool("replicate").Acquire(ctx)
 	}
 
-	return ReplicateProvider{Model: model, ReplicateAPIKey: apiKey, IsCustomAPIKey: ok}
+	var creditsPerSecond float64
+	if model.CreditType == db.SecondCreditType && model.Credit != nil {
+		creditsPerSecond = float64(*model.Credit)
+	}
+
+	return ReplicateProvider{
+		Model:            model.Model,
+		Version:          model.UpstreamID(),
+		CreditsPerSecond: creditsPerSecond,
+		Stream:           model.OptionStream,
+		ReplicateAPIKey:  apiKey,
+		IsCustomAPIKey:   ok,
+	}
 }
 
-func (m ReplicateProvider) GetCreditsPerSecond() float64 {
+/*
+ * Most of the replicate models are raw completion models finetuned on a
+ * specific chat template. This returns the prompt (and the system prompt for
+ * the models accepting it as a separate input) in the format of each model.
+ */
+func (m ReplicateProvider) FormatPrompt(messages []options.Message, autoComplete bool) (string, string) {
+	if autoComplete {
+		return options.FlattenMessages(messages, true), ""
+	}
+
 	switch m.Model {
 	case "llama-2-70b-chat":
-		return 14000.0
-	case "replit-code-v1-3b":
-		return 11500.0
-	case "wizard-mega-13b-awq":
-		return 7250.0
+		return llama2ChatTurns(messages)
 	case "airoboros-llama-2-70b":
-		return 14000.0
+		return formatRolePrompt(messages, "A chat.", "USER: ", "ASSISTANT: "), ""
+	case "wizard-mega-13b-awq":
+		return formatRolePrompt(messages, "", "### Instruction: ", "### Assistant: "), ""
 	default:
-		fmt.Printf("Invalid model: %v\n", m.Model)
-		return 0.0
+		return options.FlattenMessages(messages, false), ""
 	}
 }
 
-func (m ReplicateProvider) GetVersion() (string, bool, error) {
+// The models without a chat template in FormatPrompt get the generic flattened chat
+func (m ReplicateProvider) flattensMessages() bool {
 	switch m.Model {
-	case "llama-2-70b-chat":
-		return "02e509c789964a7ea8736978a43525956ef40397be9033abf9fd2badfe68c9e3", true, nil
-	case "replit-code-v1-3b":
-		return "b84f4c074b807211cd75e3e8b1589b6399052125b4c27106e43d47189e8415ad", true, nil
-	case "wizard-mega-13b-awq":
-		return "a4be2a7c75e51c53b22167d44de3333436f1aa9253a201d2619cf74286478599", false, nil
-	case "airoboros-llama-2-70b":
-		return "ae090a64e6b4468d7fa85c6ca33c979b3cd941c12b1cfa2a237b4a7aa6ebaac4", true, nil
+	case "llama-2-70b-chat", "airoboros-llama-2-70b", "wizard-mega-13b-awq":
+		return false
 	default:
-		return "", false, errors.New("Invalid model")
+		return true
 	}
 }
 
+func formatRolePrompt(
+	messages []options.Message,
+	defaultSystemPrompt string,
+	userPrefix string,
+	assistantPrefix string,
+) string {
+	systemPrompt := ""
+	prompt := ""
+
+	for _, message := range messages {
+		switch message.Role {
+		case options.RoleSystem:
+			systemPrompt += strings.TrimSpace(message.Content) + "\n"
+		case options.RoleAssistant:
+			prompt += assistantPrefix + strings.TrimSpace(message.Content) + "\n"
+		default:
+			prompt += userPrefix + strings.TrimSpace(message.Content) + "\n"
+		}
+	}
+
+	if systemPrompt == "" && defaultSystemPrompt != "" {
+		systemPrompt = defaultSystemPrompt + "\n"
+	}
+
+	return systemPrompt + prompt + strings.TrimSpace(assistantPrefix)
+}
+
 func (m ReplicateProvider) Generate(
-	task string,
+	ctx context.Context,
+	messages []options.Message,
 	c options.ProviderCallback,
 	opts *options.ProviderOptions,
 ) chan options.Result {
-	version, stream, err := m.GetVersion()
-	if err != nil {
-		fmt.Printf("Error getting version: %v\n", err)
-		return nil
+	if opts == nil {
+		opts = &options.ProviderOptions{}
+	}
+
+	task, systemPrompt := m.FormatPrompt(messages, opts.AutoComplete)
+	if !opts.AutoComplete && m.flattensMessages() {
+		opts = opts.WithStopWord(options.FlattenedChatStopWord)
 	}
 
 	replicateProvider := replicate.ReplicateProvider{
 		Model:            m.Model,
 		ReplicateAPIKey:  m.ReplicateAPIKey,
 		IsCustomAPIKey:   m.IsCustomAPIKey,
-		Version:          version,
-		CreditsPerSecond: m.GetCreditsPerSecond(),
+		Version:          m.Version,
+		CreditsPerSecond: m.CreditsPerSecond,
+		SystemPrompt:     systemPrompt,
 	}
 
 	var chanRes chan options.Result
-	if stream {
-		chanRes = replicateProvider.Stream(task, c, opts)
+	if m.Stream {
+		chanRes = replicateProvider.Stream(ctx, task, c, opts)
 	} else {
-		chanRes = replicateProvider.NoStream(task, c, opts)
+		chanRes = replicateProvider.NoStream(ctx, task, c, opts)
 	}
 
 	return chanRes
@@ -101,3 +152,7 @@ func (m ReplicateProvider) ProviderModel() (string, string) {
 func (m ReplicateProvider) DoesFollowRateLimit() bool {
 	return !m.IsCustomAPIKey
 }
+
+func (m ReplicateProvider) UsesCustomKey() bool {
+	return m.IsCustomAPIKey
+}
@@ -1,21 +1,23 @@
 package providers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"time"
 
 	"github.com/polyfire/api/llm/providers/options"
-	"github.com/polyfire/api/tokens"
 )
 
 type ReplicatePredictionOutput struct {
-	ID     string `json:"id"`
-	Status string `json:"status"`
-	Output string `json:"output"`
+	ID      string           `json:"id"`
+	Status  string           `json:"status"`
+	Output  string           `json:"output"`
+	Metrics ReplicateMetrics `json:"metrics"`
 }
 
 func (m ReplicateProvider) NoStream(
+	ctx context.Context,
 	task string,
 	c options.ProviderCallback,
 	opts *options.ProviderOptions,
@@ -28,20 +30,27 @@ func (m ReplicateProvider) NoStream(
 		replicateStartTime := time.Now()
 		replicateAfterBootTime := time.Now()
 
-		startResponse, errorCode := m.ReplicateStart(task, opts, false)
+		startResponse, errorCode := m.ReplicateStart(ctx, task, opts, false)
 		if errorCode != "" {
 			chanRes <- options.Result{Err: errorCode}
 			return
 		}
+		m.ReplicateAPIKey = startResponse.apiKey
 
-		var completion string
-		tokenUsage := options.TokenUsage{}
+		if unsupported := opts.Unsupported(SupportedOptions...); len(unsupported) > 0 {
+			chanRes <- options.UnsupportedOptionsResult("replicate", unsupported)
+		}
 
-		tokenUsage.Input = tokens.CountTokens(task)
+		var completion string
+		var metrics ReplicateMetrics
 		coldBootDetected := false
 
 		for {
-			respBody, err := m.SendRequest(startResponse.URLs.Get)
+			respBody, err := m.SendRequest(ctx, startResponse.URLs.Get)
+			if ctx.Err() != nil {
+				_ = m.CancelPrediction(startResponse.URLs.Cancel)
+				break
+			}
 			if err != nil {
 				fmt.Println(err)
 				chanRes <- options.Result{Err: "generation_error"}
@@ -67,16 +76,28 @@ func (m ReplicateProvider) NoStream(
 
 			if output.Status == "succeeded" {
 				completion = output.Output
-				tokenUsage.Output = tokens.CountTokens(completion)
-				chanRes <- options.Result{Result: output.Output, TokenUsage: tokenUsage}
+				if opts.StopWords != nil {
+					completion, _ = CutAtStopWord(completion, *opts.StopWords)
+				}
+				metrics = output.Metrics
+				chanRes <- options.Result{Result: completion}
 				break
 			}
 
-			time.Sleep(1 * time.Second)
+			select {
+			case <-ctx.Done():
+			case <-time.After(1 * time.Second):
+			}
 		}
 
+		tokenUsage := metrics.TokenUsage(m.Model, task, completion)
+		chanRes <- options.Result{TokenUsage: tokenUsage}
+
 		replicateEndTime := time.Now()
 		duration := replicateEndTime.Sub(replicateAfterBootTime)
+		if metrics.PredictTime > 0 {
+			duration = time.Duration(metrics.PredictTime * float64(time.Second))
+		}
 
 		if c != nil {
 			credits := int(duration.Seconds()*m.CreditsPerSecond) + 1
@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -8,6 +9,13 @@ import (
 	"strings"
 
 	"github.com/polyfire/api/llm/providers/options"
+	"github.com/polyfire/api/tokens"
+	"github.com/polyfire/api/utils"
+)
+
+var httpClient = utils.NewRetryClient(
+	utils.NewKeyPoolClient(http.DefaultClient, "replicate", "Authorization", "Token "),
+	"replicate",
 )
 
 type ReplicateProvider struct {
@@ -16,6 +24,7 @@ type ReplicateProvider struct {
 	IsCustomAPIKey   bool
 	Version          string
 	CreditsPerSecond float64
+	SystemPrompt     string
 }
 
 type ReplicateInput struct {
@@ -24,7 +33,25 @@ type ReplicateInput struct {
 	Message string `json:"message"`
 	Text    string `json:"text"`
 
-	Temperature *float32 `json:"temperature,omitempty"`
+	SystemPrompt string   `json:"system_prompt,omitempty"`
+	Temperature  *float32 `json:"temperature,omitempty"`
+
+	// The models don't agree on the name of the max tokens input, the unknown inputs are ignored
+	MaxTokens        *int     `json:"max_tokens,omitempty"`
+	MaxNewTokens     *int     `json:"max_new_tokens,omitempty"`
+	TopP             *float32 `json:"top_p,omitempty"`
+	PresencePenalty  *float32 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float32 `json:"frequency_penalty,omitempty"`
+	Seed             *int     `json:"seed,omitempty"`
+}
+
+// Replicate predictions return a single output and have no logit bias
+var SupportedOptions = []string{
+	options.OptionMaxTokens,
+	options.OptionTopP,
+	options.OptionPresencePenalty,
+	options.OptionFrequencyPenalty,
+	options.OptionSeed,
 }
 
 type ReplicateRequestBody struct {
@@ -41,6 +68,19 @@ type ReplicateStartResponse struct {
 		Get    string `json:"get"`
 		Cancel string `json:"cancel"`
 	} `json:"urls"`
+
+	// The prediction must be followed with the key that created it, a retried 429 can change it
+	apiKey string
+}
+
+/*
+ * The language models on replicate report their token counts, and
+ * predict_time is the duration replicate bills, without the cold boot.
+ */
+type ReplicateMetrics struct {
+	PredictTime      float64 `json:"predict_time"`
+	InputTokenCount  int     `json:"input_token_count"`
+	OutputTokenCount int     `json:"output_token_count"`
 }
 
 type ReplicateStartErrorResponse struct {
@@ -50,6 +90,7 @@ type ReplicateStartErrorResponse struct {
 }
 
 func (m ReplicateProvider) ReplicateStart(
+	ctx context.Context,
 	task string,
 	opts *options.ProviderOptions,
 	stream bool,
@@ -60,21 +101,33 @@ func (m ReplicateProvider) ReplicateStart(
 		Stream:  stream,
 	}
 
-	if opts != nil && opts.Temperature != nil {
+	if opts != nil {
 		reqBody.Input.Temperature = opts.Temperature
+		reqBody.Input.MaxTokens = opts.MaxTokens
+		reqBody.Input.MaxNewTokens = opts.MaxTokens
+		reqBody.Input.TopP = opts.TopP
+		reqBody.Input.PresencePenalty = opts.PresencePenalty
+		reqBody.Input.FrequencyPenalty = opts.FrequencyPenalty
+		reqBody.Input.Seed = opts.Seed
 	}
 
 	reqBody.Input.Task = task
 	reqBody.Input.Prompt = task
 	reqBody.Input.Message = task
 	reqBody.Input.Text = task
+	reqBody.Input.SystemPrompt = m.SystemPrompt
 
 	input, err := json.Marshal(reqBody)
 	if err != nil {
 		return ReplicateStartResponse{}, "generation_error"
 	}
 
-	req, err := http.NewRequest("POST", "https://api.replicate.com/v1/predictions", strings.NewReader(string(input)))
+	req, err := http.NewRequestWithContext(
+		ctx,
+		"POST",
+		"https://api.replicate.com/v1/predictions",
+		strings.NewReader(string(input)),
+	)
 	if err != nil {
 		return ReplicateStartResponse{}, "generation_error"
 	}
@@ -82,11 +135,13 @@ func (m ReplicateProvider) ReplicateStart(
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Token "+m.ReplicateAPIKey)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return ReplicateStartResponse{}, "generation_error"
 	}
 
+	defer resp.Body.Close()
+
 	res, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return ReplicateStartResponse{}, "generation_error"
@@ -116,5 +171,57 @@ func (m ReplicateProvider) ReplicateStart(
 		return ReplicateStartResponse{}, "generation_error"
 	}
 
+	startResponse.apiKey = m.ReplicateAPIKey
+	if resp.Request != nil {
+		startResponse.apiKey = strings.TrimPrefix(resp.Request.Header.Get("Authorization"), "Token ")
+	}
+
 	return startResponse, ""
 }
+
+func (m ReplicateProvider) GetPredictionMetrics(getURL string) (ReplicateMetrics, error) {
+	req, err := http.NewRequestWithContext(utils.WithPinnedAPIKey(context.Background()), "GET", getURL, nil)
+	if err != nil {
+		return ReplicateMetrics{}, err
+	}
+
+	req.Header.Set("Authorization", "Token "+m.ReplicateAPIKey)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return ReplicateMetrics{}, err
+	}
+	defer resp.Body.Close()
+
+	var output struct {
+		Metrics ReplicateMetrics `json:"metrics"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&output)
+	if err != nil {
+		return ReplicateMetrics{}, err
+	}
+
+	return output.Metrics, nil
+}
+
+/*
+ * Uses the usage reported by replicate when there is one and counts the tokens
+ * of the prompt and completion otherwise.
+ */
+func (metrics ReplicateMetrics) TokenUsage(model string, task string, completion string) options.TokenUsage {
+	tokenizer := tokens.GetTokenizer("replicate", model)
+
+	tokenUsage := options.TokenUsage{
+		Input:  metrics.InputTokenCount,
+		Output: metrics.OutputTokenCount,
+	}
+
+	if tokenUsage.Input == 0 {
+		tokenUsage.Input = tokenizer.CountTokens(task)
+	}
+	if tokenUsage.Output == 0 && completion != "" {
+		tokenUsage.Output = tokenizer.CountTokens(completion)
+	}
+
+	return tokenUsage
+}
@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,7 +11,7 @@ import (
 	"time"
 
 	"github.com/polyfire/api/llm/providers/options"
-	"github.com/polyfire/api/tokens"
+	"github.com/polyfire/api/utils"
 )
 
 type ReplicateEvent struct {
@@ -85,8 +86,8 @@ type ReplicateStreamPredictionOutput struct {
 	Status string `json:"status"`
 }
 
-func (m ReplicateProvider) SendRequest(streamURL string) (io.ReadCloser, error) {
-	req, err := http.NewRequest("GET", streamURL, nil)
+func (m ReplicateProvider) SendRequest(ctx context.Context, streamURL string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(utils.WithPinnedAPIKey(ctx), "GET", streamURL, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -94,7 +95,7 @@ func (m ReplicateProvider) SendRequest(streamURL string) (io.ReadCloser, error)
 	req.Header.Set("Authorization", "Token "+m.ReplicateAPIKey)
 	req.Header.Set("Accept", "text/event-stream")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -102,6 +103,26 @@ func (m ReplicateProvider) SendRequest(streamURL string) (io.ReadCloser, error)
 	return resp.Body, nil
 }
 
+/*
+ * The prediction keeps running (and being billed by replicate) until it's
+ * canceled, even when the request that started it has been aborted.
+ */
+func (m ReplicateProvider) CancelPrediction(cancelURL string) error {
+	req, err := http.NewRequestWithContext(utils.WithPinnedAPIKey(context.Background()), "POST", cancelURL, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Token "+m.ReplicateAPIKey)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
 type ReplicateStreamEventBuffer struct {
 	buffer string
 	Reader io.ReadCloser
@@ -137,24 +158,64 @@ type StopWords struct {
 
 var ErrStopWordFound = errors.New("Stop word found")
 
+// Returns the text before the first stop word it contains
+func CutAtStopWord(text string, stopWords []string) (string, bool) {
+	end := -1
+	for _, stopWord := range stopWords {
+		if stopWord == "" {
+			continue
+		}
+		if i := strings.Index(text, stopWord); i >= 0 && (end < 0 || i < end) {
+			end = i
+		}
+	}
+
+	if end < 0 {
+		return text, false
+	}
+	return text[:end], true
+}
+
+/*
+ * Returns the part of the output that can be sent. The end of the output that
+ * could be the beginning of a stop word is held back until the next data. Once
+ * a stop word is found, the text before it is returned with ErrStopWordFound.
+ */
 func (sw *StopWords) CacheStopWords(data string) (string, error) {
 	if sw.StopWords == nil {
 		return data, nil
 	}
 	sw.stopWordsCache += data
+
+	if result, found := CutAtStopWord(sw.stopWordsCache, *sw.StopWords); found {
+		sw.stopWordsCache = ""
+		return result, ErrStopWordFound
+	}
+
+	held := 0
 	for _, stopWord := range *sw.StopWords {
-		if stopWord == strings.TrimSpace(sw.stopWordsCache) ||
-			strings.HasPrefix(strings.TrimSpace(sw.stopWordsCache), stopWord) {
-			return sw.stopWordsCache, ErrStopWordFound
+		n := len(stopWord) - 1
+		if n > len(sw.stopWordsCache) {
+			n = len(sw.stopWordsCache)
 		}
-		if strings.HasPrefix(stopWord, strings.TrimSpace(sw.stopWordsCache)) {
-			return "", nil
+		for ; n > held; n-- {
+			if strings.HasSuffix(sw.stopWordsCache, stopWord[:n]) {
+				held = n
+				break
+			}
 		}
 	}
 
+	result := sw.stopWordsCache[:len(sw.stopWordsCache)-held]
+	sw.stopWordsCache = sw.stopWordsCache[len(sw.stopWordsCache)-held:]
+	return result, nil
+}
+
+// Returns the output held back at the end of the generation
+func (sw *StopWords) Flush() string {
 	result := sw.stopWordsCache
 	sw.stopWordsCache = ""
-	return result, nil
+	return result
 }
 
 func ReceiveStream(
@@ -177,6 +238,10 @@ func ReceiveStream(
 
 		if event.Event == "done" {
 			fmt.Println("Done", event)
+			if result := stopWords.Flush(); result != "" {
+				completion += result
+				chanRes <- options.Result{Result: result}
+			}
 			return completion, true
 		}
 
@@ -194,6 +259,10 @@ func ReceiveStream(
 
 			if errors.Is(err, ErrStopWordFound) || err != nil {
 				fmt.Printf("%v\n", err)
+				if result != "" {
+					completion += result
+					chanRes <- options.Result{Result: result}
+				}
 				return completion, true
 			}
 
@@ -203,15 +272,13 @@ func ReceiveStream(
 
 			completion += result
 
-			tokenUsage := options.TokenUsage{}
-			tokenUsage.Output = tokens.CountTokens(result)
-
-			chanRes <- options.Result{Result: result, TokenUsage: tokenUsage}
+			chanRes <- options.Result{Result: result}
 		}
 	}
 }
 
 func (m ReplicateProvider) Stream(
+	ctx context.Context,
 	task string,
 	c options.ProviderCallback,
 	opts *options.ProviderOptions,
@@ -220,24 +287,25 @@ func (m ReplicateProvider) Stream(
 
 	go func() {
 		defer close(chanRes)
-		tokenUsage := options.TokenUsage{Input: 0, Output: 0}
-		tokenUsage.Input += tokens.CountTokens(task)
-		chanRes <- options.Result{TokenUsage: tokenUsage}
 
-		startResponse, errorCode := m.ReplicateStart(task, opts, true)
+		startResponse, errorCode := m.ReplicateStart(ctx, task, opts, true)
 		if errorCode != "" {
 			chanRes <- options.Result{Err: errorCode}
 			return
 		}
+		m.ReplicateAPIKey = startResponse.apiKey
+
+		if unsupported := opts.Unsupported(SupportedOptions...); len(unsupported) > 0 {
+			chanRes <- options.UnsupportedOptionsResult("replicate", unsupported)
+		}
 
 		var replicateAfterBootTime *time.Time
 
-		totalOutputTokens := 0
 		totalCompletion := ""
 		stopWords := StopWords{StopWords: opts.StopWords}
 
 		for {
-			respBody, err := m.SendRequest(startResponse.URLs.Stream)
+			respBody, err := m.SendRequest(ctx, startResponse.URLs.Stream)
 			if err != nil {
 				chanRes <- options.Result{Err: "generation_error"}
 				return
@@ -247,12 +315,11 @@ func (m ReplicateProvider) Stream(
 
 			completion, done := ReceiveStream(chanRes, &stopWords, &eb, &replicateAfterBootTime)
 			totalCompletion += completion
-			totalOutputTokens += tokens.CountTokens(completion)
-			if done {
+			if done || ctx.Err() != nil {
 				break
 			}
 
-			respBody, err = m.SendRequest(startResponse.URLs.Get)
+			respBody, err = m.SendRequest(ctx, startResponse.URLs.Get)
 			if err != nil {
 				fmt.Println(err)
 				chanRes <- options.Result{Err: "generation_error"}
@@ -273,7 +340,7 @@ func (m ReplicateProvider) Stream(
 			fmt.Println("Waiting for model to start...", output.Status, output)
 		}
 
-		_, err := m.SendRequest(startResponse.URLs.Cancel)
+		err := m.CancelPrediction(startResponse.URLs.Cancel)
 		if err != nil {
 			fmt.Println(err)
 			chanRes <- options.Result{Err: "generation_error"}
@@ -287,9 +354,20 @@ func (m ReplicateProvider) Stream(
 			duration = replicateEndTime.Sub(*replicateAfterBootTime)
 		}
 
+		metrics, err := m.GetPredictionMetrics(startResponse.URLs.Get)
+		if err != nil {
+			fmt.Println(err)
+		}
+		if metrics.PredictTime > 0 {
+			duration = time.Duration(metrics.PredictTime * float64(time.Second))
+		}
+
+		tokenUsage := metrics.TokenUsage(m.Model, task, totalCompletion)
+		chanRes <- options.Result{TokenUsage: tokenUsage}
+
 		if c != nil {
 			credits := int(duration.Seconds()*m.CreditsPerSecond) + 1
-			(*c)("replicate", m.Model, tokenUsage.Input, totalOutputTokens, totalCompletion, &credits)
+			(*c)("replicate", m.Model, tokenUsage.Input, tokenUsage.Output, totalCompletion, &credits)
 		}
 	}()
 
@@ -0,0 +1,23 @@
+package providers
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCacheStopWords(t *testing.T) {
+	stopWords := StopWords{StopWords: &[]string{"\nUser:"}}
+
+	str := ""
+	for _, data := range []string{"Hello", "\n", "Use", "d to it.", "\nUs", "er: next"} {
+		result, err := stopWords.CacheStopWords(data)
+		str += result
+		if errors.Is(err, ErrStopWordFound) {
+			break
+		}
+	}
+
+	if str != "Hello\nUsed to it." {
+		t.Fatalf(`The output should have stopped before "\nUser:" but was %q`, str)
+	}
+}
@@ -0,0 +1,217 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	database "github.com/polyfire/api/db"
+	"github.com/polyfire/api/llm/providers/options"
+	"github.com/polyfire/api/utils"
+)
+
+/*
+ * The "auto" model picks a model for each request among the candidates of the
+ * routing rules of the project: the ones without the capabilities the request
+ * needs, too small for its prompt, unaffordable with the remaining credits,
+ * with an open circuit or too slow are ruled out. A short prompt then goes to
+ * the cheapest candidate left and a long one (or one with tools) to the most
+ * capable, unless the remaining credits are low.
+ */
+
+const AutoModel = "auto"
+
+var ErrNoRoutableModel = errors.New("No model can handle the request")
+
+var DefaultRoutingRules = database.RoutingRules{
+	Candidates:             []string{"claude-3-haiku-20240307", "gpt-3.5-turbo", "gpt-4o", "claude-3-5-sonnet-20240620"},
+	ComplexPromptTokens:    2000,
+	LowBudgetRequests:      20,
+	MaxFirstTokenLatencyMs: 10000,
+}
+
+// The answer is unknown before the generation, its length is guessed to estimate its cost
+const RoutingExpectedOutputTokens = 500
+
+type RoutingRequest struct {
+	PromptTokens int
+	JSONFormat   bool
+	JSONSchema   bool
+	Tools        bool
+	Vision       bool
+}
+
+func routingRules(ctx context.Context, projectID string) database.RoutingRules {
+	rules := DefaultRoutingRules
+	db := ctx.Value(utils.ContextKeyDB).(database.Database)
+
+	projectRules, err := db.GetRoutingRules(projectID)
+	if err != nil {
+		log.Printf("[ERROR] Can't load the routing rules of %s: %v\n", projectID, err)
+		return rules
+	}
+	if projectRules == nil {
+		return rules
+	}
+
+	if len(projectRules.Candidates) > 0 {
+		rules.Candidates = projectRules.Candidates
+	}
+	if projectRules.ComplexPromptTokens > 0 {
+		rules.ComplexPromptTokens = projectRules.ComplexPromptTokens
+	}
+	if projectRules.LowBudgetRequests > 0 {
+		rules.LowBudgetRequests = projectRules.LowBudgetRequests
+	}
+	if projectRules.MaxFirstTokenLatencyMs > 0 {
+		rules.MaxFirstTokenLatencyMs = projectRules.MaxFirstTokenLatencyMs
+	}
+
+	return rules
+}
+
+// The credits the user can still spend this month, nil without any limit
+func remainingCredits(ctx context.Context) *int64 {
+	usage, _ := ctx.Value(utils.ContextKeyProjectUserUsage).(int64)
+	rateLimit, _ := ctx.Value(utils.ContextKeyProjectUserRateLimit).(*int64)
+	if rateLimit == nil {
+		return nil
+	}
+
+	remaining := *rateLimit - usage
+	return &remaining
+}
+
+func firstTokenLatency(providerName string, modelName string) time.Duration {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+
+	h, ok := health[providerName+"/"+modelName]
+	if !ok {
+		return 0
+	}
+	return h.firstTokenLatency
+}
+
+func (r RoutingRequest) requirements() string {
+	requirements := []string{}
+	if r.JSONFormat {
+		requirements = append(requirements, "json")
+	}
+	if r.JSONSchema {
+		requirements = append(requirements, "json_schema")
+	}
+	if r.Tools {
+		requirements = append(requirements, "tools")
+	}
+	if r.Vision {
+		requirements = append(requirements, "vision")
+	}
+
+	if len(requirements) == 0 {
+		return ""
+	}
+	return " with " + strings.Join(requirements, ", ")
+}
+
+func (r RoutingRequest) canUse(model database.Model) bool {
+	capabilities := model.Capabilities()
+
+	if r.JSONFormat && !capabilities.JSON {
+		return false
+	}
+	// A JSON schema can also be answered with the structured output tool
+	if r.JSONSchema && !capabilities.JSON && !capabilities.Tools {
+		return false
+	}
+	if r.Tools && !capabilities.Tools {
+		return false
+	}
+	if r.Vision && !capabilities.Vision {
+		return false
+	}
+
+	return model.ContextWindow == nil || *model.ContextWindow >= r.PromptTokens+RoutingExpectedOutputTokens
+}
+
+func Route(ctx context.Context, request RoutingRequest) (*options.Routing, error) {
+	projectID, _ := ctx.Value(utils.ContextKeyProjectID).(string)
+	db := ctx.Value(utils.ContextKeyDB).(database.Database)
+
+	catalog, err := db.GetCatalog()
+	if err != nil {
+		return nil, err
+	}
+
+	rules := routingRules(ctx, projectID)
+	remaining := remainingCredits(ctx)
+	maxLatency := time.Duration(rules.MaxFirstTokenLatencyMs) * time.Millisecond
+
+	cost := func(model *database.Model) int {
+		return model.Credits(request.PromptTokens, RoutingExpectedOutputTokens)
+	}
+
+	eligible := []*database.Model{}
+	slow := []*database.Model{}
+	for _, candidate := range rules.Candidates {
+		model := catalog.Resolve(candidate, projectID, "completion")
+		if model == nil || !request.canUse(*model) || !circuitAllows(model.Provider, model.Model) {
+			continue
+		}
+		if remaining != nil && int64(cost(model)) > *remaining {
+			continue
+		}
+
+		if latency := firstTokenLatency(model.Provider, model.Model); maxLatency > 0 && latency > maxLatency {
+			slow = append(slow, model)
+			continue
+		}
+		eligible = append(eligible, model)
+	}
+
+	// The slow models are better than nothing
+	if len(eligible) == 0 {
+		eligible = slow
+	}
+	if len(eligible) == 0 {
+		return nil, ErrNoRoutableModel
+	}
+
+	mostCapable := eligible[len(eligible)-1]
+
+	if remaining != nil && *remaining < int64(rules.LowBudgetRequests*cost(mostCapable)) {
+		cheapest := eligible[0]
+		for _, model := range eligible {
+			if cost(model) < cost(cheapest) {
+				cheapest = model
+			}
+		}
+
+		return &options.Routing{
+			Model:  cheapest.Model,
+			Reason: fmt.Sprintf("%d credits left, cheapest model%s", *remaining, request.requirements()),
+		}, nil
+	}
+
+	if request.PromptTokens >= rules.ComplexPromptTokens {
+		return &options.Routing{
+			Model:  mostCapable.Model,
+			Reason: fmt.Sprintf("long prompt (%d tokens), most capable model%s", request.PromptTokens, request.requirements()),
+		}, nil
+	}
+
+	if request.Tools {
+		return &options.Routing{
+			Model:  mostCapable.Model,
+			Reason: "tool calls, most capable model" + request.requirements(),
+		}, nil
+	}
+
+	return &options.Routing{
+		Model:  eligible[0].Model,
+		Reason: fmt.Sprintf("short prompt (%d tokens), cheapest model%s", request.PromptTokens, request.requirements()),
+	}, nil
+}
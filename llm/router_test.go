@@ -0,0 +1,88 @@
+package llm
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	database "github.com/polyfire/api/db"
+	"github.com/polyfire/api/utils"
+)
+
+func mockRoutingCatalog() (*database.Catalog, error) {
+	cheapCredit, bestCredit := 1, 10
+	smallWindow, largeWindow := 4096, 128000
+
+	return database.NewCatalog([]database.Model{
+		{
+			ID: 1, Model: "cheap-model", Provider: "fake", Type: "completion",
+			CreditType: database.TokenInputOutputCreditType, CreditInput: &cheapCredit, CreditOutput: &cheapCredit,
+			ContextWindow: &smallWindow,
+		},
+		{
+			ID: 2, Model: "best-model", Provider: "fake", Type: "completion",
+			CreditType: database.TokenInputOutputCreditType, CreditInput: &bestCredit, CreditOutput: &bestCredit,
+			ContextWindow: &largeWindow, OptionJSON: true, OptionTools: true,
+		},
+	}, nil), nil
+}
+
+func routingContext(rateLimit *int64) context.Context {
+	ctx := context.WithValue(context.Background(), utils.ContextKeyDB, database.MockDatabase{
+		MockGetCatalog: mockRoutingCatalog,
+		MockGetRoutingRules: func(_ string) (*database.RoutingRules, error) {
+			return &database.RoutingRules{Candidates: []string{"cheap-model", "best-model"}, ComplexPromptTokens: 1000}, nil
+		},
+	})
+	ctx = context.WithValue(ctx, utils.ContextKeyProjectID, "project")
+	ctx = context.WithValue(ctx, utils.ContextKeyProjectUserUsage, int64(0))
+	return context.WithValue(ctx, utils.ContextKeyProjectUserRateLimit, rateLimit)
+}
+
+func TestRoute(t *testing.T) {
+	ResetProvidersHealth()
+	ctx := routingContext(nil)
+
+	tests := []struct {
+		request RoutingRequest
+		model   string
+	}{
+		{RoutingRequest{PromptTokens: 10}, "cheap-model"},
+		{RoutingRequest{PromptTokens: 1500}, "best-model"},
+		{RoutingRequest{PromptTokens: 10, JSONFormat: true}, "best-model"},
+		{RoutingRequest{PromptTokens: 10, JSONSchema: true}, "best-model"},
+		{RoutingRequest{PromptTokens: 10, Tools: true}, "best-model"},
+	}
+
+	for _, test := range tests {
+		routing, err := Route(ctx, test.request)
+		if err != nil {
+			t.Fatalf("Route(%+v) returned an error: %v", test.request, err)
+		}
+		if routing.Model != test.model || routing.Reason == "" {
+			t.Fatalf("Route(%+v) should have picked %s but returned %+v", test.request, test.model, routing)
+		}
+	}
+
+	if _, err := Route(ctx, RoutingRequest{PromptTokens: 10, Vision: true}); err != ErrNoRoutableModel {
+		t.Fatalf("Route should have found no model with vision but returned %v", err)
+	}
+
+	// 50000 credits can't pay for 20 long requests to best-model
+	rateLimit := int64(50000)
+	routing, err := Route(routingContext(&rateLimit), RoutingRequest{PromptTokens: 1500})
+	if err != nil || routing.Model != "cheap-model" || !strings.Contains(routing.Reason, "credits left") {
+		t.Fatalf("Route should have picked the cheapest model with a low budget but returned %+v, %v", routing, err)
+	}
+}
+
+func TestRoutingToolsForJSONSchemaOnly(t *testing.T) {
+	toolsModel := database.Model{Model: "tools-model", OptionTools: true}
+
+	if (RoutingRequest{JSONFormat: true}).canUse(toolsModel) {
+		t.Fatalf("A model without the JSON mode shouldn't be used for json_format")
+	}
+	if !(RoutingRequest{JSONSchema: true}).canUse(toolsModel) {
+		t.Fatalf("A model with tools should be used for a json_schema, answered with the structured output tool")
+	}
+}
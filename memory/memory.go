@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"net/http"
+	"sort"
 
 	"github.com/google/uuid"
 
@@ -11,12 +12,25 @@ import (
 
 	database "github.com/polyfire/api/db"
 	"github.com/polyfire/api/llm"
+	"github.com/polyfire/api/llm/providers"
 	"github.com/polyfire/api/tokens"
 	"github.com/polyfire/api/utils"
 )
 
 const BatchSize int = 512
 
+const MatchCount int = 10
+
+func embeddingCallback(ctx context.Context, userID string) func(string, string, int) {
+	db := ctx.Value(utils.ContextKeyDB).(database.Database)
+	projectID, _ := ctx.Value(utils.ContextKeyProjectID).(string)
+	return func(provider string, model string, inputCount int) {
+		db.LogRequests(
+			ctx.Value(utils.ContextKeyEventID).(string),
+			userID, projectID, provider, model, inputCount, 0, "embedding", true, utils.APIKeyID(ctx, provider))
+	}
+}
+
 func Create(w http.ResponseWriter, r *http.Request, _ router.Params) {
 	db := r.Context().Value(utils.ContextKeyDB).(database.Database)
 	record := r.Context().Value(utils.ContextKeyRecordEvent).(utils.RecordFunc)
@@ -27,7 +41,8 @@ func Create(w http.ResponseWriter, r *http.Request, _ router.Params) {
 	}
 
 	var requestBody struct {
-		Public *bool `json:"public,omitempty"`
+		Public         *bool  `json:"public,omitempty"`
+		EmbeddingModel string `json:"embedding_model,omitempty"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
@@ -40,15 +55,32 @@ func Create(w http.ResponseWriter, r *http.Request, _ router.Params) {
 		requestBody.Public = &defaultVal
 	}
 
+	embedder, err := llm.NewEmbedder(r.Context(), requestBody.EmbeddingModel)
+	if err == llm.ErrUnknownEmbeddingModel {
+		utils.RespondError(w, record, "unknown_embedding_model")
+		return
+	} else if err != nil {
+		utils.RespondError(w, record, "embedding_error")
+		return
+	}
+
+	_, embeddingModel := embedder.ProviderModel()
 	memoryID := uuid.New().String()
 
-	if err := db.CreateMemory(memoryID, userID, *requestBody.Public); err != nil {
+	err = db.CreateMemory(memoryID, userID, *requestBody.Public, embeddingModel, embedder.Dimensions())
+	if err != nil {
 		utils.RespondError(w, record, "db_creation_error")
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	memory := database.Memory{ID: memoryID, UserID: userID, Public: *requestBody.Public}
+	memory := database.Memory{
+		ID:                  memoryID,
+		UserID:              userID,
+		Public:              *requestBody.Public,
+		EmbeddingModel:      embeddingModel,
+		EmbeddingDimensions: embedder.Dimensions(),
+	}
 
 	response, _ := json.Marshal(&memory)
 	record(string(response))
@@ -99,12 +131,20 @@ func Add(w http.ResponseWriter, r *http.Request, _ router.Params) {
 		chunks = append(chunks, chunk[:]...)
 	}
 
-	callback := func(model_name string, input_count int) {
-		db.LogRequests(
-			r.Context().Value(utils.ContextKeyEventID).(string),
-			userID, "openai", model_name, input_count, 0, "embedding", true)
+	memory, err := db.GetMemory(requestBody.ID)
+	if err != nil {
+		utils.RespondError(w, record, "not_found")
+		return
+	}
+
+	embedder, err := llm.NewEmbedder(r.Context(), memory.EmbeddingModel)
+	if err != nil {
+		utils.RespondError(w, record, "embedding_error")
+		return
 	}
 
+	callback := embeddingCallback(r.Context(), userID)
+
 	var embeddings [][]float32
 
 	batches, err := tokens.BatchText(chunks, 2000)
@@ -114,7 +154,13 @@ func Add(w http.ResponseWriter, r *http.Request, _ router.Params) {
 	}
 
 	for _, batch := range batches {
-		embeddingsBatch, err := llm.Embed(r.Context(), batch, &callback)
+		embeddingsBatch, err := llm.Embed(
+			r.Context(),
+			embedder,
+			batch,
+			providers.EmbeddingInputDocument,
+			&callback,
+		)
 		if err != nil {
 			utils.RespondError(w, record, "embedding_error")
 			return
@@ -181,22 +227,50 @@ func Get(w http.ResponseWriter, r *http.Request, _ router.Params) {
 	_ = json.NewEncoder(w).Encode(response)
 }
 
-func Embedder(ctx context.Context, userID string, memoryID []string, task string) ([]database.MatchResult, error) {
+/*
+ * The task is embedded once per embedding model of the memories, each memory
+ * is only searched with the vectors of its own model.
+ */
+func Embedder(ctx context.Context, userID string, memoryIDs []string, task string) ([]database.MatchResult, error) {
 	db := ctx.Value(utils.ContextKeyDB).(database.Database)
-	callback := func(model_name string, input_count int) {
-		db.LogRequests(
-			ctx.Value(utils.ContextKeyEventID).(string),
-			userID, "openai", model_name, input_count, 0, "embedding", true)
-	}
+	callback := embeddingCallback(ctx, userID)
 
-	embeddings, err := llm.Embed(ctx, []string{task}, &callback)
+	memories, err := db.GetMemories(memoryIDs)
 	if err != nil {
 		return nil, err
 	}
 
-	results, err := db.MatchEmbeddings(memoryID, userID, embeddings[0])
-	if err != nil {
-		return nil, err
+	memoriesByModel := make(map[string][]string)
+	for _, memory := range memories {
+		memoriesByModel[memory.EmbeddingModel] = append(memoriesByModel[memory.EmbeddingModel], memory.ID)
+	}
+
+	results := make([]database.MatchResult, 0)
+	for embeddingModel, ids := range memoriesByModel {
+		embedder, err := llm.NewEmbedder(ctx, embeddingModel)
+		if err != nil {
+			return nil, err
+		}
+
+		embeddings, err := llm.Embed(ctx, embedder, []string{task}, providers.EmbeddingInputQuery, &callback)
+		if err != nil {
+			return nil, err
+		}
+
+		matches, err := db.MatchEmbeddings(ids, userID, embeddingModel, embeddings[0])
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, matches...)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Similarity > results[j].Similarity
+	})
+
+	if len(results) > MatchCount {
+		results = results[:MatchCount]
 	}
 
 	return results, nil
@@ -2,10 +2,12 @@ package middlewares
 
 import (
 	"context"
+	"crypto/subtle"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 
 	jwt "github.com/golang-jwt/jwt/v5"
 	router "github.com/julienschmidt/httprouter"
@@ -32,15 +34,14 @@ func ParseJWT(token string) (jwt.MapClaims, error) {
 	return claims, nil
 }
 
-func createUserContext(
-	r *http.Request,
+func withUserInfos(
+	ctx context.Context,
 	userID string,
 	user *database.UserInfos,
 	rateLimitStatus database.RateLimitStatus,
 	creditsStatus database.CreditsStatus,
 ) context.Context {
-	recordEventWithUserID := r.Context().Value(utils.ContextKeyRecordEventWithUserID).(utils.RecordWithUserIDFunc)
-	newCtx := context.WithValue(r.Context(), utils.ContextKeyUserID, userID)
+	newCtx := context.WithValue(ctx, utils.ContextKeyUserID, userID)
 	newCtx = context.WithValue(newCtx, utils.ContextKeyRateLimitStatus, rateLimitStatus)
 	newCtx = context.WithValue(newCtx, utils.ContextKeyCreditsStatus, creditsStatus)
 	if user != nil {
@@ -59,8 +60,31 @@ func createUserContext(
 		if user.ElevenlabsToken != "" {
 			newCtx = context.WithValue(newCtx, utils.ContextKeyElevenlabsToken, user.ElevenlabsToken)
 		}
+		if user.AnthropicToken != "" {
+			newCtx = context.WithValue(newCtx, utils.ContextKeyAnthropicToken, user.AnthropicToken)
+		}
+
+		moderationPolicy, err := database.ParseModerationPolicy(user.Moderation)
+		if err != nil {
+			log.Printf("[ERROR] Invalid moderation policy for project %s: %v\n", user.ProjectID, err)
+		} else if moderationPolicy != nil {
+			newCtx = context.WithValue(newCtx, utils.ContextKeyModerationPolicy, moderationPolicy)
+		}
 	}
 
+	return newCtx
+}
+
+func createUserContext(
+	r *http.Request,
+	userID string,
+	user *database.UserInfos,
+	rateLimitStatus database.RateLimitStatus,
+	creditsStatus database.CreditsStatus,
+) context.Context {
+	recordEventWithUserID := r.Context().Value(utils.ContextKeyRecordEventWithUserID).(utils.RecordWithUserIDFunc)
+	newCtx := withUserInfos(r.Context(), userID, user, rateLimitStatus, creditsStatus)
+
 	var recordEvent utils.RecordFunc = func(response string, props ...utils.KeyValue) {
 		recordEventWithUserID(response, userID, props...)
 	}
@@ -70,6 +94,21 @@ func createUserContext(
 	return newCtx
 }
 
+/*
+ * The asynchronous generation jobs run outside of any request. Their context
+ * is rebuilt from the user the same way the authentication does it.
+ */
+func UserContext(ctx context.Context, userID string) (context.Context, error) {
+	db := ctx.Value(utils.ContextKeyDB).(database.Database)
+
+	user, rateLimitStatus, creditsStatus, err := db.CheckRateLimit(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return withUserInfos(ctx, userID, user, rateLimitStatus, creditsStatus), nil
+}
+
 func authenticateAndHandle(
 	w http.ResponseWriter,
 	r *http.Request,
@@ -150,3 +189,29 @@ func AuthStream(
 		authenticateAndHandle(w, r, params, token, handler)
 	}
 }
+
+/*
+ * The internal endpoints are called by our own services with the
+ * INTERNAL_API_TOKEN, they don't exist when it isn't set.
+ */
+func Internal(
+	handler func(http.ResponseWriter, *http.Request, router.Params),
+) func(http.ResponseWriter, *http.Request, router.Params) {
+	return func(w http.ResponseWriter, r *http.Request, params router.Params) {
+		record := r.Context().Value(utils.ContextKeyRecordEvent).(utils.RecordFunc)
+		internalToken := os.Getenv("INTERNAL_API_TOKEN")
+
+		if internalToken == "" {
+			utils.RespondError(w, record, "not_found")
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(internalToken)) != 1 {
+			utils.RespondError(w, record, "invalid_token")
+			return
+		}
+
+		handler(w, r, params)
+	}
+}
@@ -0,0 +1,19 @@
+def migrate(cur, rls=False):
+    cur.execute("""
+        ALTER TABLE auth_users ADD COLUMN anthropic_token text;
+
+        INSERT INTO models(model, provider, credit_input, credit_type, type, credit_output, image_url, official_name, hidden, option_stream, option_temperature, option_stop)
+        VALUES
+            ('claude-3-5-sonnet-20240620', 'anthropic', 30, 'token_input_output', 'completion', 150, '/anthropic.webp', 'Anthropic', false, true, true, true),
+            ('claude-3-opus-20240229', 'anthropic', 150, 'token_input_output', 'completion', 750, '/anthropic.webp', 'Anthropic', false, true, true, true),
+            ('claude-3-sonnet-20240229', 'anthropic', 30, 'token_input_output', 'completion', 150, '/anthropic.webp', 'Anthropic', false, true, true, true),
+            ('claude-3-haiku-20240307', 'anthropic', 3, 'token_input_output', 'completion', 13, '/anthropic.webp', 'Anthropic', false, true, true, true)
+        ON CONFLICT (model) DO NOTHING;
+    """)
+
+def rollback(cur, rls=False):
+    cur.execute("""
+        DELETE FROM models WHERE provider = 'anthropic';
+
+        ALTER TABLE auth_users DROP COLUMN anthropic_token;
+    """)
@@ -0,0 +1,87 @@
+def migrate(cur, rls=False):
+    cur.execute("""
+        ALTER TABLE models ADD COLUMN project_id uuid REFERENCES projects(id) ON DELETE CASCADE;
+        ALTER TABLE models ADD COLUMN base_url text;
+        ALTER TABLE models ADD COLUMN api_key text;
+        ALTER TABLE models ADD COLUMN upstream_model text;
+
+        -- Each project names its models freely, the global names stay unique among themselves.
+        -- The model names of request_logs can't reference a single model anymore.
+        ALTER TABLE request_logs DROP CONSTRAINT request_logs_model_name_fkey;
+        ALTER TABLE models DROP CONSTRAINT models_model_key;
+        CREATE UNIQUE INDEX models_model_key ON models (model) WHERE project_id IS NULL;
+        ALTER TABLE models ADD CONSTRAINT models_project_id_model_key UNIQUE (project_id, model);
+
+        CREATE OR REPLACE FUNCTION public.get_model_info_by_project_id(param_project_id uuid) RETURNS TABLE(model_name text, provider text, credit_input bigint, credit_type text, type text, credit_output bigint, credit bigint, image_url text, total_credits bigint)
+            LANGUAGE plpgsql
+            AS $$
+        BEGIN
+            RETURN QUERY
+            SELECT
+                request_logs.model_name,
+                models.provider,
+                models.credit_input,
+                models.credit_type,
+                models.type,
+                models.credit_output,
+                models.credit,
+                models.image_url,
+                CAST(SUM(request_logs.credits) AS BIGINT) AS total_credits
+            FROM
+                request_logs
+            JOIN
+                project_users ON project_users.id::text = request_logs.user_id::text
+            JOIN
+                models ON request_logs.model_name = models.model
+                    AND (models.project_id IS NULL OR models.project_id = param_project_id)
+            WHERE
+                project_users.project_id = param_project_id
+            GROUP BY
+                request_logs.model_name, models.provider, models.credit_input, models.credit_type, models.type, models.credit_output, models.credit, models.image_url;
+        END;
+        $$;
+    """)
+
+def rollback(cur, rls=False):
+    cur.execute("""
+        DELETE FROM model_aliases WHERE model_id IN (SELECT id FROM models WHERE provider = 'openai-compatible');
+        DELETE FROM models WHERE provider = 'openai-compatible';
+
+        ALTER TABLE models DROP CONSTRAINT models_project_id_model_key;
+        DROP INDEX models_model_key;
+        ALTER TABLE models ADD CONSTRAINT models_model_key UNIQUE (model);
+        ALTER TABLE request_logs ADD CONSTRAINT request_logs_model_name_fkey FOREIGN KEY (model_name) REFERENCES models(model) NOT VALID;
+
+        CREATE OR REPLACE FUNCTION public.get_model_info_by_project_id(param_project_id uuid) RETURNS TABLE(model_name text, provider text, credit_input bigint, credit_type text, type text, credit_output bigint, credit bigint, image_url text, total_credits bigint)
+            LANGUAGE plpgsql
+            AS $$
+        BEGIN
+            RETURN QUERY
+            SELECT
+                request_logs.model_name,
+                models.provider,
+                models.credit_input,
+                models.credit_type,
+                models.type,
+                models.credit_output,
+                models.credit,
+                models.image_url,
+                CAST(SUM(request_logs.credits) AS BIGINT) AS total_credits
+            FROM
+                request_logs
+            JOIN
+                project_users ON project_users.id::text = request_logs.user_id::text
+            JOIN
+                models ON request_logs.model_name = models.model
+            WHERE
+                project_users.project_id = param_project_id
+            GROUP BY
+                request_logs.model_name, models.provider, models.credit_input, models.credit_type, models.type, models.credit_output, models.credit, models.image_url;
+        END;
+        $$;
+
+        ALTER TABLE models DROP COLUMN upstream_model;
+        ALTER TABLE models DROP COLUMN api_key;
+        ALTER TABLE models DROP COLUMN base_url;
+        ALTER TABLE models DROP COLUMN project_id;
+    """)
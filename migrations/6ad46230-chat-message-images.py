@@ -0,0 +1,9 @@
+def migrate(cur, rls=False):
+    cur.execute("""
+        ALTER TABLE chat_messages ADD COLUMN image_urls text[] DEFAULT array[]::text[] NOT NULL;
+    """)
+
+def rollback(cur, rls=False):
+    cur.execute("""
+        ALTER TABLE chat_messages DROP COLUMN image_urls;
+    """)
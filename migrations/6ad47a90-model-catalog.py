@@ -0,0 +1,91 @@
+def migrate(cur, rls=False):
+    cur.execute("""
+        ALTER TABLE models ADD COLUMN context_window integer;
+        ALTER TABLE models ADD COLUMN option_json boolean DEFAULT false NOT NULL;
+        ALTER TABLE models ADD COLUMN option_tools boolean DEFAULT false NOT NULL;
+        ALTER TABLE models ADD COLUMN option_vision boolean DEFAULT false NOT NULL;
+
+        INSERT INTO models(model, provider, type, credit_type, credit_input, credit_output, credit, upstream_model, context_window, official_name, image_url, hidden, option_stream, option_temperature, option_stop, option_json, option_tools, option_vision, tags)
+        VALUES
+            ('gpt-3.5-turbo', 'openai', 'completion', 'token_input_output', 5, 15, NULL, NULL, 16385, 'OpenAI', '/openai.webp', false, true, true, true, true, true, false, '{}'),
+            ('gpt-4', 'openai', 'completion', 'token_input_output', 300, 600, NULL, NULL, 8192, 'OpenAI', '/openai.webp', false, true, true, true, false, true, false, '{}'),
+            ('gpt-4-32k', 'openai', 'completion', 'token_input_output', 600, 1200, NULL, NULL, 32768, 'OpenAI', '/openai.webp', false, true, true, true, false, true, false, '{}'),
+            ('gpt-4-turbo', 'openai', 'completion', 'token_input_output', 100, 300, NULL, NULL, 128000, 'OpenAI', '/openai.webp', false, true, true, true, true, true, true, '{}'),
+            ('gpt-4o', 'openai', 'completion', 'token_input_output', 50, 150, NULL, NULL, 128000, 'OpenAI', '/openai.webp', false, true, true, true, true, true, true, '{}'),
+            ('text-embedding-ada-002', 'openai', 'embedding', 'token_input_output', 1, 0, NULL, NULL, 8191, 'OpenAI', '/openai.webp', true, false, false, false, false, false, false, '{}'),
+            ('dall-e-2', 'openai', 'image', 'request', NULL, NULL, 200000, NULL, NULL, 'OpenAI', '/openai.webp', false, false, false, false, false, false, false, '{}'),
+            ('dall-e-3', 'openai', 'image', 'request', NULL, NULL, 800000, NULL, NULL, 'OpenAI', '/openai.webp', false, false, false, false, false, false, false, '{}'),
+            ('claude-3-5-sonnet-20240620', 'anthropic', 'completion', 'token_input_output', 30, 150, NULL, NULL, 200000, 'Anthropic', '/anthropic.webp', false, true, true, true, false, true, false, '{}'),
+            ('claude-3-opus-20240229', 'anthropic', 'completion', 'token_input_output', 150, 750, NULL, NULL, 200000, 'Anthropic', '/anthropic.webp', false, true, true, true, false, true, false, '{}'),
+            ('claude-3-sonnet-20240229', 'anthropic', 'completion', 'token_input_output', 30, 150, NULL, NULL, 200000, 'Anthropic', '/anthropic.webp', false, true, true, true, false, true, false, '{}'),
+            ('claude-3-haiku-20240307', 'anthropic', 'completion', 'token_input_output', 3, 13, NULL, NULL, 200000, 'Anthropic', '/anthropic.webp', false, true, true, true, false, true, false, '{}'),
+            ('cohere_command', 'cohere', 'completion', 'token_input_output', 150, 150, NULL, NULL, 4096, 'Cohere', '/cohere.webp', false, false, true, true, false, false, false, '{}'),
+            ('llama2', 'llama', 'completion', 'free', NULL, NULL, NULL, NULL, 4096, 'Meta', '/meta.webp', false, true, true, false, false, false, false, '{}'),
+            ('llama-2-70b-chat', 'replicate', 'completion', 'second', NULL, NULL, 14000, '02e509c789964a7ea8736978a43525956ef40397be9033abf9fd2badfe68c9e3', 4096, 'Replicate', '/replicate.webp', false, true, true, true, false, false, false, '{}'),
+            ('replit-code-v1-3b', 'replicate', 'completion', 'second', NULL, NULL, 11500, 'b84f4c074b807211cd75e3e8b1589b6399052125b4c27106e43d47189e8415ad', 2048, 'Replicate', '/replicate.webp', false, true, true, true, false, false, false, '{}'),
+            ('wizard-mega-13b-awq', 'replicate', 'completion', 'second', NULL, NULL, 7250, 'a4be2a7c75e51c53b22167d44de3333436f1aa9253a201d2619cf74286478599', 2048, 'Replicate', '/replicate.webp', false, false, true, false, false, false, false, '{}'),
+            ('airoboros-llama-2-70b', 'replicate', 'completion', 'second', NULL, NULL, 14000, 'ae090a64e6b4468d7fa85c6ca33c979b3cd941c12b1cfa2a237b4a7aa6ebaac4', 4096, 'Replicate', '/replicate.webp', false, true, true, true, false, false, false, '{}')
+        ON CONFLICT (model) WHERE project_id IS NULL DO UPDATE SET
+            provider = EXCLUDED.provider,
+            type = EXCLUDED.type,
+            credit_type = EXCLUDED.credit_type,
+            credit_input = EXCLUDED.credit_input,
+            credit_output = EXCLUDED.credit_output,
+            credit = EXCLUDED.credit,
+            upstream_model = EXCLUDED.upstream_model,
+            context_window = EXCLUDED.context_window,
+            option_stream = EXCLUDED.option_stream,
+            option_json = EXCLUDED.option_json,
+            option_tools = EXCLUDED.option_tools,
+            option_vision = EXCLUDED.option_vision;
+
+        UPDATE models SET option_tools = true WHERE provider = 'openai-compatible';
+
+        -- The OpenRouter models were all sent the tools, and the images when their modality allowed it.
+        -- Their exact capabilities are set by scripts/update_openrouter_models.sql.
+        UPDATE models SET option_tools = true WHERE provider = 'openrouter';
+        UPDATE models SET option_vision = true
+        WHERE provider = 'openrouter' AND (
+            model LIKE '%vision%'
+            OR model LIKE '%llava%'
+            OR model LIKE '%pixtral%'
+            OR model LIKE '%-vl%'
+            OR model LIKE 'openai/gpt-4o%'
+            OR model LIKE 'openai/gpt-4-turbo%'
+            OR model LIKE 'anthropic/claude-3%'
+            OR model LIKE 'google/gemini%'
+        );
+
+        INSERT INTO model_aliases(alias, model_id)
+        SELECT aliases.alias, models.id
+        FROM (VALUES
+            ('cheap', 'llama2'),
+            ('regular', 'gpt-3.5-turbo'),
+            ('uncensored', 'wizard-mega-13b-awq'),
+            ('gpt-3.5-turbo-16k', 'gpt-3.5-turbo'),
+            ('cohere', 'cohere_command'),
+            ('claude-3-5-sonnet', 'claude-3-5-sonnet-20240620'),
+            ('claude-3-opus', 'claude-3-opus-20240229'),
+            ('claude-3-sonnet', 'claude-3-sonnet-20240229'),
+            ('claude-3-haiku', 'claude-3-haiku-20240307')
+        ) AS aliases(alias, model)
+        JOIN models ON models.model = aliases.model
+        WHERE NOT EXISTS (
+            SELECT 1 FROM model_aliases WHERE model_aliases.alias = aliases.alias AND model_aliases.project_id IS NULL
+        );
+    """)
+
+def rollback(cur, rls=False):
+    cur.execute("""
+        DELETE FROM model_aliases WHERE project_id IS NULL AND alias IN (
+            'cheap', 'regular', 'uncensored', 'gpt-3.5-turbo-16k', 'cohere',
+            'claude-3-5-sonnet', 'claude-3-opus', 'claude-3-sonnet', 'claude-3-haiku'
+        );
+
+        UPDATE models SET upstream_model = NULL WHERE provider = 'replicate';
+
+        ALTER TABLE models DROP COLUMN option_vision;
+        ALTER TABLE models DROP COLUMN option_tools;
+        ALTER TABLE models DROP COLUMN option_json;
+        ALTER TABLE models DROP COLUMN context_window;
+    """)
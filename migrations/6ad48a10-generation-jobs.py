@@ -0,0 +1,34 @@
+def migrate(cur, rls=False):
+    cur.execute("""
+        CREATE TABLE public.generation_jobs (
+            id uuid DEFAULT gen_random_uuid() NOT NULL,
+            user_id uuid NOT NULL,
+            event_id text NOT NULL,
+            status text DEFAULT 'pending' NOT NULL,
+            request jsonb NOT NULL,
+            partial_result text DEFAULT '' NOT NULL,
+            result jsonb,
+            webhook_url text,
+            webhook_secret text,
+            created_at timestamp with time zone DEFAULT now() NOT NULL,
+            updated_at timestamp with time zone DEFAULT now() NOT NULL
+        );
+
+        ALTER TABLE ONLY public.generation_jobs
+            ADD CONSTRAINT generation_jobs_pkey PRIMARY KEY (id);
+        ALTER TABLE ONLY public.generation_jobs
+            ADD CONSTRAINT generation_jobs_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.project_users(id) ON DELETE CASCADE;
+
+        CREATE INDEX generation_jobs_status_created_at ON public.generation_jobs USING btree (status, created_at);
+    """)
+    if rls:
+        cur.execute("""
+            ALTER TABLE public.generation_jobs OWNER TO postgres;
+            GRANT ALL ON TABLE public.generation_jobs TO service_role;
+            ALTER TABLE public.generation_jobs ENABLE ROW LEVEL SECURITY;
+        """)
+
+def rollback(cur, rls=False):
+    cur.execute("""
+        DROP TABLE public.generation_jobs;
+    """)
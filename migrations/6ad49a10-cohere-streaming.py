@@ -0,0 +1,9 @@
+def migrate(cur, rls=False):
+    cur.execute("""
+        UPDATE models SET option_stream = true, upstream_model = 'command' WHERE model = 'cohere_command';
+    """)
+
+def rollback(cur, rls=False):
+    cur.execute("""
+        UPDATE models SET option_stream = false, upstream_model = NULL WHERE model = 'cohere_command';
+    """)
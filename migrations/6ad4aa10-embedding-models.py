@@ -0,0 +1,105 @@
+def migrate(cur, rls=False):
+    cur.execute("""
+        ALTER TABLE models ADD COLUMN dimensions integer;
+
+        ALTER TABLE memories ADD COLUMN embedding_model text DEFAULT 'text-embedding-ada-002' NOT NULL;
+        ALTER TABLE memories ADD COLUMN embedding_dimensions integer DEFAULT 1536 NOT NULL;
+
+        DROP INDEX IF EXISTS embeddings_embedding_idx;
+        ALTER TABLE embeddings ALTER COLUMN embedding TYPE vector;
+
+        -- A column without dimensions can't be indexed, each dimension gets its own partial index.
+        -- The vector indexes are limited to 2000 dimensions, the 3072 ones are indexed as halfvec.
+        CREATE INDEX embeddings_embedding_1024_idx ON public.embeddings USING ivfflat ((embedding::vector(1024)) vector_cosine_ops) WITH (lists='100') WHERE vector_dims(embedding) = 1024;
+        CREATE INDEX embeddings_embedding_1536_idx ON public.embeddings USING ivfflat ((embedding::vector(1536)) vector_cosine_ops) WITH (lists='100') WHERE vector_dims(embedding) = 1536;
+        CREATE INDEX embeddings_embedding_3072_idx ON public.embeddings USING ivfflat ((embedding::halfvec(3072)) halfvec_cosine_ops) WITH (lists='100') WHERE vector_dims(embedding) = 3072;
+
+        INSERT INTO models(model, provider, type, credit_type, credit_input, credit_output, credit, upstream_model, context_window, dimensions, official_name, image_url, hidden, option_stream, option_temperature, option_stop, option_json, option_tools, option_vision, tags)
+        VALUES
+            ('text-embedding-3-small', 'openai', 'embedding', 'token_input_output', 1, 0, NULL, NULL, 8191, 1536, 'OpenAI', '/openai.webp', true, false, false, false, false, false, false, '{}'),
+            ('text-embedding-3-large', 'openai', 'embedding', 'token_input_output', 2, 0, NULL, NULL, 8191, 3072, 'OpenAI', '/openai.webp', true, false, false, false, false, false, false, '{}'),
+            ('embed-english-v3.0', 'cohere', 'embedding', 'token_input_output', 1, 0, NULL, NULL, 512, 1024, 'Cohere', '/cohere.webp', true, false, false, false, false, false, false, '{}'),
+            ('embed-multilingual-v3.0', 'cohere', 'embedding', 'token_input_output', 1, 0, NULL, NULL, 512, 1024, 'Cohere', '/cohere.webp', true, false, false, false, false, false, false, '{}')
+        ON CONFLICT (model) WHERE project_id IS NULL DO NOTHING;
+
+        UPDATE models SET dimensions = 1536 WHERE model = 'text-embedding-ada-002';
+
+        DROP FUNCTION public.retrieve_embeddings(query_embedding vector, match_threshold double precision, match_count integer, memoryid uuid[], userid text);
+
+        CREATE FUNCTION public.retrieve_embeddings(query_embedding vector, match_threshold double precision, match_count integer, memoryid uuid[], userid text, embeddingmodel text) RETURNS TABLE(id uuid, content text, similarity double precision)
+            LANGUAGE sql STABLE
+            AS $$SELECT
+          embeddings.id,
+          embeddings.content,
+          1 - (embeddings.embedding <=> query_embedding) as similarity
+        FROM embeddings
+        JOIN memories ON embeddings.memory_id = memories.id
+        WHERE
+          memories.embedding_model = embeddingmodel
+          AND vector_dims(embeddings.embedding) = vector_dims(query_embedding)
+          AND 1 - (embeddings.embedding <=> query_embedding) > match_threshold
+          AND embeddings.memory_id = ANY(memoryid)
+          AND (
+            memories.user_id::text = userid
+            OR memories.public = true
+          )
+        ORDER BY similarity DESC
+        LIMIT match_count;
+        $$;
+
+        ALTER FUNCTION public.retrieve_embeddings(query_embedding vector, match_threshold double precision, match_count integer, memoryid uuid[], userid text, embeddingmodel text) OWNER TO postgres;
+    """)
+
+    if rls:
+        cur.execute("""
+            GRANT ALL ON FUNCTION public.retrieve_embeddings(query_embedding vector, match_threshold double precision, match_count integer, memoryid uuid[], userid text, embeddingmodel text) TO authenticated;
+            GRANT ALL ON FUNCTION public.retrieve_embeddings(query_embedding vector, match_threshold double precision, match_count integer, memoryid uuid[], userid text, embeddingmodel text) TO service_role;
+            GRANT ALL ON FUNCTION public.retrieve_embeddings(query_embedding vector, match_threshold double precision, match_count integer, memoryid uuid[], userid text, embeddingmodel text) TO anon;
+        """)
+
+def rollback(cur, rls=False):
+    cur.execute("""
+        DROP FUNCTION public.retrieve_embeddings(query_embedding vector, match_threshold double precision, match_count integer, memoryid uuid[], userid text, embeddingmodel text);
+
+        CREATE FUNCTION public.retrieve_embeddings(query_embedding vector, match_threshold double precision, match_count integer, memoryid uuid[], userid text) RETURNS TABLE(id uuid, content text, similarity double precision)
+            LANGUAGE sql STABLE
+            AS $$SELECT
+          embeddings.id,
+          embeddings.content,
+          1 - (embeddings.embedding <=> query_embedding) as similarity
+        FROM embeddings
+        JOIN memories ON embeddings.memory_id = memories.id
+        WHERE
+          1 - (embeddings.embedding <=> query_embedding) > match_threshold
+          AND embeddings.memory_id = ANY(memoryid)
+          AND (
+            memories.user_id::text = userid
+            OR memories.public = true
+          )
+        ORDER BY similarity DESC
+        LIMIT match_count;
+        $$;
+
+        ALTER FUNCTION public.retrieve_embeddings(query_embedding vector, match_threshold double precision, match_count integer, memoryid uuid[], userid text) OWNER TO postgres;
+
+        DELETE FROM embeddings WHERE memory_id IN (SELECT id FROM memories WHERE embedding_dimensions != 1536);
+        DELETE FROM memories WHERE embedding_dimensions != 1536;
+        DROP INDEX IF EXISTS embeddings_embedding_1024_idx;
+        DROP INDEX IF EXISTS embeddings_embedding_1536_idx;
+        DROP INDEX IF EXISTS embeddings_embedding_3072_idx;
+        ALTER TABLE embeddings ALTER COLUMN embedding TYPE vector(1536);
+        CREATE INDEX embeddings_embedding_idx ON public.embeddings USING ivfflat (embedding vector_cosine_ops) WITH (lists='100');
+
+        DELETE FROM models WHERE model IN ('text-embedding-3-small', 'text-embedding-3-large', 'embed-english-v3.0', 'embed-multilingual-v3.0');
+
+        ALTER TABLE memories DROP COLUMN embedding_dimensions;
+        ALTER TABLE memories DROP COLUMN embedding_model;
+        ALTER TABLE models DROP COLUMN dimensions;
+    """)
+
+    if rls:
+        cur.execute("""
+            GRANT ALL ON FUNCTION public.retrieve_embeddings(query_embedding vector, match_threshold double precision, match_count integer, memoryid uuid[], userid text) TO authenticated;
+            GRANT ALL ON FUNCTION public.retrieve_embeddings(query_embedding vector, match_threshold double precision, match_count integer, memoryid uuid[], userid text) TO service_role;
+            GRANT ALL ON FUNCTION public.retrieve_embeddings(query_embedding vector, match_threshold double precision, match_count integer, memoryid uuid[], userid text) TO anon;
+        """)
@@ -0,0 +1,9 @@
+def migrate(cur, rls=False):
+    cur.execute("""
+        ALTER TABLE request_logs ADD COLUMN api_key_id text;
+    """)
+
+def rollback(cur, rls=False):
+    cur.execute("""
+        ALTER TABLE request_logs DROP COLUMN api_key_id;
+    """)
@@ -0,0 +1,9 @@
+def migrate(cur, rls=False):
+    cur.execute("""
+        ALTER TABLE projects ADD COLUMN routing_rules jsonb;
+    """)
+
+def rollback(cur, rls=False):
+    cur.execute("""
+        ALTER TABLE projects DROP COLUMN routing_rules;
+    """)
@@ -0,0 +1,9 @@
+def migrate(cur, rls=False):
+    cur.execute("""
+        ALTER TABLE projects ADD COLUMN moderation jsonb;
+    """)
+
+def rollback(cur, rls=False):
+    cur.execute("""
+        ALTER TABLE projects DROP COLUMN moderation;
+    """)
@@ -0,0 +1,25 @@
+def migrate(cur, rls=False):
+    cur.execute("""
+        ALTER TABLE model_aliases ADD COLUMN position integer DEFAULT 0 NOT NULL;
+
+        -- "best" keeps answering with gpt-4, the other models are only tried when it fails.
+        -- A project can replace the chain with its own "best" aliases.
+        INSERT INTO model_aliases(alias, model_id, position)
+        SELECT 'best', models.id, chain.position
+        FROM (VALUES
+            ('gpt-4', 'openai', 0),
+            ('anthropic/claude-3.5-sonnet', 'openrouter', 1),
+            ('llama-2-70b-chat', 'replicate', 2)
+        ) AS chain(model, provider, position)
+        JOIN models ON models.model = chain.model AND models.provider = chain.provider AND models.project_id IS NULL
+        WHERE NOT EXISTS (
+            SELECT 1 FROM model_aliases WHERE model_aliases.alias = 'best' AND model_aliases.project_id IS NULL
+        );
+    """)
+
+def rollback(cur, rls=False):
+    cur.execute("""
+        DELETE FROM model_aliases WHERE project_id IS NULL AND alias = 'best';
+
+        ALTER TABLE model_aliases DROP COLUMN position;
+    """)
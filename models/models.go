@@ -0,0 +1,45 @@
+package models
+
+import (
+	"encoding/json"
+	"net/http"
+
+	router "github.com/julienschmidt/httprouter"
+	database "github.com/polyfire/api/db"
+	"github.com/polyfire/api/llm"
+	"github.com/polyfire/api/utils"
+)
+
+// Lists the models (and their aliases) the project of the user can generate with
+func List(w http.ResponseWriter, r *http.Request, _ router.Params) {
+	db := r.Context().Value(utils.ContextKeyDB).(database.Database)
+	record := r.Context().Value(utils.ContextKeyRecordEvent).(utils.RecordFunc)
+	projectID, _ := r.Context().Value(utils.ContextKeyProjectID).(string)
+
+	catalog, err := db.GetCatalog()
+	if err != nil {
+		utils.RespondError(w, record, "database_error")
+		return
+	}
+
+	result := catalog.List(projectID)
+
+	response, _ := json.Marshal(result)
+	record(string(response))
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// The live health and circuit state of the providers of this instance
+func ProvidersStatus(w http.ResponseWriter, r *http.Request, _ router.Params) {
+	record := r.Context().Value(utils.ContextKeyRecordEvent).(utils.RecordFunc)
+
+	result := map[string][]llm.ProviderStatus{"providers": llm.ProvidersStatus()}
+
+	response, _ := json.Marshal(result)
+	record(string(response))
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
@@ -10,7 +10,11 @@ CREATE TEMP TABLE openrouter_models(
 	hidden boolean,
 	option_stream boolean,
 	option_temperature boolean,
-	option_stop boolean
+	option_stop boolean,
+	context_window integer,
+	option_json boolean,
+	option_tools boolean,
+	option_vision boolean
 );
 \copy openrouter_models FROM 'codegen/openrouter-models.csv' DELIMITER ',' CSV HEADER ;
 UPDATE models
@@ -19,7 +23,11 @@ SET
   credit_output = openrouter_models.credit_output,
   option_stream = openrouter_models.option_stream,
   option_temperature = openrouter_models.option_temperature,
-  option_stop = openrouter_models.option_stop
+  option_stop = openrouter_models.option_stop,
+  context_window = openrouter_models.context_window,
+  option_json = openrouter_models.option_json,
+  option_tools = openrouter_models.option_tools,
+  option_vision = openrouter_models.option_vision
 FROM openrouter_models
 WHERE models.provider = 'openrouter' AND models.model = openrouter_models.model;
 DELETE FROM openrouter_models WHERE model IN (SELECT model FROM models WHERE provider = 'openrouter');
@@ -35,5 +43,10 @@ INSERT INTO models(
 	hidden,
 	option_stream,
 	option_temperature,
-	option_stop
-) SELECT model, provider, credit_input, credit_type, type, credit_output, image_url, official_name, hidden, option_stream, option_temperature, option_stop FROM openrouter_models;
+	option_stop,
+	context_window,
+	option_json,
+	option_tools,
+	option_vision,
+	tags
+) SELECT model, provider, credit_input, credit_type, type, credit_output, image_url, official_name, hidden, option_stream, option_temperature, option_stop, context_window, option_json, option_tools, option_vision, '{}' FROM openrouter_models;
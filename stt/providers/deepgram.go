@@ -1,14 +1,21 @@
 package providers
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
 
 	"github.com/deepgram-devs/deepgram-go-sdk/deepgram"
+	"github.com/google/go-querystring/query"
+
+	"github.com/polyfire/api/utils"
 )
 
 type DeepgramProvider struct{}
@@ -105,8 +112,59 @@ func keywordBoostToDeepgramKeyword(keywordBoosts []KeywordBoost) []string {
 	return results
 }
 
+var deepgramClient = utils.NewRetryClient(http.DefaultClient, "deepgram")
+
+/*
+ * The same request as deepgram.Client.PreRecordedFromStream but sent with a
+ * client retrying the transient errors (the sdk creates its own client). The
+ * audio is buffered so it can be sent again.
+ */
+func preRecordedFromStream(
+	ctx context.Context,
+	dg *deepgram.Client,
+	source deepgram.ReadStreamSource,
+	opts deepgram.PreRecordedTranscriptionOptions,
+) (*deepgram.PreRecordedResponse, error) {
+	audio, err := io.ReadAll(source.Stream)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := query.Values(opts)
+	if err != nil {
+		return nil, err
+	}
+	u := url.URL{Scheme: "https", Host: dg.Host, Path: dg.TranscriptionPath, RawQuery: values.Encode()}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewReader(audio))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", source.Mimetype)
+	req.Header.Set("Authorization", "token "+dg.ApiKey)
+
+	res, err := deepgramClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("response error: %s", string(b))
+	}
+
+	var result deepgram.PreRecordedResponse
+	err = json.NewDecoder(res.Body).Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
 func (DeepgramProvider) Transcribe(
-	_ context.Context,
+	ctx context.Context,
 	reader io.Reader,
 	opts TranscriptionInputOptions,
 ) (*TranscriptionResult, error) {
@@ -120,7 +178,9 @@ func (DeepgramProvider) Transcribe(
 		language = *(opts.Language)
 	}
 
-	res, err := dg.PreRecordedFromStream(
+	res, err := preRecordedFromStream(
+		ctx,
+		dg,
 		deepgram.ReadStreamSource{
 			Stream:   reader,
 			Mimetype: "audio/mp3",
@@ -27,11 +27,12 @@ func (WhisperProvider) Transcribe(
 			(*session).OrganizationID = customOrg
 		}
 	} else {
-		session = openai.NewSession(os.Getenv("OPENAI_API_KEY"))
+		session = openai.NewSession(utils.GetKeyPool("openai").Acquire(ctx))
 		(*session).OrganizationID = os.Getenv("OPENAI_ORGANIZATION")
 	}
 
 	(*((*session).HTTPClient)).Timeout = 600 * time.Second
+	(*session).HTTPClient = utils.NewKeyPoolClient((*session).HTTPClient, "openai", "Authorization", "Bearer ")
 
 	client := audio.NewClient(session, "whisper-1")
 
@@ -184,7 +184,7 @@ func Transcribe(w http.ResponseWriter, r *http.Request, _ router.Params) {
 	res.Text = strings.Trim(strings.Join(texts, " "), " \t\n")
 	db.LogRequestsCredits(
 		r.Context().Value(utils.ContextKeyEventID).(string),
-		userID, "whisper", duration*1000, 0, 0, "transcription")
+		userID, "whisper", duration*1000, 0, 0, "transcription", utils.APIKeyID(r.Context(), "openai"))
 
 	response, _ := json.Marshal(&res)
 	record(string(response))
@@ -0,0 +1,39 @@
+package tokens
+
+import "math"
+
+// Used when the size of an image can't be known without downloading it
+const (
+	DefaultImageWidth  = 1024
+	DefaultImageHeight = 1024
+)
+
+/*
+ * Follows the OpenAI vision pricing: a low detail image costs a fixed 85 tokens.
+ * Otherwise the image is scaled to fit in 2048x2048, then its shortest side to
+ * 768px, and each 512px tile costs 170 tokens on top of the base 85.
+ */
+func CountImageTokens(width int, height int, detail string) int {
+	if detail == "low" {
+		return 85
+	}
+
+	w := float64(width)
+	h := float64(height)
+
+	if w > 2048 || h > 2048 {
+		ratio := 2048 / math.Max(w, h)
+		w *= ratio
+		h *= ratio
+	}
+
+	if math.Min(w, h) > 768 {
+		ratio := 768 / math.Min(w, h)
+		w *= ratio
+		h *= ratio
+	}
+
+	tiles := int(math.Ceil(w/512) * math.Ceil(h/512))
+
+	return 85 + 170*tiles
+}
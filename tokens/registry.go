@@ -0,0 +1,92 @@
+package tokens
+
+import (
+	"strings"
+	"sync"
+)
+
+type Tokenizer interface {
+	CountTokens(text string) int
+	SplitText(text string, chunkSize int) []string
+}
+
+const (
+	Cl100kBase          = "cl100k_base"
+	O200kBase           = "o200k_base"
+	LlamaSentencePiece  = "llama_sentencepiece"
+	defaultEncodingName = Cl100kBase
+)
+
+var cl100kBase = &tiktokenTokenizer{encoding: Cl100kBase}
+
+var encodings = map[string]Tokenizer{
+	Cl100kBase:         cl100kBase,
+	O200kBase:          &tiktokenTokenizer{encoding: O200kBase, fallback: cl100kBase},
+	LlamaSentencePiece: sentencePieceApproximation{},
+}
+
+var (
+	modelEncodingsMutex sync.RWMutex
+	modelEncodings      = map[string]string{}
+)
+
+func modelKey(provider string, model string) string {
+	return provider + ":" + model
+}
+
+// Overrides the encoding guessed from the model name
+func RegisterModelEncoding(provider string, model string, encoding string) {
+	modelEncodingsMutex.Lock()
+	defer modelEncodingsMutex.Unlock()
+
+	modelEncodings[modelKey(provider, model)] = encoding
+}
+
+/*
+ * The same model can be served by several providers (gpt-4o on openai and
+ * "openai/gpt-4o" on openrouter, llama on replicate or on our own server) so
+ * the encoding is mostly guessed from the model name.
+ */
+func guessEncoding(provider string, model string) string {
+	name := strings.ToLower(model)
+	if i := strings.LastIndex(name, "/"); i != -1 {
+		name = name[i+1:]
+	}
+
+	switch {
+	case strings.HasPrefix(name, "gpt-4o"), strings.HasPrefix(name, "o1"):
+		return O200kBase
+	// Llama 3 moved to a tiktoken vocabulary, closer to cl100k than to the SentencePiece one
+	case strings.Contains(name, "llama-3"), strings.Contains(name, "llama3"):
+		return Cl100kBase
+	case provider == "llama",
+		strings.Contains(name, "llama"),
+		strings.Contains(name, "mistral"),
+		strings.Contains(name, "mixtral"),
+		strings.Contains(name, "wizard"):
+		return LlamaSentencePiece
+	default:
+		return defaultEncodingName
+	}
+}
+
+func GetTokenizerByEncoding(encoding string) Tokenizer {
+	tokenizer, ok := encodings[encoding]
+	if !ok {
+		return encodings[defaultEncodingName]
+	}
+
+	return tokenizer
+}
+
+func GetTokenizer(provider string, model string) Tokenizer {
+	modelEncodingsMutex.RLock()
+	encoding, ok := modelEncodings[modelKey(provider, model)]
+	modelEncodingsMutex.RUnlock()
+
+	if !ok {
+		encoding = guessEncoding(provider, model)
+	}
+
+	return GetTokenizerByEncoding(encoding)
+}
@@ -0,0 +1,49 @@
+package tokens
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGetTokenizer(t *testing.T) {
+	tests := []struct {
+		provider string
+		model    string
+		encoding string
+	}{
+		{"openai", "gpt-3.5-turbo", Cl100kBase},
+		{"openai", "gpt-4o", O200kBase},
+		{"openrouter", "openai/gpt-4o-mini", O200kBase},
+		{"replicate", "llama-2-70b-chat", LlamaSentencePiece},
+		{"llama", "custom", LlamaSentencePiece},
+		{"openrouter", "meta-llama/llama-3-70b-instruct", Cl100kBase},
+		{"cohere", "cohere", Cl100kBase},
+	}
+
+	for _, test := range tests {
+		if GetTokenizer(test.provider, test.model) != encodings[test.encoding] {
+			t.Fatalf(`GetTokenizer("%s", "%s") should have used %s`, test.provider, test.model, test.encoding)
+		}
+	}
+
+	RegisterModelEncoding("openai-compatible", "project-model", LlamaSentencePiece)
+	if GetTokenizer("openai-compatible", "project-model") != encodings[LlamaSentencePiece] {
+		t.Fatalf(`GetTokenizer should use the registered encoding`)
+	}
+}
+
+func TestSentencePieceSplitText(t *testing.T) {
+	tokenizer := GetTokenizerByEncoding(LlamaSentencePiece)
+	text := "Hello world, the answer is 42.\nÇa va très bien, 你好!"
+
+	splits := tokenizer.SplitText(text, 3)
+	if strings.Join(splits, "") != text {
+		t.Fatalf(`SplitText should not lose any character but returned %q`, splits)
+	}
+
+	for _, split := range splits {
+		if tokenizer.CountTokens(split) > 3 {
+			t.Fatalf(`SplitText returned a chunk bigger than the chunk size: %q`, split)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package tokens
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The average number of characters of a word piece in the Llama 2 vocabulary
+const sentencePieceCharsPerToken = 4
+
+/*
+ * The Llama 2 family uses a 32k SentencePiece vocabulary we don't ship. This
+ * approximates it by cutting the text the way SentencePiece does: a space is
+ * merged with the word following it, words are cut in pieces of a few
+ * characters, digits are split one by one and the other symbols, newlines
+ * and non latin characters (that mostly fall back to bytes) are a piece each.
+ * Every piece counts as one token.
+ */
+type sentencePieceApproximation struct{}
+
+func isLatinLetter(r rune) bool {
+	return r < unicode.MaxLatin1 && unicode.IsLetter(r) || r >= 0x100 && r < 0x250
+}
+
+func (sentencePieceApproximation) pieces(text string) []string {
+	pieces := make([]string, 0, len(text)/sentencePieceCharsPerToken+1)
+
+	start := 0
+	letters := 0
+	flush := func(end int) {
+		if end > start {
+			pieces = append(pieces, text[start:end])
+		}
+		start = end
+		letters = 0
+	}
+
+	for i, r := range text {
+		switch {
+		case r == ' ':
+			// The space is the "▁" prefix of the next piece
+			flush(i)
+		case isLatinLetter(r):
+			if letters == sentencePieceCharsPerToken {
+				flush(i)
+			}
+			letters++
+		default:
+			flush(i)
+			flush(i + utf8.RuneLen(r))
+		}
+	}
+	flush(len(text))
+
+	return pieces
+}
+
+func (s sentencePieceApproximation) CountTokens(text string) int {
+	return len(s.pieces(text))
+}
+
+func (s sentencePieceApproximation) SplitText(text string, chunkSize int) []string {
+	pieces := s.pieces(text)
+	splits := make([]string, 0, len(pieces)/chunkSize+1)
+
+	for start := 0; start < len(pieces); start += chunkSize {
+		end := start + chunkSize
+		if end > len(pieces) {
+			end = len(pieces)
+		}
+
+		splits = append(splits, strings.Join(pieces[start:end], ""))
+	}
+
+	return splits
+}
@@ -0,0 +1,68 @@
+package tokens
+
+import (
+	"log"
+	"sync"
+
+	tiktoken "github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+/*
+ * The offline loader embeds cl100k_base but not o200k_base. The encodings it
+ * doesn't have are downloaded (and cached in TIKTOKEN_CACHE_DIR) on first use.
+ */
+type bpeLoader struct {
+	offline tiktoken.BpeLoader
+	online  tiktoken.BpeLoader
+}
+
+func (l bpeLoader) LoadTiktokenBpe(tiktokenBpeFile string) (map[string]int, error) {
+	ranks, err := l.offline.LoadTiktokenBpe(tiktokenBpeFile)
+	if err == nil {
+		return ranks, nil
+	}
+
+	return l.online.LoadTiktokenBpe(tiktokenBpeFile)
+}
+
+func init() {
+	tiktoken.SetBpeLoader(bpeLoader{
+		offline: tiktoken_loader.NewOfflineLoader(),
+		online:  tiktoken.NewDefaultBpeLoader(),
+	})
+}
+
+// The encodings are only loaded when a model using them is first used
+type tiktokenTokenizer struct {
+	encoding string
+	fallback *tiktokenTokenizer
+
+	once sync.Once
+	tke  *tiktoken.Tiktoken
+}
+
+func (t *tiktokenTokenizer) get() *tiktoken.Tiktoken {
+	t.once.Do(func() {
+		tke, err := tiktoken.GetEncoding(t.encoding)
+		if err != nil && t.fallback == nil {
+			panic(err)
+		}
+		if err != nil {
+			log.Printf("[WARN] Can't load the %s encoding, using %s instead: %v\n", t.encoding, t.fallback.encoding, err)
+			tke = t.fallback.get()
+		}
+		t.tke = tke
+	})
+
+	return t.tke
+}
+
+func (t *tiktokenTokenizer) CountTokens(text string) int {
+	return len(t.get().Encode(text, nil, nil))
+}
+
+func (t *tiktokenTokenizer) SplitText(text string, chunkSize int) []string {
+	tke := t.get()
+	return splitEncoded(tke.Encode(text, nil, nil), chunkSize, tke.Decode)
+}
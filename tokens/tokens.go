@@ -2,33 +2,25 @@ package tokens
 
 import (
 	"errors"
-
-	tiktoken "github.com/pkoukk/tiktoken-go"
-	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
 )
 
-func initEncoding() *tiktoken.Tiktoken {
-	encoding := "cl100k_base"
-	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
-	tke, err := tiktoken.GetEncoding(encoding)
-	if err != nil {
-		panic(err)
-	}
-
-	return tke
-}
-
-var tke = initEncoding()
+// Used when the model isn't known, like for the embeddings of ada-002
+var DefaultTokenizer = GetTokenizerByEncoding(Cl100kBase)
 
 func CountTokens(text string) int {
-	token := tke.Encode(text, nil, nil)
-
-	return len(token)
+	return DefaultTokenizer.CountTokens(text)
 }
 
 func SplitText(text string, chunkSize int) []string {
+	return DefaultTokenizer.SplitText(text, chunkSize)
+}
+
+/*
+ * Splits a list of token ids in chunks of chunkSize and decodes them. Shared by
+ * the tokenizers that can encode text.
+ */
+func splitEncoded(inputIDs []int, chunkSize int, decode func([]int) string) []string {
 	splits := make([]string, 0)
-	inputIDs := tke.Encode(text, nil, nil)
 
 	startIdx := 0
 	curIdx := len(inputIDs)
@@ -37,7 +29,7 @@ func SplitText(text string, chunkSize int) []string {
 	}
 	for startIdx < len(inputIDs) {
 		chunkIDs := inputIDs[startIdx:curIdx]
-		splits = append(splits, tke.Decode(chunkIDs))
+		splits = append(splits, decode(chunkIDs))
 		startIdx += chunkSize
 		curIdx = startIdx + chunkSize
 		if curIdx > len(inputIDs) {
@@ -1,13 +1,13 @@
 package tts
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
@@ -28,7 +28,7 @@ var (
 func TextToSpeech(ctx context.Context, w io.Writer, text string, voiceID string) error {
 	customToken, ok := ctx.Value(utils.ContextKeyElevenlabsToken).(string)
 	if !ok {
-		customToken = os.Getenv("ELEVENLABS_API_KEY")
+		customToken = utils.GetKeyPool("elevenlabs").Acquire(ctx)
 		rateLimitStatus := ctx.Value(utils.ContextKeyRateLimitStatus)
 		if rateLimitStatus != database.RateLimitStatusOk {
 			return ErrRateLimitReached
@@ -42,14 +42,66 @@ func TextToSpeech(ctx context.Context, w io.Writer, text string, voiceID string)
 
 	}
 
-	client := elevenlabs.NewClient(context.Background(), customToken, 30*time.Second)
-
 	ttsReq := elevenlabs.TextToSpeechRequest{
 		Text:    text,
 		ModelID: "eleven_multilingual_v2",
 	}
 
-	return client.TextToSpeechStream(w, voiceID, ttsReq)
+	return textToSpeechStream(ctx, w, customToken, voiceID, ttsReq)
+}
+
+const (
+	ElevenlabsBaseURL = "https://api.elevenlabs.io/v1"
+	ElevenlabsTimeout = 30 * time.Second
+)
+
+var elevenlabsClient = utils.NewRetryClient(
+	utils.NewKeyPoolClient(&http.Client{Timeout: ElevenlabsTimeout}, "elevenlabs", "xi-api-key", ""),
+	"elevenlabs",
+)
+
+/*
+ * The same request as elevenlabs.Client.TextToSpeechStream but sent with a
+ * client retrying the transient errors (the sdk creates its own client). The
+ * retries happen before the audio is streamed to w.
+ */
+func textToSpeechStream(
+	ctx context.Context,
+	w io.Writer,
+	apiKey string,
+	voiceID string,
+	ttsReq elevenlabs.TextToSpeechRequest,
+) error {
+	reqBody, err := json.Marshal(ttsReq)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		"POST",
+		ElevenlabsBaseURL+"/text-to-speech/"+voiceID+"/stream",
+		bytes.NewReader(reqBody),
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "*/*")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("xi-api-key", apiKey)
+
+	resp, err := elevenlabsClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected HTTP status \"%d %s\" returned from server", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return err
 }
 
 type RequestBody struct {
@@ -84,6 +136,8 @@ func Handler(w http.ResponseWriter, r *http.Request, _ router.Params) {
 
 	w.Header().Set("Content-Type", "audio/mp3")
 
+	err = TextToSpeech(r.Context(), w, reqBody.Text, voice.ProviderVoiceID)
+
 	db.LogRequestsCredits(
 		r.Context().Value(utils.ContextKeyEventID).(string),
 		userID,
@@ -92,8 +146,9 @@ func Handler(w http.ResponseWriter, r *http.Request, _ router.Params) {
 		len(reqBody.Text),
 		0,
 		"tts",
+		utils.APIKeyID(r.Context(), "elevenlabs"),
 	)
-	err = TextToSpeech(r.Context(), w, reqBody.Text, voice.ProviderVoiceID)
+
 	if err != nil {
 		fmt.Println(err)
 		utils.RespondError(w, record, "elevenlabs_error")
@@ -144,11 +144,76 @@ var ErrorMessages = map[string]APIError{
 		Message:    "An error occurred while starting the generation. Please try again.",
 		StatusCode: http.StatusBadRequest,
 	},
+	"generation_invalid_request": {
+		Code:       "generation_invalid_request",
+		Message:    "The provider rejected the request. Please check the length of the prompt, the generation options and the quota of your API key.",
+		StatusCode: http.StatusBadRequest,
+	},
+	"tools_not_supported": {
+		Code:       "tools_not_supported",
+		Message:    "The selected model doesn't support tools. Please use a model supporting function calling or remove the tools from the request.",
+		StatusCode: http.StatusBadRequest,
+	},
+	"model_does_not_support_vision": {
+		Code:       "model_does_not_support_vision",
+		Message:    "The selected model doesn't support images. Please use a vision model like gpt-4o or remove the images from the request.",
+		StatusCode: http.StatusBadRequest,
+	},
+	"invalid_image": {
+		Code:       "invalid_image",
+		Message:    "Each image must have exactly one of url (http/https), data (base64 with an image mime_type) or path (in the storage bucket).",
+		StatusCode: http.StatusBadRequest,
+	},
+	"invalid_batch_size": {
+		Code:       "invalid_batch_size",
+		Message:    "A batch must have between 1 and 50 items.",
+		StatusCode: http.StatusBadRequest,
+	},
+	"batch_exceeds_rate_limit": {
+		Code:       "batch_exceeds_rate_limit",
+		Message:    "The estimated cost of the batch exceeds your remaining monthly credits. Please split it or wait for the next month.",
+		StatusCode: http.StatusTooManyRequests,
+	},
+	"invalid_webhook_url": {
+		Code:       "invalid_webhook_url",
+		Message:    "The webhook must be an http or https URL.",
+		StatusCode: http.StatusBadRequest,
+	},
+	"invalid_json_schema": {
+		Code:       "invalid_json_schema",
+		Message:    "The json_schema must be a JSON schema object.",
+		StatusCode: http.StatusBadRequest,
+	},
 	"json_format_must_mention_json": {
 		Code:       "json_format_must_mention_json",
 		Message:    "Json format enforcing needs the word \"json\" to be mentioned in the task",
 		StatusCode: http.StatusBadRequest,
 	},
+	"provider_unavailable": {
+		Code:       "provider_unavailable",
+		Message:    "The model's provider is failing, please retry later or use another model.",
+		StatusCode: http.StatusServiceUnavailable,
+	},
+	"credit_ceiling_too_low": {
+		Code:       "credit_ceiling_too_low",
+		Message:    "The max_credits of the request can't pay for its input.",
+		StatusCode: http.StatusBadRequest,
+	},
+	"content_blocked": {
+		Code:       "content_blocked",
+		Message:    "The request was blocked by the moderation policy of the project.",
+		StatusCode: http.StatusBadRequest,
+	},
+	"moderation_unavailable": {
+		Code:       "moderation_unavailable",
+		Message:    "The request couldn't be checked by the moderation policy of the project. Please try again later.",
+		StatusCode: http.StatusServiceUnavailable,
+	},
+	"no_routable_model": {
+		Code:       "no_routable_model",
+		Message:    "None of the models of the auto routing can handle this request.",
+		StatusCode: http.StatusBadRequest,
+	},
 	"invalid_model_provider": {
 		Code:       "invalid_model_provider",
 		Message:    "Provided model provider is unknown.",
@@ -245,6 +310,11 @@ var ErrorMessages = map[string]APIError{
 		Message:    "Failed to process the embedding.",
 		StatusCode: http.StatusInternalServerError,
 	},
+	"unknown_embedding_model": {
+		Code:       "unknown_embedding_model",
+		Message:    "The embedding model doesn't exist.",
+		StatusCode: http.StatusBadRequest,
+	},
 
 	// Not Found Errors
 	"data_not_found": {
@@ -385,6 +455,26 @@ var ErrorMessages = map[string]APIError{
 		Message:    "OpenAI replied with \"Invalid API key\". Please check your custom API key is valid.",
 		StatusCode: http.StatusForbidden,
 	},
+	"llama_model_not_found": {
+		Code:       "llama_model_not_found",
+		Message:    "The LLaMa server doesn't have this model. Please check it's loaded on the server.",
+		StatusCode: http.StatusNotFound,
+	},
+	"llama_invalid_request": {
+		Code:       "llama_invalid_request",
+		Message:    "The LLaMa server rejected the request. Please check the generation options.",
+		StatusCode: http.StatusBadRequest,
+	},
+	"llama_unavailable": {
+		Code:       "llama_unavailable",
+		Message:    "The LLaMa server is unreachable or busy. Please try again later.",
+		StatusCode: http.StatusServiceUnavailable,
+	},
+	"anthropic_invalid_api_key": {
+		Code:       "anthropic_invalid_api_key",
+		Message:    "Anthropic replied with \"authentication_error\". Please check your custom API key is valid.",
+		StatusCode: http.StatusForbidden,
+	},
 
 	// Fallback error
 
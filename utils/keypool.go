@@ -0,0 +1,391 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Each provider can have several API keys so the rate limit of a single
+ * account doesn't cap the whole platform. <PROVIDER>_API_KEYS is either a
+ * comma separated list of keys or a JSON array of {"id", "key", "weight"}, and
+ * <PROVIDER>_API_KEY is used when it isn't set.
+ *
+ * A key is picked when a provider is created (a Replicate prediction must be
+ * polled with the key that created it) by weight, or by least outstanding
+ * requests per weight with <PROVIDER>_API_KEYS_STRATEGY=least_outstanding (the
+ * default). The keys that returned a 429 or a 401 are taken out until their
+ * cooldown is over, and a retried 429 is sent with another key. The users' own
+ * keys always take precedence over the pool.
+ */
+
+type KeyPoolStrategy string
+
+const (
+	KeyPoolWeighted         KeyPoolStrategy = "weighted"
+	KeyPoolLeastOutstanding KeyPoolStrategy = "least_outstanding"
+)
+
+var (
+	KeyRateLimitedCooldown  = time.Minute
+	KeyUnauthorizedCooldown = 10 * time.Minute
+)
+
+type APIKey struct {
+	ID     string `json:"id"`
+	Value  string `json:"key"`
+	Weight int    `json:"weight"`
+
+	outstanding   int
+	disabledUntil time.Time
+}
+
+type KeyPool struct {
+	Provider string
+	Strategy KeyPoolStrategy
+
+	mutex sync.Mutex
+	keys  []*APIKey
+}
+
+// The id logged in request_logs when a key has none, it must never reveal the key
+func keyFingerprint(provider string, value string) string {
+	hash := sha256.Sum256([]byte(value))
+	return provider + ":" + hex.EncodeToString(hash[:4])
+}
+
+func parseAPIKeys(provider string, value string) []*APIKey {
+	keys := []*APIKey{}
+
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "[") {
+		if err := json.Unmarshal([]byte(value), &keys); err != nil {
+			log.Printf("[ERROR] Invalid API keys for %s: %v\n", provider, err)
+			return nil
+		}
+	} else {
+		for _, key := range strings.Split(value, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				keys = append(keys, &APIKey{Value: key})
+			}
+		}
+	}
+
+	for _, key := range keys {
+		if key.ID == "" {
+			key.ID = keyFingerprint(provider, key.Value)
+		}
+		if key.Weight <= 0 {
+			key.Weight = 1
+		}
+	}
+
+	return keys
+}
+
+func NewKeyPool(provider string) *KeyPool {
+	prefix := strings.ToUpper(strings.ReplaceAll(provider, "-", "_")) + "_API_KEY"
+
+	keys := parseAPIKeys(provider, os.Getenv(prefix+"S"))
+	if len(keys) == 0 {
+		keys = parseAPIKeys(provider, os.Getenv(prefix))
+	}
+
+	strategy := KeyPoolStrategy(os.Getenv(prefix + "S_STRATEGY"))
+	if strategy != KeyPoolWeighted {
+		strategy = KeyPoolLeastOutstanding
+	}
+
+	return &KeyPool{Provider: provider, Strategy: strategy, keys: keys}
+}
+
+var (
+	keyPoolsMutex sync.Mutex
+	keyPools      = map[string]*KeyPool{}
+)
+
+func GetKeyPool(provider string) *KeyPool {
+	keyPoolsMutex.Lock()
+	defer keyPoolsMutex.Unlock()
+
+	pool, ok := keyPools[provider]
+	if !ok {
+		pool = NewKeyPool(provider)
+		keyPools[provider] = pool
+	}
+
+	return pool
+}
+
+// Must be called with the mutex locked
+func (p *KeyPool) pick(now time.Time) *APIKey {
+	available := []*APIKey{}
+	for _, key := range p.keys {
+		if !now.Before(key.disabledUntil) {
+			available = append(available, key)
+		}
+	}
+
+	// Without any key left, the one coming back first is the best bet
+	if len(available) == 0 {
+		var next *APIKey
+		for _, key := range p.keys {
+			if next == nil || key.disabledUntil.Before(next.disabledUntil) {
+				next = key
+			}
+		}
+		return next
+	}
+
+	if p.Strategy == KeyPoolLeastOutstanding {
+		best := []*APIKey{}
+		for _, key := range available {
+			if len(best) == 0 {
+				best = []*APIKey{key}
+				continue
+			}
+
+			// outstanding/weight compared without division
+			load := key.outstanding * best[0].Weight
+			bestLoad := best[0].outstanding * key.Weight
+			if load < bestLoad {
+				best = []*APIKey{key}
+			} else if load == bestLoad {
+				best = append(best, key)
+			}
+		}
+		available = best
+	}
+
+	totalWeight := 0
+	for _, key := range available {
+		totalWeight += key.Weight
+	}
+
+	n := rand.Intn(totalWeight)
+	for _, key := range available {
+		n -= key.Weight
+		if n < 0 {
+			return key
+		}
+	}
+
+	return available[len(available)-1]
+}
+
+/*
+ * Returns the value of the key to use, or "" if the provider has no key. Its
+ * id is recorded in the APIKeyUsage of the context to be logged with the
+ * request.
+ */
+func (p *KeyPool) Acquire(ctx context.Context) string {
+	p.mutex.Lock()
+	key := p.pick(time.Now())
+	p.mutex.Unlock()
+
+	if key == nil {
+		return ""
+	}
+
+	if usage, ok := ctx.Value(ContextKeyAPIKeyUsage).(*APIKeyUsage); ok {
+		usage.Set(p.Provider, key.ID)
+	}
+
+	return key.Value
+}
+
+/*
+ * Returns the key to retry a request rate limited with the key value, the
+ * same value when it isn't a key of the pool or no other key is available.
+ */
+func (p *KeyPool) replace(ctx context.Context, value string) string {
+	p.mutex.Lock()
+	if p.find(value) == nil {
+		p.mutex.Unlock()
+		return value
+	}
+	key := p.pick(time.Now())
+	p.mutex.Unlock()
+
+	if key == nil || key.Value == value {
+		return value
+	}
+
+	if usage, ok := ctx.Value(ContextKeyAPIKeyUsage).(*APIKeyUsage); ok {
+		usage.Set(p.Provider, key.ID)
+	}
+
+	return key.Value
+}
+
+// Must be called with the mutex locked
+func (p *KeyPool) find(value string) *APIKey {
+	for _, key := range p.keys {
+		if key.Value == value {
+			return key
+		}
+	}
+	return nil
+}
+
+func (p *KeyPool) started(value string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if key := p.find(value); key != nil {
+		key.outstanding++
+	}
+}
+
+func (p *KeyPool) finished(value string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if key := p.find(value); key != nil && key.outstanding > 0 {
+		key.outstanding--
+	}
+}
+
+// Takes out the keys rejected by the provider
+func (p *KeyPool) report(value string, resp *http.Response) {
+	var cooldown time.Duration
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		cooldown = KeyRateLimitedCooldown
+		if delay, ok := ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			cooldown = delay
+		}
+	case http.StatusUnauthorized:
+		cooldown = KeyUnauthorizedCooldown
+	default:
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if key := p.find(value); key != nil {
+		log.Printf("[WARNING] %s key %s returned %d, taken out for %v\n", p.Provider, key.ID, resp.StatusCode, cooldown)
+		key.disabledUntil = time.Now().Add(cooldown)
+	}
+}
+
+// The request used by a body is outstanding until the body is closed
+type keyPoolBody struct {
+	io.ReadCloser
+	once     sync.Once
+	finished func()
+}
+
+func (b *keyPoolBody) Close() error {
+	b.once.Do(b.finished)
+	return b.ReadCloser.Close()
+}
+
+/*
+ * Watches the requests sent with the keys of a pool. The key is read from the
+ * Header of the request (without its Prefix), the requests sent with a user's
+ * own key aren't in the pool and are ignored. The Request of the response is
+ * the one that was sent, with the key that answered.
+ */
+type KeyPoolTransport struct {
+	Base   http.RoundTripper
+	Pool   *KeyPool
+	Header string
+	Prefix string
+}
+
+func (t KeyPoolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	value := strings.TrimPrefix(req.Header.Get(t.Header), t.Prefix)
+
+	rateLimited, _ := req.Context().Value(contextKeyRateLimitedRetry).(bool)
+	pinned, _ := req.Context().Value(contextKeyPinnedAPIKey).(bool)
+	if rateLimited && !pinned {
+		if replacement := t.Pool.replace(req.Context(), value); replacement != value {
+			req = req.Clone(req.Context())
+			req.Header.Set(t.Header, t.Prefix+replacement)
+			value = replacement
+		}
+	}
+
+	t.Pool.started(value)
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		t.Pool.finished(value)
+		return resp, err
+	}
+
+	t.Pool.report(value, resp)
+	resp.Request = req
+	resp.Body = &keyPoolBody{ReadCloser: resp.Body, finished: func() { t.Pool.finished(value) }}
+
+	return resp, nil
+}
+
+const contextKeyPinnedAPIKey ContextKey = "pinnedAPIKey"
+
+// The requests following what a key created (e.g. a Replicate prediction) are never sent with another key
+func WithPinnedAPIKey(ctx context.Context) context.Context {
+	return context.WithValue(ctx, contextKeyPinnedAPIKey, true)
+}
+
+// Returns a copy of the client watching the keys of the pool of the provider
+func NewKeyPoolClient(client *http.Client, provider string, header string, prefix string) *http.Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	keyPoolClient := *client
+	keyPoolClient.Transport = KeyPoolTransport{
+		Base:   client.Transport,
+		Pool:   GetKeyPool(provider),
+		Header: header,
+		Prefix: prefix,
+	}
+
+	return &keyPoolClient
+}
+
+// The keys used to answer a request, by provider
+type APIKeyUsage struct {
+	mutex sync.Mutex
+	keys  map[string]string
+}
+
+func (u *APIKeyUsage) Set(provider string, keyID string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.keys == nil {
+		u.keys = map[string]string{}
+	}
+	u.keys[provider] = keyID
+}
+
+// The id of the pool key used for the provider during the request, "" for the users' own keys
+func APIKeyID(ctx context.Context, provider string) string {
+	usage, ok := ctx.Value(ContextKeyAPIKeyUsage).(*APIKeyUsage)
+	if !ok {
+		return ""
+	}
+
+	usage.mutex.Lock()
+	defer usage.mutex.Unlock()
+
+	return usage.keys[provider]
+}
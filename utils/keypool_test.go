@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestKeyPool(t *testing.T) {
+	t.Setenv("TEST_API_KEYS", `[{"id":"main","key":"key-main","weight":3},{"id":"backup","key":"key-backup"}]`)
+	pool := NewKeyPool("test")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "Bearer key-main" {
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	client := *server.Client()
+	client.Transport = KeyPoolTransport{Base: client.Transport, Pool: pool, Header: "Authorization", Prefix: "Bearer "}
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Authorization", "Bearer key-main")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	usage := &APIKeyUsage{}
+	ctx := context.WithValue(context.Background(), ContextKeyAPIKeyUsage, usage)
+
+	// The rate limited key is taken out of the pool despite its weight
+	for i := 0; i < 20; i++ {
+		if key := pool.Acquire(ctx); key != "key-backup" {
+			t.Fatalf("Acquire should have returned the backup key but returned %s", key)
+		}
+	}
+
+	if keyID := APIKeyID(ctx, "test"); keyID != "backup" {
+		t.Fatalf(`APIKeyID should have returned "backup" but returned %q`, keyID)
+	}
+}
+
+func TestKeyPoolFingerprint(t *testing.T) {
+	t.Setenv("TEST_API_KEY", "secret-key")
+	pool := NewKeyPool("test")
+
+	if len(pool.keys) != 1 || pool.keys[0].ID == "" || pool.keys[0].ID == "secret-key" {
+		t.Fatalf("A single key should be identified by its fingerprint but the pool is %+v", pool.keys)
+	}
+}
+
+func TestKeyPoolRetryWithAnotherKey(t *testing.T) {
+	t.Setenv("TEST_API_KEYS", `[{"id":"main","key":"key-main"},{"id":"backup","key":"key-backup"}]`)
+	pool := NewKeyPool("test")
+
+	keys := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get("Authorization"))
+		if r.Header.Get("Authorization") == "Bearer key-main" {
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: RetryTransport{
+		Base:     KeyPoolTransport{Base: server.Client().Transport, Pool: pool, Header: "Authorization", Prefix: "Bearer "},
+		Policy:   testRetryPolicy,
+		Provider: "test",
+	}}
+
+	usage := &APIKeyUsage{}
+	ctx := context.WithValue(context.Background(), ContextKeyAPIKeyUsage, usage)
+
+	send := func(ctx context.Context) *http.Response {
+		req, _ := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+		req.Header.Set("Authorization", "Bearer key-main")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := send(ctx)
+	if resp.StatusCode != http.StatusOK || len(keys) != 2 || keys[1] != "Bearer key-backup" {
+		t.Fatalf("The 429 should have been retried with the backup key but the keys sent were %v", keys)
+	}
+	if resp.Request.Header.Get("Authorization") != "Bearer key-backup" || APIKeyID(ctx, "test") != "backup" {
+		t.Fatalf("The response should tell the backup key answered")
+	}
+
+	// A request following what the key created keeps it
+	keys = nil
+	resp = send(WithPinnedAPIKey(ctx))
+	if resp.StatusCode != http.StatusTooManyRequests || len(keys) != testRetryPolicy.MaxAttempts || keys[1] != "Bearer key-main" {
+		t.Fatalf("The pinned request should have kept its key but the keys sent were %v", keys)
+	}
+}
@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"time"
+)
+
+/*
+ * The URLs given by the users (the webhooks of the jobs, the base_url of the
+ * projects' own models) mustn't reach the network of the server. Their host
+ * must only resolve to public addresses, and the clients of
+ * NewPublicHTTPClient check the address again when they connect so a DNS
+ * rebinding or a redirection can't get around it.
+ *
+ * ALLOW_PRIVATE_URLS=true lifts this, e.g. for a local Ollama in development.
+ */
+
+var AllowPrivateURLs = os.Getenv("ALLOW_PRIVATE_URLS") == "true"
+
+var ErrPrivateURL = errors.New("The URL must be a public http(s) address")
+
+// 100.64.0.0/10, the addresses shared by carrier-grade NATs aren't in net.IP.IsPrivate
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func IsPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() &&
+		!ip.IsPrivate() &&
+		!ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() &&
+		!ip.IsMulticast() &&
+		!ip.IsUnspecified() &&
+		!sharedAddressSpace.Contains(ip)
+}
+
+func ValidatePublicURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return ErrPrivateURL
+	}
+
+	if AllowPrivateURLs {
+		return nil
+	}
+
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil || len(addresses) == 0 {
+		return ErrPrivateURL
+	}
+
+	for _, address := range addresses {
+		if !IsPublicIP(address.IP) {
+			return ErrPrivateURL
+		}
+	}
+
+	return nil
+}
+
+func publicDialControl(_ string, address string, _ syscall.RawConn) error {
+	if AllowPrivateURLs {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return ErrPrivateURL
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !IsPublicIP(ip) {
+		return ErrPrivateURL
+	}
+
+	return nil
+}
+
+// Returns a copy of the client that can only connect to public addresses
+func NewPublicHTTPClient(client *http.Client) *http.Client {
+	if client == nil {
+		client = &http.Client{}
+	}
+
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok || transport == nil {
+		transport = http.DefaultTransport.(*http.Transport)
+	}
+	transport = transport.Clone()
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: publicDialControl}
+	transport.DialContext = dialer.DialContext
+	// A proxy would connect in place of the dialer
+	transport.Proxy = nil
+
+	publicClient := *client
+	publicClient.Transport = transport
+
+	return &publicClient
+}
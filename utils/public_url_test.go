@@ -0,0 +1,24 @@
+package utils
+
+import (
+	"context"
+	"testing"
+)
+
+func TestValidatePublicURL(t *testing.T) {
+	for _, rawURL := range []string{
+		"http://localhost:8080",
+		"http://169.254.169.254/latest/meta-data",
+		"https://10.0.0.1",
+		"http://[::1]",
+		"ftp://example.com",
+	} {
+		if ValidatePublicURL(context.Background(), rawURL) == nil {
+			t.Fatalf("%s should have been refused", rawURL)
+		}
+	}
+
+	if err := ValidatePublicURL(context.Background(), "https://8.8.8.8/webhook"); err != nil {
+		t.Fatalf("A public address should have been accepted but returned %v", err)
+	}
+}
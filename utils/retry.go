@@ -0,0 +1,265 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * The providers' transient errors (rate limits, overloaded or restarting
+ * servers) are retried with an exponential backoff and a full jitter, or after
+ * the delay of their Retry-After header. The retries happen in the transport,
+ * before the response is returned to the provider, so nothing has been
+ * streamed to the user yet.
+ */
+
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+
+	/*
+	 * The 429 and 503 are rejected before being processed so they're always
+	 * safe to retry. The 500, 502, 504 and the connection lost after sending
+	 * the request might have been processed: they're only retried for the
+	 * idempotent requests, or when a duplicate request is harmless for the
+	 * provider (e.g. a generation that wasn't streamed).
+	 */
+	RetryUnsafe bool
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    10 * time.Second,
+}
+
+// A POST that might have been processed would start a second prediction, transcription or speech billed again
+var RetryPolicies = map[string]RetryPolicy{
+	"openai":     {MaxAttempts: 3, BaseDelay: 500 * time.Millisecond, MaxDelay: 10 * time.Second, RetryUnsafe: true},
+	"openrouter": {MaxAttempts: 3, BaseDelay: 500 * time.Millisecond, MaxDelay: 10 * time.Second, RetryUnsafe: true},
+	"anthropic":  {MaxAttempts: 3, BaseDelay: 500 * time.Millisecond, MaxDelay: 10 * time.Second, RetryUnsafe: true},
+	"cohere":     {MaxAttempts: 3, BaseDelay: 500 * time.Millisecond, MaxDelay: 10 * time.Second, RetryUnsafe: true},
+	"replicate":  {MaxAttempts: 4, BaseDelay: time.Second, MaxDelay: 15 * time.Second},
+	"deepgram":   {MaxAttempts: 3, BaseDelay: time.Second, MaxDelay: 15 * time.Second},
+	"elevenlabs": {MaxAttempts: 3, BaseDelay: 500 * time.Millisecond, MaxDelay: 10 * time.Second},
+}
+
+func envDuration(name string, defaultValue time.Duration) time.Duration {
+	ms, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || ms < 0 {
+		return defaultValue
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+/*
+ * The policy of a provider can be changed with RETRY_<PROVIDER>_MAX_ATTEMPTS,
+ * RETRY_<PROVIDER>_BASE_DELAY_MS and RETRY_<PROVIDER>_MAX_DELAY_MS (e.g.
+ * RETRY_OPENAI_MAX_ATTEMPTS=1 disables the retries of OpenAI).
+ */
+func GetRetryPolicy(provider string) RetryPolicy {
+	policy, ok := RetryPolicies[provider]
+	if !ok {
+		policy = DefaultRetryPolicy
+	}
+
+	prefix := "RETRY_" + strings.ToUpper(strings.ReplaceAll(provider, "-", "_")) + "_"
+
+	if attempts, err := strconv.Atoi(os.Getenv(prefix + "MAX_ATTEMPTS")); err == nil && attempts > 0 {
+		policy.MaxAttempts = attempts
+	}
+	policy.BaseDelay = envDuration(prefix+"BASE_DELAY_MS", policy.BaseDelay)
+	policy.MaxDelay = envDuration(prefix+"MAX_DELAY_MS", policy.MaxDelay)
+
+	return policy
+}
+
+// The delay before the attempt following the failed attempt n (starting at 0)
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	ceiling := p.MaxDelay
+	if attempt < 32 && p.BaseDelay<<attempt < ceiling && p.BaseDelay<<attempt > 0 {
+		ceiling = p.BaseDelay << attempt
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// Retry-After is either a number of seconds or an HTTP date
+func ParseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+
+	delay := date.Sub(now)
+	if delay < 0 {
+		delay = 0
+	}
+	return delay, true
+}
+
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != ""
+}
+
+func isConnectionRefused(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+/*
+ * Returns whether the attempt should be retried and, when the provider asked
+ * for it with Retry-After, the delay to wait.
+ */
+func (p RetryPolicy) shouldRetry(req *http.Request, resp *http.Response, err error) (bool, *time.Duration) {
+	if req.Context().Err() != nil {
+		return false, nil
+	}
+
+	unsafe := p.RetryUnsafe || isIdempotent(req)
+
+	if err != nil {
+		return unsafe || isConnectionRefused(err), nil
+	}
+
+	// OpenAI and Anthropic tell whether the error is worth retrying
+	switch resp.Header.Get("X-Should-Retry") {
+	case "false":
+		return false, nil
+	case "true":
+		unsafe = true
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusGatewayTimeout:
+		if !unsafe {
+			return false, nil
+		}
+	default:
+		return false, nil
+	}
+
+	if delay, ok := ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+		// Waiting longer than the policy allows would only delay the error
+		if delay > p.MaxDelay {
+			return false, nil
+		}
+		return true, &delay
+	}
+
+	return true, nil
+}
+
+// Set on the retries of a 429 so the KeyPoolTransport sends them with another key
+const contextKeyRateLimitedRetry ContextKey = "rateLimitedRetry"
+
+type RetryTransport struct {
+	Base     http.RoundTripper
+	Policy   RetryPolicy
+	Provider string
+}
+
+func (t RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	// A body that can't be read twice can't be sent again
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+
+	attemptReq := req
+	for attempt := 0; ; attempt++ {
+		resp, err := base.RoundTrip(attemptReq)
+
+		if !replayable || attempt+1 >= t.Policy.MaxAttempts {
+			return resp, err
+		}
+
+		retry, retryAfter := t.Policy.shouldRetry(req, resp, err)
+		if !retry {
+			return resp, err
+		}
+
+		delay := t.Policy.Backoff(attempt)
+		if retryAfter != nil {
+			delay = *retryAfter
+		}
+
+		if resp != nil {
+			log.Printf("[WARNING] %s returned %d, retrying in %v\n", t.Provider, resp.StatusCode, delay)
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+			resp.Body.Close()
+		} else {
+			log.Printf("[WARNING] %s request failed (%v), retrying in %v\n", t.Provider, err, delay)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+
+		attemptCtx := req.Context()
+		if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+			attemptCtx = context.WithValue(attemptCtx, contextKeyRateLimitedRetry, true)
+		}
+
+		attemptReq = req.Clone(attemptCtx)
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq.Body = body
+		}
+	}
+}
+
+// Returns a copy of the client retrying with the policy of the provider
+func NewRetryClient(client *http.Client, provider string) *http.Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	retryClient := *client
+	retryClient.Transport = RetryTransport{
+		Base:     client.Transport,
+		Policy:   GetRetryPolicy(provider),
+		Provider: provider,
+	}
+
+	return &retryClient
+}
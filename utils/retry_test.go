@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testRetryPolicy = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+
+// Fails with each status in order then answers "ok"
+func flakyServer(t *testing.T, statuses []int, header http.Header) (*httptest.Server, *int) {
+	calls := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "task" {
+			t.Errorf("Attempt %d received the body \"%s\" instead of \"task\"", calls, string(body))
+		}
+
+		calls++
+		if calls <= len(statuses) {
+			for key, values := range header {
+				w.Header()[key] = values
+			}
+			w.WriteHeader(statuses[calls-1])
+			return
+		}
+
+		_, _ = w.Write([]byte("ok"))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &calls
+}
+
+func post(t *testing.T, policy RetryPolicy, url string) *http.Response {
+	client := &http.Client{Transport: RetryTransport{Policy: policy, Provider: "test"}}
+
+	resp, err := client.Post(url, "text/plain", strings.NewReader("task"))
+	if err != nil {
+		t.Fatalf("The request failed: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	return resp
+}
+
+func TestRetryTransientErrors(t *testing.T) {
+	server, calls := flakyServer(t, []int{http.StatusTooManyRequests, http.StatusServiceUnavailable}, nil)
+
+	resp := post(t, testRetryPolicy, server.URL)
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" || *calls != 3 {
+		t.Fatalf("The request should have succeeded on the 3rd attempt but returned %d after %d attempts", resp.StatusCode, *calls)
+	}
+}
+
+func TestRetryGivesUpAfterMaxAttempts(t *testing.T) {
+	server, calls := flakyServer(t, []int{502, 502, 502, 502}, nil)
+
+	policy := testRetryPolicy
+	policy.RetryUnsafe = true
+	resp := post(t, policy, server.URL)
+
+	if resp.StatusCode != http.StatusBadGateway || *calls != 3 {
+		t.Fatalf("The request should have returned 502 after 3 attempts but returned %d after %d", resp.StatusCode, *calls)
+	}
+}
+
+func TestRetryUnsafeErrorsOnlyWhenAllowed(t *testing.T) {
+	server, calls := flakyServer(t, []int{http.StatusBadGateway}, nil)
+
+	resp := post(t, testRetryPolicy, server.URL)
+
+	if resp.StatusCode != http.StatusBadGateway || *calls != 1 {
+		t.Fatalf("A POST shouldn't be retried on 502 without RetryUnsafe but was attempted %d times", *calls)
+	}
+}
+
+func TestRetryIdempotentPost(t *testing.T) {
+	server, calls := flakyServer(t, []int{http.StatusBadGateway}, nil)
+
+	req, _ := http.NewRequest("POST", server.URL, strings.NewReader("task"))
+	req.Header.Set("Idempotency-Key", "key")
+
+	client := &http.Client{Transport: RetryTransport{Policy: testRetryPolicy, Provider: "test"}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("The request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || *calls != 2 {
+		t.Fatalf("A POST with an Idempotency-Key should have been retried on 502 but returned %d after %d attempts", resp.StatusCode, *calls)
+	}
+
+	// A second prediction, transcription or speech would be billed again
+	for _, provider := range []string{"replicate", "deepgram", "elevenlabs"} {
+		if GetRetryPolicy(provider).RetryUnsafe {
+			t.Fatalf("The POST of %s shouldn't be retried once they might have been processed", provider)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	server, calls := flakyServer(t, []int{http.StatusTooManyRequests}, http.Header{"Retry-After": {"0"}})
+	resp := post(t, testRetryPolicy, server.URL)
+	if resp.StatusCode != http.StatusOK || *calls != 2 {
+		t.Fatalf("The request should have been retried after Retry-After but returned %d", resp.StatusCode)
+	}
+
+	// Waiting a minute would exceed the policy's maximum delay
+	server, calls = flakyServer(t, []int{http.StatusTooManyRequests}, http.Header{"Retry-After": {"60"}})
+	resp = post(t, testRetryPolicy, server.URL)
+	if resp.StatusCode != http.StatusTooManyRequests || *calls != 1 {
+		t.Fatalf("The request shouldn't have been retried but was attempted %d times", *calls)
+	}
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	delay, ok := ParseRetryAfter(now.Add(3*time.Second).Format(http.TimeFormat), now)
+	if !ok || delay != 3*time.Second {
+		t.Fatalf("ParseRetryAfter should have returned 3s but returned %v", delay)
+	}
+}
+
+func TestRetryBackoffIsBounded(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+
+	for attempt := 0; attempt < 40; attempt++ {
+		delay := policy.Backoff(attempt)
+		if delay < 0 || delay > time.Second || (attempt == 0 && delay > 100*time.Millisecond) {
+			t.Fatalf("Backoff(%d) returned %v", attempt, delay)
+		}
+	}
+}
@@ -22,6 +22,8 @@ data: {"id":"chatcmpl-mock","object":"chat.completion.chunk","created":170000000
 
 data: {"id":"chatcmpl-mock","object":"chat.completion.chunk","created":1700000000,"model":"gpt-3.5-turbo-0613","system_fingerprint":null,"choices":[{"index":0,"delta":{},"logprobs":null,"finish_reason":"stop"}]}
 
+data: {"id":"chatcmpl-mock","object":"chat.completion.chunk","created":1700000000,"model":"gpt-3.5-turbo-0613","system_fingerprint":null,"choices":[],"usage":{"prompt_tokens":9,"completion_tokens":2,"total_tokens":11}}
+
 data: [DONE]`,
 			)
 		}
@@ -60,3 +62,87 @@ data: [DONE]`,
 
 	return ctx
 }
+
+func MockAnthropicServer(ctx context.Context) context.Context {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("[INFO] Received request on mock Anthropic server url: %v\n", r.URL.Path)
+		if r.URL.Path == "/messages" {
+			if r.Header.Get("X-Api-Key") == "invalid-key" {
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprintln(w, `{"type":"error","error":{"type":"authentication_error","message":"invalid x-api-key"}}`)
+				return
+			}
+
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprintln(
+				w,
+				`event: message_start
+data: {"type":"message_start","message":{"id":"msg_mock","type":"message","role":"assistant","content":[],"model":"claude-3-haiku-20240307","stop_reason":null,"stop_sequence":null,"usage":{"input_tokens":12,"output_tokens":1}}}
+
+event: content_block_start
+data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}
+
+event: ping
+data: {"type":"ping"}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Test"}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":" response"}}
+
+event: content_block_stop
+data: {"type":"content_block_stop","index":0}
+
+event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"end_turn","stop_sequence":null},"usage":{"output_tokens":2}}
+
+event: message_stop
+data: {"type":"message_stop"}`,
+			)
+		}
+	}))
+
+	ctx = context.WithValue(
+		ctx,
+		ContextKeyHTTPClient,
+		server.Client(),
+	)
+
+	ctx = context.WithValue(ctx, ContextKeyAnthropicBaseURL, server.URL)
+
+	return ctx
+}
+
+func MockCohereServer(ctx context.Context) context.Context {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("[INFO] Received request on mock Cohere server url: %v\n", r.URL.Path)
+		if r.URL.Path == "/chat" {
+			w.Header().Set("Content-Type", "application/stream+json")
+			fmt.Fprintln(
+				w,
+				`{"is_finished":false,"event_type":"stream-start","generation_id":"mock"}
+{"is_finished":false,"event_type":"text-generation","text":"Test"}
+{"is_finished":false,"event_type":"text-generation","text":" response"}
+{"is_finished":true,"event_type":"stream-end","finish_reason":"COMPLETE","response":{"text":"Test response","generation_id":"mock","meta":{"billed_units":{"input_tokens":7,"output_tokens":2},"tokens":{"input_tokens":73,"output_tokens":2}}}}`,
+			)
+		}
+
+		if r.URL.Path == "/embed" {
+			fmt.Fprintln(
+				w,
+				`{"id":"mock","embeddings":{"float":[[0,-1,1]]},"texts":["Test"],"meta":{"billed_units":{"input_tokens":1}}}`,
+			)
+		}
+	}))
+
+	ctx = context.WithValue(
+		ctx,
+		ContextKeyHTTPClient,
+		server.Client(),
+	)
+
+	ctx = context.WithValue(ctx, ContextKeyCohereBaseURL, server.URL)
+
+	return ctx
+}
@@ -39,6 +39,12 @@ const (
 	ContextKeyProjectUserRateLimit  ContextKey = "projectUserRateLimit"
 	ContextKeyHTTPClient            ContextKey = "httpClient"
 	ContextKeyOpenAIBaseURL         ContextKey = "openAIBaseURL"
+	ContextKeyAnthropicToken        ContextKey = "anthropicToken"
+	ContextKeyAnthropicBaseURL      ContextKey = "anthropicBaseURL"
+	ContextKeyCohereBaseURL         ContextKey = "cohereBaseURL"
+	ContextKeyRateLimitChecked      ContextKey = "rateLimitChecked"
+	ContextKeyAPIKeyUsage           ContextKey = "apiKeyUsage"
+	ContextKeyModerationPolicy      ContextKey = "moderationPolicy"
 )
 
 type EventType string
@@ -57,12 +63,19 @@ const (
 
 	Usage EventType = "auth.user.usage"
 
-	Generate    EventType = "models.completion.generate"
-	ChatHistory EventType = "models.chat.history"
-	ChatCreate  EventType = "models.chat.create"
-	ChatUpdate  EventType = "models.chat.update"
-	ChatDelete  EventType = "models.chat.delete"
-	ChatList    EventType = "models.chat.list"
+	Generate      EventType = "models.completion.generate"
+	GenerateBatch EventType = "models.completion.batch"
+	JobGet        EventType = "models.completion.job"
+	ChatHistory   EventType = "models.chat.history"
+	ChatCreate    EventType = "models.chat.create"
+	ChatUpdate    EventType = "models.chat.update"
+	ChatDelete    EventType = "models.chat.delete"
+	ChatList      EventType = "models.chat.list"
+
+	ModelList      EventType = "models.catalog.list"
+	ProviderStatus EventType = "models.providers.status"
+
+	ModerationFlagged EventType = "models.moderation.flagged"
 
 	SpeechToText EventType = "models.stt.transcribe"
 	TextToSpeech EventType = "models.tts.synthesize"